@@ -20,18 +20,45 @@ const (
 	VERIFICATION_EMAIL_NEW = "d-2785f85539db4bb7ab9a2f763dee89b9"
 	PASSWORD_RESET_EMAIL   = "d-5f1d97747dd249fbb576c5daa543f430"
 	//PATINET_EMAIL_NOTIFICATION        = "d-c2e691190e1145d58d2fdda9782257ed"
-	PATIENT_MESSAGE = `Hi %s 
-	
-	You've been referred to %s.
-	
-	Address: %s
-	
-	Phone: %s
-	
-	Comments: %s
-	
-	You can text directly in this thread to chat with your specialist and book a convenient appointment time. Your specialist may also message you first!`
-	PATIENT_MESSAGE_NOTICE = ` Hi %s 
-	
-	Message from %s : %s`
+	SMS_MENU_KEYWORD         = "MENU"
+	SMS_MENU_WINDOW          = 60 // mins a referral menu takes a choice, it is not sent again sooner
+	REMINDER_POLL_INTERVAL   = 5  // mins
+	SLA_POLL_INTERVAL        = 30 // mins
+	DIGEST_POLL_INTERVAL     = 5  // mins, held notifications go out this late at most
+	IMPORT_MAX_ROWS          = 2000
+	IMPORT_PROGRESS_ROWS     = 25 // rows between job progress saves
+	EVENT_STREAM_DURATION    = 45 // secs, below MAX_WRITE_TIMEOUT, clients reconnect with Last-Event-ID
+	EVENT_STREAM_HEARTBEAT   = 15 // secs
+	EVENT_REPLAY_LIMIT       = 500
+	EVENT_RETENTION_DAYS     = 7  // clinic events older than this are swept, dashboards replay only recent ones
+	EVENT_SWEEP_INTERVAL     = 60 // mins
+	UNREAD_COUNT_WORKERS     = 8  // referrals counted at once for listings
+	MESSAGE_EDIT_WINDOW      = 15 // mins an author can edit or retract a message
+	FORWARD_CLAIM_TIMEOUT    = 10 // mins after which a forward that never finished no longer blocks another
+	UPLOAD_MAX_FILE_MB       = 25 // documents clinics upload to a referral
+	UPLOAD_MAX_REQUEST_MB    = 100
+	QR_UPLOAD_MAX_FILE_MB    = 10 // public referral and patient forms
+	QR_UPLOAD_MAX_REQUEST_MB = 40
+	INBOUND_MAX_FILE_MB      = 25 // attachments of inbound mail and MMS
+	SIGNED_URL_EXPIRY        = 15 // mins a signed download URL is valid
+	ZIP_EXPORT_RETENTION     = 60 // mins zips built for signed downloads are kept, above SIGNED_URL_EXPIRY
+	ZIP_SWEEP_INTERVAL       = 30 // mins
+	// ZIP_EXPORT_FOLDER of the referral bucket, zips built for signed downloads
+	ZIP_EXPORT_FOLDER = "exports"
+	// EXTRACTION_TEMPLATES_DIR per sender rules for reading treatment summaries
+	EXTRACTION_TEMPLATES_DIR = "./templates/extraction"
+	// MESSAGE_TEMPLATES_DIR patient texts and emails, one <locale>.json per language
+	MESSAGE_TEMPLATES_DIR = "./templates/messages"
+	// EMAIL_TEMPLATES_DIR <kind>.html and <kind>.txt of the transactional emails rendered locally
+	EMAIL_TEMPLATES_DIR = "./templates/email"
+	// SUMMARY_REVIEW_FOLDER of the referral bucket, files of summaries waiting on review
+	SUMMARY_REVIEW_FOLDER = "summary-reviews"
+	// QUARANTINE_FOLDER of the referral bucket, raw payloads of inbound messages nothing matched
+	QUARANTINE_FOLDER = "quarantine"
+	// QUARANTINE_PREVIEW_LENGTH characters of a quarantined message's text shown in lists
+	QUARANTINE_PREVIEW_LENGTH = 280
+	// QUARANTINE_LIST_LIMIT messages returned by one list call
+	QUARANTINE_LIST_LIMIT = 200
+	// SMS_CONVERSATION_FOLDER of the referral bucket, media of texts held until the patient picks a referral
+	SMS_CONVERSATION_FOLDER = "sms-conversations"
 )
@@ -2,6 +2,7 @@ package contracts
 
 import (
 	"context"
+	"time"
 
 	"github.com/superdentist/superdentist-backend/lib/gmaps"
 	"googlemaps.github.io/maps"
@@ -41,16 +42,125 @@ type ClinicJoinDetails struct {
 // PhysicalClinicMapLocation ....
 type PhysicalClinicMapLocation struct {
 	PhysicalClinicsRegistration
-	Location     ClinicLocation
-	IsVerified   bool
-	Geohash      string `json:"-"`
-	Precision    int    `json:"-"`
-	PlaceID      string
-	AutoEmail    string   `json:"-"`
-	TwilioNumber string   `json:"-"`
-	CustomText   string   `json:"-"`
-	Domain       []string `json:"-"`
+	Location      ClinicLocation
+	IsVerified    bool
+	Geohash       string `json:"-"`
+	Precision     int    `json:"-"`
+	PlaceID       string
+	AutoEmail     string   `json:"-"`
+	TwilioNumber  string   `json:"-"`
+	CustomText    string   `json:"-"`
+	Domain        []string `json:"-"`
+	CalendarToken string   `json:"-"`
 }
+
+// SLARule .... a referral sitting in SPStatus for longer than BusinessDays is overdue,
+// escalation moves up one level every EscalateAfterDays business days after that
+type SLARule struct {
+	Name              string `json:"name" valid:"required"`
+	SPStatus          string `json:"spStatus" valid:"required"`
+	BusinessDays      int    `json:"businessDays" valid:"required"`
+	EscalateAfterDays int    `json:"escalateAfterDays"`
+}
+
+// ClinicSLA ....
+type ClinicSLA struct {
+	AddressID string    `json:"addressId"`
+	PlaceID   string    `json:"placeId"`
+	Rules     []SLARule `json:"rules" valid:"required"`
+}
+
+// MessageTemplateOverride .... the clinic's own wording of a patient message in one locale
+type MessageTemplateOverride struct {
+	AddressID string    `json:"addressId"`
+	Locale    string    `json:"locale" valid:"required"`
+	Key       string    `json:"key" valid:"required"`
+	Text      string    `json:"text" valid:"required" datastore:",noindex"`
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedOn time.Time `json:"updatedOn"`
+}
+
+// MessageTemplate .... a patient message as the clinic sees it, the catalog's text, the clinic's
+// override and the message they send rendered with sample values
+type MessageTemplate struct {
+	Key       string   `json:"key"`
+	Locale    string   `json:"locale"`
+	Variables []string `json:"variables"`
+	Default   string   `json:"default"`
+	Override  string   `json:"override"`
+	Preview   string   `json:"preview"`
+}
+
+// MessagePreview .... Text is previewed when it is given, otherwise the clinic's current wording of Key
+type MessagePreview struct {
+	Key    string `json:"key" valid:"required"`
+	Locale string `json:"locale"`
+	Text   string `json:"text"`
+}
+
+// DeviceToken .... a staff device push notifications go to, it is subscribed to the topics of its user's clinics
+type DeviceToken struct {
+	Token      string    `json:"token" valid:"required"`
+	Platform   string    `json:"platform"`
+	UserID     string    `json:"-"`
+	Email      string    `json:"-"`
+	AddressIDs []string  `json:"addressIds"`
+	Topics     []string  `json:"-"`
+	CreatedOn  time.Time `json:"createdOn"`
+	UpdatedOn  time.Time `json:"updatedOn"`
+}
+
+// NotificationPreferences .... how a clinic, or one of its staff when UserID is set, hears of referral events.
+// Staff without their own follow the clinic's, a clinic without any gets email and push of every event.
+type NotificationPreferences struct {
+	AddressID  string              `json:"addressId"`
+	UserID     string              `json:"userId"`
+	Email      string              `json:"email"`
+	Channels   []ChannelPreference `json:"channels"`
+	QuietHours QuietHours          `json:"quietHours"`
+	DigestTime string              `json:"digestTime"`
+	SMSPhone   string              `json:"smsPhone"`
+	TimeZone   string              `json:"timeZone"`
+	UpdatedBy  string              `json:"updatedBy"`
+	UpdatedOn  time.Time           `json:"updatedOn"`
+}
+
+// ChannelPreference .... the events sent on a channel (email, sms or push), all of them when Events is empty,
+// and whether they go out right away or in a daily digest
+type ChannelPreference struct {
+	Channel  string   `json:"channel"`
+	Enabled  bool     `json:"enabled"`
+	Events   []string `json:"events"`
+	Delivery string   `json:"delivery"`
+}
+
+// QuietHours .... local times, "22:00" to "07:00", notifications in between are held until the end.
+// None when either is empty.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// PendingNotification .... a notification held for a digest or the end of quiet hours, Recipient is the email
+// address, phone or push topic of the channel
+type PendingNotification struct {
+	ID         string    `json:"id"`
+	AddressID  string    `json:"addressId"`
+	UserID     string    `json:"userId"`
+	Channel    string    `json:"channel"`
+	Recipient  string    `json:"recipient"`
+	Name       string    `json:"name"`
+	Event      string    `json:"event"`
+	ReferralID string    `json:"referralId"`
+	Text       string    `json:"text" datastore:",noindex"`
+	Link       string    `json:"link" datastore:",noindex"`
+	CreatedOn  time.Time `json:"createdOn"`
+	DueOn      time.Time `json:"dueOn"`
+	// ClaimedBy the instance sending the notification since ClaimedOn, see notify.Flush
+	ClaimedBy string    `json:"-"`
+	ClaimedOn time.Time `json:"-"`
+}
+
 type ClinicList struct {
 	Clinics    []PhysicalClinicMapLocation `json:"clinics"`
 	CursorNext string                      `json:"cursorNext"`
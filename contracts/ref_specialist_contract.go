@@ -98,6 +98,10 @@ type Patient struct {
 	CreationDate     string                    `json:"creationDate"`
 	VisitCount       int                       `json:"visitCount"`
 	LastAppointment  int64                     `json:"lastAppointment"`
+	// PreferredLanguage picks the locale of the texts and emails sent to the patient
+	PreferredLanguage string `json:"preferredLanguage"`
+	// SMSConsent is filled in by the single patient lookup
+	SMSConsent *SMSConsent `json:"smsConsent,omitempty" datastore:"-"`
 }
 
 // PatientStore ....
@@ -127,6 +131,7 @@ type PatientStore struct {
 	ZipCode            string        `json:"zipCode"`
 	CreatedOn          int64         `json:"createdOn"`
 	CreationDate       string        `json:"creationDate"`
+	PreferredLanguage  string        `json:"preferredLanguage"`
 }
 
 //PatientVerificationStatistics ...
@@ -184,6 +189,197 @@ const GDCBox ChatBox = "c2c"
 // SPCBox ....
 const SPCBox ChatBox = "c2p"
 
+// Clinic dashboard event types
+const (
+	EventReferralCreated   = "referral.created"
+	EventReferralStatus    = "referral.status"
+	EventMessageCreated    = "message.created"
+	EventMessageUpdated    = "message.updated"
+	EventDocumentUploaded  = "document.uploaded"
+	EventDocumentDeleted   = "document.deleted"
+	EventPatientRegistered = "patient.registered"
+	EventSummaryReview     = "summary.review"
+	// EventSLAEscalation is only notified, dashboards do not get it
+	EventSLAEscalation = "sla.escalation"
+)
+
+// ClinicEvent .... dashboard event of one clinic, ids sort in the order the events happened
+type ClinicEvent struct {
+	EventID    string    `json:"id"`
+	Type       string    `json:"type"`
+	AddressID  string    `json:"addressId"`
+	ReferralID string    `json:"referralId,omitempty"`
+	PatientID  string    `json:"patientId,omitempty"`
+	MessageID  string    `json:"messageId,omitempty"`
+	DocumentID string    `json:"documentId,omitempty"`
+	ReviewID   string    `json:"reviewId,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	CreatedOn  time.Time `json:"createdOn"`
+}
+
+// Chat websocket event types
+const (
+	ChatEventMessage   = "message"
+	ChatEventEdited    = "edited"
+	ChatEventRetracted = "retracted"
+	ChatEventError     = "error"
+)
+
+// ChatEvent .... frame written to chat websocket subscribers
+type ChatEvent struct {
+	Type       string   `json:"type"`
+	ReferralID string   `json:"referralId,omitempty"`
+	Channel    ChatBox  `json:"channel,omitempty"`
+	Comment    *Comment `json:"comment,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// ChatPayload .... message sent by a chat websocket client
+type ChatPayload struct {
+	Text  string   `json:"text"`
+	Files []string `json:"file"`
+}
+
+// ReadMarker .... newest message of a referral a user has read, messages are compared by TimeStamp
+type ReadMarker struct {
+	ReferralID string    `json:"referralId"`
+	UserID     string    `json:"userId"`
+	LastRead   int64     `json:"lastRead"`
+	ReadOn     time.Time `json:"readOn"`
+}
+
+// MarkRead .... read up to TimeStamp, everything posted so far when it is zero
+type MarkRead struct {
+	TimeStamp int64 `json:"timeStamp"`
+}
+
+// UnreadCount .... unread messages of a referral by channel
+type UnreadCount struct {
+	Clinic  int `json:"c2c"`
+	Patient int `json:"c2p"`
+}
+
+// MessageIndex .... live messages of a referral by who wrote them, with the TimeStamp of the newest of each,
+// kept as messages are written so unread counts only load the messages of referrals with new ones. Clinic
+// messages are the dentist's or the specialist's when posted under their clinic email, anyone else's count
+// as other. Patient messages are those of the patient channel not posted by the specialist.
+type MessageIndex struct {
+	ReferralID      string `json:"referralId"`
+	FromEmail       string `json:"fromEmail"`
+	ToEmail         string `json:"toEmail"`
+	DentistCount    int    `json:"dentistCount"`
+	DentistLast     int64  `json:"dentistLast"`
+	SpecialistCount int    `json:"specialistCount"`
+	SpecialistLast  int64  `json:"specialistLast"`
+	OtherCount      int    `json:"otherCount"`
+	OtherLast       int64  `json:"otherLast"`
+	PatientCount    int    `json:"patientCount"`
+	PatientLast     int64  `json:"patientLast"`
+}
+
+// Add .... counts the message in, or out again with a delta of -1, retracted messages are not counted
+func (index *MessageIndex) Add(comment Comment, delta int) {
+	if comment.Retracted {
+		return
+	}
+	count, last := index.bucket(comment)
+	if count == nil {
+		return
+	}
+	*count += delta
+	if *count < 0 {
+		*count = 0
+	}
+	if delta > 0 && comment.TimeStamp > *last {
+		*last = comment.TimeStamp
+	}
+}
+
+func (index *MessageIndex) bucket(comment Comment) (*int, *int64) {
+	specialist := index.ToEmail != "" && comment.UserID == index.ToEmail
+	switch comment.Channel {
+	case GDCBox:
+		if specialist {
+			return &index.SpecialistCount, &index.SpecialistLast
+		}
+		if index.FromEmail != "" && comment.UserID == index.FromEmail {
+			return &index.DentistCount, &index.DentistLast
+		}
+		return &index.OtherCount, &index.OtherLast
+	case SPCBox:
+		if !specialist {
+			return &index.PatientCount, &index.PatientLast
+		}
+	}
+	return nil, nil
+}
+
+// UnreadReferral .... referral with unread messages in the inbox
+type UnreadReferral struct {
+	ReferralID       string      `json:"referralId"`
+	AddressID        string      `json:"addressId"`
+	PatientFirstName string      `json:"patientFirstName"`
+	PatientLastName  string      `json:"patientLastName"`
+	ModifiedOn       time.Time   `json:"modifiedOn"`
+	Unread           UnreadCount `json:"unread"`
+}
+
+// InboxUnread .... unread messages across the clinics of a user
+type InboxUnread struct {
+	Total     int              `json:"total"`
+	Clinics   map[string]int   `json:"clinics"`
+	Referrals []UnreadReferral `json:"referrals"`
+}
+
+// Where a document came from
+const (
+	DocumentSourceWeb   = "web"
+	DocumentSourceEmail = "email"
+	DocumentSourceSMS   = "sms"
+	DocumentSourceQR    = "qr"
+)
+
+// What a document is, clients may pick one when uploading
+const (
+	DocumentCategoryXray      = "xray"
+	DocumentCategoryPhoto     = "photo"
+	DocumentCategoryReport    = "report"
+	DocumentCategorySummary   = "summary"
+	DocumentCategoryInsurance = "insurance"
+	DocumentCategoryOther     = "other"
+)
+
+// Document .... metadata of an uploaded file of a referral or of a patient. A re-upload under the same
+// original name becomes the next version of the document, the previous one is kept as a child entity.
+type Document struct {
+	DocumentID   string     `json:"documentId"`
+	ReferralID   string     `json:"referralId"`
+	PatientID    string     `json:"patientId"`
+	Name         string     `json:"name"`
+	StoredKey    string     `json:"storedKey"`
+	OriginalName string     `json:"originalName"`
+	ContentType  string     `json:"contentType"`
+	Size         int64      `json:"size"`
+	SHA256       string     `json:"sha256"`
+	Thumbnail    string     `json:"thumbnail" datastore:",noindex"`
+	Preview      string     `json:"preview"`
+	Source       string     `json:"source"`
+	Category     string     `json:"category"`
+	UploadedBy   string     `json:"uploadedBy"`
+	Version      int        `json:"version"`
+	Deleted      bool       `json:"deleted"`
+	DeletedBy    string     `json:"deletedBy,omitempty"`
+	DeletedOn    time.Time  `json:"deletedOn,omitempty"`
+	CreatedOn    time.Time  `json:"createdOn"`
+	Versions     []Document `json:"versions,omitempty" datastore:"-"`
+}
+
+// SignedDownload .... short lived URL a client downloads documents from without going through the backend
+type SignedDownload struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
 // Thumbnails
 type Media struct {
 	Name  string `json:"name"`
@@ -199,6 +395,44 @@ type Comment struct {
 	UserID    string   `json:"userId" valid:"required"`
 	Files     []string `json:"file"`
 	Media     []Media  `json:"media"`
+	// PatientSMS the patient currently holds this message by SMS
+	PatientSMS bool  `json:"patientSms"`
+	Version    int   `json:"version"`
+	EditedOn   int64 `json:"editedOn"`
+	Retracted  bool  `json:"retracted"`
+	// RefiledTo the referral the message was moved to, it is retracted here
+	RefiledTo string `json:"refiledTo"`
+}
+
+// Message revision actions
+const (
+	MessageEdited    = "edited"
+	MessageRetracted = "retracted"
+	MessageRefiled   = "refiled"
+)
+
+// MessageVersion .... content of a message before one of its revisions
+type MessageVersion struct {
+	ReferralID string    `json:"referralId"`
+	MessageID  string    `json:"messageId"`
+	Version    int       `json:"version"`
+	Text       string    `json:"text" datastore:",noindex"`
+	Channel    ChatBox   `json:"channel"`
+	Files      []string  `json:"file"`
+	Action     string    `json:"action"`
+	RevisedBy  string    `json:"revisedBy"`
+	RevisedOn  time.Time `json:"revisedOn"`
+}
+
+// MessageEdit .... corrected text of a message, the channel only changes when set
+type MessageEdit struct {
+	Text    string  `json:"text"`
+	Channel ChatBox `json:"channel"`
+}
+
+// MessageRefile .... referral of the same patient a message is moved to
+type MessageRefile struct {
+	ReferralID string `json:"referralId"`
 }
 
 // Status ....
@@ -220,6 +454,196 @@ type ReferralDetails struct {
 	History       []string     `json:"history"`
 	Tooth         []string     `json:"tooth"`
 	IsSummary     bool         `json:"isSummary"`
+	// SuppressPatientNotice skips the patient email and SMS sent when the referral is created
+	SuppressPatientNotice bool   `json:"-"`
+	ImportJobID           string `json:"-"`
+}
+
+// ForwardReferral .... the receiving clinic is either a registered address or just a google place
+type ForwardReferral struct {
+	ToAddressID string `json:"toAddressId"`
+	ToPlaceID   string `json:"toPlaceId"`
+	Reason      string `json:"reason"`
+}
+
+// Referral import job statuses
+const (
+	ImportQueued    = "queued"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// ImportRowResult .... outcome of one CSV line, line numbers count the header as line 1
+type ImportRowResult struct {
+	Line       int    `json:"line"`
+	ReferralID string `json:"referralId"`
+	Error      string `json:"error"`
+}
+
+// ReferralImportJob ....
+type ReferralImportJob struct {
+	JobID          string            `json:"jobId"`
+	AddressID      string            `json:"addressId"`
+	Role           string            `json:"role"`
+	CreatedBy      string            `json:"createdBy"`
+	FileName       string            `json:"fileName"`
+	Status         string            `json:"status"`
+	Total          int               `json:"total"`
+	Processed      int               `json:"processed"`
+	Succeeded      int               `json:"succeeded"`
+	Failed         int               `json:"failed"`
+	NotifyPatients bool              `json:"notifyPatients"`
+	Error          string            `json:"error" datastore:",noindex"`
+	CreatedOn      time.Time         `json:"createdOn"`
+	FinishedOn     time.Time         `json:"finishedOn"`
+	Results        []ImportRowResult `json:"results" datastore:",noindex"`
+}
+
+// ExtractedField .... value read from a document and how sure the reading is, from 0 to 1
+type ExtractedField struct {
+	Value      string  `json:"value"`
+	Confidence float64 `json:"confidence"`
+}
+
+// ExtractedProcedure .... CDT code of a procedure and the tooth it was done on, if any
+type ExtractedProcedure struct {
+	Code       string  `json:"code"`
+	Tooth      string  `json:"tooth"`
+	Confidence float64 `json:"confidence"`
+}
+
+// SummaryExtraction .... patient and treatment details read from a treatment summary. Dates are
+// 2006-01-02, Confidence is the lowest of the fields the template requires.
+type SummaryExtraction struct {
+	Template   string               `json:"template"`
+	FirstName  ExtractedField       `json:"firstName"`
+	LastName   ExtractedField       `json:"lastName"`
+	DOB        ExtractedField       `json:"dob"`
+	VisitDate  ExtractedField       `json:"visitDate"`
+	Procedures []ExtractedProcedure `json:"procedures"`
+	Teeth      []string             `json:"teeth"`
+	Confidence float64              `json:"confidence"`
+	Review     bool                 `json:"review"`
+}
+
+// Status of a SummaryReview
+const (
+	SummaryReviewPending  = "pending"
+	SummaryReviewApproved = "approved"
+	SummaryReviewRejected = "rejected"
+)
+
+// SummaryReview .... inbound treatment summary whose patient could not be read with confidence, it
+// waits for a clinic to confirm the details before it is filed
+type SummaryReview struct {
+	ReviewID      string            `json:"reviewId"`
+	Status        string            `json:"status"`
+	FromAddressID string            `json:"fromAddressId"`
+	ToAddressID   string            `json:"toAddressId"`
+	SenderEmail   string            `json:"senderEmail"`
+	Subject       string            `json:"subject" datastore:",noindex"`
+	Body          string            `json:"body" datastore:",noindex"`
+	Folder        string            `json:"-"`
+	Files         []string          `json:"files" datastore:",noindex"`
+	SummaryText   string            `json:"summaryText" datastore:",noindex"`
+	Extraction    SummaryExtraction `json:"extraction" datastore:",noindex"`
+	ReferralID    string            `json:"referralId"`
+	ReviewedBy    string            `json:"reviewedBy"`
+	ReviewedOn    time.Time         `json:"reviewedOn"`
+	CreatedOn     time.Time         `json:"createdOn"`
+}
+
+// SummaryReviewDecision .... patient details a clinic confirmed or corrected
+type SummaryReviewDecision struct {
+	PatientFirstName string `json:"patientFirstName" valid:"required"`
+	PatientLastName  string `json:"patientLastName" valid:"required"`
+	PatientDOB       DOB    `json:"patientDob"`
+}
+
+// Sources of a QuarantinedMessage
+const (
+	QuarantineReferralMail = "referral_mail"
+	QuarantineSummaryMail  = "summary_mail"
+	QuarantineSMS          = "sms"
+)
+
+// Status of a QuarantinedMessage
+const (
+	QuarantinePending   = "pending"
+	QuarantineAssigned  = "assigned"
+	QuarantineDiscarded = "discarded"
+)
+
+// QuarantinedMessage .... inbound email or SMS that matched no referral or clinic. The raw payload is
+// kept in Folder, with the media of an SMS next to it as Attachments. For an email Attachments are only
+// the names of those inside the raw message.
+type QuarantinedMessage struct {
+	QuarantineID string    `json:"quarantineId"`
+	Source       string    `json:"source"`
+	Status       string    `json:"status"`
+	Reason       string    `json:"reason" datastore:",noindex"`
+	Sender       string    `json:"sender"`
+	Recipient    string    `json:"recipient"`
+	Subject      string    `json:"subject" datastore:",noindex"`
+	Preview      string    `json:"preview" datastore:",noindex"`
+	Folder       string    `json:"-"`
+	Attachments  []string  `json:"attachments" datastore:",noindex"`
+	ReferralID   string    `json:"referralId"`
+	AddressID    string    `json:"addressId"`
+	ResolvedBy   string    `json:"resolvedBy"`
+	ResolvedOn   time.Time `json:"resolvedOn"`
+	CreatedOn    time.Time `json:"createdOn"`
+}
+
+// QuarantineAssignment .... where an admin sends a quarantined message. Emails and texts of patients
+// go to a referral, a summary to the clinic that sent it and, when its auto email address is not
+// known, the dentist it is for.
+type QuarantineAssignment struct {
+	ReferralID       string `json:"referralId"`
+	AddressID        string `json:"addressId"`
+	DentistAddressID string `json:"dentistAddressId"`
+}
+
+// SMSConversation .... texts between a patient's phone and one of our numbers. ReferralID is the referral
+// the patient last texted about. While the patient has a menu of Candidates to answer, their texts are held
+// in PendingText and PendingFiles, files kept in Folder.
+type SMSConversation struct {
+	ConversationID string    `json:"conversationId"`
+	PatientPhone   string    `json:"patientPhone"`
+	ReceivingPhone string    `json:"receivingPhone"`
+	ReferralID     string    `json:"referralId"`
+	Candidates     []string  `json:"candidates" datastore:",noindex"`
+	PendingText    []string  `json:"pendingText" datastore:",noindex"`
+	PendingFiles   []string  `json:"pendingFiles" datastore:",noindex"`
+	Folder         string    `json:"-"`
+	MenuSentOn     time.Time `json:"menuSentOn"`
+	UpdatedOn      time.Time `json:"updatedOn"`
+}
+
+// SMS consent statuses
+const (
+	SMSOptedIn  = "opted_in"
+	SMSOptedOut = "opted_out"
+)
+
+// Sources of SMS consent
+const (
+	ConsentSourceReferral = "referral"
+	ConsentSourceQRForm   = "qr_form"
+	ConsentSourceImport   = "import"
+	ConsentSourceKeyword  = "keyword"
+)
+
+// SMSConsent .... whether a patient's phone may be texted and how that was given. An opt out only ends
+// with the patient texting START.
+type SMSConsent struct {
+	Phone      string    `json:"phone"`
+	Status     string    `json:"status"`
+	Source     string    `json:"source"`
+	ReferralID string    `json:"referralId"`
+	Keyword    string    `json:"keyword"`
+	UpdatedOn  time.Time `json:"updatedOn"`
 }
 
 // ReferralComments .....
@@ -234,40 +658,107 @@ type ReferralStatus struct {
 
 // DSReferral .....
 type DSReferral struct {
-	ReferralID         string    `json:"referralId" valid:"required"`
-	Documents          []string  `json:"documents" valid:"required"`
-	FromPlaceID        string    `json:"fromPlaceID" valid:"required"`
-	ToPlaceID          string    `json:"toPlaceID" valid:"required"`
-	FromClinicName     string    `json:"fromClinicName" valid:"required"`
-	ToClinicName       string    `json:"toClinicName" valid:"required"`
-	FromClinicAddress  string    `json:"fromClinicAddress" valid:"required"`
-	ToClinicAddress    string    `json:"toClinicAddress" valid:"required"`
-	FromAddressID      string    `json:"fromAddressId" valid:"required"`
-	ToAddressID        string    `json:"toAddressId" valid:"required"`
-	Status             Status    `json:"status" valid:"required"`
-	Reasons            []string  `json:"reasons"`
-	History            []string  `json:"history"`
-	Tooth              []string  `json:"tooth"`
-	CreatedOn          time.Time `json:"createdOn" valid:"required"`
-	ModifiedOn         time.Time `json:"modifiedOn" valid:"required"`
-	PatientEmail       string    `json:"patientEmail" valid:"required"`
-	PatientFirstName   string    `json:"patientFirstName" valid:"required"`
-	PatientLastName    string    `json:"patientLastName" valid:"required"`
-	PatientDOBYear     string    `json:"patientDobYear" valid:"required"`
-	PatientDOBMonth    string    `json:"patientDobMonth" valid:"required"`
-	PatientDOBDay      string    `json:"patientDobDay" valid:"required"`
-	PatientPhone       string    `json:"patientPhone" valid:"required"`
-	FromClinicPhone    string    `json:"fromClinicPhone" valid:"required"`
-	ToClinicPhone      string    `json:"toClinicPhone" valid:"required"`
-	FromEmail          string    `json:"fromEmail" valid:"required"`
-	ToEmail            string    `json:"toEmail" valid:"required"`
-	IsDirty            bool      `json:"isDirty" valid:"required"`
-	CommunicationPhone string    `json:"-"`
-	CommunicationText  string    `datastore:"CommunicationText,noindex"`
-	IsSummary          bool      `json:"isSummary" valid:"required"`
-	IsQR               bool      `json:"isQR" valid:"required"`
-	SummaryText        string    `datastore:"SummaryText,noindex"`
-	IsNew              bool      `json:"-"`
+	ReferralID         string      `json:"referralId" valid:"required"`
+	Documents          []string    `json:"documents" valid:"required"`
+	FromPlaceID        string      `json:"fromPlaceID" valid:"required"`
+	ToPlaceID          string      `json:"toPlaceID" valid:"required"`
+	FromClinicName     string      `json:"fromClinicName" valid:"required"`
+	ToClinicName       string      `json:"toClinicName" valid:"required"`
+	FromClinicAddress  string      `json:"fromClinicAddress" valid:"required"`
+	ToClinicAddress    string      `json:"toClinicAddress" valid:"required"`
+	FromAddressID      string      `json:"fromAddressId" valid:"required"`
+	ToAddressID        string      `json:"toAddressId" valid:"required"`
+	Status             Status      `json:"status" valid:"required"`
+	Reasons            []string    `json:"reasons"`
+	History            []string    `json:"history"`
+	Tooth              []string    `json:"tooth"`
+	CreatedOn          time.Time   `json:"createdOn" valid:"required"`
+	ModifiedOn         time.Time   `json:"modifiedOn" valid:"required"`
+	PatientEmail       string      `json:"patientEmail" valid:"required"`
+	PatientFirstName   string      `json:"patientFirstName" valid:"required"`
+	PatientLastName    string      `json:"patientLastName" valid:"required"`
+	PatientDOBYear     string      `json:"patientDobYear" valid:"required"`
+	PatientDOBMonth    string      `json:"patientDobMonth" valid:"required"`
+	PatientDOBDay      string      `json:"patientDobDay" valid:"required"`
+	PatientPhone       string      `json:"patientPhone" valid:"required"`
+	FromClinicPhone    string      `json:"fromClinicPhone" valid:"required"`
+	ToClinicPhone      string      `json:"toClinicPhone" valid:"required"`
+	FromEmail          string      `json:"fromEmail" valid:"required"`
+	ToEmail            string      `json:"toEmail" valid:"required"`
+	IsDirty            bool        `json:"isDirty" valid:"required"`
+	CommunicationPhone string      `json:"-"`
+	CommunicationText  string      `datastore:"CommunicationText,noindex"`
+	IsSummary          bool        `json:"isSummary" valid:"required"`
+	IsQR               bool        `json:"isQR" valid:"required"`
+	SummaryText        string      `datastore:"SummaryText,noindex"`
+	IsNew              bool        `json:"-"`
+	Appointment        Appointment `json:"appointment"`
+	StatusChangedOn    time.Time   `json:"statusChangedOn"`
+	Overdue            bool        `json:"overdue"`
+	OverdueRule        string      `json:"overdueRule"`
+	EscalationLevel    int         `json:"escalationLevel"`
+	LastEscalatedOn    time.Time   `json:"lastEscalatedOn"`
+	ForwardedFrom      string      `json:"forwardedFrom"`
+	ForwardedTo        string      `json:"forwardedTo"`
+	ForwardedOn        time.Time   `json:"forwardedOn"`
+	ForwardReason      string      `json:"forwardReason" datastore:",noindex"`
+	// ForwardingOn a forward of the referral started and has not finished, see ClaimForward
+	ForwardingOn       time.Time   `json:"-"`
+	ReferralChain      []string    `json:"referralChain"`
+	ImportJobID        string      `json:"importJobId"`
+	// PreferredLanguage of the patient, the locale of the texts and emails sent to them
+	PreferredLanguage string `json:"preferredLanguage"`
+	// Extraction is what was read from the treatment summary of a summary referral
+	Extraction SummaryExtraction `json:"extraction" datastore:",noindex"`
+	// SuppressPatientNotice is only honoured while the referral is new
+	SuppressPatientNotice bool `json:"-"`
+	// Unread is filled in per user by the referral listings
+	Unread *UnreadCount `json:"unread,omitempty" datastore:"-"`
+	// SMSConsent is filled in by the single referral lookup
+	SMSConsent *SMSConsent `json:"smsConsent,omitempty" datastore:"-"`
+}
+
+// Escalation levels of an overdue referral
+const (
+	EscalationNone       = 0
+	EscalationSpecialist = 1
+	EscalationDentist    = 2
+	EscalationAdmin      = 3
+)
+
+// Appointment statuses
+const (
+	AppointmentBooked    = "booked"
+	AppointmentCancelled = "cancelled"
+)
+
+// Patient responses to appointment reminders
+const (
+	AppointmentConfirmed  = "confirmed"
+	AppointmentReschedule = "reschedule"
+)
+
+// Appointment ....
+type Appointment struct {
+	UID       string    `json:"uid"`
+	Start     time.Time `json:"start"`
+	Duration  int       `json:"duration"`
+	Notes     string    `json:"notes" datastore:",noindex"`
+	Status    string    `json:"status"`
+	Sequence  int       `json:"sequence"`
+	TimeZone  string    `json:"timeZone"`
+	UpdatedOn time.Time `json:"updatedOn"`
+	// RemindersSent holds the reminder offsets already sent for the current sequence
+	RemindersSent   []string  `json:"remindersSent"`
+	PatientResponse string    `json:"patientResponse"`
+	RespondedOn     time.Time `json:"respondedOn"`
+}
+
+// AppointmentRequest .... start is epoch milliseconds, duration in minutes
+type AppointmentRequest struct {
+	Start    int64  `json:"start" valid:"required"`
+	Duration int    `json:"duration"`
+	Notes    string `json:"notes"`
 }
 
 // AllReferrals ....
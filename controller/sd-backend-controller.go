@@ -10,6 +10,7 @@ import (
 	"github.com/superdentist/superdentist-backend/constants"
 	"github.com/superdentist/superdentist-backend/global"
 	"github.com/superdentist/superdentist-backend/router"
+	"github.com/superdentist/superdentist-backend/scheduler"
 	graceful "gopkg.in/tylerb/graceful.v1" // see: https://github.com/tylerb/graceful
 )
 
@@ -27,7 +28,7 @@ func (handler *maxPayloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 // SDBackendController ....
 func SDBackendController(ctx context.Context, port int, errorChannel chan error) {
 	log.Infof("Initializing router and endpoints.")
-	sdRouter, err := router.SDRouter()
+	sdRouter, err := router.SDRouter(ctx)
 	if err != nil {
 		errorChannel <- err
 		return
@@ -44,6 +45,12 @@ func SDBackendController(ctx context.Context, port int, errorChannel chan error)
 	}
 	global.WaitGroupServer.Add(1)
 	go serverHTTPRoutes(ctx, httpAddress, httpHandler, errorChannel)
+	// background jobs stop with the server context
+	go scheduler.RunAppointmentReminders(ctx)
+	go scheduler.RunSLAEvaluator(ctx)
+	go scheduler.RunNotificationDigests(ctx)
+	go scheduler.RunClinicEventSweep(ctx)
+	go scheduler.RunZipExportSweep(ctx)
 }
 
 func serverHTTPRoutes(ctx context.Context, httpAddress string, handler http.Handler, errorChannel <-chan error) {
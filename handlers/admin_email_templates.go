@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/lib/mailtemplates"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+)
+
+// emailTemplatesForAdmin ... the local email templates for a platform admin, it aborts the request otherwise
+func emailTemplatesForAdmin(c *gin.Context) (*mailtemplates.Set, bool) {
+	ctx := c.Request.Context()
+	userEmail, _, _, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, false
+	}
+	if !isPlatformAdmin(userEmail) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return nil, false
+	}
+	set := sendgrid.LocalTemplates()
+	if set == nil {
+		c.AbortWithStatusJSON(
+			http.StatusServiceUnavailable,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("email templates are not loaded").Error(),
+			},
+		)
+		return nil, false
+	}
+	return set, true
+}
+
+// ListEmailTemplates ... every kind of transactional email, whether it has local templates and whether it
+// is sent with them
+func ListEmailTemplates(c *gin.Context) {
+	log.Infof("List email templates")
+	set, ok := emailTemplatesForAdmin(c)
+	if !ok {
+		return
+	}
+	kinds := make([]string, 0, len(mailtemplates.Samples))
+	for kind := range mailtemplates.Samples {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	templates := make([]gin.H, 0, len(kinds))
+	for _, kind := range kinds {
+		templates = append(templates, gin.H{
+			"kind":           kind,
+			"hasTemplates":   set.Has(kind),
+			"rendersLocally": sendgrid.RendersLocally(kind),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   templates,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// PreviewEmailTemplate ... the email of a kind rendered from the local templates with sample data. With
+// format html or text the part is returned as it is, for a browser to show.
+func PreviewEmailTemplate(c *gin.Context) {
+	log.Infof("Preview email template")
+	set, ok := emailTemplatesForAdmin(c)
+	if !ok {
+		return
+	}
+	kind := c.Param("kind")
+	if !set.Has(kind) {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("no local templates for email %s", kind).Error(),
+			},
+		)
+		return
+	}
+	email, err := set.Render(kind, mailtemplates.Samples[kind])
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	switch c.Query("format") {
+	case "html":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(email.HTML))
+	case "text":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(email.Text))
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			constants.RESPONSE_JSON_DATA:   email,
+			constants.RESPONSDE_JSON_ERROR: nil,
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/fcm"
+	"github.com/superdentist/superdentist-backend/lib/notify"
+)
+
+var devicePlatforms = map[string]bool{"": true, "web": true, "android": true, "ios": true}
+
+// pushReferralEvent ... pushes and texts the event to the staff of the clinics it concerns, as their
+// notification preferences say
+func pushReferralEvent(ctx context.Context, eventType string, referral contracts.DSReferral, channel contracts.ChatBox, messageID string) {
+	for addressID, notification := range fcm.ReferralNotifications(eventType, referral, channel, messageID, global.Options.ContinueURL) {
+		push := notification
+		err := notify.Dispatch(ctx, notify.Notice{
+			Event:      eventType,
+			AddressID:  addressID,
+			ReferralID: referral.ReferralID,
+			Text:       notification.Body,
+			Link:       notification.Link,
+			Push:       &push,
+			SMS:        true,
+		})
+		if err != nil {
+			log.Errorf("Failed to push %s: %v", eventType, err.Error())
+		}
+	}
+}
+
+// deviceTopics ... the topics a device of the user gets pushes on: the staff topic of the clinics where the
+// user has their own notification preferences, the clinic topic of the others
+func deviceTopics(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, userID string, addressIDs []string) []string {
+	topics := make([]string, 0, len(addressIDs))
+	for _, addressID := range addressIDs {
+		prefs, err := clinicDB.GetNotificationPreferences(ctx, addressID, userID)
+		if err != nil {
+			log.Errorf("Failed to get notification preferences: %v", err.Error())
+		}
+		if prefs != nil {
+			topics = append(topics, fcm.StaffTopic(addressID, userID))
+		} else {
+			topics = append(topics, fcm.ClinicTopic(addressID))
+		}
+	}
+	return topics
+}
+
+// subscribedTopics ... the topics the device was subscribed to, devices registered before staff topics only
+// had those of their clinics
+func subscribedTopics(device contracts.DeviceToken) []string {
+	if device.Topics != nil {
+		return device.Topics
+	}
+	topics := make([]string, 0, len(device.AddressIDs))
+	for _, addressID := range device.AddressIDs {
+		topics = append(topics, fcm.ClinicTopic(addressID))
+	}
+	return topics
+}
+
+// resubscribeUserDevices ... moves the devices of the user to the topics their preferences call for now
+func resubscribeUserDevices(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, userID string) {
+	sender := notify.PushSender()
+	if sender == nil {
+		return
+	}
+	devices, err := clinicDB.GetUserDeviceTokens(ctx, userID)
+	if err != nil {
+		log.Errorf("Failed to get devices: %v", err.Error())
+		return
+	}
+	for _, device := range devices {
+		topics := deviceTopics(ctx, clinicDB, userID, device.AddressIDs)
+		err := fcm.Register(ctx, sender, device.Token, topics, subscribedTopics(device))
+		if err == fcm.ErrInvalidToken {
+			err = clinicDB.DeleteDeviceToken(ctx, device.Token)
+		} else if err == nil {
+			device.Topics = topics
+			device.UpdatedOn = time.Now()
+			err = clinicDB.SaveDeviceToken(ctx, device)
+		}
+		if err != nil {
+			log.Errorf("Failed to move device to new topics: %v", err.Error())
+		}
+	}
+}
+
+// loadDeviceUser ... the user of the request and the clinic database, it aborts the request when either fails
+func loadDeviceUser(c *gin.Context) (string, string, *datastoredb.DSClinicMeta, bool) {
+	ctx := c.Request.Context()
+	if notify.PushSender() == nil {
+		c.AbortWithStatusJSON(
+			http.StatusServiceUnavailable,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("push notifications are not available").Error(),
+			},
+		)
+		return "", "", nil, false
+	}
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return "", "", nil, false
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return "", "", nil, false
+	}
+	return userEmail, userID, clinicDB, true
+}
+
+// RegisterDevice ... registers a staff device for push notifications of the user's clinics. Devices register
+// every time the app starts, which also moves them to the clinics the user belongs to now.
+func RegisterDevice(c *gin.Context) {
+	log.Infof("Register device")
+	ctx := c.Request.Context()
+	userEmail, userID, clinicDB, ok := loadDeviceUser(c)
+	if !ok {
+		return
+	}
+	var device contracts.DeviceToken
+	if err := c.ShouldBindWith(&device, binding.JSON); err != nil || strings.TrimSpace(device.Token) == "" || !devicePlatforms[device.Platform] {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	clinics, err := clinicDB.GetAllClinics(ctx, userEmail, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	addressIDs := make([]string, 0, len(clinics))
+	for _, clinic := range clinics {
+		if clinic.AddressID != "" {
+			addressIDs = append(addressIDs, clinic.AddressID)
+		}
+	}
+	now := time.Now()
+	device.CreatedOn = now
+	topics := deviceTopics(ctx, clinicDB, userID, addressIDs)
+	var previous []string
+	existing, err := clinicDB.GetDeviceToken(ctx, device.Token)
+	if err != nil {
+		log.Errorf("Failed to get device: %v", err.Error())
+	}
+	if existing != nil {
+		// a device signed in with another user moves to that user's clinics
+		previous = subscribedTopics(*existing)
+		device.CreatedOn = existing.CreatedOn
+	}
+	err = fcm.Register(ctx, notify.PushSender(), device.Token, topics, previous)
+	if err == fcm.ErrInvalidToken {
+		if existing != nil {
+			if err := clinicDB.DeleteDeviceToken(ctx, device.Token); err != nil {
+				log.Errorf("Failed to delete invalid device: %v", err.Error())
+			}
+		}
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadGateway,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	device.UserID = userID
+	device.Email = userEmail
+	device.AddressIDs = addressIDs
+	device.Topics = topics
+	device.UpdatedOn = now
+	err = clinicDB.SaveDeviceToken(ctx, device)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   device,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// UnregisterDevice ... the device of the user gets no more pushes, on sign out
+func UnregisterDevice(c *gin.Context) {
+	log.Infof("Unregister device")
+	ctx := c.Request.Context()
+	_, userID, clinicDB, ok := loadDeviceUser(c)
+	if !ok {
+		return
+	}
+	token := c.Param("token")
+	device, err := clinicDB.GetDeviceToken(ctx, token)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if device == nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("device is not registered").Error(),
+			},
+		)
+		return
+	}
+	if device.UserID != userID {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	err = fcm.Unregister(ctx, notify.PushSender(), token, subscribedTopics(*device))
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadGateway,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	err = clinicDB.DeleteDeviceToken(ctx, token)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   "device unregistered",
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
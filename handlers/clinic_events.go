@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/websocket"
+)
+
+// StreamClinicEvents ... server-sent events for the dashboards of the user's clinics, or only the
+// addressId one. A stream lasts EVENT_STREAM_DURATION so it ends before the server write timeout,
+// the browser then reconnects with Last-Event-ID and gets whatever it missed replayed.
+func StreamClinicEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	tokenFromQuery(c)
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if websocketPool == nil {
+		c.AbortWithStatusJSON(
+			http.StatusServiceUnavailable,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("event stream is not available").Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	adminClinics, err := clinicDB.GetAllClinics(ctx, userEmail, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	onlyAddressID := c.Query("addressId")
+	addressIDs := make([]string, 0)
+	topics := make([]string, 0)
+	for _, clinic := range adminClinics {
+		if clinic.AddressID == "" || (onlyAddressID != "" && clinic.AddressID != onlyAddressID) {
+			continue
+		}
+		addressIDs = append(addressIDs, clinic.AddressID)
+		topics = append(topics, websocket.ClinicTopic(clinic.AddressID))
+	}
+	if len(addressIDs) == 0 {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	// subscribe before replaying so nothing published in between is lost
+	connID, _ := uuid.NewUUID()
+	client := websocket.NewClient(websocketPool, nil, connID.String())
+	websocketPool.Register(client, topics...)
+	defer websocketPool.Unregister(client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: 2000\n\n")
+	replayed := make(map[string]bool)
+	if lastEventID != "" {
+		missed := make([]contracts.ClinicEvent, 0)
+		for _, addressID := range addressIDs {
+			events, err := clinicDB.GetClinicEventsAfter(ctx, addressID, lastEventID, constants.EVENT_REPLAY_LIMIT)
+			if err != nil {
+				log.Errorf("Failed to replay events of %s: %v", addressID, err.Error())
+				continue
+			}
+			missed = append(missed, events...)
+		}
+		sort.Slice(missed, func(i, j int) bool { return missed[i].EventID < missed[j].EventID })
+		for _, event := range missed {
+			replayed[event.AddressID+"/"+event.EventID] = true
+			writeClinicEvent(c.Writer, event)
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(constants.EVENT_STREAM_HEARTBEAT) * time.Second)
+	defer heartbeat.Stop()
+	streamEnd := time.NewTimer(time.Duration(constants.EVENT_STREAM_DURATION) * time.Second)
+	defer streamEnd.Stop()
+	for {
+		select {
+		case message, ok := <-client.Send:
+			if !ok {
+				return
+			}
+			var event contracts.ClinicEvent
+			if err := json.Unmarshal(message, &event); err != nil || event.EventID == "" {
+				continue
+			}
+			if replayed[event.AddressID+"/"+event.EventID] {
+				continue
+			}
+			if err := writeClinicEvent(c.Writer, event); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-streamEnd.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func writeClinicEvent(w gin.ResponseWriter, event contracts.ClinicEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.EventID, event.Type, data)
+	return err
+}
+
+// publishClinicEvent ... records the event for each clinic and pushes it to their live dashboards,
+// clinics that are not registered (empty address id) are skipped
+func publishClinicEvent(ctx context.Context, event contracts.ClinicEvent, addressIDs ...string) {
+	now := time.Now()
+	eventUUID, _ := uuid.NewUUID()
+	event.EventID = fmt.Sprintf("%019d-%s", now.UnixNano(), eventUUID.String()[:8])
+	event.CreatedOn = now
+	var clinicDB *datastoredb.DSClinicMeta
+	published := make(map[string]bool)
+	for _, addressID := range addressIDs {
+		if addressID == "" || published[addressID] {
+			continue
+		}
+		published[addressID] = true
+		if clinicDB == nil {
+			clinicDB = datastoredb.NewClinicMetaHandler()
+			err := clinicDB.InitializeDataBase(ctx, googleprojectlib.GetGoogleProjectID())
+			if err != nil {
+				log.Errorf("Failed to record %s event: %v", event.Type, err.Error())
+				return
+			}
+		}
+		event.AddressID = addressID
+		err := clinicDB.AddClinicEvent(ctx, event)
+		if err != nil {
+			log.Errorf("Failed to record %s event for %s: %v", event.Type, addressID, err.Error())
+		}
+		if websocketPool != nil {
+			err = websocketPool.PublishJSON(ctx, websocket.ClinicTopic(addressID), event)
+			if err != nil {
+				log.Errorf("Failed to publish %s event for %s: %v", event.Type, addressID, err.Error())
+			}
+		}
+	}
+}
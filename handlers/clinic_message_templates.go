@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+)
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// referralMessageVars ... variables every patient message of the referral may use
+func referralMessageVars(referral contracts.DSReferral) map[string]string {
+	return map[string]string{
+		"PatientName":   referral.PatientFirstName + " " + referral.PatientLastName,
+		"ClinicName":    referral.ToClinicName,
+		"ClinicAddress": referral.ToClinicAddress,
+		"ClinicPhone":   referral.ToClinicPhone,
+		"ReferralID":    referral.ReferralID,
+	}
+}
+
+// patientMessage ... the message for the patient of the referral, in their language and the specialist's
+// wording. Empty when it cannot be rendered, callers then send nothing.
+func patientMessage(ctx context.Context, referral contracts.DSReferral, key string, vars map[string]string) string {
+	all := referralMessageVars(referral)
+	for name, value := range vars {
+		all[name] = value
+	}
+	text, err := messages.Render(ctx, referral.ToAddressID, referral.PreferredLanguage, key, all)
+	if err != nil {
+		log.Errorf("Failed to render %s for %s: %v", key, referral.ReferralID, err.Error())
+		return ""
+	}
+	return text
+}
+
+// loadClinicForTemplates ... the clinic of the request for one of its admins, it aborts the request otherwise
+func loadClinicForTemplates(c *gin.Context) (*contracts.PhysicalClinicMapLocation, string, *datastoredb.DSClinicMeta, bool) {
+	ctx := c.Request.Context()
+	addressID := c.Param("addressId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, false
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, false
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, addressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return nil, "", nil, false
+	}
+	clinic, err := clinicDB.GetSingleClinic(ctx, addressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, false
+	}
+	if messages.CurrentCatalog() == nil {
+		c.AbortWithStatusJSON(
+			http.StatusServiceUnavailable,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("message catalog is not loaded").Error(),
+			},
+		)
+		return nil, "", nil, false
+	}
+	clinic.AddressID = addressID
+	return clinic, userEmail, clinicDB, true
+}
+
+// templateLocale ... the locale of the request, it aborts the request when it is not one
+func templateLocale(c *gin.Context, language string) (string, bool) {
+	locale := messages.Locale(language)
+	if !localePattern.MatchString(locale) {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("%q is not a locale", language).Error(),
+			},
+		)
+		return "", false
+	}
+	return locale, true
+}
+
+// previewMessage ... the text rendered with sample values, the clinic's own where the message uses them
+func previewMessage(clinic *contracts.PhysicalClinicMapLocation, key string, text string) (string, error) {
+	return messages.Preview(key, text, map[string]string{
+		"ClinicName":    clinic.Name,
+		"ClinicAddress": clinic.Address,
+		"ClinicPhone":   clinic.PhoneNumber,
+		"ClinicText":    clinic.CustomText,
+	})
+}
+
+// GetClinicMessageTemplates ... the patient messages of the clinic in a locale, with the clinic's overrides
+func GetClinicMessageTemplates(c *gin.Context) {
+	log.Infof("Get clinic message templates")
+	ctx := c.Request.Context()
+	clinic, _, clinicDB, ok := loadClinicForTemplates(c)
+	if !ok {
+		return
+	}
+	locale, ok := templateLocale(c, c.Query("locale"))
+	if !ok {
+		return
+	}
+	overrides, err := clinicDB.GetMessageOverrides(ctx, clinic.AddressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	overridden := make(map[string]string)
+	for _, override := range overrides {
+		if override.Locale == locale {
+			overridden[override.Key] = override.Text
+		}
+	}
+	catalog := messages.CurrentCatalog()
+	keys := make([]string, 0, len(messages.Variables))
+	for key := range messages.Variables {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	templates := make([]contracts.MessageTemplate, 0, len(keys))
+	for _, key := range keys {
+		template := contracts.MessageTemplate{
+			Key:       key,
+			Locale:    locale,
+			Variables: messages.Variables[key],
+			Default:   catalog.Text(locale, key),
+			Override:  overridden[key],
+		}
+		text := template.Default
+		if template.Override != "" {
+			text = template.Override
+		}
+		template.Preview, err = previewMessage(clinic, key, text)
+		if err != nil {
+			log.Errorf("Failed to preview %s of %s: %v", key, clinic.AddressID, err.Error())
+		}
+		templates = append(templates, template)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA: gin.H{
+			"locales":   catalog.Locales(),
+			"templates": templates,
+		},
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// SaveClinicMessageTemplate ... the clinic's own wording of a patient message, a text using variables the
+// message does not have is refused
+func SaveClinicMessageTemplate(c *gin.Context) {
+	log.Infof("Save clinic message template")
+	ctx := c.Request.Context()
+	clinic, userEmail, clinicDB, ok := loadClinicForTemplates(c)
+	if !ok {
+		return
+	}
+	var override contracts.MessageTemplateOverride
+	if err := c.ShouldBindWith(&override, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	override.Locale, ok = templateLocale(c, override.Locale)
+	if !ok {
+		return
+	}
+	preview, err := previewMessage(clinic, override.Key, override.Text)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	override.AddressID = clinic.AddressID
+	override.UpdatedBy = userEmail
+	override.UpdatedOn = time.Now()
+	err = clinicDB.SaveMessageOverride(ctx, override)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA: contracts.MessageTemplate{
+			Key:       override.Key,
+			Locale:    override.Locale,
+			Variables: messages.Variables[override.Key],
+			Default:   messages.CurrentCatalog().Text(override.Locale, override.Key),
+			Override:  override.Text,
+			Preview:   preview,
+		},
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// DeleteClinicMessageTemplate ... the clinic goes back to the catalog's wording of the message
+func DeleteClinicMessageTemplate(c *gin.Context) {
+	log.Infof("Delete clinic message template")
+	ctx := c.Request.Context()
+	clinic, _, clinicDB, ok := loadClinicForTemplates(c)
+	if !ok {
+		return
+	}
+	locale, ok := templateLocale(c, c.Param("locale"))
+	if !ok {
+		return
+	}
+	key := c.Param("key")
+	if _, known := messages.Variables[key]; !known {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("unknown message %s", key).Error(),
+			},
+		)
+		return
+	}
+	err := clinicDB.DeleteMessageOverride(ctx, clinic.AddressID, locale, key)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   "message template deleted",
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// PreviewClinicMessageTemplate ... a message rendered with sample values, of a draft text or the clinic's
+// current wording
+func PreviewClinicMessageTemplate(c *gin.Context) {
+	log.Infof("Preview clinic message template")
+	ctx := c.Request.Context()
+	clinic, _, clinicDB, ok := loadClinicForTemplates(c)
+	if !ok {
+		return
+	}
+	var request contracts.MessagePreview
+	if err := c.ShouldBindWith(&request, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	locale, ok := templateLocale(c, request.Locale)
+	if !ok {
+		return
+	}
+	text := request.Text
+	if text == "" {
+		override, err := clinicDB.MessageOverride(ctx, clinic.AddressID, locale, request.Key)
+		if err != nil {
+			log.Errorf("Failed to get %s of %s: %v", request.Key, clinic.AddressID, err.Error())
+		}
+		text = override
+	}
+	if text == "" {
+		text = messages.CurrentCatalog().Text(locale, request.Key)
+	}
+	preview, err := previewMessage(clinic, request.Key, text)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA: contracts.MessageTemplate{
+			Key:       request.Key,
+			Locale:    locale,
+			Variables: messages.Variables[request.Key],
+			Preview:   preview,
+		},
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
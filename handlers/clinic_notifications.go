@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/fcm"
+	"github.com/superdentist/superdentist-backend/lib/notify"
+)
+
+// loadNotificationClinic ... the user of the request, the clinic database and the clinic of the addressId, it
+// aborts the request unless the user is staff of the clinic
+func loadNotificationClinic(c *gin.Context) (string, string, *datastoredb.DSClinicMeta, *contracts.PhysicalClinicMapLocation, bool) {
+	ctx := c.Request.Context()
+	addressID := c.Param("addressId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return "", "", nil, nil, false
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return "", "", nil, nil, false
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, addressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return "", "", nil, nil, false
+	}
+	clinic, err := clinicDB.GetSingleClinic(ctx, addressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return "", "", nil, nil, false
+	}
+	clinic.AddressID = addressID
+	return userEmail, userID, clinicDB, clinic, true
+}
+
+// clinicNotificationPreferences ... the preferences of the clinic, its defaults when it has none
+func clinicNotificationPreferences(c *gin.Context, clinicDB *datastoredb.DSClinicMeta, clinic *contracts.PhysicalClinicMapLocation) contracts.NotificationPreferences {
+	prefs, err := clinicDB.GetNotificationPreferences(c.Request.Context(), clinic.AddressID, "")
+	if err != nil {
+		log.Errorf("Failed to get notification preferences: %v", err.Error())
+	}
+	if prefs == nil {
+		defaults := notify.Defaults(clinic.AddressID)
+		defaults.TimeZone = clinicTimeLocation(*clinic).String()
+		return defaults
+	}
+	return *prefs
+}
+
+// saveNotificationPreferences ... checks and saves the preferences of the request, for the clinic or for the
+// staff user when userID is set
+func saveNotificationPreferences(c *gin.Context, clinicDB *datastoredb.DSClinicMeta, clinic *contracts.PhysicalClinicMapLocation, userEmail string, userID string) (*contracts.NotificationPreferences, bool) {
+	var prefs contracts.NotificationPreferences
+	if err := c.ShouldBindWith(&prefs, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return nil, false
+	}
+	// quiet hours and digests are in the clinic's time, wherever its staff are
+	prefs.AddressID = clinic.AddressID
+	prefs.UserID = userID
+	prefs.Email = ""
+	if userID != "" {
+		prefs.Email = userEmail
+	}
+	prefs.TimeZone = clinicTimeLocation(*clinic).String()
+	if err := notify.Normalize(&prefs); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, false
+	}
+	prefs.UpdatedBy = userEmail
+	prefs.UpdatedOn = time.Now()
+	err := clinicDB.SaveNotificationPreferences(c.Request.Context(), prefs)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, false
+	}
+	return &prefs, true
+}
+
+// GetClinicNotificationPreferences ... how the clinic hears of referral events, staff without their own
+// preferences follow these
+func GetClinicNotificationPreferences(c *gin.Context) {
+	log.Infof("Get clinic notification preferences")
+	_, _, clinicDB, clinic, ok := loadNotificationClinic(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   clinicNotificationPreferences(c, clinicDB, clinic),
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// SaveClinicNotificationPreferences ... replaces the notification preferences of the clinic
+func SaveClinicNotificationPreferences(c *gin.Context) {
+	log.Infof("Save clinic notification preferences")
+	userEmail, _, clinicDB, clinic, ok := loadNotificationClinic(c)
+	if !ok {
+		return
+	}
+	prefs, ok := saveNotificationPreferences(c, clinicDB, clinic, userEmail, "")
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   prefs,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// GetMyNotificationPreferences ... the user's own preferences for the clinic, the clinic's when the user has
+// none of their own, then userId is empty
+func GetMyNotificationPreferences(c *gin.Context) {
+	log.Infof("Get my notification preferences")
+	ctx := c.Request.Context()
+	_, userID, clinicDB, clinic, ok := loadNotificationClinic(c)
+	if !ok {
+		return
+	}
+	prefs, err := clinicDB.GetNotificationPreferences(ctx, clinic.AddressID, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if prefs == nil {
+		clinicPrefs := clinicNotificationPreferences(c, clinicDB, clinic)
+		prefs = &clinicPrefs
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   prefs,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// SaveMyNotificationPreferences ... the user's own preferences for the clinic, they replace the clinic's for
+// the user. The user's devices move to their own push topic of the clinic.
+func SaveMyNotificationPreferences(c *gin.Context) {
+	log.Infof("Save my notification preferences")
+	userEmail, userID, clinicDB, clinic, ok := loadNotificationClinic(c)
+	if !ok {
+		return
+	}
+	prefs, ok := saveNotificationPreferences(c, clinicDB, clinic, userEmail, userID)
+	if !ok {
+		return
+	}
+	resubscribeUserDevices(c.Request.Context(), clinicDB, userID)
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   prefs,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// DeleteMyNotificationPreferences ... the user follows the clinic's preferences again
+func DeleteMyNotificationPreferences(c *gin.Context) {
+	log.Infof("Delete my notification preferences")
+	ctx := c.Request.Context()
+	_, userID, clinicDB, clinic, ok := loadNotificationClinic(c)
+	if !ok {
+		return
+	}
+	err := clinicDB.DeleteNotificationPreferences(ctx, clinic.AddressID, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	resubscribeUserDevices(ctx, clinicDB, userID)
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   clinicNotificationPreferences(c, clinicDB, clinic),
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// notifyClinicEmail ... sends a staff email of a referral event, as the preferences of the clinic at addressID
+// or of its staff with the email say. Emails to our admin inbox, for clinics we have no email of, always go out.
+// The text stands for the email in digests and never names the patient.
+func notifyClinicEmail(ctx context.Context, eventType string, referral contracts.DSReferral, addressID string, email string, name string, text string, send func() error) error {
+	if addressID == "" || email == "" || email == constants.SD_ADMIN_EMAIL {
+		return send()
+	}
+	return notify.Dispatch(ctx, clinicNotice(eventType, referral, addressID, email, name, text, send))
+}
+
+// notifyClinicAlert ... like notifyClinicEmail, for events that also go out by push, titled title, and by text
+func notifyClinicAlert(ctx context.Context, eventType string, referral contracts.DSReferral, addressID string, email string, name string, title string, text string, send func() error) error {
+	if addressID == "" || email == "" || email == constants.SD_ADMIN_EMAIL {
+		return send()
+	}
+	notice := clinicNotice(eventType, referral, addressID, email, name, text, send)
+	push := fcm.ReferralNotification(eventType, referral, addressID, title, text, "", global.Options.ContinueURL)
+	notice.Push = &push
+	notice.SMS = true
+	return notify.Dispatch(ctx, notice)
+}
+
+func clinicNotice(eventType string, referral contracts.DSReferral, addressID string, email string, name string, text string, send func() error) notify.Notice {
+	return notify.Notice{
+		Event:      eventType,
+		AddressID:  addressID,
+		ReferralID: referral.ReferralID,
+		Text:       text,
+		Link:       fcm.ReferralLink(global.Options.ContinueURL, referral.ReferralID, ""),
+		Email:      email,
+		Name:       name,
+		SendEmail:  send,
+	}
+}
+
+func withClinicName(text string, joiner string, clinicName string) string {
+	if clinicName == "" {
+		return text
+	}
+	return text + joiner + clinicName
+}
@@ -804,19 +804,10 @@ func GetAllQRZip(c *gin.Context) {
 		)
 		return
 	}
-	err = storageC.ZipFile(ctx, currentClinic.PlaceID, constants.SD_QR_BUCKET)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{
-				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
-			},
-		)
-		return
+	entries, err := storageC.FolderEntries(ctx, currentClinic.PlaceID, constants.SD_QR_BUCKET)
+	if err == nil && len(entries) == 0 {
+		err = fmt.Errorf("No QR code is stored for the clinic")
 	}
-
-	zipReader, err := storageC.DownloadAsZip(ctx, currentClinic.PlaceID, constants.SD_QR_BUCKET)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -827,20 +818,8 @@ func GetAllQRZip(c *gin.Context) {
 		)
 		return
 	}
-	fileNameDefault := currentClinic.Name + ".zip"
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileNameDefault))
-	c.Header("Content-Type", "application/zip")
 	clinicMetaDB.Close()
-	if _, err := io.Copy(c.Writer, zipReader); err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{
-				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
-			},
-		)
-		return
-	}
+	streamZip(c, storageC, constants.SD_QR_BUCKET, currentClinic.Name+".zip", entries)
 }
 
 // GetFavoriteClinics ...
@@ -727,54 +727,11 @@ func QueryAddressHandlerWebsocket(webPool *websocket.Pool, c *gin.Context) {
 	webSocketConn, err := websocket.UpgradeWebSocket(c)
 	if err != nil {
 		log.Errorf("Failed to establish websocket connection: %v", err.Error())
-	}
-	connID, _ := uuid.NewUUID()
-	client := &websocket.Client{
-		CurrentPool:   webPool,
-		CurrentConn:   webSocketConn,
-		CurrentConnID: connID.String(),
-		Send:          make(chan []byte, 1024),
-	}
-	client.CurrentPool.Register <- &websocket.RegisterChannel{
-		ClientID:  connID.String(),
-		WebClient: client,
-	}
-	go client.ReadAddressString()
-	go client.WriteAdderessJSON(mapClient)
-}
-
-// ChatWebSocketHandler ...
-func ChatWebSocketHandler(webPool *websocket.Pool, c *gin.Context) {
-	ctx := c.Request.Context()
-	gproject := googleprojectlib.GetGoogleProjectID()
-
-	mapClient := gmaps.NewMapsHandler()
-	err := mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{
-				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
-			},
-		)
 		return
 	}
-	webSocketConn, err := websocket.UpgradeWebSocket(c)
-	if err != nil {
-		log.Errorf("Failed to establish websocket connection: %v", err.Error())
-	}
 	connID, _ := uuid.NewUUID()
-	client := &websocket.Client{
-		CurrentPool:   webPool,
-		CurrentConn:   webSocketConn,
-		CurrentConnID: connID.String(),
-		Send:          make(chan []byte, 1024),
-	}
-	client.CurrentPool.Register <- &websocket.RegisterChannel{
-		ClientID:  connID.String(),
-		WebClient: client,
-	}
+	client := websocket.NewClient(webPool, webSocketConn, connID.String())
+	webPool.Register(client)
 	go client.ReadAddressString()
 	go client.WriteAdderessJSON(mapClient)
 }
@@ -806,6 +763,53 @@ func getProviderID(ctx context.Context, request *http.Request) (string, error) {
 	providerID, err := jwt.GetProviderID(request)
 	return providerID, err
 }
+
+// isClinicAdmin ... true when the clinic address is registered under the signed in admin
+func isClinicAdmin(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, email string, uid string, addressID string) bool {
+	adminClinics, err := clinicDB.GetAllClinics(ctx, email, uid)
+	if err != nil {
+		return false
+	}
+	for _, clinic := range adminClinics {
+		if clinic.AddressID == addressID {
+			return true
+		}
+	}
+	return false
+}
+
+// isClinicAdminOfPlace ... same as isClinicAdmin for clinics only known by their google place id
+func isClinicAdminOfPlace(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, email string, uid string, placeID string) bool {
+	if placeID == "" {
+		return false
+	}
+	adminClinics, err := clinicDB.GetAllClinics(ctx, email, uid)
+	if err != nil {
+		return false
+	}
+	for _, clinic := range adminClinics {
+		if clinic.PlaceID == placeID {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessReferral ... the user administers either the referring or the receiving clinic
+func canAccessReferral(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, email string, uid string, referral contracts.DSReferral) bool {
+	adminClinics, err := clinicDB.GetAllClinics(ctx, email, uid)
+	if err != nil {
+		return false
+	}
+	for _, clinic := range adminClinics {
+		if (clinic.AddressID != "" && (clinic.AddressID == referral.FromAddressID || clinic.AddressID == referral.ToAddressID)) ||
+			(clinic.PlaceID != "" && (clinic.PlaceID == referral.FromPlaceID || clinic.PlaceID == referral.ToPlaceID)) {
+			return true
+		}
+	}
+	return false
+}
+
 func registerAndSendVerification(ctx context.Context, gproject string, clinicRegistrationReq contracts.ClinicRegistrationData) error {
 	sgClient := sendgrid.NewSendGridClient()
 	err := sgClient.InitializeSendGridClient()
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+)
+
+// AddClinicSLA ... replaces the SLA rules for referrals received by the clinic
+func AddClinicSLA(c *gin.Context) {
+	log.Infof("Add Clinic SLA")
+	ctx := c.Request.Context()
+	addressID := c.Param("addressId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	var clinicSLA contracts.ClinicSLA
+	if err := c.ShouldBindWith(&clinicSLA, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened"),
+			},
+		)
+		return
+	}
+	for _, rule := range clinicSLA.Rules {
+		if strings.TrimSpace(rule.SPStatus) == "" || rule.BusinessDays <= 0 || rule.EscalateAfterDays < 0 {
+			c.AbortWithStatusJSON(
+				http.StatusBadRequest,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: fmt.Errorf("sla rule %q needs a status and a positive number of business days", rule.Name).Error(),
+				},
+			)
+			return
+		}
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, addressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	clinic, err := clinicDB.GetSingleClinic(ctx, addressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicSLA.AddressID = addressID
+	clinicSLA.PlaceID = clinic.PlaceID
+	err = clinicDB.AddClinicSLA(ctx, clinicSLA)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   clinicSLA,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// GetClinicSLA ....
+func GetClinicSLA(c *gin.Context) {
+	log.Infof("Get Clinic SLA")
+	ctx := c.Request.Context()
+	addressID := c.Param("addressId")
+	_, _, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicSLA, err := clinicDB.GetClinicSLA(ctx, addressID)
+	if err != nil {
+		clinicSLA = &contracts.ClinicSLA{AddressID: addressID, Rules: make([]contracts.SLARule, 0)}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   clinicSLA,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
@@ -1,11 +1,9 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
@@ -20,10 +18,12 @@ import (
 	"github.com/superdentist/superdentist-backend/constants"
 	"github.com/superdentist/superdentist-backend/contracts"
 	"github.com/superdentist/superdentist-backend/helpers"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
 	"github.com/superdentist/superdentist-backend/lib/datastoredb"
 	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
 	"github.com/superdentist/superdentist-backend/lib/gsheets"
 	"github.com/superdentist/superdentist-backend/lib/identity"
+	"github.com/superdentist/superdentist-backend/lib/messages"
 	"github.com/superdentist/superdentist-backend/lib/sms"
 	"github.com/superdentist/superdentist-backend/lib/storage"
 	"go.opencensus.io/trace"
@@ -39,12 +39,11 @@ func RegisterPatientInformation(c *gin.Context) {
 	defer span.End()
 	// here is we have referral id
 
-	const _24K = 256 << 20
-	var documentFiles *multipart.Form
-	if err := c.Request.ParseMultipartForm(_24K); err == nil {
-		documentFiles = c.Request.MultipartForm
+	uploads, ok := parseUploads(c, formUploadLimits(), contracts.DocumentSourceQR, "")
+	if !ok {
+		return
 	}
-	go registerPatientInDB(documentFiles)
+	go registerPatientInDB(c.Request.MultipartForm, uploads)
 	gproject := googleprojectlib.GetGoogleProjectID()
 	userID, err := getUserDetailsAnonymous(ctx, c.Request)
 	providerID, err := getProviderID(ctx, c.Request)
@@ -366,6 +365,11 @@ func GetSinglePatientForClinic(c *gin.Context) {
 		)
 		return
 	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err == nil && patients.Phone != "" {
+		patients.SMSConsent = smsConsent(ctx, dsRefC, patientSMSPhone(patients.Phone))
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		constants.RESPONSE_JSON_DATA:   patients,
@@ -727,12 +731,11 @@ func UploadPatientDocuments(c *gin.Context) {
 	// here is we have referral id
 	pID := c.Param("patientId")
 
-	const _24K = 256 << 20
-	var documentFiles *multipart.Form
-	if err := c.Request.ParseMultipartForm(_24K); err == nil {
-		documentFiles = c.Request.MultipartForm
+	uploads, ok := parseUploads(c, formUploadLimits(), contracts.DocumentSourceWeb, "")
+	if !ok {
+		return
 	}
-	err := uploadPatientDocs(ctx, pID, documentFiles)
+	err := uploadPatientDocs(ctx, pID, uploads)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -749,7 +752,7 @@ func UploadPatientDocuments(c *gin.Context) {
 	})
 }
 
-func registerPatientInDB(documentFiles *multipart.Form) error {
+func registerPatientInDB(documentFiles *multipart.Form, uploads []attachments.File) error {
 	var patientDetails contracts.PatientStore
 	dentalInsurance := make([]contracts.PatientDentalInsurance, 0)
 	medicalInsurance := make([]contracts.PatientMedicalInsurance, 0)
@@ -765,6 +768,8 @@ func registerPatientInDB(documentFiles *multipart.Form) error {
 			patientDetails.Phone = fieldValue[0]
 		case "email":
 			patientDetails.Email = fieldValue[0]
+		case "preferredLanguage":
+			patientDetails.PreferredLanguage = messages.Locale(fieldValue[0])
 		case "ssn":
 			patientDetails.SSN = fieldValue[0]
 		case "zipCode":
@@ -866,6 +871,14 @@ func registerPatientInDB(documentFiles *multipart.Form) error {
 			log.Errorf("Failed to created patient information: %v", err.Error())
 			return err
 		}
+		if patientDetails.PreferredLanguage != "" && patientDetails.PreferredLanguage != dsReferral.PreferredLanguage {
+			// the patient's own choice wins over the language the referring clinic gave
+			dsReferral.PreferredLanguage = patientDetails.PreferredLanguage
+			err = dsRefC.CreateReferral(ctx, *dsReferral)
+			if err != nil {
+				log.Errorf("Failed to save preferred language of %s: %v", refID, err.Error())
+			}
+		}
 		if dsReferral.FromAddressID != "" {
 			patientDetails.GD = dsReferral.FromAddressID
 			currentClinic, err := clinicDB.GetSingleClinic(ctx, patientDetails.GD)
@@ -934,6 +947,15 @@ func registerPatientInDB(documentFiles *multipart.Form) error {
 		log.Errorf("Failed to created patient information: %v", err.Error())
 		return err
 	}
+	eventAddressIDs := []string{patientDetails.AddressID}
+	if refID != "" {
+		eventAddressIDs = append(eventAddressIDs, dsReferral.FromAddressID, dsReferral.ToAddressID)
+	}
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:       contracts.EventPatientRegistered,
+		ReferralID: refID,
+		PatientID:  pIDString,
+	}, eventAddressIDs...)
 	patientFolder := key
 	var patientStore contracts.Patient
 	patientStore.AddressID = patientDetails.AddressID
@@ -956,6 +978,7 @@ func registerPatientInDB(documentFiles *multipart.Form) error {
 	patientStore.AppointmentTime = patientDetails.AppointmentTime
 	patientStore.CreatedOn = patientDetails.CreatedOn
 	patientStore.CreationDate = patientDetails.CreationDate
+	patientStore.PreferredLanguage = patientDetails.PreferredLanguage
 	patientStore.PatientID = patientDetails.PatientID
 	patientStore.DentalInsurance = dentalInsurance
 	patientStore.MedicalInsurance = medicalInsurance
@@ -965,50 +988,16 @@ func registerPatientInDB(documentFiles *multipart.Form) error {
 	if err != nil {
 		log.Errorf("Sheet write error: %v", err.Error())
 	}
-	if documentFiles != nil && documentFiles.File != nil && len(documentFiles.File) > 0 {
-		for _, fheaders := range documentFiles.File {
-			for _, hdr := range fheaders {
-				// open uploaded
-				var infile multipart.File
-				if infile, err = hdr.Open(); err != nil {
-
-					log.Errorf("Failed to created patient information: %v", err.Error())
-					return err
-
-				}
-				fileName := hdr.Filename
-
-				reader, err := storageC.DownloadSingleFile(ctx, patientFolder, constants.SD_PATIENT_BUCKET, fileName)
-				if err == nil && reader != nil {
-					timeNow := time.Now()
-					stripFile := strings.Split(fileName, ".")
-					name := stripFile[0]
-					name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-					fileName = name + "." + stripFile[len(stripFile)-1]
-				}
-				bucketPath := patientFolder + "/" + fileName
-				buckerW, err := storageC.UploadToGCSPatient(ctx, bucketPath)
-				if err != nil {
-					log.Errorf("Failed to created patient information: %v", err.Error())
-					return err
-				}
-				imageBuffer := bytes.NewBuffer(nil)
-				if _, err := io.Copy(imageBuffer, infile); err != nil {
-
-					log.Errorf("Failed to created patient information: %v", err.Error())
-					return err
-
-				}
-				currentBytes := imageBuffer.Bytes()
-				io.Copy(buckerW, bytes.NewReader(currentBytes))
-				buckerW.Close()
+	if len(uploads) > 0 {
+		pipeline := patientPipeline(ctx, storageC)
+		for _, file := range uploads {
+			file.PatientID = patientFolder
+			_, err = pipeline.Ingest(ctx, patientFolder, file)
+			if err != nil {
+				log.Errorf("Failed to created patient information: %v", err.Error())
+				return err
 			}
 		}
-		err = storageC.ZipFile(ctx, patientFolder, constants.SD_PATIENT_BUCKET)
-		if err != nil {
-			log.Errorf("Failed to created patient information: %v", err.Error())
-			return err
-		}
 	}
 	if dsReferral != nil && patientDetails.AddressID == "" && dsReferral.CommunicationText != "" && dsReferral.CommunicationPhone != "" {
 		clientSMS := sms.NewSMSClient()
@@ -1025,7 +1014,7 @@ func registerPatientInDB(documentFiles *multipart.Form) error {
 	return nil
 }
 
-func uploadPatientDocs(ctx context.Context, patientFolder string, documentFiles *multipart.Form) error {
+func uploadPatientDocs(ctx context.Context, patientFolder string, uploads []attachments.File) error {
 	gproject := googleprojectlib.GetGoogleProjectID()
 	storageC := storage.NewStorageHandler()
 	err := storageC.InitializeStorageClient(ctx, gproject)
@@ -1033,50 +1022,16 @@ func uploadPatientDocs(ctx context.Context, patientFolder string, documentFiles
 		log.Errorf("Failed to created patient information: %v", err.Error())
 		return err
 	}
-	if documentFiles != nil {
-		for _, fheaders := range documentFiles.File {
-			for _, hdr := range fheaders {
-				// open uploaded
-				var infile multipart.File
-				if infile, err = hdr.Open(); err != nil {
-
-					log.Errorf("Failed to created patient information: %v", err.Error())
-					return err
-
-				}
-				fileName := hdr.Filename
-
-				reader, err := storageC.DownloadSingleFile(ctx, patientFolder, constants.SD_PATIENT_BUCKET, fileName)
-				if err == nil && reader != nil {
-					timeNow := time.Now()
-					stripFile := strings.Split(fileName, ".")
-					name := stripFile[0]
-					name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-					fileName = name + "." + stripFile[len(stripFile)-1]
-				}
-				bucketPath := patientFolder + "/" + fileName
-				buckerW, err := storageC.UploadToGCSPatient(ctx, bucketPath)
-				if err != nil {
-					log.Errorf("Failed to created patient information: %v", err.Error())
-					return err
-				}
-				imageBuffer := bytes.NewBuffer(nil)
-				if _, err := io.Copy(imageBuffer, infile); err != nil {
-
-					log.Errorf("Failed to created patient information: %v", err.Error())
-					return err
-
-				}
-				currentBytes := imageBuffer.Bytes()
-				io.Copy(buckerW, bytes.NewReader(currentBytes))
-				buckerW.Close()
+	if len(uploads) > 0 {
+		pipeline := patientPipeline(ctx, storageC)
+		for _, file := range uploads {
+			file.PatientID = patientFolder
+			_, err = pipeline.Ingest(ctx, patientFolder, file)
+			if err != nil {
+				log.Errorf("Failed to created patient information: %v", err.Error())
+				return err
 			}
 		}
-		err = storageC.ZipFile(ctx, patientFolder, constants.SD_PATIENT_BUCKET)
-		if err != nil {
-			log.Errorf("Failed to created patient information: %v", err.Error())
-			return err
-		}
 	}
 	return nil
 }
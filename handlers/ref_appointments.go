@@ -0,0 +1,559 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/gmaps"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/ical"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+	"gopkg.in/ugjka/go-tz.v2/tz"
+)
+
+const defaultAppointmentMinutes = 60
+
+// BookReferralAppointment ... creates or moves the appointment of a referral and emails invites
+func BookReferralAppointment(c *gin.Context) {
+	log.Infof("Book Referral Appointment")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	var appointmentDetails contracts.AppointmentRequest
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if err := c.ShouldBindWith(&appointmentDetails, binding.JSON); err != nil || appointmentDetails.Start <= 0 {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	dsReferral, err := dsRefC.GetReferral(ctx, referralID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !canAccessReferral(ctx, clinicDB, userEmail, userID, *dsReferral) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	location := time.UTC
+	toClinic, err := clinicDB.GetSingleClinicViaPlace(ctx, dsReferral.ToPlaceID)
+	if err == nil && toClinic != nil {
+		location = clinicTimeLocation(*toClinic)
+	}
+	duration := appointmentDetails.Duration
+	if duration <= 0 {
+		duration = defaultAppointmentMinutes
+	}
+	appointment := dsReferral.Appointment
+	if appointment.UID == "" {
+		appointment.UID = dsReferral.ReferralID + "@superdentist.io"
+	} else {
+		// any change to an existing event must bump the sequence so calendar clients replace it
+		appointment.Sequence++
+	}
+	appointment.Start = time.Unix(0, appointmentDetails.Start*int64(time.Millisecond)).In(location)
+	appointment.Duration = duration
+	appointment.Notes = appointmentDetails.Notes
+	appointment.Status = contracts.AppointmentBooked
+	appointment.TimeZone = location.String()
+	// a new time needs new reminders and a new answer from the patient
+	appointment.RemindersSent = nil
+	appointment.PatientResponse = ""
+	appointment.RespondedOn = time.Time{}
+	appointment.UpdatedOn = time.Now()
+	dsReferral.Appointment = appointment
+	dsReferral.ModifiedOn = time.Now().In(location)
+	err = dsRefC.CreateReferral(ctx, *dsReferral)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	err = sendAppointmentInvites(ctx, *dsReferral, location)
+	if err != nil {
+		log.Errorf("failed to send appointment invites for %s: %v", dsReferral.ReferralID, err)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   dsReferral,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// CancelReferralAppointment ... cancels the appointment and sends CANCEL invites
+func CancelReferralAppointment(c *gin.Context) {
+	log.Infof("Cancel Referral Appointment")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	dsReferral, err := dsRefC.GetReferral(ctx, referralID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !canAccessReferral(ctx, clinicDB, userEmail, userID, *dsReferral) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	if dsReferral.Appointment.UID == "" || dsReferral.Appointment.Status == contracts.AppointmentCancelled {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("no booked appointment for referral %s", referralID).Error(),
+			},
+		)
+		return
+	}
+	location := appointmentLocation(dsReferral.Appointment)
+	dsReferral.Appointment.Sequence++
+	dsReferral.Appointment.Status = contracts.AppointmentCancelled
+	dsReferral.Appointment.UpdatedOn = time.Now()
+	dsReferral.ModifiedOn = time.Now().In(location)
+	err = dsRefC.CreateReferral(ctx, *dsReferral)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	err = sendAppointmentInvites(ctx, *dsReferral, location)
+	if err != nil {
+		log.Errorf("failed to send appointment cancellation for %s: %v", dsReferral.ReferralID, err)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   dsReferral,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// RotateCalendarFeedToken ... issues a new feed token for the clinic, old subscriptions stop working
+func RotateCalendarFeedToken(c *gin.Context) {
+	log.Infof("Rotate Calendar Feed Token")
+	ctx := c.Request.Context()
+	addressID := c.Param("addressId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, addressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	clinic, clinicKey, err := clinicDB.GetSingleClinicViaIDKey(ctx, addressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	token, err := newCalendarToken()
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinic.CalendarToken = token
+	err = clinicDB.UpdatePhysicalAddessressToClinicKey(ctx, clinicKey, *clinic)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	feedPath := "/v1/clinic/calendar/" + addressID + "/feed.ics?token=" + token
+	baseURL := global.Options.APIBaseURL
+	if baseURL == "" {
+		baseURL = "https://" + c.Request.Host
+	}
+	httpsURL := strings.TrimSuffix(baseURL, "/") + feedPath
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA: gin.H{
+			"webcal": "webcal://" + strings.TrimPrefix(strings.TrimPrefix(httpsURL, "https://"), "http://"),
+			"https":  httpsURL,
+		},
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// GetClinicCalendarFeed ... token protected ics feed of the clinic's referral appointments
+func GetClinicCalendarFeed(c *gin.Context) {
+	log.Infof("Clinic Calendar Feed")
+	ctx := c.Request.Context()
+	addressID := c.Param("addressId")
+	token := c.Query("token")
+	gproject := googleprojectlib.GetGoogleProjectID()
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err := clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	clinic, err := clinicDB.GetSingleClinic(ctx, addressID)
+	if err != nil || clinic.CalendarToken == "" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(clinic.CalendarToken), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	// keep a week of history so events that just passed don't vanish from subscribed calendars
+	referrals, err := dsRefC.GetUpcomingAppointments(ctx, clinic.PlaceID, time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	location := clinicTimeLocation(*clinic)
+	calendar := ical.NewCalendar(clinic.Name+" Referral Appointments", ical.MethodPublish, location)
+	for _, referral := range referrals {
+		if referral.Appointment.UID == "" {
+			continue
+		}
+		calendar.AddEvent(appointmentEvent(referral))
+	}
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", calendar.Bytes())
+}
+
+func sendAppointmentInvites(ctx context.Context, referral contracts.DSReferral, location *time.Location) error {
+	method := ical.MethodRequest
+	subject := "Appointment at " + referral.ToClinicName + " Referral ID: " + referral.ReferralID
+	if referral.Appointment.Status == contracts.AppointmentCancelled {
+		method = ical.MethodCancel
+		subject = "Cancelled: " + subject
+	}
+	calendar := ical.NewCalendar("", method, location)
+	calendar.AddEvent(appointmentEvent(referral))
+	invite := calendar.Bytes()
+	start := referral.Appointment.Start.In(location)
+	body := fmt.Sprintf("%s %s for %s %s at %s, %s.\nPhone: %s",
+		strings.Title(referral.Appointment.Status), start.Format("Monday, January 2 2006 3:04 PM MST"),
+		referral.PatientFirstName, referral.PatientLastName, referral.ToClinicName, referral.ToClinicAddress, referral.ToClinicPhone)
+	if referral.Appointment.Notes != "" {
+		body += "\n\n" + referral.Appointment.Notes
+	}
+	sgClient := sendgrid.NewSendGridClient()
+	err := sgClient.InitializeSendGridClient()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	if referral.PatientEmail != "" {
+		// the patient reads the invite in their language, the referring clinic in ours
+		cancelled := ""
+		if referral.Appointment.Status == contracts.AppointmentCancelled {
+			cancelled = "true"
+		}
+		vars := map[string]string{
+			"When":      messages.FormatTime(start, referral.PreferredLanguage),
+			"Cancelled": cancelled,
+			"Notes":     referral.Appointment.Notes,
+		}
+		patientSubject := patientMessage(ctx, referral, messages.KeyAppointmentInviteSubject, vars)
+		patientBody := patientMessage(ctx, referral, messages.KeyAppointmentInvite, vars)
+		if patientSubject == "" || patientBody == "" {
+			patientSubject, patientBody = subject, body
+		}
+		err = sgClient.SendAppointmentInvite(referral.PatientEmail, referral.PatientFirstName+" "+referral.PatientLastName, referral.ReferralID, patientSubject, patientBody, method, invite)
+		if err != nil {
+			sendErr = err
+		}
+	}
+	if referral.FromEmail != "" {
+		err = sgClient.SendAppointmentInvite(referral.FromEmail, referral.FromClinicName, referral.ReferralID, subject, body, method, invite)
+		if err != nil {
+			sendErr = err
+		}
+	}
+	return sendErr
+}
+
+// appointmentReply maps a patient text to a reminder response, empty when it is not one
+func appointmentReply(text string) string {
+	switch strings.ToUpper(strings.Trim(strings.TrimSpace(text), ".!")) {
+	case "C", "CONFIRM", "CONFIRMED", "YES":
+		return contracts.AppointmentConfirmed
+	case "R", "RESCHEDULE":
+		return contracts.AppointmentReschedule
+	}
+	return ""
+}
+
+// recordAppointmentReply stores the patient's C/R answer on the referral and acknowledges it by SMS,
+// it returns false when the referral has no upcoming appointment to answer for
+func recordAppointmentReply(ctx context.Context, referral *contracts.DSReferral, reply string, fromPhone string, clientSMS *sms.ClientSMS) bool {
+	if reply == "" || referral.Appointment.Status != contracts.AppointmentBooked || referral.Appointment.Start.Before(time.Now()) {
+		return false
+	}
+	referral.Appointment.PatientResponse = reply
+	referral.Appointment.RespondedOn = time.Now()
+	location := appointmentLocation(referral.Appointment)
+	key := messages.KeyAppointmentReschedule
+	if reply == contracts.AppointmentConfirmed {
+		key = messages.KeyAppointmentConfirmed
+	}
+	message := patientMessage(ctx, *referral, key, map[string]string{
+		"When": messages.FormatTime(referral.Appointment.Start.In(location), referral.PreferredLanguage),
+	})
+	if clientSMS != nil && fromPhone != "" && referral.PatientPhone != "" && message != "" {
+		err := clientSMS.SendSMS(fromPhone, referral.PatientPhone, message)
+		if err != nil {
+			log.Errorf("Failed to acknowledge appointment reply: %v", err.Error())
+		}
+	}
+	return true
+}
+
+func appointmentEvent(referral contracts.DSReferral) ical.Event {
+	appointment := referral.Appointment
+	status := ical.StatusConfirmed
+	if appointment.Status == contracts.AppointmentCancelled {
+		status = ical.StatusCancelled
+	}
+	duration := appointment.Duration
+	if duration <= 0 {
+		duration = defaultAppointmentMinutes
+	}
+	description := "SuperDentist Referral ID: " + referral.ReferralID + "\nReferred by: " + referral.FromClinicName
+	if appointment.Notes != "" {
+		description += "\n" + appointment.Notes
+	}
+	return ical.Event{
+		UID:          appointment.UID,
+		Summary:      referral.PatientFirstName + " " + referral.PatientLastName + " - " + referral.ToClinicName,
+		Description:  description,
+		Location:     referral.ToClinicAddress,
+		Start:        appointment.Start,
+		End:          appointment.Start.Add(time.Duration(duration) * time.Minute),
+		Sequence:     appointment.Sequence,
+		Status:       status,
+		LastModified: appointment.UpdatedOn,
+		Organizer:    ical.Person{Name: referral.ToClinicName, Email: referral.ToEmail},
+		Attendees: []ical.Person{
+			{Name: referral.PatientFirstName + " " + referral.PatientLastName, Email: referral.PatientEmail},
+			{Name: referral.FromClinicName, Email: referral.FromEmail},
+		},
+	}
+}
+
+// clinicTimeLocation resolves the clinic's zone from its coordinates, UTC when it cannot be found
+func clinicTimeLocation(clinic contracts.PhysicalClinicMapLocation) *time.Location {
+	zone, err := tz.GetZone(tz.Point{
+		Lon: clinic.Location.Long, Lat: clinic.Location.Lat,
+	})
+	if err != nil || len(zone) == 0 {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(zone[0])
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// placeTimeLocation ... time zone of the clinic with the google place, looked up on maps for clinics
+// that are not registered. UTC when neither knows the place.
+func placeTimeLocation(ctx context.Context, gproject string, placeID string) *time.Location {
+	clinicMetaDB := datastoredb.NewClinicMetaHandler()
+	err := clinicMetaDB.InitializeDataBase(ctx, gproject)
+	if err == nil {
+		clinic, err := clinicMetaDB.GetSingleClinicViaPlace(ctx, placeID)
+		if err == nil && clinic.PhysicalClinicsRegistration.Name != "" {
+			return clinicTimeLocation(*clinic)
+		}
+	}
+	mapClient := gmaps.NewMapsHandler()
+	err = mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
+	if err != nil {
+		return time.UTC
+	}
+	details, err := mapClient.FindPlaceFromID(placeID)
+	if err != nil || details == nil {
+		return time.UTC
+	}
+	var clinic contracts.PhysicalClinicMapLocation
+	clinic.Location.Lat = details.Geometry.Location.Lat
+	clinic.Location.Long = details.Geometry.Location.Lng
+	return clinicTimeLocation(clinic)
+}
+
+func appointmentLocation(appointment contracts.Appointment) *time.Location {
+	if appointment.TimeZone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(appointment.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+func newCalendarToken() (string, error) {
+	tokenBytes := make([]byte, 24)
+	_, err := rand.Read(tokenBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
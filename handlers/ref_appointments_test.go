@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+func TestAppointmentReply(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"C", contracts.AppointmentConfirmed},
+		{"c", contracts.AppointmentConfirmed},
+		{" Confirm! ", contracts.AppointmentConfirmed},
+		{"CONFIRMED.", contracts.AppointmentConfirmed},
+		{"yes", contracts.AppointmentConfirmed},
+		{"R", contracts.AppointmentReschedule},
+		{"reschedule", contracts.AppointmentReschedule},
+		{"cancel", ""},
+		{"C please", ""},
+		{"can I confirm?", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, appointmentReply(test.text), test.text)
+	}
+}
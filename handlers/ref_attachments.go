@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// attachmentScanner ... every upload is scanned with it, an antivirus service replaces the local stand-in
+var attachmentScanner attachments.Scanner = attachments.LocalScanner{}
+
+// documentCategories ... categories clients may pick
+var documentCategories = map[string]bool{
+	contracts.DocumentCategoryXray:      true,
+	contracts.DocumentCategoryPhoto:     true,
+	contracts.DocumentCategoryReport:    true,
+	contracts.DocumentCategorySummary:   true,
+	contracts.DocumentCategoryInsurance: true,
+	contracts.DocumentCategoryOther:     true,
+}
+
+// SetAttachmentScanner ....
+func SetAttachmentScanner(scanner attachments.Scanner) {
+	attachmentScanner = scanner
+}
+
+// uploadLimits ... limits of the authenticated document upload routes
+func uploadLimits() attachments.Limits {
+	return attachments.Limits{
+		MaxFileSize:    constants.UPLOAD_MAX_FILE_MB << 20,
+		MaxRequestSize: constants.UPLOAD_MAX_REQUEST_MB << 20,
+	}
+}
+
+// formUploadLimits ... limits of the public referral and patient forms
+func formUploadLimits() attachments.Limits {
+	return attachments.Limits{
+		MaxFileSize:    constants.QR_UPLOAD_MAX_FILE_MB << 20,
+		MaxRequestSize: constants.QR_UPLOAD_MAX_REQUEST_MB << 20,
+	}
+}
+
+// inboundLimits ... limits of inbound mail and MMS attachments, a refused attachment is skipped
+func inboundLimits() attachments.Limits {
+	return attachments.Limits{MaxFileSize: constants.INBOUND_MAX_FILE_MB << 20}
+}
+
+// attachmentPipeline ... pipeline that checks files it gets unvalidated against the limits
+func attachmentPipeline(storageC *storage.Client, catalog attachments.Catalog, bucket string, limits attachments.Limits) *attachments.Pipeline {
+	pipeline := attachments.NewPipeline(storageC, catalog, bucket)
+	pipeline.SetScanner(attachmentScanner)
+	pipeline.SetLimits(limits)
+	return pipeline
+}
+
+// newAttachmentPipeline ... every referral ingest path stores its files through this pipeline
+func newAttachmentPipeline(ctx context.Context, gproject string, limits attachments.Limits) (*attachments.Pipeline, error) {
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, gproject)
+	if err != nil {
+		return nil, err
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		return nil, err
+	}
+	return attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, limits), nil
+}
+
+// patientPipeline ... pipeline of the patient bucket, documents are still recorded with the patient id
+func patientPipeline(ctx context.Context, storageC *storage.Client) *attachments.Pipeline {
+	dsRefC := datastoredb.NewReferralHandler()
+	err := dsRefC.InitializeDataBase(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		log.Errorf("Failed to record patient documents: %v", err.Error())
+		return attachmentPipeline(storageC, nil, constants.SD_PATIENT_BUCKET, formUploadLimits())
+	}
+	return attachmentPipeline(storageC, dsRefC, constants.SD_PATIENT_BUCKET, formUploadLimits())
+}
+
+// parseUploads ... reads the multipart body within the limits of the route and validates its files,
+// the request is refused as a whole when one of them is not accepted and the response is written.
+// Other form values stay available in c.Request.MultipartForm, requests that are not multipart have
+// no files.
+func parseUploads(c *gin.Context, limits attachments.Limits, source string, uploadedBy string) ([]attachments.File, bool) {
+	const _24K = 256 << 20
+	files := make([]attachments.File, 0)
+	if limits.MaxRequestSize > 0 {
+		// room for the form fields next to the files
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limits.MaxRequestSize+1<<20)
+	}
+	err := c.Request.ParseMultipartForm(_24K)
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			abortUpload(c, &attachments.ValidationError{
+				Code:    attachments.CodeRequestTooLarge,
+				Message: fmt.Sprintf("uploads are limited to %d MB per request", limits.MaxRequestSize>>20),
+			})
+			return nil, false
+		}
+		return files, true
+	}
+	// one category for the files of the request, the pipeline picks one from the content otherwise
+	category := c.Request.FormValue("category")
+	if !documentCategories[category] {
+		category = ""
+	}
+	for _, fheaders := range c.Request.MultipartForm.File {
+		for _, hdr := range fheaders {
+			if limits.MaxFileSize > 0 && hdr.Size > limits.MaxFileSize {
+				abortUpload(c, &attachments.ValidationError{
+					Code:    attachments.CodeFileTooLarge,
+					File:    hdr.Filename,
+					Message: fmt.Sprintf("files are limited to %d MB", limits.MaxFileSize>>20),
+				})
+				return nil, false
+			}
+			infile, err := hdr.Open()
+			if err != nil {
+				abortUpload(c, fmt.Errorf("Bad files sent to backend"))
+				return nil, false
+			}
+			data, err := ioutil.ReadAll(infile)
+			infile.Close()
+			if err != nil {
+				abortUpload(c, fmt.Errorf("Bad files sent to backend"))
+				return nil, false
+			}
+			files = append(files, attachments.File{Name: hdr.Filename, Data: data, Source: source, Category: category, UploadedBy: uploadedBy})
+		}
+	}
+	files, err = attachments.NewValidator(attachmentScanner).CheckAll(c.Request.Context(), limits, files)
+	if err != nil {
+		abortUpload(c, err)
+		return nil, false
+	}
+	return files, true
+}
+
+// abortUpload ... a refused file is reported with its reason as data
+func abortUpload(c *gin.Context, err error) {
+	validationErr, ok := err.(*attachments.ValidationError)
+	if !ok {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	status := http.StatusUnprocessableEntity
+	switch validationErr.Code {
+	case attachments.CodeFileTooLarge, attachments.CodeRequestTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case attachments.CodeNotAllowed:
+		status = http.StatusUnsupportedMediaType
+	}
+	c.AbortWithStatusJSON(
+		status,
+		gin.H{
+			constants.RESPONSE_JSON_DATA:   validationErr,
+			constants.RESPONSDE_JSON_ERROR: validationErr.Error(),
+		},
+	)
+}
+
+// copyDocumentRecords ... the forwarded referral gets the metadata of the files copied from the original
+func copyDocumentRecords(ctx context.Context, dsRefC *datastoredb.DSReferral, fromReferralID string, toReferralID string, copiedFiles []string) {
+	docs, err := dsRefC.GetDocuments(ctx, fromReferralID)
+	if err != nil {
+		log.Errorf("Failed to copy document records of %s: %v", fromReferralID, err.Error())
+		return
+	}
+	copied := make(map[string]bool)
+	for _, name := range copiedFiles {
+		copied[name] = true
+	}
+	for _, doc := range docs {
+		if !copied[doc.Name] {
+			continue
+		}
+		documentID, _ := uuid.NewUUID()
+		doc.DocumentID = documentID.String()
+		doc.ReferralID = toReferralID
+		doc.StoredKey = toReferralID + "/" + doc.Name
+		doc.Preview = ""
+		doc.CreatedOn = time.Now()
+		err = dsRefC.SaveDocument(ctx, &doc)
+		if err != nil {
+			log.Errorf("Failed to copy document record %s: %v", doc.Name, err.Error())
+		}
+	}
+}
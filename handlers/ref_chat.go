@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/websocket"
+)
+
+// websocketPool ... hub chat and dashboard events are published to, nil until the router sets it
+var websocketPool *websocket.Pool
+
+// SetWebsocketPool ....
+func SetWebsocketPool(webPool *websocket.Pool) {
+	websocketPool = webPool
+}
+
+// tokenFromQuery ... browsers cannot set headers on websockets and event streams so the
+// bearer token may also be passed as the token query parameter
+func tokenFromQuery(c *gin.Context) {
+	if c.Request.Header.Get("Authorization") == "" && c.Query("token") != "" {
+		c.Request.Header.Set("Authorization", "Bearer "+c.Query("token"))
+	}
+}
+
+// ChatWebSocketHandler ... live chat of one referral channel (c2c or c2p)
+func ChatWebSocketHandler(webPool *websocket.Pool, c *gin.Context) {
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	channel := contracts.ChatBox(c.Param("channel"))
+	tokenFromQuery(c)
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if channel != contracts.GDCBox && channel != contracts.SPCBox {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("unknown chat channel %s", channel).Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	referral, err := dsRefC.GetReferral(ctx, referralID)
+	if err != nil || referral.IsDirty {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("referral %s not found", referralID).Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !canAccessReferral(ctx, clinicDB, userEmail, userID, *referral) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	webSocketConn, err := websocket.UpgradeWebSocket(c)
+	if err != nil {
+		log.Errorf("Failed to establish websocket connection: %v", err.Error())
+		return
+	}
+	connID, _ := uuid.NewUUID()
+	client := websocket.NewClient(webPool, webSocketConn, connID.String())
+	webPool.Register(client, websocket.ChatTopic(referralID, string(channel)))
+	go client.ReadChatPayload(func(message []byte) error {
+		var payload contracts.ChatPayload
+		if err := json.Unmarshal(message, &payload); err != nil || strings.TrimSpace(payload.Text) == "" {
+			return fmt.Errorf("Bad data sent to backened")
+		}
+		comment := contracts.Comment{
+			Text:      payload.Text,
+			Files:     payload.Files,
+			Channel:   channel,
+			UserID:    userEmail,
+			TimeStamp: time.Now().UnixNano() / int64(time.Millisecond),
+		}
+		// the sender gets its own message back through the pool once it is stored
+		_, err := ProcessComments(context.Background(), gproject, referralID, contracts.ReferralComments{Comments: []contracts.Comment{comment}})
+		return err
+	})
+	go client.WritePingsToChat()
+}
+
+// publishComments ... pushes stored comments to the chat subscribers of their channel and
+// tells both clinics' dashboards about them
+func publishComments(referral contracts.DSReferral, comments []contracts.Comment) {
+	ctx := context.Background()
+	for i := range comments {
+		if websocketPool != nil {
+			event := contracts.ChatEvent{
+				Type:       contracts.ChatEventMessage,
+				ReferralID: referral.ReferralID,
+				Channel:    comments[i].Channel,
+				Comment:    &comments[i],
+			}
+			err := websocketPool.PublishJSON(ctx, websocket.ChatTopic(referral.ReferralID, string(comments[i].Channel)), event)
+			if err != nil {
+				log.Errorf("Failed to publish message %s: %v", comments[i].MessageID, err.Error())
+			}
+		}
+		publishClinicEvent(ctx, contracts.ClinicEvent{
+			Type:       contracts.EventMessageCreated,
+			ReferralID: referral.ReferralID,
+			MessageID:  comments[i].MessageID,
+		}, referral.FromAddressID, referral.ToAddressID)
+		pushReferralEvent(ctx, contracts.EventMessageCreated, referral, comments[i].Channel, comments[i].MessageID)
+	}
+}
@@ -1,34 +1,27 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
-	"image/jpeg"
-	"image/png"
-	"io"
-	"mime/multipart"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/ugjka/go-tz.v2/tz"
 
-	"github.com/disintegration/imaging"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/google/uuid"
-	"github.com/nyaruka/phonenumbers"
 	log "github.com/sirupsen/logrus"
 	"github.com/superdentist/superdentist-backend/constants"
 	"github.com/superdentist/superdentist-backend/contracts"
 	"github.com/superdentist/superdentist-backend/helpers"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
 	"github.com/superdentist/superdentist-backend/lib/datastoredb"
 	"github.com/superdentist/superdentist-backend/lib/gmaps"
 	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
 	"github.com/superdentist/superdentist-backend/lib/identity"
+	"github.com/superdentist/superdentist-backend/lib/messages"
 	"github.com/superdentist/superdentist-backend/lib/sendgrid"
 	"github.com/superdentist/superdentist-backend/lib/storage"
 	"go.opencensus.io/trace"
@@ -40,7 +33,7 @@ func CreateRefSpecialist(c *gin.Context) {
 	log.Infof("Creating Referral")
 	ctx := c.Request.Context()
 	var referralDetails contracts.ReferralDetails
-	_, _, gproject, err := getUserDetails(ctx, c.Request)
+	userEmail, _, gproject, err := getUserDetails(ctx, c.Request)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -63,18 +56,17 @@ func CreateRefSpecialist(c *gin.Context) {
 		)
 		return
 	}
-	const _24K = 256 << 20
-	var documentFiles *multipart.Form
-	if err = c.Request.ParseMultipartForm(_24K); err == nil {
-		documentFiles = c.Request.MultipartForm
+	documentFiles, ok := parseUploads(c, uploadLimits(), contracts.DocumentSourceWeb, userEmail)
+	if !ok {
+		return
 	}
-	dsReferral, _ := processReferral(referralDetails, gproject, false, documentFiles)
-	if dsReferral == nil {
+	dsReferral, _, err := processReferral(referralDetails, gproject, false, documentFiles)
+	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
 			gin.H{
 				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: "Unable to create referral",
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
 			},
 		)
 		return
@@ -94,6 +86,7 @@ func QRReferral(c *gin.Context) {
 	patientLName := c.Query("lastName")
 	patientPhone := c.Query("phone")
 	patientEmail := c.Query("email")
+	preferredLanguage := c.Query("preferredLanguage")
 	dobYear := c.Query("year")
 	dobMonth := c.Query("month")
 	dobDay := c.Query("day")
@@ -153,13 +146,13 @@ func QRReferral(c *gin.Context) {
 			Month: dobMonth,
 			Day:   dobDay,
 		},
+		PreferredLanguage: preferredLanguage,
 	}
 	referralDetails.Status.GDStatus = "referred"
 	referralDetails.Status.SPStatus = "referred"
-	const _24K = 256 << 20
-	var documentFiles *multipart.Form
-	if err = c.Request.ParseMultipartForm(_24K); err == nil {
-		documentFiles = c.Request.MultipartForm
+	documentFiles, ok := parseUploads(c, formUploadLimits(), contracts.DocumentSourceQR, patientEmail)
+	if !ok {
+		return
 	}
 	go processReferral(referralDetails, gproject, true, documentFiles)
 	userID, err := getUserDetailsAnonymous(ctx, c.Request)
@@ -191,31 +184,31 @@ func QRReferral(c *gin.Context) {
 	})
 }
 
-func processReferral(referralDetails contracts.ReferralDetails, gproject string, isQR bool, documentFiles *multipart.Form) (*contracts.DSReferral, *contracts.ReferralComments) {
+func processReferral(referralDetails contracts.ReferralDetails, gproject string, isQR bool, documentFiles []attachments.File) (*contracts.DSReferral, *contracts.ReferralComments, error) {
 	storageC := storage.NewStorageHandler()
 	ctx := context.Background()
 	err := storageC.InitializeStorageClient(ctx, gproject)
 	if err != nil {
 		log.Errorf("Failed to created referral: %v", err.Error())
-		return nil, nil
+		return nil, nil, err
 	}
 	clinicDB := datastoredb.NewClinicMetaHandler()
 	err = clinicDB.InitializeDataBase(ctx, gproject)
 	if err != nil {
 		log.Errorf("Failed to created referral: %v", err.Error())
-		return nil, nil
+		return nil, nil, err
 	}
 	sgClient := sendgrid.NewSendGridClient()
 	err = sgClient.InitializeSendGridClient()
 	if err != nil {
 		log.Errorf("Failed to created referral: %v", err.Error())
-		return nil, nil
+		return nil, nil, err
 	}
 	dsRefC := datastoredb.NewReferralHandler()
 	err = dsRefC.InitializeDataBase(ctx, gproject)
 	if err != nil {
 		log.Errorf("Failed to created referral: %v", err.Error())
-		return nil, nil
+		return nil, nil, err
 	}
 	currentRefUUID, _ := uuid.NewUUID()
 	uniqueRefID := currentRefUUID.String()
@@ -226,84 +219,21 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 	// parse request
 
 	foundImage := false
-	if documentFiles != nil {
-		for _, fheaders := range documentFiles.File {
-			for _, hdr := range fheaders {
-				// open uploaded
-				var infile multipart.File
-				if infile, err = hdr.Open(); err != nil {
-
-					log.Errorf("Failed to created referral: %v", err.Error())
-					return nil, nil
-
-				}
-				fileName := hdr.Filename
-
-				reader, err := storageC.DownloadSingleFile(ctx, uniqueRefID, constants.SD_REFERRAL_BUCKET, fileName)
-				if err == nil && reader != nil {
-					timeNow := time.Now()
-					stripFile := strings.Split(fileName, ".")
-					name := stripFile[0]
-					name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-					fileName = name + "." + stripFile[len(stripFile)-1]
-				}
-				bucketPath := uniqueRefID + "/" + fileName
-				buckerW, err := storageC.UploadToGCS(ctx, bucketPath)
-				if err != nil {
-					log.Errorf("Failed to created referral: %v", err.Error())
-					return nil, nil
-				}
-				imageBuffer := bytes.NewBuffer(nil)
-				if _, err := io.Copy(imageBuffer, infile); err != nil {
-
-					log.Errorf("Failed to created referral: %v", err.Error())
-					return nil, nil
-
-				}
-				currentBytes := imageBuffer.Bytes()
-				if isQR {
-					//client.SetImageFromBytes(currentBytes)
-				}
-				foundImage = true
-				io.Copy(buckerW, bytes.NewReader(currentBytes))
-				buckerW.Close()
-				extentionFile := strings.Split(fileName, ".")
-				ext := extentionFile[len(extentionFile)-1]
-				var docMedia contracts.Media
-				docMedia.Name = fileName
-				docMedia.Image = ""
-				switch strings.ToLower(ext) {
-				case "jpg", "jpeg":
-					img, err := jpeg.Decode(bytes.NewReader(currentBytes))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-							log.Info(docMedia.Image)
-						}
-					}
-				case "png":
-					img, err := png.Decode(bytes.NewReader(currentBytes))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				}
-				docsMedia = append(docsMedia, docMedia)
-				docIDNames = append(docIDNames, fileName)
-			}
-		}
-		err = storageC.ZipFile(ctx, uniqueRefID, constants.SD_REFERRAL_BUCKET)
+	if len(documentFiles) > 0 {
+		pipeline, err := newAttachmentPipeline(ctx, gproject, uploadLimits())
 		if err != nil {
 			log.Errorf("Failed to created referral: %v", err.Error())
-			return nil, nil
+			return nil, nil, err
+		}
+		for _, file := range documentFiles {
+			doc, err := pipeline.Ingest(ctx, uniqueRefID, file)
+			if err != nil {
+				log.Errorf("Failed to created referral: %v", err.Error())
+				return nil, nil, err
+			}
+			foundImage = true
+			docsMedia = append(docsMedia, attachments.Media(*doc))
+			docIDNames = append(docIDNames, doc.Name)
 		}
 	}
 	ocrText := ""
@@ -328,13 +258,7 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 	}
 	dsReferral.IsSummary = referralDetails.IsSummary
 	if referralDetails.Patient.Phone != "" {
-		currentPhone := referralDetails.Patient.Phone
-		pnum, _ := phonenumbers.Parse(currentPhone, "US")
-		countryCode := "+1"
-		if pnum.CountryCode != nil {
-			countryCode = "+" + strconv.Itoa(int(*pnum.CountryCode))
-		}
-		dsReferral.PatientPhone = countryCode + strconv.Itoa(int(*pnum.NationalNumber))
+		dsReferral.PatientPhone = patientSMSPhone(referralDetails.Patient.Phone)
 	}
 	dsReferral.IsQR = isQR
 	dsReferral.Documents = docIDNames
@@ -352,6 +276,7 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 	dsReferral.PatientEmail = referralDetails.Patient.Email
 	dsReferral.PatientFirstName = referralDetails.Patient.FirstName
 	dsReferral.PatientLastName = referralDetails.Patient.LastName
+	dsReferral.PreferredLanguage = messages.Locale(referralDetails.Patient.PreferredLanguage)
 	dsReferral.IsDirty = false
 	dsReferral.FromAddressID = referralDetails.FromAddressID
 	dsReferral.ToAddressID = referralDetails.ToAddressID
@@ -360,7 +285,7 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 		fromClinic, err := clinicDB.GetSingleClinic(ctx, referralDetails.FromAddressID)
 		if err != nil {
 			log.Errorf("Failed to created referral: %v", err.Error())
-			return nil, nil
+			return nil, nil, err
 		}
 		dsReferral.FromPlaceID = fromClinic.PlaceID
 		dsReferral.FromClinicName = fromClinic.Name
@@ -426,10 +351,12 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 			err = mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
 			if err != nil {
 				log.Errorf("Failed to created referral: %v", err.Error())
-				return nil, nil
+				return nil, nil, err
 			}
 			details, _ := mapClient.FindPlaceFromID(referralDetails.FromPlaceID)
 			dsReferral.FromPlaceID = referralDetails.FromPlaceID
+			dsReferral.CreatedOn = time.Now()
+			dsReferral.ModifiedOn = time.Now()
 			if details != nil && details.PlaceID == referralDetails.FromPlaceID {
 				dsReferral.FromClinicName = details.Name
 				dsReferral.FromClinicAddress = details.FormattedAddress
@@ -441,7 +368,7 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 		toClinic, err := clinicDB.GetSingleClinic(ctx, referralDetails.ToAddressID)
 		if err != nil {
 			log.Errorf("Failed to created referral: %v", err.Error())
-			return nil, nil
+			return nil, nil, err
 		}
 		dsReferral.ToPlaceID = toClinic.PlaceID
 		dsReferral.ToClinicName = toClinic.Name
@@ -467,12 +394,12 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 			err = mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
 			if err != nil {
 				log.Errorf("Failed to created referral: %v", err.Error())
-				return nil, nil
+				return nil, nil, err
 			}
 			details, err := mapClient.FindPlaceFromID(referralDetails.ToPlaceID)
 			if err != nil {
 				log.Errorf("Failed to created referral: %v", err.Error())
-				return nil, nil
+				return nil, nil, err
 			}
 			dsReferral.ToClinicAddress = details.FormattedAddress
 			dsReferral.ToPlaceID = details.PlaceID
@@ -481,11 +408,21 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 		}
 	}
 	dsReferral.IsNew = true
+	dsReferral.SuppressPatientNotice = referralDetails.SuppressPatientNotice
+	dsReferral.ImportJobID = referralDetails.ImportJobID
+	dsReferral.StatusChangedOn = time.Now()
 	err = dsRefC.CreateReferral(ctx, dsReferral)
 	if err != nil {
 		log.Errorf("Failed to created referral: %v", err.Error())
-		return nil, nil
+		return nil, nil, err
 	}
+	recordReferralConsent(ctx, dsRefC, dsReferral)
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:       contracts.EventReferralCreated,
+		ReferralID: dsReferral.ReferralID,
+		Status:     dsReferral.Status.SPStatus,
+	}, dsReferral.FromAddressID, dsReferral.ToAddressID)
+	pushReferralEvent(ctx, contracts.EventReferralCreated, dsReferral, "", "")
 	var returnComments contracts.ReferralComments
 	returnComments.Comments = updatedComm
 	var refComments contracts.ReferralComments
@@ -493,12 +430,12 @@ func processReferral(referralDetails contracts.ReferralDetails, gproject string,
 	_, err = ProcessComments(ctx, gproject, dsReferral.ReferralID, refComments)
 	if err != nil {
 		log.Errorf("Failed to created referral: %v", err.Error())
-		return nil, nil
+		return &dsReferral, &returnComments, err
 	}
 	//err = clinicDB.AddPatientInformation(ctx, referralDetails.Patient)
 	//if err != nil {
 	//	log.Errorf("Failed to create patient information: %v", err.Error())
 	//	return nil, nil
 	//}
-	return &dsReferral, &returnComments
+	return &dsReferral, &returnComments, nil
 }
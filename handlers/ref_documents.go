@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// deletedFolder ... sub folder of a referral deleted files are moved to, zips leave it out
+const deletedFolder = "deleted"
+
+// ListDocuments ... metadata of the current documents of a referral, with their previous versions
+// when versions=true
+func ListDocuments(c *gin.Context) {
+	log.Infof("List referral documents")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	referral, _, _, dsRefC, ok := loadReferralForUser(c, referralID)
+	if !ok {
+		return
+	}
+	docs, err := dsRefC.GetDocuments(ctx, referral.ReferralID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if c.Query("versions") == "true" {
+		for i := range docs {
+			if docs[i].Version <= 1 {
+				continue
+			}
+			docs[i].Versions, err = dsRefC.GetDocumentVersions(ctx, docs[i].DocumentID)
+			if err != nil {
+				log.Errorf("Failed to get versions of %s: %v", docs[i].DocumentID, err.Error())
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   docs,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// DeleteDocument ... soft deletes a document of the referral with its previous versions, their files are
+// moved out of the referral folder so they no longer show in downloads
+func DeleteDocument(c *gin.Context) {
+	log.Infof("Delete referral document")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	documentID := c.Param("documentId")
+	referral, userEmail, _, dsRefC, ok := loadReferralForUser(c, referralID)
+	if !ok {
+		return
+	}
+	doc, err := dsRefC.GetDocument(ctx, documentID)
+	if err != nil || doc.ReferralID != referral.ReferralID || doc.Deleted {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("document %s not found", documentID).Error(),
+			},
+		)
+		return
+	}
+	storageC := storage.NewStorageHandler()
+	err = storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	files := []contracts.Document{*doc}
+	if doc.Version > 1 {
+		versions, err := dsRefC.GetDocumentVersions(ctx, documentID)
+		if err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: err.Error(),
+				},
+			)
+			return
+		}
+		files = append(files, versions...)
+	}
+	// every version has a file of its own in the referral folder, they all go
+	storedKeys := make(map[int]string)
+	deletedNames := make(map[string]bool)
+	for _, file := range files {
+		if file.Deleted {
+			continue
+		}
+		storedKey := referral.ReferralID + "/" + deletedFolder + "/" + file.DocumentID + "-" + file.Name
+		err = storageC.MoveFile(ctx, constants.SD_REFERRAL_BUCKET, file.StoredKey, storedKey)
+		if err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: err.Error(),
+				},
+			)
+			return
+		}
+		storedKeys[file.Version] = storedKey
+		deletedNames[file.Name] = true
+	}
+	doc, err = dsRefC.DeleteDocument(ctx, documentID, userEmail, storedKeys)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	documents := make([]string, 0)
+	for _, name := range referral.Documents {
+		if !deletedNames[name] {
+			documents = append(documents, name)
+		}
+	}
+	referral.Documents = documents
+	err = dsRefC.CreateReferral(ctx, *referral)
+	if err != nil {
+		log.Errorf("Failed to update documents of %s: %v", referral.ReferralID, err.Error())
+	}
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:       contracts.EventDocumentDeleted,
+		ReferralID: referral.ReferralID,
+		DocumentID: doc.DocumentID,
+	}, referral.FromAddressID, referral.ToAddressID)
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   doc,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// signedFilePath ... route of links signed by the backend itself
+const signedFilePath = "/v1/files/signed"
+
+// sendSignedDownload ... responds with a short lived URL of the object instead of its bytes, callers
+// check the user's access to it first. GCS signs the URL when the credentials are a service account
+// key, otherwise it is a signed link to DownloadSignedFile.
+func sendSignedDownload(c *gin.Context, storageC *storage.Client, bucket string, object string, downloadName string) {
+	expires := time.Now().Add(constants.SIGNED_URL_EXPIRY * time.Minute).Truncate(time.Second)
+	signedURL, err := storageC.SignedURL(bucket, object, downloadName, expires)
+	if err == storage.ErrSigningUnavailable {
+		signedURL, err = signedLinkURL(c, storage.SignedLink{
+			Bucket:       bucket,
+			Object:       object,
+			DownloadName: downloadName,
+			Expires:      expires,
+		})
+	}
+	sendSignedURL(c, signedURL, expires, err)
+}
+
+// signedLinkURL ... HMAC signed URL of DownloadSignedFile
+func signedLinkURL(c *gin.Context, link storage.SignedLink) (string, error) {
+	if global.Options.URLSigningKey == "" {
+		return "", storage.ErrSigningUnavailable
+	}
+	baseURL := global.Options.APIBaseURL
+	if baseURL == "" {
+		baseURL = "https://" + c.Request.Host
+	}
+	query := storage.NewLinkSigner([]byte(global.Options.URLSigningKey)).Sign(link)
+	return strings.TrimSuffix(baseURL, "/") + signedFilePath + "?" + query, nil
+}
+
+func sendSignedURL(c *gin.Context, signedURL string, expires time.Time, err error) {
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   contracts.SignedDownload{URL: signedURL, ExpiresAt: expires},
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// documentIDsQuery ... documents picked with documentIds=id1,id2, none means all of them
+func documentIDsQuery(c *gin.Context) []string {
+	documentIDs := make([]string, 0)
+	for _, documentID := range strings.Split(c.Query("documentIds"), ",") {
+		if documentID = strings.TrimSpace(documentID); documentID != "" {
+			documentIDs = append(documentIDs, documentID)
+		}
+	}
+	return documentIDs
+}
+
+// referralZipEntries ... the current documents of the referral, or those picked by ID. Files of the referral
+// without a record, from before documents had them, go in under their names, previous versions stay out.
+func referralZipEntries(referral contracts.DSReferral, docs []contracts.Document, versions []contracts.Document, documentIDs []string) ([]storage.ZipEntry, error) {
+	entries := make([]storage.ZipEntry, 0)
+	if len(documentIDs) > 0 {
+		byID := make(map[string]contracts.Document)
+		for _, doc := range docs {
+			byID[doc.DocumentID] = doc
+		}
+		for _, documentID := range documentIDs {
+			doc, ok := byID[documentID]
+			if !ok {
+				return nil, fmt.Errorf("document %s not found", documentID)
+			}
+			entries = append(entries, documentZipEntry(referral, doc))
+		}
+		return entries, nil
+	}
+	recorded := make(map[string]bool)
+	for _, doc := range docs {
+		recorded[doc.Name] = true
+		entries = append(entries, documentZipEntry(referral, doc))
+	}
+	for _, version := range versions {
+		recorded[version.Name] = true
+	}
+	for _, name := range referral.Documents {
+		if !recorded[name] {
+			recorded[name] = true
+			entries = append(entries, storage.ZipEntry{Object: referral.ReferralID + "/" + name, Name: name})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("No document is associated with current referral")
+	}
+	return entries, nil
+}
+
+func documentZipEntry(referral contracts.DSReferral, doc contracts.Document) storage.ZipEntry {
+	object := doc.StoredKey
+	if object == "" {
+		object = referral.ReferralID + "/" + doc.Name
+	}
+	return storage.ZipEntry{Object: object, Name: doc.Name}
+}
+
+// streamZip ... writes the zip straight to the response. Once the first bytes are out an error can
+// only be logged, the client sees a truncated archive.
+func streamZip(c *gin.Context, storageC *storage.Client, bucket string, downloadName string, entries []storage.ZipEntry) {
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", downloadName))
+	c.Header("Content-Type", "application/zip")
+	err := storageC.StreamZip(c.Request.Context(), c.Writer, bucket, entries)
+	if err == nil {
+		return
+	}
+	log.Errorf("Failed to zip %s: %v", downloadName, err.Error())
+	if !c.Writer.Written() {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+	}
+}
+
+// DownloadSignedFile ... streams the object of a link signed by sendSignedDownload, the signature
+// stands in for the user's token. Downloads still pass through the backend here, so large files
+// need credentials that let GCS sign the URL.
+func DownloadSignedFile(c *gin.Context) {
+	log.Infof("Download signed file")
+	ctx := c.Request.Context()
+	link, err := storage.NewLinkSigner([]byte(global.Options.URLSigningKey)).Verify(c.Request.URL.Query(), time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	storageC := storage.NewStorageHandler()
+	err = storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	fileReader, err := storageC.DownloadSingleFile(ctx, path.Dir(link.Object), link.Bucket, path.Base(link.Object))
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	defer fileReader.Close()
+	c.DataFromReader(http.StatusOK, fileReader.Attrs.Size, fileReader.Attrs.ContentType, fileReader, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", link.DownloadName),
+		"Cache-Control":       "private, no-store",
+	})
+}
+
+// sendSignedZip ... stores the zip under ZIP_EXPORT_FOLDER and responds with a short lived URL of it, so
+// the browser fetches it from GCS and no download is held to the server's write timeout. The zip itself is
+// built from GCS to GCS, which is quick next to sending it to the client.
+func sendSignedZip(c *gin.Context, storageC *storage.Client, referralID string, entries []storage.ZipEntry) {
+	exportID, _ := uuid.NewUUID()
+	object := constants.ZIP_EXPORT_FOLDER + "/" + referralID + "/" + exportID.String() + ".zip"
+	err := storageC.WriteZip(c.Request.Context(), constants.SD_REFERRAL_BUCKET, object, entries)
+	if err == nil {
+		sendSignedDownload(c, storageC, constants.SD_REFERRAL_BUCKET, object, referralID+".zip")
+		return
+	}
+	log.Errorf("Failed to store zip of %s: %v", referralID, err.Error())
+	c.AbortWithStatusJSON(
+		http.StatusInternalServerError,
+		gin.H{
+			constants.RESPONSE_JSON_DATA:   nil,
+			constants.RESPONSDE_JSON_ERROR: err.Error(),
+		},
+	)
+}
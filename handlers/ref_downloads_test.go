@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+func TestReferralZipEntries(t *testing.T) {
+	referral := contracts.DSReferral{ReferralID: "ref-1", Documents: []string{"xray.png", "old-scan.pdf", "notes-2.pdf", "notes.pdf"}}
+	docs := []contracts.Document{
+		{DocumentID: "doc-1", Name: "xray.png", StoredKey: "ref-1/xray.png"},
+		{DocumentID: "doc-2", Name: "notes-2.pdf", StoredKey: "ref-1/notes-2.pdf", Version: 2},
+	}
+	versions := []contracts.Document{{DocumentID: "doc-2", Name: "notes.pdf", StoredKey: "ref-1/notes.pdf", Version: 1}}
+
+	entries, err := referralZipEntries(referral, docs, versions, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.ZipEntry{
+		{Object: "ref-1/xray.png", Name: "xray.png"},
+		{Object: "ref-1/notes-2.pdf", Name: "notes-2.pdf"},
+		{Object: "ref-1/old-scan.pdf", Name: "old-scan.pdf"},
+	}, entries, "files without a record are zipped too, previous versions are not")
+
+	entries, err = referralZipEntries(referral, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4, "referrals from before records zip every file")
+
+	entries, err = referralZipEntries(referral, docs, versions, []string{"doc-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.ZipEntry{{Object: "ref-1/notes-2.pdf", Name: "notes-2.pdf"}}, entries)
+	_, err = referralZipEntries(referral, docs, versions, []string{"doc-3"})
+	assert.Error(t, err)
+
+	_, err = referralZipEntries(contracts.DSReferral{ReferralID: "ref-2"}, nil, nil, nil)
+	assert.Error(t, err)
+}
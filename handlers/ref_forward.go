@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// ForwardedStatus ... status of a referral that was handed to another clinic
+const ForwardedStatus = "forwarded"
+
+// ForwardReferral ... hands a referral from the receiving clinic to another clinic. A new referral
+// is created through processReferral so the new clinic and the patient get the usual notifications,
+// the documents and message thread are carried over and both referrals record the chain.
+func ForwardReferral(c *gin.Context) {
+	log.Infof("Forward Referral")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	var forwardDetails contracts.ForwardReferral
+	if err := c.ShouldBindWith(&forwardDetails, binding.JSON); err != nil || (forwardDetails.ToAddressID == "" && forwardDetails.ToPlaceID == "") {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	original, err := dsRefC.GetReferral(ctx, referralID)
+	if err != nil || original.IsDirty {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("referral %s not found", referralID).Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	// only the clinic the referral was sent to can pass it on
+	if !isClinicAdminOfPlace(ctx, clinicDB, userEmail, userID, original.ToPlaceID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	if (forwardDetails.ToPlaceID != "" && forwardDetails.ToPlaceID == original.ToPlaceID) ||
+		(forwardDetails.ToAddressID != "" && forwardDetails.ToAddressID == original.ToAddressID) {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("referral cannot be forwarded to the same clinic").Error(),
+			},
+		)
+		return
+	}
+	// reserve the referral so a second forward running at the same time stops here
+	original, claimed, err := dsRefC.ClaimForward(ctx, referralID, time.Now(), constants.FORWARD_CLAIM_TIMEOUT*time.Minute)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !claimed {
+		err = fmt.Errorf("referral is already being forwarded")
+		if original.ForwardedTo != "" {
+			err = fmt.Errorf("referral already forwarded as %s", original.ForwardedTo)
+		}
+		c.AbortWithStatusJSON(
+			http.StatusConflict,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	claimedOn := original.ForwardingOn
+	forwardDone := false
+	defer func() {
+		if forwardDone {
+			return
+		}
+		if err := dsRefC.ReleaseForward(ctx, referralID, claimedOn); err != nil {
+			log.Errorf("Failed to release forward of %s: %v", referralID, err.Error())
+		}
+	}()
+	var referralDetails contracts.ReferralDetails
+	referralDetails.FromAddressID = original.FromAddressID
+	referralDetails.FromPlaceID = original.FromPlaceID
+	referralDetails.ToAddressID = forwardDetails.ToAddressID
+	referralDetails.ToPlaceID = forwardDetails.ToPlaceID
+	referralDetails.Patient = contracts.PatientStore{
+		FirstName: original.PatientFirstName,
+		LastName:  original.PatientLastName,
+		Phone:     original.PatientPhone,
+		Email:     original.PatientEmail,
+		Dob: contracts.DOB{
+			Year:  original.PatientDOBYear,
+			Month: original.PatientDOBMonth,
+			Day:   original.PatientDOBDay,
+		},
+		PreferredLanguage: original.PreferredLanguage,
+	}
+	referralDetails.Reasons = original.Reasons
+	referralDetails.History = original.History
+	referralDetails.Tooth = original.Tooth
+	referralDetails.Status.GDStatus = "referred"
+	referralDetails.Status.SPStatus = "referred"
+	forwardText := "Referral forwarded by " + original.ToClinicName
+	if forwardDetails.Reason != "" {
+		forwardText += ": " + forwardDetails.Reason
+	}
+	referralDetails.Comments = []contracts.Comment{{
+		Text:      forwardText,
+		Channel:   contracts.GDCBox,
+		UserID:    userEmail,
+		TimeStamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}}
+	forwarded, _, err := processReferral(referralDetails, gproject, false, nil)
+	if err != nil {
+		if forwarded != nil {
+			log.Errorf("Forward of %s left referral %s half created: %v", original.ReferralID, forwarded.ReferralID, err.Error())
+		} else {
+			log.Errorf("Failed to forward referral %s: %v", original.ReferralID, err.Error())
+		}
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	// re-read, ProcessComments has already saved the new referral with its clinic details
+	if current, err := dsRefC.GetReferral(ctx, forwarded.ReferralID); err == nil {
+		forwarded = current
+	}
+	storageC := storage.NewStorageHandler()
+	err = storageC.InitializeStorageClient(ctx, gproject)
+	if err == nil {
+		copiedFiles, err := storageC.CopyFolder(ctx, original.ReferralID, forwarded.ReferralID, constants.SD_REFERRAL_BUCKET)
+		if err != nil {
+			log.Errorf("Failed to copy documents of %s: %v", original.ReferralID, err.Error())
+		}
+		if len(copiedFiles) > 0 {
+			forwarded.Documents = append(forwarded.Documents, copiedFiles...)
+			copyDocumentRecords(ctx, dsRefC, original.ReferralID, forwarded.ReferralID, copiedFiles)
+		}
+	} else {
+		log.Errorf("Failed to copy documents of %s: %v", original.ReferralID, err.Error())
+	}
+	thread, err := dsRefC.GetMessagesAll(ctx, original.ReferralID)
+	if err == nil && len(thread) > 0 {
+		err = dsRefC.CreateMessage(ctx, *forwarded, thread)
+		if err != nil {
+			log.Errorf("Failed to copy messages of %s: %v", original.ReferralID, err.Error())
+		}
+	}
+	now := time.Now()
+	forwarded.ForwardedFrom = original.ReferralID
+	forwarded.ForwardedOn = now
+	forwarded.ForwardReason = forwardDetails.Reason
+	forwarded.ReferralChain = append(append([]string{}, original.ReferralChain...), original.ReferralID)
+	err = dsRefC.CreateReferral(ctx, *forwarded)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	original.ForwardedTo = forwarded.ReferralID
+	original.ForwardedOn = now
+	original.ForwardReason = forwardDetails.Reason
+	original.Status.GDStatus = ForwardedStatus
+	original.Status.SPStatus = ForwardedStatus
+	original.StatusChangedOn = now
+	original.Overdue = false
+	original.EscalationLevel = contracts.EscalationNone
+	original.ModifiedOn = now
+	original.ForwardingOn = time.Time{}
+	err = dsRefC.CreateReferral(ctx, *original)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	forwardDone = true
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:       contracts.EventReferralStatus,
+		ReferralID: original.ReferralID,
+		Status:     original.Status.SPStatus,
+	}, original.FromAddressID, original.ToAddressID)
+	pushReferralEvent(ctx, contracts.EventReferralStatus, *original, "", "")
+	// the new clinic and the patient were notified on creation, let the referring dentist know
+	sgClient := sendgrid.NewSendGridClient()
+	err = sgClient.InitializeSendGridClient()
+	if err == nil {
+		notifyEmail, notifyName := original.FromEmail, original.FromClinicName
+		if notifyEmail == "" {
+			notifyEmail = constants.SD_ADMIN_EMAIL
+		}
+		err = notifyClinicEmail(ctx, contracts.EventReferralStatus, *original, original.FromAddressID, notifyEmail, notifyName,
+			withClinicName("Your referral was forwarded", " by ", original.ToClinicName), func() error {
+				return sgClient.SendClinicNotification(notifyEmail, notifyName,
+					original.PatientFirstName+" "+original.PatientLastName, forwarded.ReferralID)
+			})
+	}
+	if err != nil {
+		log.Errorf("Failed to notify referring clinic of forward: %v", err.Error())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   forwarded,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
@@ -0,0 +1,371 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/csvimport"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/gmaps"
+)
+
+// Roles of the importing clinic in the imported referrals
+const (
+	importRoleDentist    = "dentist"
+	importRoleSpecialist = "specialist"
+)
+
+// ImportReferrals ... accepts a multipart CSV upload ("file") with a JSON column mapping ("mapping"),
+// the importing clinic ("addressId"), its role in the referrals ("role": dentist or specialist) and
+// "notifyPatients". Rows are validated up front and the referrals are created by a background job.
+func ImportReferrals(c *gin.Context) {
+	log.Infof("Import Referrals")
+	ctx := c.Request.Context()
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	const _24K = 256 << 20
+	if err := c.Request.ParseMultipartForm(_24K); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	addressID := c.Request.FormValue("addressId")
+	role := strings.ToLower(c.Request.FormValue("role"))
+	if role == "" {
+		role = importRoleDentist
+	}
+	mapping, err := csvimport.ParseMapping([]byte(c.Request.FormValue("mapping")))
+	if err == nil && addressID == "" {
+		err = fmt.Errorf("addressId is required")
+	}
+	if err == nil && role != importRoleDentist && role != importRoleSpecialist {
+		err = fmt.Errorf("role must be %s or %s", importRoleDentist, importRoleSpecialist)
+	}
+	var rows []csvimport.Row
+	var csvFile multipart.File
+	var csvHeader *multipart.FileHeader
+	if err == nil {
+		csvFile, csvHeader, err = c.Request.FormFile("file")
+	}
+	if err == nil {
+		rows, err = csvimport.ReadRows(csvFile, mapping, constants.IMPORT_MAX_ROWS)
+		csvFile.Close()
+	}
+	if err == nil && len(rows) == 0 {
+		err = fmt.Errorf("csv has no rows")
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, addressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	jobUUID, _ := uuid.NewUUID()
+	job := contracts.ReferralImportJob{
+		JobID:          jobUUID.String(),
+		AddressID:      addressID,
+		Role:           role,
+		CreatedBy:      userEmail,
+		FileName:       csvHeader.Filename,
+		Status:         contracts.ImportQueued,
+		Total:          len(rows),
+		NotifyPatients: c.Request.FormValue("notifyPatients") == "true",
+		CreatedOn:      time.Now(),
+		Results:        make([]contracts.ImportRowResult, 0),
+	}
+	err = dsRefC.SaveImportJob(ctx, job)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	go runReferralImport(gproject, job, rows)
+	c.JSON(http.StatusAccepted, gin.H{
+		constants.RESPONSE_JSON_DATA:   job,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// GetReferralImport ... progress and per row report of an import job
+func GetReferralImport(c *gin.Context) {
+	log.Infof("Get Referral Import")
+	ctx := c.Request.Context()
+	jobID := c.Param("jobId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	job, err := dsRefC.GetImportJob(ctx, jobID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("import job %s not found", jobID).Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, job.AddressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   job,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// runReferralImport ... creates the referrals of an import job one row at a time, saving progress as it goes
+func runReferralImport(gproject string, job contracts.ReferralImportJob, rows []csvimport.Row) {
+	ctx := context.Background()
+	dsRefC := datastoredb.NewReferralHandler()
+	err := dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		log.Errorf("Import %s failed: %v", job.JobID, err.Error())
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	var importingClinic *contracts.PhysicalClinicMapLocation
+	if err == nil {
+		importingClinic, err = clinicDB.GetSingleClinic(ctx, job.AddressID)
+	}
+	mapClient := gmaps.NewMapsHandler()
+	if err == nil {
+		err = mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
+	}
+	if err != nil {
+		job.Status = contracts.ImportFailed
+		job.Error = err.Error()
+		job.FinishedOn = time.Now()
+		if err := dsRefC.SaveImportJob(ctx, job); err != nil {
+			log.Errorf("Failed to save import job %s: %v", job.JobID, err.Error())
+		}
+		return
+	}
+	job.Status = contracts.ImportRunning
+	if err := dsRefC.SaveImportJob(ctx, job); err != nil {
+		log.Errorf("Failed to save import job %s: %v", job.JobID, err.Error())
+	}
+	places := make(map[string]string)
+	for i, row := range rows {
+		result := contracts.ImportRowResult{Line: row.Line}
+		referralID, err := importReferralRow(ctx, gproject, clinicDB, mapClient, places, job, importingClinic, row)
+		if err != nil {
+			result.Error = err.Error()
+			job.Failed++
+		} else {
+			result.ReferralID = referralID
+			job.Succeeded++
+		}
+		job.Results = append(job.Results, result)
+		job.Processed++
+		if (i+1)%constants.IMPORT_PROGRESS_ROWS == 0 {
+			if err := dsRefC.SaveImportJob(ctx, job); err != nil {
+				log.Errorf("Failed to save import job %s: %v", job.JobID, err.Error())
+			}
+		}
+	}
+	job.Status = contracts.ImportCompleted
+	job.FinishedOn = time.Now()
+	if err := dsRefC.SaveImportJob(ctx, job); err != nil {
+		log.Errorf("Failed to save import job %s: %v", job.JobID, err.Error())
+	}
+	log.Infof("Import %s finished: %d created, %d failed", job.JobID, job.Succeeded, job.Failed)
+}
+
+func importReferralRow(ctx context.Context, gproject string, clinicDB *datastoredb.DSClinicMeta, mapClient *gmaps.ClientGMaps,
+	places map[string]string, job contracts.ReferralImportJob, importingClinic *contracts.PhysicalClinicMapLocation, row csvimport.Row) (string, error) {
+	if row.Err != nil {
+		return "", row.Err
+	}
+	placeID, err := resolveImportPlace(ctx, clinicDB, mapClient, places, row)
+	if err != nil {
+		return "", err
+	}
+	if placeID == importingClinic.PlaceID {
+		return "", fmt.Errorf("clinic is the importing clinic")
+	}
+	var referralDetails contracts.ReferralDetails
+	if job.Role == importRoleSpecialist {
+		referralDetails.FromPlaceID = placeID
+		referralDetails.ToAddressID = job.AddressID
+	} else {
+		referralDetails.FromAddressID = job.AddressID
+		referralDetails.ToPlaceID = placeID
+	}
+	referralDetails.Patient = contracts.PatientStore{
+		FirstName: row.FirstName,
+		LastName:  row.LastName,
+		Phone:     row.Phone,
+		Email:     row.Email,
+		Dob:       row.DOB,
+	}
+	referralDetails.Reasons = row.Reasons
+	referralDetails.History = row.History
+	referralDetails.Tooth = row.Tooth
+	status := "referred"
+	if row.Status != "" {
+		status = strings.ToLower(row.Status)
+	}
+	referralDetails.Status = contracts.Status{GDStatus: status, SPStatus: status}
+	referralDetails.Comments = make([]contracts.Comment, 0)
+	if row.Notes != "" {
+		referralDetails.Comments = append(referralDetails.Comments, contracts.Comment{
+			Text:      row.Notes,
+			Channel:   contracts.GDCBox,
+			UserID:    job.CreatedBy,
+			TimeStamp: time.Now().UnixNano() / int64(time.Millisecond),
+		})
+	}
+	referralDetails.SuppressPatientNotice = !job.NotifyPatients
+	referralDetails.ImportJobID = job.JobID
+	dsReferral, _, err := processReferral(referralDetails, gproject, false, nil)
+	if err != nil {
+		return "", err
+	}
+	return dsReferral.ReferralID, nil
+}
+
+// resolveImportPlace ... google place of the other clinic, looked up by name/address when no place id is given
+func resolveImportPlace(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, mapClient *gmaps.ClientGMaps,
+	places map[string]string, row csvimport.Row) (string, error) {
+	if row.ClinicPlaceID != "" {
+		if placeID, ok := places["id:"+row.ClinicPlaceID]; ok {
+			return placeID, nil
+		}
+		clinic, err := clinicDB.GetSingleClinicViaPlace(ctx, row.ClinicPlaceID)
+		if err != nil || clinic.AddressID == "" {
+			details, err := mapClient.FindPlaceFromID(row.ClinicPlaceID)
+			if err != nil || details == nil || details.PlaceID == "" {
+				return "", fmt.Errorf("unknown clinic place %q", row.ClinicPlaceID)
+			}
+		}
+		places["id:"+row.ClinicPlaceID] = row.ClinicPlaceID
+		return row.ClinicPlaceID, nil
+	}
+	key := "text:" + strings.ToLower(row.Clinic)
+	if placeID, ok := places[key]; ok {
+		if placeID == "" {
+			return "", fmt.Errorf("no dental clinic found for %q", row.Clinic)
+		}
+		return placeID, nil
+	}
+	found, err := mapClient.FindPlacesFromText(row.Clinic)
+	if err != nil {
+		return "", fmt.Errorf("clinic lookup for %q failed: %v", row.Clinic, err)
+	}
+	placeID := ""
+	if len(found.Results) > 0 {
+		placeID = found.Results[0].PlaceID
+	}
+	places[key] = placeID
+	if placeID == "" {
+		return "", fmt.Errorf("no dental clinic found for %q", row.Clinic)
+	}
+	return placeID, nil
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	pe "github.com/DusanKasan/parsemail"
+	"github.com/gin-gonic/gin"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/mailthread"
+)
+
+// inboundRecipients ... addresses an inbound email was delivered to, its To and Cc headers and the
+// SMTP envelope the inbound parse webhook posts with it, which also has the Bcc recipients
+func inboundRecipients(c *gin.Context, parsedEmail pe.Email) []string {
+	recipients := headerRecipients(parsedEmail)
+	if c.Request.MultipartForm == nil || len(c.Request.MultipartForm.Value["envelope"]) == 0 {
+		return recipients
+	}
+	var envelope struct {
+		To []string `json:"to"`
+	}
+	if err := json.Unmarshal([]byte(c.Request.MultipartForm.Value["envelope"][0]), &envelope); err == nil {
+		recipients = append(recipients, envelope.To...)
+	}
+	return recipients
+}
+
+// headerRecipients ... addresses of the To and Cc headers of an email
+func headerRecipients(parsedEmail pe.Email) []string {
+	recipients := make([]string, 0)
+	for _, address := range append(parsedEmail.To, parsedEmail.Cc...) {
+		if address != nil {
+			recipients = append(recipients, address.Address)
+		}
+	}
+	return recipients
+}
+
+// replyReferral ... referral an inbound email answers, by the signed reply address it was sent to.
+// Replies to emails from before reply addresses fall back to a subject that is a referral ID, then to
+// the sender's open referral when there is only one. With several it cannot tell which one is meant.
+func replyReferral(ctx context.Context, dsRefC *datastoredb.DSReferral, recipients []string, subject string, fromEmail string) (*contracts.DSReferral, error) {
+	key := []byte(global.Options.ReplySigningKey)
+	for _, recipient := range recipients {
+		referralID, ok := mailthread.ReferralID(recipient, key)
+		if !ok {
+			continue
+		}
+		dsReferral, err := dsRefC.GetReferral(ctx, referralID)
+		if err != nil || dsReferral.IsDirty {
+			return nil, fmt.Errorf("referral %s of the reply address not found", referralID)
+		}
+		return dsReferral, nil
+	}
+	if subject != "" {
+		dsReferral, err := dsRefC.GetReferral(ctx, strings.TrimSpace(subject))
+		if err == nil && !dsReferral.IsDirty {
+			return dsReferral, nil
+		}
+	}
+	dsReferralAll, err := dsRefC.GetReferralFromEmail(ctx, fromEmail)
+	if err != nil {
+		return nil, err
+	}
+	if len(dsReferralAll) != 1 {
+		return nil, fmt.Errorf("%d open referrals for %s and no reply address", len(dsReferralAll), fromEmail)
+	}
+	return &dsReferralAll[0], nil
+}
+
+// replySender ... channel and name of whoever replied, a clinic of the referral or its patient
+func replySender(dsReferral contracts.DSReferral, fromEmail string) (contracts.ChatBox, string, string) {
+	switch {
+	case dsReferral.ToEmail != "" && strings.EqualFold(fromEmail, dsReferral.ToEmail):
+		return contracts.GDCBox, fromEmail, dsReferral.ToClinicName
+	case dsReferral.FromEmail != "" && strings.EqualFold(fromEmail, dsReferral.FromEmail):
+		return contracts.GDCBox, fromEmail, dsReferral.FromClinicName
+	}
+	if dsReferral.PatientEmail != "" {
+		return contracts.SPCBox, dsReferral.PatientEmail, dsReferral.PatientFirstName + " " + dsReferral.PatientLastName
+	}
+	return contracts.SPCBox, dsReferral.PatientPhone, dsReferral.PatientFirstName + " " + dsReferral.PatientLastName
+}
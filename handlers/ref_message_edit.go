@@ -0,0 +1,357 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+	"github.com/superdentist/superdentist-backend/lib/websocket"
+)
+
+var (
+	errNotMessageAuthor = fmt.Errorf("only the author can change a message")
+	errEditWindowClosed = fmt.Errorf("messages can only be changed for %d minutes", constants.MESSAGE_EDIT_WINDOW)
+	errMessageRetracted = fmt.Errorf("message was retracted")
+)
+
+// EditMessage ... the author corrects the text or channel of a recent message
+func EditMessage(c *gin.Context) {
+	reviseMessage(c, contracts.MessageEdited)
+}
+
+// RetractMessage ... the author withdraws a recent message
+func RetractMessage(c *gin.Context) {
+	reviseMessage(c, contracts.MessageRetracted)
+}
+
+// GetMessageVersions ... previous contents of a message
+func GetMessageVersions(c *gin.Context) {
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	messageID := c.Param("messageId")
+	referral, _, _, dsRefC, ok := loadReferralForUser(c, referralID)
+	if !ok {
+		return
+	}
+	versions, err := dsRefC.GetMessageVersions(ctx, referral.ReferralID, messageID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   versions,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+func reviseMessage(c *gin.Context, action string) {
+	log.Infof("Revise referral message: %s", action)
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	messageID := c.Param("messageId")
+	var edit contracts.MessageEdit
+	if action == contracts.MessageEdited {
+		err := c.ShouldBindWith(&edit, binding.JSON)
+		if err != nil || strings.TrimSpace(edit.Text) == "" ||
+			(edit.Channel != "" && edit.Channel != contracts.GDCBox && edit.Channel != contracts.SPCBox) {
+			c.AbortWithStatusJSON(
+				http.StatusBadRequest,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+				},
+			)
+			return
+		}
+	}
+	referral, userEmail, asSpecialist, dsRefC, ok := loadReferralForUser(c, referralID)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	previous, updated, err := dsRefC.ReviseMessage(ctx, referralID, messageID, action, userEmail, func(comment *contracts.Comment) error {
+		if comment.UserID != userEmail {
+			return errNotMessageAuthor
+		}
+		if comment.Retracted {
+			return errMessageRetracted
+		}
+		if now.Sub(time.Unix(0, comment.TimeStamp*int64(time.Millisecond))) > time.Duration(constants.MESSAGE_EDIT_WINDOW)*time.Minute {
+			return errEditWindowClosed
+		}
+		if action == contracts.MessageRetracted {
+			comment.Retracted = true
+			comment.Text = ""
+			comment.Files = nil
+			comment.Media = nil
+			comment.PatientSMS = false
+			return nil
+		}
+		comment.Text = edit.Text
+		if edit.Channel != "" {
+			comment.Channel = edit.Channel
+		}
+		// the notices below keep the patient's copy in line with the patient channel
+		comment.PatientSMS = comment.Channel == contracts.SPCBox && referral.PatientPhone != ""
+		return nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errNotMessageAuthor, errEditWindowClosed:
+			status = http.StatusForbidden
+		case errMessageRetracted:
+			status = http.StatusConflict
+		case datastore.ErrNoSuchEntity:
+			status = http.StatusNotFound
+		}
+		c.AbortWithStatusJSON(
+			status,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	notifyMessageRevision(ctx, *referral, *previous, *updated, asSpecialist)
+	publishMessageRevision(*referral, *previous, *updated, action)
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   updated,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// loadReferralForUser ... the referral if the caller's clinic is part of it, the response is written otherwise
+func loadReferralForUser(c *gin.Context, referralID string) (*contracts.DSReferral, string, bool, *datastoredb.DSReferral, bool) {
+	ctx := c.Request.Context()
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", false, nil, false
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", false, nil, false
+	}
+	referral, err := dsRefC.GetReferral(ctx, referralID)
+	if err != nil || referral.IsDirty {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("referral %s not found", referralID).Error(),
+			},
+		)
+		return nil, "", false, nil, false
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", false, nil, false
+	}
+	adminClinics, err := clinicDB.GetAllClinics(ctx, userEmail, userID)
+	isDentist, isSpecialist := false, false
+	if err == nil {
+		for _, clinic := range adminClinics {
+			if (clinic.AddressID != "" && clinic.AddressID == referral.FromAddressID) ||
+				(clinic.PlaceID != "" && clinic.PlaceID == referral.FromPlaceID) {
+				isDentist = true
+			}
+			if (clinic.AddressID != "" && clinic.AddressID == referral.ToAddressID) ||
+				(clinic.PlaceID != "" && clinic.PlaceID == referral.ToPlaceID) {
+				isSpecialist = true
+			}
+		}
+	}
+	if !isDentist && !isSpecialist {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return nil, "", false, nil, false
+	}
+	return referral, userEmail, isSpecialist, dsRefC, true
+}
+
+// revisionNotice ... who hears of a revised message
+type revisionNotice struct {
+	// clinic the other clinic is sent a correction, or a withdrawal when clinicRetracted
+	clinic          bool
+	clinicRetracted bool
+	// patientKey the patient text to send, on each of patientSMS and patientEmail
+	patientKey   string
+	patientSMS   bool
+	patientEmail bool
+}
+
+// revisionNotices ... the other clinic is told when the clinic channel is involved. The patient is told on
+// every channel they can be reached on when a message they were sent was corrected or withdrawn, or when one
+// is moved to the patient channel.
+func revisionNotices(referral contracts.DSReferral, previous contracts.Comment, updated contracts.Comment) revisionNotice {
+	var notice revisionNotice
+	if previous.Channel == contracts.GDCBox || updated.Channel == contracts.GDCBox {
+		notice.clinic = true
+		notice.clinicRetracted = updated.Retracted || updated.Channel != contracts.GDCBox
+	}
+	sent := previous.PatientSMS || previous.Channel == contracts.SPCBox
+	holds := !updated.Retracted && (updated.PatientSMS || updated.Channel == contracts.SPCBox)
+	switch {
+	case sent && !holds:
+		notice.patientKey = messages.KeyMessageRetracted
+	case sent && holds:
+		notice.patientKey = messages.KeyMessageCorrection
+	case holds:
+		notice.patientKey = messages.KeyMessageNotice
+	}
+	if notice.patientKey != "" {
+		notice.patientSMS = referral.PatientPhone != ""
+		notice.patientEmail = referral.PatientEmail != ""
+	}
+	return notice
+}
+
+// notifyMessageRevision ... sends the notices revisionNotices decides on
+func notifyMessageRevision(ctx context.Context, referral contracts.DSReferral, previous contracts.Comment, updated contracts.Comment, asSpecialist bool) {
+	notice := revisionNotices(referral, previous, updated)
+	sgClient := sendgrid.NewSendGridClient()
+	err := sgClient.InitializeSendGridClient()
+	if err != nil {
+		log.Errorf("Failed to send revision notice: %v", err.Error())
+		return
+	}
+	patientName := referral.PatientFirstName + " " + referral.PatientLastName
+	if notice.clinic {
+		otherEmail, otherName, otherAddressID := referral.ToEmail, referral.ToClinicName, referral.ToAddressID
+		authorName := referral.FromClinicName
+		if asSpecialist {
+			otherEmail, otherName, otherAddressID = referral.FromEmail, referral.FromClinicName, referral.FromAddressID
+			authorName = referral.ToClinicName
+		}
+		if otherEmail == "" {
+			otherEmail = constants.SD_ADMIN_EMAIL
+		}
+		text := "A message on a referral was corrected"
+		body := fmt.Sprintf("%s corrected a message on the referral of %s:\n\n%s\n", authorName, patientName, updated.Text)
+		if notice.clinicRetracted {
+			text = "A message on a referral was withdrawn"
+			body = fmt.Sprintf("%s withdrew a message on the referral of %s, please disregard it.\n", authorName, patientName)
+		}
+		err = notifyClinicEmail(ctx, contracts.EventMessageUpdated, referral, otherAddressID, otherEmail, otherName, text, func() error {
+			return sgClient.SendMessageRevision(otherEmail, otherName, referral.ReferralID, notice.clinicRetracted, body)
+		})
+		if err != nil {
+			log.Errorf("Failed to send revision notice: %v", err.Error())
+		}
+	}
+	if notice.patientKey == "" {
+		return
+	}
+	var vars map[string]string
+	if notice.patientKey != messages.KeyMessageRetracted {
+		vars = map[string]string{"Message": updated.Text}
+	}
+	patientNotice := patientMessage(ctx, referral, notice.patientKey, vars)
+	if patientNotice == "" {
+		return
+	}
+	if notice.patientSMS {
+		clientSMS := sms.NewSMSClient()
+		err = clientSMS.InitializeSMSClient()
+		if err != nil {
+			log.Errorf("Failed to send SMS: %v", err.Error())
+		} else {
+			fromPhone := referral.CommunicationPhone
+			if fromPhone == "" {
+				fromPhone = global.Options.ReferralPhone
+			}
+			err = clientSMS.SendSMS(fromPhone, referral.PatientPhone, patientNotice)
+			if err != nil {
+				log.Errorf("Failed to send SMS: %v", err.Error())
+			}
+		}
+	}
+	if notice.patientEmail {
+		err = sgClient.SendCommentNotificationPatient(patientName, referral.PatientEmail, patientNotice,
+			referral.ToClinicName, referral.ReferralID)
+		if err != nil {
+			log.Errorf("Failed to send email: %v", err.Error())
+		}
+	}
+}
+
+// publishMessageRevision ... updates open chats, a message moved to another channel is withdrawn from
+// the old one
+func publishMessageRevision(referral contracts.DSReferral, previous contracts.Comment, updated contracts.Comment, action string) {
+	ctx := context.Background()
+	if websocketPool != nil {
+		eventType := contracts.ChatEventEdited
+		if action == contracts.MessageRetracted {
+			eventType = contracts.ChatEventRetracted
+		}
+		event := contracts.ChatEvent{Type: eventType, ReferralID: referral.ReferralID, Channel: updated.Channel, Comment: &updated}
+		err := websocketPool.PublishJSON(ctx, websocket.ChatTopic(referral.ReferralID, string(updated.Channel)), event)
+		if err != nil {
+			log.Errorf("Failed to publish message %s: %v", updated.MessageID, err.Error())
+		}
+		if previous.Channel != updated.Channel {
+			withdrawn := updated
+			withdrawn.Channel = previous.Channel
+			withdrawn.Text = ""
+			withdrawn.Retracted = true
+			event = contracts.ChatEvent{Type: contracts.ChatEventRetracted, ReferralID: referral.ReferralID, Channel: previous.Channel, Comment: &withdrawn}
+			err = websocketPool.PublishJSON(ctx, websocket.ChatTopic(referral.ReferralID, string(previous.Channel)), event)
+			if err != nil {
+				log.Errorf("Failed to publish message %s: %v", updated.MessageID, err.Error())
+			}
+		}
+	}
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:       contracts.EventMessageUpdated,
+		ReferralID: referral.ReferralID,
+		MessageID:  updated.MessageID,
+	}, referral.FromAddressID, referral.ToAddressID)
+}
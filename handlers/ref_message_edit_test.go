@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+)
+
+func TestRevisionNotices(t *testing.T) {
+	both := contracts.DSReferral{PatientPhone: "+15550001111", PatientEmail: "maria@example.com"}
+	emailOnly := contracts.DSReferral{PatientEmail: "maria@example.com"}
+	clinic := contracts.Comment{Channel: contracts.GDCBox}
+	patient := contracts.Comment{Channel: contracts.SPCBox, PatientSMS: true}
+	patientByEmail := contracts.Comment{Channel: contracts.SPCBox}
+	retracted := contracts.Comment{Channel: contracts.SPCBox, Retracted: true}
+	clinicRetracted := contracts.Comment{Channel: contracts.GDCBox, Retracted: true}
+	firstComment := contracts.Comment{Channel: contracts.GDCBox, PatientSMS: true}
+
+	tests := []struct {
+		name     string
+		referral contracts.DSReferral
+		previous contracts.Comment
+		updated  contracts.Comment
+		want     revisionNotice
+	}{
+		{"clinic message corrected", both, clinic, clinic, revisionNotice{clinic: true}},
+		{"clinic message retracted", both, clinic, clinicRetracted, revisionNotice{clinic: true, clinicRetracted: true}},
+		{"patient message corrected", both, patient, patient,
+			revisionNotice{patientKey: messages.KeyMessageCorrection, patientSMS: true, patientEmail: true}},
+		{"patient message retracted", both, patient, retracted,
+			revisionNotice{patientKey: messages.KeyMessageRetracted, patientSMS: true, patientEmail: true}},
+		{"patient with only email told of a correction", emailOnly, patientByEmail, patientByEmail,
+			revisionNotice{patientKey: messages.KeyMessageCorrection, patientEmail: true}},
+		{"patient with only email told of a retraction", emailOnly, patientByEmail, retracted,
+			revisionNotice{patientKey: messages.KeyMessageRetracted, patientEmail: true}},
+		{"moved to the patient channel", both, clinic, patient,
+			revisionNotice{clinic: true, clinicRetracted: true, patientKey: messages.KeyMessageNotice, patientSMS: true, patientEmail: true}},
+		{"moved to the clinic channel", emailOnly, patientByEmail, clinic,
+			revisionNotice{clinic: true, patientKey: messages.KeyMessageRetracted, patientEmail: true}},
+		{"first comment the patient was texted", both, firstComment, clinic,
+			revisionNotice{clinic: true, patientKey: messages.KeyMessageRetracted, patientSMS: true, patientEmail: true}},
+		{"patient nobody can reach", contracts.DSReferral{}, patientByEmail, retracted, revisionNotice{patientKey: messages.KeyMessageRetracted}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, revisionNotices(test.referral, test.previous, test.updated), test.name)
+	}
+}
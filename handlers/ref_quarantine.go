@@ -0,0 +1,541 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pe "github.com/DusanKasan/parsemail"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/mailthread"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// isPlatformAdmin ... SuperDentist staff, who see messages that belong to no clinic yet
+func isPlatformAdmin(email string) bool {
+	for _, admin := range strings.Split(global.Options.PlatformAdmins, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// inboundRawEmail ... raw MIME message the inbound parse webhook posts as its email field
+func inboundRawEmail(c *gin.Context) (string, bool) {
+	const _24K = 256 << 20
+	err := c.Request.ParseMultipartForm(_24K)
+	if err != nil || len(c.Request.MultipartForm.Value["email"]) == 0 {
+		log.Errorf("Error reading inbound email: %v", err)
+		return "", false
+	}
+	return c.Request.MultipartForm.Value["email"][0], true
+}
+
+// customPhone ... receiving number of a text the way referrals store their CommunicationPhone
+func customPhone(to string) string {
+	for _, symbol := range []string{"-", "(", ")", " "} {
+		to = strings.Replace(to, symbol, "", -1)
+	}
+	return to
+}
+
+func messagePreview(text string) string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) > constants.QUARANTINE_PREVIEW_LENGTH {
+		return string(runes[:constants.QUARANTINE_PREVIEW_LENGTH]) + "…"
+	}
+	return string(runes)
+}
+
+// quarantineEmail ... keeps an inbound email nothing matched, attachments stay inside the raw message
+func quarantineEmail(ctx context.Context, dsRefC *datastoredb.DSReferral, source string, raw string, parsedEmail pe.Email, reason string) {
+	message := contracts.QuarantinedMessage{
+		Source:      source,
+		Reason:      reason,
+		Subject:     parsedEmail.Subject,
+		Preview:     messagePreview(mailthread.StripQuoted(parsedEmail.TextBody)),
+		Attachments: make([]string, 0),
+	}
+	if len(parsedEmail.From) > 0 {
+		message.Sender = parsedEmail.From[0].Address
+	}
+	message.Recipient = strings.Join(headerRecipients(parsedEmail), ", ")
+	for _, attach := range parsedEmail.Attachments {
+		message.Attachments = append(message.Attachments, attach.Filename)
+	}
+	quarantineInbound(ctx, dsRefC, message, []byte(raw), nil)
+}
+
+// quarantineText ... keeps an inbound text nothing matched with its media, the provider's media URLs
+// do not last
+func quarantineText(ctx context.Context, dsRefC *datastoredb.DSReferral, form url.Values, filePatients map[string][]byte, reason string) {
+	message := contracts.QuarantinedMessage{
+		Source:    contracts.QuarantineSMS,
+		Reason:    reason,
+		Sender:    form.Get("From"),
+		Recipient: form.Get("To"),
+		Preview:   messagePreview(form.Get("Body")),
+	}
+	quarantineInbound(ctx, dsRefC, message, []byte(form.Encode()), filePatients)
+}
+
+// quarantineInbound ... stores the raw payload and media of the message and records it as pending.
+// A message that cannot be stored is only logged, as it was before quarantine.
+func quarantineInbound(ctx context.Context, dsRefC *datastoredb.DSReferral, message contracts.QuarantinedMessage, raw []byte, files map[string][]byte) {
+	quarantineUUID, _ := uuid.NewUUID()
+	message.QuarantineID = quarantineUUID.String()
+	message.Status = contracts.QuarantinePending
+	message.Folder = constants.QUARANTINE_FOLDER + "/" + message.QuarantineID
+	message.CreatedOn = time.Now()
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		log.Errorf("Failed to quarantine message from %s: %v", message.Sender, err.Error())
+		return
+	}
+	err = storageC.WriteFile(ctx, constants.SD_REFERRAL_BUCKET, message.Folder+"/"+quarantineRawName(message.Source), raw, quarantineRawType(message.Source))
+	if err != nil {
+		log.Errorf("Failed to quarantine message from %s: %v", message.Sender, err.Error())
+		return
+	}
+	if files != nil {
+		message.Attachments = storeHeldFiles(ctx, storageC, message.Folder, files, 0)
+	}
+	err = dsRefC.SaveQuarantinedMessage(ctx, message)
+	if err != nil {
+		log.Errorf("Failed to quarantine message from %s: %v", message.Sender, err.Error())
+		return
+	}
+	log.Infof("Quarantined %s from %s as %s: %s", message.Source, message.Sender, message.QuarantineID, message.Reason)
+}
+
+func quarantineRawName(source string) string {
+	if source == contracts.QuarantineSMS {
+		return "raw.txt"
+	}
+	return "raw.eml"
+}
+
+func quarantineRawType(source string) string {
+	if source == contracts.QuarantineSMS {
+		return "application/x-www-form-urlencoded"
+	}
+	return "message/rfc822"
+}
+
+// ListQuarantinedMessages ... messages with the status, pending by default, newest first
+func ListQuarantinedMessages(c *gin.Context) {
+	log.Infof("List Quarantined Messages")
+	ctx := c.Request.Context()
+	userEmail, _, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !isPlatformAdmin(userEmail) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	status := c.DefaultQuery("status", contracts.QuarantinePending)
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	messages, err := dsRefC.GetQuarantinedMessages(ctx, status, constants.QUARANTINE_LIST_LIMIT)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   messages,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// loadQuarantineForAdmin ... the message if the user is a platform admin, otherwise it aborts the
+// request
+func loadQuarantineForAdmin(c *gin.Context, quarantineID string) (*contracts.QuarantinedMessage, string, string, *datastoredb.DSReferral, bool) {
+	ctx := c.Request.Context()
+	userEmail, _, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", "", nil, false
+	}
+	if !isPlatformAdmin(userEmail) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return nil, "", "", nil, false
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", "", nil, false
+	}
+	message, err := dsRefC.GetQuarantinedMessage(ctx, quarantineID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", "", nil, false
+	}
+	return message, userEmail, gproject, dsRefC, true
+}
+
+// GetQuarantinedMessage ...
+func GetQuarantinedMessage(c *gin.Context) {
+	log.Infof("Get Quarantined Message")
+	message, _, _, _, ok := loadQuarantineForAdmin(c, c.Param("quarantineId"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   message,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// DownloadQuarantinedMessage ... short lived URL of the raw email or text, or of one of the media of
+// a text with ?attachment=
+func DownloadQuarantinedMessage(c *gin.Context) {
+	log.Infof("Download Quarantined Message")
+	message, _, gproject, _, ok := loadQuarantineForAdmin(c, c.Param("quarantineId"))
+	if !ok {
+		return
+	}
+	name := quarantineRawName(message.Source)
+	downloadName := message.QuarantineID + "-" + name
+	if attachment := c.Query("attachment"); attachment != "" {
+		found := false
+		for _, stored := range message.Attachments {
+			found = found || (stored == attachment && message.Source == contracts.QuarantineSMS)
+		}
+		if !found {
+			c.AbortWithStatusJSON(
+				http.StatusNotFound,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: fmt.Errorf("attachment %s not found", attachment).Error(),
+				},
+			)
+			return
+		}
+		name, downloadName = attachment, attachment
+	}
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(c.Request.Context(), gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	sendSignedDownload(c, storageC, constants.SD_REFERRAL_BUCKET, message.Folder+"/"+name, downloadName)
+}
+
+// AssignQuarantinedMessage ... replays the message through the processing it missed, with the
+// referral or clinics the admin picked. It stays pending if the replay fails.
+func AssignQuarantinedMessage(c *gin.Context) {
+	log.Infof("Assign Quarantined Message")
+	ctx := c.Request.Context()
+	var assignment contracts.QuarantineAssignment
+	if err := c.ShouldBindWith(&assignment, binding.JSON); err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	message, userEmail, gproject, dsRefC, ok := loadQuarantineForAdmin(c, c.Param("quarantineId"))
+	if !ok {
+		return
+	}
+	if message.Status != contracts.QuarantinePending {
+		c.AbortWithStatusJSON(
+			http.StatusConflict,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("message is %s", message.Status).Error(),
+			},
+		)
+		return
+	}
+	if (message.Source == contracts.QuarantineSummaryMail && assignment.AddressID == "" && assignment.DentistAddressID == "") ||
+		(message.Source != contracts.QuarantineSummaryMail && assignment.ReferralID == "") {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("summaries are assigned to clinics, other messages to a referral").Error(),
+			},
+		)
+		return
+	}
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	raw, err := readStoredFile(ctx, storageC, message.Folder, quarantineRawName(message.Source))
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	status, err := replayQuarantined(ctx, gproject, dsRefC, storageC, *message, raw, assignment)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			status,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	message.Status = contracts.QuarantineAssigned
+	message.ReferralID = assignment.ReferralID
+	message.AddressID = assignment.AddressID
+	message.ResolvedBy = userEmail
+	message.ResolvedOn = time.Now()
+	sendQuarantinedMessage(c, dsRefC, *message)
+}
+
+// replayQuarantined ... runs the message through the handler it came in on, the status is the one to
+// answer with when it fails
+func replayQuarantined(ctx context.Context, gproject string, dsRefC *datastoredb.DSReferral, storageC *storage.Client,
+	message contracts.QuarantinedMessage, raw []byte, assignment contracts.QuarantineAssignment) (int, error) {
+	var dsReferral *contracts.DSReferral
+	if assignment.ReferralID != "" {
+		var err error
+		dsReferral, err = dsRefC.GetReferral(ctx, assignment.ReferralID)
+		if err != nil || dsReferral.IsDirty {
+			return http.StatusNotFound, fmt.Errorf("referral %s not found", assignment.ReferralID)
+		}
+	}
+	switch message.Source {
+	case contracts.QuarantineSMS:
+		form, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return http.StatusUnprocessableEntity, err
+		}
+		files, err := readHeldFiles(ctx, storageC, message.Folder, message.Attachments)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		clientSMS := sms.NewSMSClient()
+		err = clientSMS.InitializeSMSClient()
+		if err != nil {
+			log.Errorf("Error replaying text: %v", err.Error())
+		}
+		processPatientText(ctx, gproject, dsRefC, clientSMS, []contracts.DSReferral{*dsReferral}, form.Get("Body"), files, customPhone(form.Get("To")))
+		return http.StatusOK, nil
+	}
+	parsedEmail, err := pe.Parse(strings.NewReader(string(raw)))
+	if err != nil || len(parsedEmail.From) == 0 {
+		return http.StatusUnprocessableEntity, fmt.Errorf("cannot parse email: %v", err)
+	}
+	if message.Source == contracts.QuarantineReferralMail {
+		err = processReferralMail(ctx, gproject, dsRefC, parsedEmail, dsReferral)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return http.StatusOK, nil
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	fromEmail := summarySenderEmail(parsedEmail)
+	var sender, dentist *contracts.PhysicalClinicMapLocation
+	if assignment.AddressID != "" {
+		sender, err = clinicDB.GetSingleClinic(ctx, assignment.AddressID)
+	} else {
+		sender, err = summarySenderClinic(ctx, clinicDB, fromEmail)
+	}
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	if assignment.DentistAddressID != "" {
+		dentist, err = clinicDB.GetSingleClinic(ctx, assignment.DentistAddressID)
+	} else {
+		dentist, err = summaryDentistClinic(ctx, clinicDB, headerRecipients(parsedEmail))
+	}
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	err = processSummaryMail(ctx, gproject, dsRefC, parsedEmail, fromEmail, *sender, *dentist)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// storeHeldFiles ... writes inbound media to the folder as <n>-<name>, n counting from first, and
+// returns the stored names. A file that cannot be written is logged and left out.
+func storeHeldFiles(ctx context.Context, storageC *storage.Client, folder string, files map[string][]byte, first int) []string {
+	stored := make([]string, 0)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		contentType := attachments.Sniff(files[name])
+		storedName := strconv.Itoa(first+i) + "-" + attachments.SafeName(name, contentType)
+		err := storageC.WriteFile(ctx, constants.SD_REFERRAL_BUCKET, folder+"/"+storedName, files[name], contentType)
+		if err != nil {
+			log.Errorf("Failed to store %s: %v", storedName, err.Error())
+			continue
+		}
+		stored = append(stored, storedName)
+	}
+	return stored
+}
+
+// readHeldFiles ... media stored by storeHeldFiles, by their names without the <n>- prefix
+func readHeldFiles(ctx context.Context, storageC *storage.Client, folder string, stored []string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, storedName := range stored {
+		data, err := readStoredFile(ctx, storageC, folder, storedName)
+		if err != nil {
+			return nil, err
+		}
+		files[storedName[strings.Index(storedName, "-")+1:]] = data
+	}
+	return files, nil
+}
+
+func readStoredFile(ctx context.Context, storageC *storage.Client, folder string, name string) ([]byte, error) {
+	fileReader, err := storageC.DownloadSingleFile(ctx, folder, constants.SD_REFERRAL_BUCKET, name)
+	if err != nil {
+		return nil, err
+	}
+	defer fileReader.Close()
+	return ioutil.ReadAll(fileReader)
+}
+
+// DiscardQuarantinedMessage ... spam and messages for nobody on SuperDentist, the payload is kept
+func DiscardQuarantinedMessage(c *gin.Context) {
+	log.Infof("Discard Quarantined Message")
+	message, userEmail, _, dsRefC, ok := loadQuarantineForAdmin(c, c.Param("quarantineId"))
+	if !ok {
+		return
+	}
+	if message.Status != contracts.QuarantinePending {
+		c.AbortWithStatusJSON(
+			http.StatusConflict,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("message is %s", message.Status).Error(),
+			},
+		)
+		return
+	}
+	message.Status = contracts.QuarantineDiscarded
+	message.ResolvedBy = userEmail
+	message.ResolvedOn = time.Now()
+	sendQuarantinedMessage(c, dsRefC, *message)
+}
+
+func sendQuarantinedMessage(c *gin.Context, dsRefC *datastoredb.DSReferral, message contracts.QuarantinedMessage) {
+	err := dsRefC.SaveQuarantinedMessage(c.Request.Context(), message)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   message,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+)
+
+// MarkMessagesRead ... moves the user's read marker of the referral forward
+func MarkMessagesRead(c *gin.Context) {
+	log.Infof("Mark referral messages read")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	var markRead contracts.MarkRead
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindWith(&markRead, binding.JSON); err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusBadRequest,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+				},
+			)
+			return
+		}
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	referral, err := dsRefC.GetReferral(ctx, referralID)
+	if err != nil || referral.IsDirty {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("referral %s not found", referralID).Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	if !canAccessReferral(ctx, clinicDB, userEmail, userID, *referral) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	// without a timestamp everything posted so far is read, clients that render a thread pass the
+	// timestamp of the newest message they showed so nothing arriving meanwhile is skipped
+	upTo := markRead.TimeStamp
+	if upTo <= 0 {
+		upTo = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	marker, err := dsRefC.MarkMessagesRead(ctx, referralID, userEmail, upTo)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   marker,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// GetUnreadInbox ... referrals with unread messages across the clinics of the user
+func GetUnreadInbox(c *gin.Context) {
+	log.Infof("Get unread inbox")
+	ctx := c.Request.Context()
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusUnauthorized,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	adminClinics, err := clinicDB.GetAllClinics(ctx, userEmail, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	markers, err := dsRefC.GetReadMarkers(ctx, userEmail)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	inbox := contracts.InboxUnread{Clinics: make(map[string]int), Referrals: make([]contracts.UnreadReferral, 0)}
+	counted := make(map[string]bool)
+	for _, clinic := range adminClinics {
+		if clinic.AddressID == "" {
+			continue
+		}
+		inbox.Clinics[clinic.AddressID] = 0
+		// both lists come back empty with an error when the clinic has no referrals
+		sent, _ := dsRefC.GetAllReferralsGD(ctx, clinic.AddressID)
+		received := make([]contracts.DSReferral, 0)
+		if clinic.PlaceID != "" {
+			received, _ = dsRefC.GetAllReferralsSP(ctx, clinic.PlaceID, clinic.Name)
+		}
+		addUnreadCounts(ctx, dsRefC, sent, markers, userEmail, false)
+		addUnreadCounts(ctx, dsRefC, received, markers, userEmail, true)
+		for _, referral := range append(sent, received...) {
+			if referral.Unread == nil || counted[referral.ReferralID] {
+				continue
+			}
+			unread := referral.Unread.Clinic + referral.Unread.Patient
+			if unread == 0 {
+				continue
+			}
+			counted[referral.ReferralID] = true
+			inbox.Total += unread
+			inbox.Clinics[clinic.AddressID] += unread
+			inbox.Referrals = append(inbox.Referrals, contracts.UnreadReferral{
+				ReferralID:       referral.ReferralID,
+				AddressID:        clinic.AddressID,
+				PatientFirstName: referral.PatientFirstName,
+				PatientLastName:  referral.PatientLastName,
+				ModifiedOn:       referral.ModifiedOn,
+				Unread:           *referral.Unread,
+			})
+		}
+	}
+	sort.Slice(inbox.Referrals, func(i, j int) bool {
+		return inbox.Referrals[i].ModifiedOn.After(inbox.Referrals[j].ModifiedOn)
+	})
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   inbox,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// listingUnreadCounts ... unread counts of a referral listing for the calling user
+func listingUnreadCounts(ctx context.Context, dsRefC *datastoredb.DSReferral, referrals []contracts.DSReferral, userEmail string, asSpecialist bool) {
+	markers, err := dsRefC.GetReadMarkers(ctx, userEmail)
+	if err != nil {
+		log.Errorf("Failed to get read markers of %s: %v", userEmail, err.Error())
+		return
+	}
+	addUnreadCounts(ctx, dsRefC, referrals, markers, userEmail, asSpecialist)
+}
+
+// addUnreadCounts ... sets Unread on each referral from its message index, messages after the user's read
+// marker are only loaded for referrals the index cannot tell about
+func addUnreadCounts(ctx context.Context, dsRefC *datastoredb.DSReferral, referrals []contracts.DSReferral, markers map[string]contracts.ReadMarker, userEmail string, asSpecialist bool) {
+	indexes, err := dsRefC.GetMessageIndexes(ctx, referrals)
+	if err != nil {
+		log.Errorf("Failed to get message indexes: %v", err.Error())
+		indexes = make(map[string]contracts.MessageIndex)
+	}
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, constants.UNREAD_COUNT_WORKERS)
+	for i := range referrals {
+		index, indexed := indexes[referrals[i].ReferralID]
+		if indexed {
+			unread, scan := indexedUnread(index, markers[referrals[i].ReferralID].LastRead, asSpecialist)
+			if !scan {
+				referrals[i].Unread = &unread
+				continue
+			}
+		}
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(referral *contracts.DSReferral) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			if !indexed {
+				if _, err := dsRefC.BuildMessageIndex(ctx, *referral); err != nil {
+					log.Errorf("Failed to index messages of %s: %v", referral.ReferralID, err.Error())
+				}
+			}
+			comments, err := dsRefC.GetMessagesAfter(ctx, referral.ReferralID, markers[referral.ReferralID].LastRead)
+			if err != nil {
+				log.Errorf("Failed to count unread messages of %s: %v", referral.ReferralID, err.Error())
+				return
+			}
+			unread := countUnread(*referral, comments, userEmail, asSpecialist)
+			referral.Unread = &unread
+		}(&referrals[i])
+	}
+	wg.Wait()
+}
+
+// indexedUnread ... unread counts of a referral from its message index and the user's read marker, scan is true
+// when the index cannot tell and the messages after the marker have to be counted. Messages of others may be the
+// user's own, posted under their email rather than the clinic's.
+func indexedUnread(index contracts.MessageIndex, lastRead int64, asSpecialist bool) (contracts.UnreadCount, bool) {
+	theirCount, theirLast := index.SpecialistCount, index.SpecialistLast
+	if asSpecialist {
+		theirCount, theirLast = index.DentistCount, index.DentistLast
+	}
+	var unread contracts.UnreadCount
+	if lastRead == 0 {
+		if index.OtherCount > 0 {
+			return unread, true
+		}
+		unread.Clinic = theirCount
+		if asSpecialist {
+			unread.Patient = index.PatientCount
+		}
+		return unread, false
+	}
+	newest := theirLast
+	if index.OtherLast > newest {
+		newest = index.OtherLast
+	}
+	if asSpecialist && index.PatientLast > newest {
+		newest = index.PatientLast
+	}
+	return unread, newest > lastRead
+}
+
+// countUnread ... messages the user's side did not write that were not retracted, clinic messages are
+// often posted under the clinic email rather than the user's. The referring dentist is not part of
+// the patient channel.
+func countUnread(referral contracts.DSReferral, comments []contracts.Comment, userEmail string, asSpecialist bool) contracts.UnreadCount {
+	clinicEmail := referral.FromEmail
+	if asSpecialist {
+		clinicEmail = referral.ToEmail
+	}
+	var unread contracts.UnreadCount
+	for _, comment := range comments {
+		if comment.Retracted || comment.UserID == userEmail || (clinicEmail != "" && comment.UserID == clinicEmail) {
+			continue
+		}
+		switch comment.Channel {
+		case contracts.GDCBox:
+			unread.Clinic++
+		case contracts.SPCBox:
+			if asSpecialist {
+				unread.Patient++
+			}
+		}
+	}
+	return unread
+}
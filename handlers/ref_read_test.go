@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+func TestIndexedUnread(t *testing.T) {
+	referral := contracts.DSReferral{ReferralID: "ref-1", FromEmail: "gd@smile.com", ToEmail: "sp@ortho.com"}
+	comments := []contracts.Comment{
+		{MessageID: "1", TimeStamp: 100, Channel: contracts.GDCBox, UserID: "gd@smile.com"},
+		{MessageID: "2", TimeStamp: 200, Channel: contracts.GDCBox, UserID: "sp@ortho.com"},
+		{MessageID: "3", TimeStamp: 300, Channel: contracts.SPCBox, UserID: "+15550001111"},
+		{MessageID: "4", TimeStamp: 400, Channel: contracts.SPCBox, UserID: "sp@ortho.com"},
+		{MessageID: "5", TimeStamp: 500, Channel: contracts.GDCBox, UserID: "sp@ortho.com", Retracted: true},
+	}
+	index := contracts.MessageIndex{ReferralID: referral.ReferralID, FromEmail: referral.FromEmail, ToEmail: referral.ToEmail}
+	for _, comment := range comments {
+		index.Add(comment, 1)
+	}
+	assert.Equal(t, 1, index.DentistCount)
+	assert.Equal(t, 1, index.SpecialistCount)
+	assert.Equal(t, int64(200), index.SpecialistLast, "retracted messages are not counted")
+	assert.Equal(t, 1, index.PatientCount, "the specialist's patient messages are not the patient's")
+
+	tests := []struct {
+		name         string
+		lastRead     int64
+		asSpecialist bool
+		want         contracts.UnreadCount
+		scan         bool
+	}{
+		{"dentist never read", 0, false, contracts.UnreadCount{Clinic: 1}, false},
+		{"specialist never read", 0, true, contracts.UnreadCount{Clinic: 1, Patient: 1}, false},
+		{"dentist read it all", 200, false, contracts.UnreadCount{}, false},
+		{"dentist behind", 150, false, contracts.UnreadCount{}, true},
+		{"patient message after the specialist read", 250, true, contracts.UnreadCount{}, true},
+		{"specialist read it all", 300, true, contracts.UnreadCount{}, false},
+	}
+	for _, test := range tests {
+		unread, scan := indexedUnread(index, test.lastRead, test.asSpecialist)
+		assert.Equal(t, test.scan, scan, test.name)
+		assert.Equal(t, test.want, unread, test.name)
+		if scan {
+			continue
+		}
+		after := make([]contracts.Comment, 0)
+		for _, comment := range comments {
+			if comment.TimeStamp > test.lastRead {
+				after = append(after, comment)
+			}
+		}
+		assert.Equal(t, countUnread(referral, after, "staff@ortho.com", test.asSpecialist), unread, "%s agrees with a scan", test.name)
+	}
+
+	index.Add(contracts.Comment{TimeStamp: 600, Channel: contracts.GDCBox, UserID: "front@smile.com"}, 1)
+	_, scan := indexedUnread(index, 0, false)
+	assert.True(t, scan, "messages of others may be the user's own")
+	index.Add(comments[1], -1)
+	index.Add(comments[1], -1)
+	assert.Equal(t, 0, index.SpecialistCount, "counts never go below zero")
+}
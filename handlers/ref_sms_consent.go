@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nyaruka/phonenumbers"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+)
+
+// patientSMSPhone ... a patient's phone the way referrals store it, with its country code
+func patientSMSPhone(phone string) string {
+	pnum, err := phonenumbers.Parse(phone, "US")
+	if err != nil || pnum.NationalNumber == nil {
+		return sms.NormalizePhone(phone)
+	}
+	countryCode := "+1"
+	if pnum.CountryCode != nil {
+		countryCode = "+" + strconv.Itoa(int(*pnum.CountryCode))
+	}
+	return countryCode + strconv.Itoa(int(*pnum.NationalNumber))
+}
+
+// recordReferralConsent ... the phone given with a new referral is opted in, unless it opted out before
+func recordReferralConsent(ctx context.Context, dsRefC *datastoredb.DSReferral, dsReferral contracts.DSReferral) {
+	if dsReferral.PatientPhone == "" {
+		return
+	}
+	source := contracts.ConsentSourceReferral
+	if dsReferral.IsQR {
+		source = contracts.ConsentSourceQRForm
+	} else if dsReferral.ImportJobID != "" {
+		source = contracts.ConsentSourceImport
+	}
+	_, err := dsRefC.RecordSMSConsent(ctx, contracts.SMSConsent{
+		Phone:      sms.NormalizePhone(dsReferral.PatientPhone),
+		Status:     contracts.SMSOptedIn,
+		Source:     source,
+		ReferralID: dsReferral.ReferralID,
+	})
+	if err != nil {
+		log.Errorf("Failed to record sms consent of %s: %v", dsReferral.ReferralID, err.Error())
+	}
+}
+
+// smsConsent ... consent of the phone, nil when it has no record
+func smsConsent(ctx context.Context, dsRefC *datastoredb.DSReferral, phone string) *contracts.SMSConsent {
+	if phone == "" {
+		return nil
+	}
+	consent, err := dsRefC.GetSMSConsent(ctx, sms.NormalizePhone(phone))
+	if err != nil {
+		return nil
+	}
+	return consent
+}
+
+// handleConsentKeyword ... records a STOP or START of the phone and answers the keyword. The consent is
+// the phone's for all our numbers, a STOP to one clinic stops the texts of every clinic.
+func handleConsentKeyword(ctx context.Context, dsRefC *datastoredb.DSReferral, clientSMS *sms.ClientSMS, keyword string,
+	incomingPhone string, receivingCustomPhone string, dsReferrals []contracts.DSReferral) {
+	clinicName, addressID, locale := "SuperDentist", "", ""
+	if len(dsReferrals) > 0 && dsReferrals[0].ToClinicName != "" {
+		clinicName, addressID, locale = dsReferrals[0].ToClinicName, dsReferrals[0].ToAddressID, dsReferrals[0].PreferredLanguage
+	}
+	key := messages.KeySMSHelp
+	if keyword != sms.KeywordHelp {
+		status, note := contracts.SMSOptedOut, "Patient replied STOP and will not get texts until they reply START."
+		key = messages.KeySMSStop
+		if keyword == sms.KeywordStart {
+			status, note = contracts.SMSOptedIn, "Patient replied START and gets texts again."
+			key = messages.KeySMSStart
+		}
+		referralID := ""
+		if len(dsReferrals) > 0 {
+			referralID = dsReferrals[0].ReferralID
+		}
+		_, err := dsRefC.RecordSMSConsent(ctx, contracts.SMSConsent{
+			Phone:      sms.NormalizePhone(incomingPhone),
+			Status:     status,
+			Source:     contracts.ConsentSourceKeyword,
+			ReferralID: referralID,
+			Keyword:    keyword,
+		})
+		if err != nil {
+			// without the opt out on record the confirmation would be a lie
+			log.Errorf("Failed to record %s of %s: %v", keyword, incomingPhone, err.Error())
+			return
+		}
+		for _, dsReferral := range dsReferrals {
+			noteConsentChange(ctx, dsRefC, dsReferral, note)
+		}
+	}
+	if clientSMS == nil {
+		return
+	}
+	reply, err := messages.Render(ctx, addressID, locale, key, map[string]string{
+		"ClinicName": clinicName,
+		"HelpEmail":  constants.SD_ADMIN_EMAIL,
+	})
+	if err != nil {
+		log.Errorf("Failed to answer %s of %s: %v", keyword, incomingPhone, err.Error())
+		return
+	}
+	err = clientSMS.SendConsentReply(receivingCustomPhone, incomingPhone, reply)
+	if err != nil {
+		log.Errorf("Failed to answer %s of %s: %v", keyword, incomingPhone, err.Error())
+	}
+}
+
+// noteConsentChange ... tells the clinics of the referral why the patient stopped or started getting texts
+func noteConsentChange(ctx context.Context, dsRefC *datastoredb.DSReferral, dsReferral contracts.DSReferral, note string) {
+	id, _ := uuid.NewUUID()
+	comment := contracts.Comment{
+		MessageID: id.String(),
+		TimeStamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Text:      note,
+		Channel:   contracts.SPCBox,
+		UserID:    dsReferral.PatientPhone,
+	}
+	err := dsRefC.CreateMessage(ctx, dsReferral, []contracts.Comment{comment})
+	if err != nil {
+		log.Errorf("Failed to note sms consent on %s: %v", dsReferral.ReferralID, err.Error())
+		return
+	}
+	publishComments(dsReferral, []contracts.Comment{comment})
+}
@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// routePatientText ... files a patient's text in the one referral it is about, or holds it until the patient
+// picks the referral off a menu, see patientTextRoute
+func routePatientText(ctx context.Context, gproject string, dsRefC *datastoredb.DSReferral, clientSMS *sms.ClientSMS,
+	incomingPhone string, receivingCustomPhone string, matched []contracts.DSReferral, incomingText string, filePatients map[string][]byte) {
+	conversationID := incomingPhone + "-" + receivingCustomPhone
+	conversation, err := dsRefC.GetSMSConversation(ctx, conversationID)
+	if err != nil {
+		conversation = &contracts.SMSConversation{
+			ConversationID: conversationID,
+			PatientPhone:   incomingPhone,
+			ReceivingPhone: receivingCustomPhone,
+			Folder:         constants.SMS_CONVERSATION_FOLDER + "/" + conversationID,
+		}
+	}
+	route := patientTextRoute(*conversation, matched, incomingText, time.Now())
+	if route.hold {
+		holdPatientText(ctx, gproject, conversation, route.text, filePatients)
+		if route.menu {
+			sendReferralMenu(ctx, clientSMS, conversation, matched)
+		}
+		saveConversation(ctx, dsRefC, conversation)
+		return
+	}
+	if len(conversation.Candidates) > 0 || len(conversation.PendingText) > 0 || len(conversation.PendingFiles) > 0 {
+		releaseHeldTexts(ctx, gproject, dsRefC, clientSMS, conversation, route.referral, route.text, filePatients)
+		return
+	}
+	if conversation.ReferralID != route.referral.ReferralID {
+		conversation.ReferralID = route.referral.ReferralID
+		saveConversation(ctx, dsRefC, conversation)
+	}
+	processPatientText(ctx, gproject, dsRefC, clientSMS, []contracts.DSReferral{route.referral}, route.text, filePatients, receivingCustomPhone)
+}
+
+// textRoute ... the referral a patient text is filed in with the texts held so far, or that it is held
+type textRoute struct {
+	referral contracts.DSReferral
+	// text is what is filed or held of the text, a menu choice or request is not
+	text string
+	hold bool
+	// menu the referral menu goes out with the held text
+	menu bool
+}
+
+// patientTextRoute ... with several open referrals on the number a text goes to the one the patient picks off
+// the menu, the one a C/R reply answers or the one the patient last texted about. Otherwise it is held and the
+// patient gets the menu. A menu takes a choice for SMS_MENU_WINDOW minutes, while it does texts that are not
+// a choice are held without sending it again, unless the patient asks for it.
+func patientTextRoute(conversation contracts.SMSConversation, matched []contracts.DSReferral, incomingText string, now time.Time) textRoute {
+	byID := make(map[string]contracts.DSReferral)
+	for _, dsReferral := range matched {
+		byID[dsReferral.ReferralID] = dsReferral
+	}
+	menuOpen := len(conversation.Candidates) > 0 &&
+		now.Sub(conversation.MenuSentOn) < time.Duration(constants.SMS_MENU_WINDOW)*time.Minute
+	if menuOpen {
+		if choice := menuChoice(incomingText, len(conversation.Candidates)); choice > 0 {
+			if dsReferral, ok := byID[conversation.Candidates[choice-1]]; ok {
+				// the number itself is not part of the conversation
+				return textRoute{referral: dsReferral}
+			}
+		}
+	}
+	reply := appointmentReply(incomingText)
+	switch {
+	case len(matched) == 1:
+		return textRoute{referral: matched[0], text: incomingText}
+	case strings.EqualFold(strings.TrimSpace(incomingText), constants.SMS_MENU_KEYWORD):
+		return textRoute{hold: true, menu: true}
+	case menuOpen:
+		return textRoute{text: incomingText, hold: true}
+	case reply != "" && appointmentReplyReferral(matched) != nil:
+		return textRoute{referral: *appointmentReplyReferral(matched), text: incomingText}
+	case byID[conversation.ReferralID].ReferralID != "":
+		return textRoute{referral: byID[conversation.ReferralID], text: incomingText}
+	}
+	return textRoute{text: incomingText, hold: true, menu: true}
+}
+
+// menuChoice ... the option a patient replied with, 0 when the text is not one of them
+func menuChoice(text string, options int) int {
+	choice, err := strconv.Atoi(strings.Trim(strings.TrimSpace(text), ".!#"))
+	if err != nil || choice < 1 || choice > options {
+		return 0
+	}
+	return choice
+}
+
+// appointmentReplyReferral ... the referral a C/R reply answers when only one has an upcoming appointment
+func appointmentReplyReferral(dsReferrals []contracts.DSReferral) *contracts.DSReferral {
+	var found *contracts.DSReferral
+	for i, dsReferral := range dsReferrals {
+		if dsReferral.Appointment.Status != contracts.AppointmentBooked || dsReferral.Appointment.Start.Before(time.Now()) {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = &dsReferrals[i]
+	}
+	return found
+}
+
+// patientText ... a message of the catalog that is not about one clinic's referral, in the patient's language
+func patientText(ctx context.Context, locale string, key string, vars map[string]string) string {
+	text, err := messages.Render(ctx, "", locale, key, vars)
+	if err != nil {
+		log.Errorf("Failed to render %s: %v", key, err.Error())
+		return ""
+	}
+	return text
+}
+
+// referralMenuItem ... the specialist of the referral, with when and by whom it was referred when the
+// patient has another referral to the same clinic
+func referralMenuItem(ctx context.Context, number int, dsReferral contracts.DSReferral, dsReferrals []contracts.DSReferral, locale string) string {
+	vars := map[string]string{
+		"Number":     strconv.Itoa(number),
+		"ClinicName": dsReferral.ToClinicName,
+	}
+	for _, other := range dsReferrals {
+		if other.ReferralID != dsReferral.ReferralID && strings.EqualFold(other.ToClinicName, dsReferral.ToClinicName) {
+			vars["ReferredOn"] = messages.FormatDate(dsReferral.CreatedOn, locale)
+			vars["ReferredBy"] = dsReferral.FromClinicName
+			break
+		}
+	}
+	return patientText(ctx, locale, messages.KeyReferralMenuItem, vars)
+}
+
+// sendReferralMenu ... asks the patient which referral they are texting about, oldest referral first
+func sendReferralMenu(ctx context.Context, clientSMS *sms.ClientSMS, conversation *contracts.SMSConversation, dsReferrals []contracts.DSReferral) {
+	sorted := make([]contracts.DSReferral, len(dsReferrals))
+	copy(sorted, dsReferrals)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedOn.Before(sorted[j].CreatedOn) })
+	locale := sorted[0].PreferredLanguage
+	conversation.Candidates = make([]string, 0)
+	items := ""
+	for i, dsReferral := range sorted {
+		conversation.Candidates = append(conversation.Candidates, dsReferral.ReferralID)
+		items += referralMenuItem(ctx, i+1, dsReferral, sorted, locale)
+	}
+	conversation.ReferralID = ""
+	conversation.MenuSentOn = time.Now()
+	if clientSMS == nil {
+		return
+	}
+	menu := patientText(ctx, locale, messages.KeyReferralMenu, map[string]string{
+		"PatientName": sorted[0].PatientFirstName,
+		"Items":       items,
+	})
+	if menu == "" {
+		return
+	}
+	err := clientSMS.SendSMS(conversation.ReceivingPhone, conversation.PatientPhone, menu)
+	if err != nil {
+		log.Errorf("Failed to send referral menu: %v", err.Error())
+	}
+}
+
+// holdPatientText ... keeps a text until the patient picks the referral, media is stored as the provider's
+// URLs do not last
+func holdPatientText(ctx context.Context, gproject string, conversation *contracts.SMSConversation, incomingText string, filePatients map[string][]byte) {
+	if strings.TrimSpace(incomingText) != "" {
+		conversation.PendingText = append(conversation.PendingText, incomingText)
+	}
+	if len(filePatients) == 0 {
+		return
+	}
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, gproject)
+	if err != nil {
+		log.Errorf("Failed to hold media of %s: %v", conversation.PatientPhone, err.Error())
+		return
+	}
+	stored := storeHeldFiles(ctx, storageC, conversation.Folder, filePatients, len(conversation.PendingFiles))
+	conversation.PendingFiles = append(conversation.PendingFiles, stored...)
+}
+
+// releaseHeldTexts ... files the held texts, with incomingText, in the referral the patient picked and makes
+// it the one the conversation is about
+func releaseHeldTexts(ctx context.Context, gproject string, dsRefC *datastoredb.DSReferral, clientSMS *sms.ClientSMS,
+	conversation *contracts.SMSConversation, dsReferral contracts.DSReferral, incomingText string, filePatients map[string][]byte) {
+	texts := conversation.PendingText
+	if strings.TrimSpace(incomingText) != "" {
+		texts = append(texts, incomingText)
+	}
+	files := make(map[string][]byte)
+	if len(conversation.PendingFiles) > 0 {
+		storageC := storage.NewStorageHandler()
+		err := storageC.InitializeStorageClient(ctx, gproject)
+		if err == nil {
+			files, err = readHeldFiles(ctx, storageC, conversation.Folder, conversation.PendingFiles)
+		}
+		if err != nil {
+			log.Errorf("Failed to read held media of %s: %v", conversation.PatientPhone, err.Error())
+			files = make(map[string][]byte)
+		}
+	}
+	for name, data := range filePatients {
+		files[name] = data
+	}
+	conversation.ReferralID = dsReferral.ReferralID
+	conversation.Candidates = nil
+	conversation.PendingText = nil
+	conversation.PendingFiles = nil
+	conversation.MenuSentOn = time.Time{}
+	saveConversation(ctx, dsRefC, conversation)
+	chosen := patientMessage(ctx, dsReferral, messages.KeyReferralMenuChosen, map[string]string{
+		"PatientName": dsReferral.PatientFirstName,
+	})
+	if clientSMS != nil && chosen != "" {
+		err := clientSMS.SendSMS(conversation.ReceivingPhone, conversation.PatientPhone, chosen)
+		if err != nil {
+			log.Errorf("Failed to confirm referral choice: %v", err.Error())
+		}
+	}
+	if len(texts) == 0 && len(files) == 0 {
+		return
+	}
+	processPatientText(ctx, gproject, dsRefC, clientSMS, []contracts.DSReferral{dsReferral}, strings.Join(texts, "\n"), files, conversation.ReceivingPhone)
+}
+
+func saveConversation(ctx context.Context, dsRefC *datastoredb.DSReferral, conversation *contracts.SMSConversation) {
+	conversation.UpdatedOn = time.Now()
+	err := dsRefC.SaveSMSConversation(ctx, *conversation)
+	if err != nil {
+		log.Errorf("Failed to save conversation of %s: %v", conversation.PatientPhone, err.Error())
+	}
+}
+
+// RefileMessage ... staff move a message filed in the wrong referral to another referral of the same
+// patient. It is retracted where it was, its documents are copied to the other referral.
+func RefileMessage(c *gin.Context) {
+	log.Infof("Refile referral message")
+	ctx := c.Request.Context()
+	referralID := c.Param("referralId")
+	messageID := c.Param("messageId")
+	var refile contracts.MessageRefile
+	err := c.ShouldBindWith(&refile, binding.JSON)
+	if err != nil || refile.ReferralID == "" || refile.ReferralID == referralID {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	referral, userEmail, _, dsRefC, ok := loadReferralForUser(c, referralID)
+	if !ok {
+		return
+	}
+	target, _, _, _, ok := loadReferralForUser(c, refile.ReferralID)
+	if !ok {
+		return
+	}
+	if !samePatient(*referral, *target) {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("referral %s is not of the same patient", target.ReferralID).Error(),
+			},
+		)
+		return
+	}
+	previous, updated, err := dsRefC.ReviseMessage(ctx, referralID, messageID, contracts.MessageRefiled, userEmail, func(comment *contracts.Comment) error {
+		if comment.Retracted {
+			return errMessageRetracted
+		}
+		comment.Retracted = true
+		comment.Text = ""
+		comment.Files = nil
+		comment.Media = nil
+		comment.PatientSMS = false
+		comment.RefiledTo = target.ReferralID
+		return nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errMessageRetracted:
+			status = http.StatusConflict
+		case datastore.ErrNoSuchEntity:
+			status = http.StatusNotFound
+		}
+		c.AbortWithStatusJSON(
+			status,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	moved := *previous
+	moved.Version = 0
+	moved.EditedOn = 0
+	if len(previous.Files) > 0 {
+		moved.Files, moved.Media = copyMessageDocuments(ctx, dsRefC, *referral, target, previous.Files)
+	}
+	err = dsRefC.CreateMessage(ctx, *target, []contracts.Comment{moved})
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	publishMessageRevision(*referral, *previous, *updated, contracts.MessageRetracted)
+	publishComments(*target, []contracts.Comment{moved})
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   moved,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// samePatient ... referrals of one patient, by phone or email
+func samePatient(a contracts.DSReferral, b contracts.DSReferral) bool {
+	return (a.PatientPhone != "" && a.PatientPhone == b.PatientPhone) ||
+		(a.PatientEmail != "" && strings.EqualFold(a.PatientEmail, b.PatientEmail))
+}
+
+// copyMessageDocuments ... ingests the documents of a message again in the target referral, the originals
+// stay with the referral they were sent to
+func copyMessageDocuments(ctx context.Context, dsRefC *datastoredb.DSReferral, from contracts.DSReferral, target *contracts.DSReferral,
+	names []string) ([]string, []contracts.Media) {
+	copiedNames := make([]string, 0)
+	copiedMedia := make([]contracts.Media, 0)
+	docs, err := dsRefC.GetDocuments(ctx, from.ReferralID)
+	if err != nil {
+		log.Errorf("Failed to copy documents of %s: %v", from.ReferralID, err.Error())
+		return copiedNames, copiedMedia
+	}
+	gproject := googleprojectlib.GetGoogleProjectID()
+	storageC := storage.NewStorageHandler()
+	err = storageC.InitializeStorageClient(ctx, gproject)
+	if err != nil {
+		log.Errorf("Failed to copy documents of %s: %v", from.ReferralID, err.Error())
+		return copiedNames, copiedMedia
+	}
+	pipeline := attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, inboundLimits())
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, doc := range docs {
+		if !wanted[doc.Name] {
+			continue
+		}
+		data, err := readStoredFile(ctx, storageC, path.Dir(doc.StoredKey), path.Base(doc.StoredKey))
+		if err != nil {
+			log.Errorf("Failed to copy document %s: %v", doc.Name, err.Error())
+			continue
+		}
+		copied, err := pipeline.Ingest(ctx, target.ReferralID, attachments.File{
+			Name:       doc.OriginalName,
+			Data:       data,
+			Source:     doc.Source,
+			Category:   doc.Category,
+			UploadedBy: doc.UploadedBy,
+		})
+		if err != nil {
+			log.Errorf("Failed to copy document %s: %v", doc.Name, err.Error())
+			continue
+		}
+		copiedNames = append(copiedNames, copied.Name)
+		copiedMedia = append(copiedMedia, attachments.Media(*copied))
+	}
+	if len(copiedNames) > 0 {
+		target.Documents = append(target.Documents, copiedNames...)
+		target.ModifiedOn = time.Now()
+		err = dsRefC.CreateReferral(ctx, *target)
+		if err != nil {
+			log.Errorf("Failed to add documents to %s: %v", target.ReferralID, err.Error())
+		}
+	}
+	return copiedNames, copiedMedia
+}
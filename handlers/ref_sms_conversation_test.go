@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+func TestMenuChoice(t *testing.T) {
+	tests := []struct {
+		text    string
+		options int
+		want    int
+	}{
+		{"1", 2, 1},
+		{" 2. ", 2, 2},
+		{"#2!", 3, 2},
+		{"3", 2, 0},
+		{"0", 2, 0},
+		{"-1", 2, 0},
+		{"two", 2, 0},
+		{"1 please", 2, 0},
+		{"", 2, 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, menuChoice(test.text, test.options), test.text)
+	}
+}
+
+func TestPatientTextRoute(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	ortho := contracts.DSReferral{ReferralID: "ref-1"}
+	endo := contracts.DSReferral{ReferralID: "ref-2"}
+	booked := endo
+	booked.Appointment = contracts.Appointment{Status: contracts.AppointmentBooked, Start: time.Now().Add(24 * time.Hour)}
+	both := []contracts.DSReferral{ortho, endo}
+	menu := contracts.SMSConversation{Candidates: []string{"ref-1", "ref-2"}, MenuSentOn: now.Add(-10 * time.Minute)}
+	expired := contracts.SMSConversation{Candidates: []string{"ref-1", "ref-2"}, MenuSentOn: now.Add(-2 * time.Hour)}
+	texting := contracts.SMSConversation{ReferralID: "ref-2"}
+
+	tests := []struct {
+		name         string
+		conversation contracts.SMSConversation
+		matched      []contracts.DSReferral
+		text         string
+		want         textRoute
+	}{
+		{"one referral", contracts.SMSConversation{}, []contracts.DSReferral{ortho}, "hello", textRoute{referral: ortho, text: "hello"}},
+		{"first text is held with the menu", contracts.SMSConversation{}, both, "hello", textRoute{text: "hello", hold: true, menu: true}},
+		{"choice off an open menu", menu, both, "2", textRoute{referral: endo}},
+		{"open menu is not sent again", menu, both, "hello?", textRoute{text: "hello?", hold: true}},
+		{"choice out of range", menu, both, "3", textRoute{text: "3", hold: true}},
+		{"patient asks for the menu", menu, both, "menu", textRoute{hold: true, menu: true}},
+		{"expired menu takes no choice", expired, both, "2", textRoute{text: "2", hold: true, menu: true}},
+		{"one referral left after the menu", menu, []contracts.DSReferral{endo}, "hello", textRoute{referral: endo, text: "hello"}},
+		{"referral last texted about", texting, both, "thanks", textRoute{referral: endo, text: "thanks"}},
+		{"reply to the one upcoming appointment", contracts.SMSConversation{}, []contracts.DSReferral{ortho, booked}, "C", textRoute{referral: booked, text: "C"}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, patientTextRoute(test.conversation, test.matched, test.text, now), test.name)
+	}
+}
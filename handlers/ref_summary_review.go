@@ -0,0 +1,701 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.sajari.com/docconv"
+	pe "github.com/DusanKasan/parsemail"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/extraction"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+var (
+	extractionTemplates     *extraction.Set
+	extractionTemplatesOnce sync.Once
+)
+
+// summaryTemplates ... extraction templates, read once. Without them every summary goes to review.
+func summaryTemplates() *extraction.Set {
+	extractionTemplatesOnce.Do(func() {
+		set, err := extraction.LoadTemplates(constants.EXTRACTION_TEMPLATES_DIR)
+		if err != nil {
+			log.Errorf("Failed to load extraction templates: %v", err.Error())
+			return
+		}
+		extractionTemplates = set
+	})
+	return extractionTemplates
+}
+
+// summaryText ... text of an attachment, PDFs with a text layer are read directly and anything else
+// goes through OCR
+func summaryText(file attachments.File) string {
+	if file.ContentType == "application/pdf" {
+		text, err := extraction.PDFText(file.Data)
+		if err == nil && strings.TrimSpace(text) != "" {
+			return text
+		}
+	}
+	res, err := docconv.Convert(bytes.NewReader(file.Data), file.ContentType, true)
+	if err != nil {
+		log.Errorf("deconv error: %v", err.Error())
+		return ""
+	}
+	return res.Body
+}
+
+// extractSummary ... the most confident extraction of the attachments and the text it was read from
+func extractSummary(domain string, files []attachments.File) (string, contracts.SummaryExtraction) {
+	templates := summaryTemplates()
+	bestText := ""
+	best := contracts.SummaryExtraction{Review: true}
+	for _, file := range files {
+		text := summaryText(file)
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		current := templates.Extract(domain, text, time.Now())
+		if bestText == "" || current.Confidence > best.Confidence {
+			bestText = text
+			best = current
+		}
+	}
+	return bestText, best
+}
+
+// summarySenderEmail ... address of the clinic that sent a summary. Penn's summaries come through
+// their mail filter, which rewrites the sender.
+func summarySenderEmail(parsedEmail pe.Email) string {
+	fromEmail := parsedEmail.From[0].Address
+	if strings.Contains(fromEmail, "cloud-protect.net") {
+		fromEmail = "info@penndios.com"
+	}
+	return fromEmail
+}
+
+// summarySenderClinic ... clinic with the sender's address, or else one on the sender's domain
+func summarySenderClinic(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, fromEmail string) (*contracts.PhysicalClinicMapLocation, error) {
+	if !strings.Contains(fromEmail, "@") {
+		return nil, fmt.Errorf("no clinic sends summaries from %s", fromEmail)
+	}
+	clinics, err := clinicDB.GetAllClinicsByEmail(ctx, fromEmail)
+	if err != nil || len(clinics) == 0 {
+		clinics, err = clinicDB.GetAllClinicsByDomain(ctx, fromEmail[strings.LastIndex(fromEmail, "@")+1:])
+	}
+	if err != nil || len(clinics) == 0 {
+		return nil, fmt.Errorf("no clinic sends summaries from %s", fromEmail)
+	}
+	return &clinics[0], nil
+}
+
+// summaryDentistClinic ... dentist whose auto summary address the email was sent to
+func summaryDentistClinic(ctx context.Context, clinicDB *datastoredb.DSClinicMeta, recipients []string) (*contracts.PhysicalClinicMapLocation, error) {
+	for _, recipient := range recipients {
+		// an empty address would match every clinic
+		if recipient == "" {
+			continue
+		}
+		clinics, err := clinicDB.GetAllClinicsByAutoEmail(ctx, recipient)
+		if err == nil && len(clinics) > 0 {
+			return &clinics[0], nil
+		}
+	}
+	return nil, fmt.Errorf("no clinic receives summaries at %s", strings.Join(recipients, ", "))
+}
+
+// summaryReferral ... summary referral between the clinic sending it and the dentist receiving it,
+// the sender is the To side as for any referral the dentist made
+func summaryReferral(sender contracts.PhysicalClinicMapLocation, dentist contracts.PhysicalClinicMapLocation) contracts.DSReferral {
+	var dsReferral contracts.DSReferral
+	dsReferral.IsSummary = true
+	dsReferral.ToAddressID = sender.AddressID
+	dsReferral.ToPlaceID = sender.PlaceID
+	dsReferral.ToClinicAddress = sender.Address
+	dsReferral.ToClinicName = sender.Name
+	dsReferral.ToClinicPhone = sender.PhoneNumber
+	dsReferral.ToEmail = sender.EmailAddress
+	dsReferral.FromAddressID = dentist.AddressID
+	dsReferral.FromEmail = dentist.EmailAddress
+	dsReferral.FromPlaceID = dentist.PlaceID
+	dsReferral.FromClinicAddress = dentist.Address
+	dsReferral.FromClinicName = dentist.Name
+	dsReferral.FromClinicPhone = dentist.PhoneNumber
+	currentRefUUID, _ := uuid.NewUUID()
+	dsReferral.ReferralID = currentRefUUID.String()
+	return dsReferral
+}
+
+// setSummaryPatient ... patient of the summary from the extraction, or from what a clinic confirmed
+func setSummaryPatient(dsReferral *contracts.DSReferral, firstName string, lastName string, dob contracts.DOB) {
+	dsReferral.PatientFirstName = firstName
+	dsReferral.PatientLastName = lastName
+	dsReferral.PatientDOBYear = dob.Year
+	dsReferral.PatientDOBMonth = dob.Month
+	dsReferral.PatientDOBDay = dob.Day
+}
+
+// extractedDOB ... DOB of an extracted 2006-01-02 date
+func extractedDOB(field contracts.ExtractedField) contracts.DOB {
+	date, err := time.Parse("2006-01-02", field.Value)
+	if err != nil {
+		return contracts.DOB{}
+	}
+	return contracts.DOB{
+		Year:  strconv.Itoa(date.Year()),
+		Month: strconv.Itoa(int(date.Month())),
+		Day:   strconv.Itoa(date.Day()),
+	}
+}
+
+// queueSummaryReview ... keeps the attachments of a summary whose patient could not be read and asks
+// both clinics to confirm it, nothing is filed until then
+func queueSummaryReview(ctx context.Context, storageC *storage.Client, dsRefC *datastoredb.DSReferral, dsReferral contracts.DSReferral,
+	files []attachments.File, senderEmail string, subject string, body string) error {
+	reviewUUID, _ := uuid.NewUUID()
+	review := contracts.SummaryReview{
+		ReviewID:      reviewUUID.String(),
+		Status:        contracts.SummaryReviewPending,
+		FromAddressID: dsReferral.FromAddressID,
+		ToAddressID:   dsReferral.ToAddressID,
+		SenderEmail:   senderEmail,
+		Subject:       subject,
+		Body:          body,
+		Folder:        constants.SUMMARY_REVIEW_FOLDER + "/" + reviewUUID.String(),
+		Files:         make([]string, 0),
+		SummaryText:   dsReferral.SummaryText,
+		Extraction:    dsReferral.Extraction,
+		CreatedOn:     time.Now(),
+	}
+	for i, file := range files {
+		name := strconv.Itoa(i) + "-" + attachments.SafeName(file.Name, file.ContentType)
+		err := storageC.WriteFile(ctx, constants.SD_REFERRAL_BUCKET, review.Folder+"/"+name, file.Data, file.ContentType)
+		if err != nil {
+			return err
+		}
+		review.Files = append(review.Files, name)
+	}
+	err := dsRefC.SaveSummaryReview(ctx, review)
+	if err != nil {
+		return err
+	}
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:     contracts.EventSummaryReview,
+		ReviewID: review.ReviewID,
+		Status:   review.Status,
+	}, review.FromAddressID, review.ToAddressID)
+	return nil
+}
+
+// fileAutoSummary ... adds the attachments of a summary to the patient's summary referral, created
+// with the first one, and to the patient's referral with the sender when there is one. The dentist is
+// emailed. It returns the ID of the summary referral.
+func fileAutoSummary(ctx context.Context, dsRefC *datastoredb.DSReferral, pipeline *attachments.Pipeline, dsReferral contracts.DSReferral,
+	dentist contracts.PhysicalClinicMapLocation, files []attachments.File, body string) (string, error) {
+	currentComments := make([]contracts.Comment, 0)
+	docIDNames := make([]string, 0)
+	docsMedia := make([]contracts.Media, 0)
+	log.Infof("PatientName: %s", dsReferral.PatientFirstName+dsReferral.PatientLastName)
+	// try to find existing patient summary
+	var existingReferralMain *contracts.DSReferral
+	var existingSummary *contracts.DSReferral
+	existingReferrals, err := dsRefC.GetReferralUsingFields(ctx, dsReferral.FromEmail, dsReferral.PatientFirstName, dsReferral.PatientLastName)
+	if err != nil {
+		log.Errorf("Error finding referrals of summary %s: %v", dsReferral.ReferralID, err.Error())
+	} else {
+		for i := range existingReferrals {
+			if !existingReferrals[i].IsSummary {
+				existingReferralMain = &existingReferrals[i]
+			} else {
+				existingSummary = &existingReferrals[i]
+			}
+		}
+	}
+	if existingReferralMain != nil {
+		mainDocNames := make([]string, 0)
+		for _, file := range files {
+			doc, err := pipeline.Ingest(ctx, existingReferralMain.ReferralID, file)
+			if err != nil {
+				return "", err
+			}
+			mainDocNames = append(mainDocNames, doc.Name)
+		}
+		if len(mainDocNames) > 0 {
+			existingReferralMain.Documents = append(existingReferralMain.Documents, mainDocNames...)
+		}
+	}
+	if existingSummary != nil {
+		// the latest summary's text and extraction replace those of the earlier ones
+		summaryText, summaryExtraction := dsReferral.SummaryText, dsReferral.Extraction
+		dob := contracts.DOB{Year: dsReferral.PatientDOBYear, Month: dsReferral.PatientDOBMonth, Day: dsReferral.PatientDOBDay}
+		dsReferral = *existingSummary
+		dsReferral.SummaryText = summaryText
+		dsReferral.Extraction = summaryExtraction
+		if dsReferral.PatientDOBYear == "" {
+			dsReferral.PatientDOBYear = dob.Year
+			dsReferral.PatientDOBMonth = dob.Month
+			dsReferral.PatientDOBDay = dob.Day
+		}
+	}
+	// stored only now so the files land in the folder of the summary they are added to
+	for _, file := range files {
+		doc, err := pipeline.Ingest(ctx, dsReferral.ReferralID, file)
+		if err != nil {
+			return "", err
+		}
+		docsMedia = append(docsMedia, attachments.Media(*doc))
+		docIDNames = append(docIDNames, doc.Name)
+	}
+	dsReferral.IsDirty = false
+	dsReferral.IsNew = false
+	dsReferral.Status.GDStatus = "completed"
+	dsReferral.Status.SPStatus = "completed"
+	location := clinicTimeLocation(dentist)
+	dsReferral.CreatedOn = time.Now().In(location)
+	dsReferral.ModifiedOn = time.Now().In(location)
+	dsReferral.StatusChangedOn = time.Now()
+	if len(docIDNames) > 0 {
+		var uploadComment contracts.Comment
+		uploadComment.Channel = contracts.GDCBox
+		if dsReferral.PatientEmail != "" {
+			uploadComment.UserID = dsReferral.PatientEmail
+		} else {
+			uploadComment.UserID = dsReferral.PatientPhone
+		}
+		id, _ := uuid.NewUUID()
+		uploadComment.MessageID = id.String()
+		uploadComment.Media = docsMedia
+		uploadComment.Files = docIDNames
+		uploadComment.Text = "New documents are uploaded by " + dsReferral.ToClinicName
+		uploadComment.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
+		currentComments = append(currentComments, uploadComment)
+	}
+
+	dsReferral.Documents = append(dsReferral.Documents, docIDNames...)
+	var comm contracts.Comment
+	id, _ := uuid.NewUUID()
+	comm.MessageID = id.String()
+	comm.Channel = contracts.GDCBox
+	comm.UserID = dsReferral.ToEmail
+	comm.Text = body
+	comm.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
+	currentComments = append(currentComments, comm)
+
+	err = dsRefC.CreateMessage(ctx, dsReferral, currentComments)
+	if err != nil {
+		log.Errorf("Error adding messages of summary %s: %v", dsReferral.ReferralID, err.Error())
+	} else {
+		publishComments(dsReferral, currentComments)
+	}
+	if existingReferralMain != nil {
+		err = dsRefC.CreateMessage(ctx, *existingReferralMain, currentComments)
+		if err != nil {
+			log.Errorf("Error adding messages of summary to %s: %v", existingReferralMain.ReferralID, err.Error())
+		} else {
+			publishComments(*existingReferralMain, currentComments)
+		}
+		existingReferralMain.ModifiedOn = time.Now()
+		err = dsRefC.CreateReferral(ctx, *existingReferralMain)
+		if err != nil {
+			log.Errorf("Error updating referral %s: %v", existingReferralMain.ReferralID, err.Error())
+		}
+	}
+	dsReferral.ModifiedOn = time.Now()
+
+	err = dsRefC.CreateReferral(ctx, dsReferral)
+	if err != nil {
+		return "", err
+	}
+	sgClient := sendgrid.NewSendGridClient()
+	err = sgClient.InitializeSendGridClient()
+	if err != nil {
+		log.Errorf("Error processing sms error:%v ", err.Error())
+	}
+	sendPatientComments := make([]string, 0)
+	for _, comment := range currentComments {
+		if comment.Channel == contracts.GDCBox && dsReferral.ToEmail != "" && comment.UserID == dsReferral.ToEmail {
+			sendPatientComments = append(sendPatientComments, comment.Text)
+		}
+	}
+	y, m, d := dsReferral.ModifiedOn.Date()
+	dateString := fmt.Sprintf("%d-%d-%d", y, int(m), d)
+	if dsReferral.FromEmail != "" {
+		err = notifyClinicAlert(ctx, contracts.EventSummaryReview, dsReferral, dsReferral.FromAddressID, dsReferral.FromEmail, dsReferral.FromClinicName,
+			"Treatment summary", withClinicName("A treatment summary was sent", " by ", dsReferral.ToClinicName), func() error {
+				return sgClient.SendAutoEmailNotificationToGD(dsReferral.FromEmail, dsReferral.FromClinicName,
+					dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName, dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
+			})
+		if err != nil {
+			log.Errorf("Failed to send email: %v", err.Error())
+		}
+	} else {
+
+		sgClient.SendAutoEmailNotificationToGD(constants.SD_ADMIN_EMAIL, dsReferral.FromClinicName,
+			dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName, dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
+
+	}
+	return dsReferral.ReferralID, nil
+}
+
+// ListSummaryReviews ... pending reviews of the user's clinics, or only of the addressId one
+func ListSummaryReviews(c *gin.Context) {
+	log.Infof("List Summary Reviews")
+	ctx := c.Request.Context()
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	adminClinics, err := clinicDB.GetAllClinics(ctx, userEmail, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	onlyAddressID := c.Query("addressId")
+	addressIDs := make([]string, 0)
+	for _, clinic := range adminClinics {
+		if clinic.AddressID == "" || (onlyAddressID != "" && clinic.AddressID != onlyAddressID) {
+			continue
+		}
+		addressIDs = append(addressIDs, clinic.AddressID)
+	}
+	if len(addressIDs) == 0 {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	reviews := make([]contracts.SummaryReview, 0)
+	seen := make(map[string]bool)
+	for _, addressID := range addressIDs {
+		clinicReviews, err := dsRefC.GetPendingSummaryReviews(ctx, addressID)
+		if err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: err.Error(),
+				},
+			)
+			return
+		}
+		for _, review := range clinicReviews {
+			if !seen[review.ReviewID] {
+				seen[review.ReviewID] = true
+				reviews = append(reviews, review)
+			}
+		}
+	}
+	sort.Slice(reviews, func(i, j int) bool { return reviews[i].CreatedOn.Before(reviews[j].CreatedOn) })
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   reviews,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// loadSummaryReviewForUser ... the review if the user administers the dentist or the sender of the
+// summary, otherwise it aborts the request
+func loadSummaryReviewForUser(c *gin.Context, reviewID string) (*contracts.SummaryReview, string, *datastoredb.DSReferral, *datastoredb.DSClinicMeta, bool) {
+	ctx := c.Request.Context()
+	userEmail, userID, gproject, err := getUserDetails(ctx, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, nil, false
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, nil, false
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, nil, false
+	}
+	review, err := dsRefC.GetSummaryReview(ctx, reviewID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return nil, "", nil, nil, false
+	}
+	if !isClinicAdmin(ctx, clinicDB, userEmail, userID, review.FromAddressID) &&
+		!isClinicAdmin(ctx, clinicDB, userEmail, userID, review.ToAddressID) {
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Unauthorized access: aborting").Error(),
+			},
+		)
+		return nil, "", nil, nil, false
+	}
+	return review, userEmail, dsRefC, clinicDB, true
+}
+
+// GetSummaryReview ... one review with the extraction and the text it was read from
+func GetSummaryReview(c *gin.Context) {
+	log.Infof("Get Summary Review")
+	review, _, _, _, ok := loadSummaryReviewForUser(c, c.Param("reviewId"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   review,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
+
+// ApproveSummaryReview ... files a reviewed summary under the patient the clinic confirmed
+func ApproveSummaryReview(c *gin.Context) {
+	log.Infof("Approve Summary Review")
+	ctx := c.Request.Context()
+	var decision contracts.SummaryReviewDecision
+	if err := c.ShouldBindWith(&decision, binding.JSON); err != nil ||
+		strings.TrimSpace(decision.PatientFirstName) == "" || strings.TrimSpace(decision.PatientLastName) == "" {
+		c.AbortWithStatusJSON(
+			http.StatusBadRequest,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad data sent to backened").Error(),
+			},
+		)
+		return
+	}
+	review, userEmail, dsRefC, clinicDB, ok := loadSummaryReviewForUser(c, c.Param("reviewId"))
+	if !ok {
+		return
+	}
+	if review.Status != contracts.SummaryReviewPending {
+		c.AbortWithStatusJSON(
+			http.StatusConflict,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("summary review is %s", review.Status).Error(),
+			},
+		)
+		return
+	}
+	dentist, err := clinicDB.GetSingleClinic(ctx, review.FromAddressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	sender, err := clinicDB.GetSingleClinic(ctx, review.ToAddressID)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusNotFound,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	storageC := storage.NewStorageHandler()
+	err = storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	files := make([]attachments.File, 0)
+	for _, name := range review.Files {
+		fileReader, err := storageC.DownloadSingleFile(ctx, review.Folder, constants.SD_REFERRAL_BUCKET, name)
+		if err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: err.Error(),
+				},
+			)
+			return
+		}
+		data, err := ioutil.ReadAll(fileReader)
+		contentType := fileReader.Attrs.ContentType
+		fileReader.Close()
+		if err != nil {
+			c.AbortWithStatusJSON(
+				http.StatusInternalServerError,
+				gin.H{
+					constants.RESPONSE_JSON_DATA:   nil,
+					constants.RESPONSDE_JSON_ERROR: err.Error(),
+				},
+			)
+			return
+		}
+		// the files were validated when the summary came in
+		files = append(files, attachments.File{
+			Name:        name[strings.Index(name, "-")+1:],
+			Data:        data,
+			Source:      contracts.DocumentSourceEmail,
+			Category:    contracts.DocumentCategorySummary,
+			UploadedBy:  review.SenderEmail,
+			ContentType: contentType,
+		})
+	}
+	dsReferral := summaryReferral(*sender, *dentist)
+	setSummaryPatient(&dsReferral, strings.TrimSpace(decision.PatientFirstName), strings.TrimSpace(decision.PatientLastName), decision.PatientDOB)
+	dsReferral.SummaryText = review.SummaryText
+	dsReferral.Extraction = review.Extraction
+	pipeline := attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, inboundLimits())
+	referralID, err := fileAutoSummary(ctx, dsRefC, pipeline, dsReferral, *dentist, files, review.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	review.Status = contracts.SummaryReviewApproved
+	review.ReferralID = referralID
+	review.ReviewedBy = userEmail
+	review.ReviewedOn = time.Now()
+	sendSummaryReview(c, dsRefC, *review)
+}
+
+// RejectSummaryReview ... drops a summary that does not belong to any patient of the clinics
+func RejectSummaryReview(c *gin.Context) {
+	log.Infof("Reject Summary Review")
+	review, userEmail, dsRefC, _, ok := loadSummaryReviewForUser(c, c.Param("reviewId"))
+	if !ok {
+		return
+	}
+	if review.Status != contracts.SummaryReviewPending {
+		c.AbortWithStatusJSON(
+			http.StatusConflict,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("summary review is %s", review.Status).Error(),
+			},
+		)
+		return
+	}
+	review.Status = contracts.SummaryReviewRejected
+	review.ReviewedBy = userEmail
+	review.ReviewedOn = time.Now()
+	sendSummaryReview(c, dsRefC, *review)
+}
+
+// sendSummaryReview ... saves the decision on the review and tells both clinics
+func sendSummaryReview(c *gin.Context, dsRefC *datastoredb.DSReferral, review contracts.SummaryReview) {
+	ctx := c.Request.Context()
+	err := dsRefC.SaveSummaryReview(ctx, review)
+	if err != nil {
+		c.AbortWithStatusJSON(
+			http.StatusInternalServerError,
+			gin.H{
+				constants.RESPONSE_JSON_DATA:   nil,
+				constants.RESPONSDE_JSON_ERROR: err.Error(),
+			},
+		)
+		return
+	}
+	publishClinicEvent(ctx, contracts.ClinicEvent{
+		Type:       contracts.EventSummaryReview,
+		ReviewID:   review.ReviewID,
+		ReferralID: review.ReferralID,
+		Status:     review.Status,
+	}, review.FromAddressID, review.ToAddressID)
+	c.JSON(http.StatusOK, gin.H{
+		constants.RESPONSE_JSON_DATA:   review,
+		constants.RESPONSDE_JSON_ERROR: nil,
+	})
+}
@@ -1,26 +1,20 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/google/uuid"
 	"gopkg.in/ugjka/go-tz.v2/tz"
 
-	"code.sajari.com/docconv"
 	pe "github.com/DusanKasan/parsemail"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
@@ -29,9 +23,11 @@ import (
 	"github.com/superdentist/superdentist-backend/contracts"
 	"github.com/superdentist/superdentist-backend/global"
 	"github.com/superdentist/superdentist-backend/helpers"
+	"github.com/superdentist/superdentist-backend/lib/attachments"
 	"github.com/superdentist/superdentist-backend/lib/datastoredb"
-	"github.com/superdentist/superdentist-backend/lib/gmaps"
 	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/mailthread"
+	"github.com/superdentist/superdentist-backend/lib/messages"
 	"github.com/superdentist/superdentist-backend/lib/sendgrid"
 	"github.com/superdentist/superdentist-backend/lib/sms"
 	"github.com/superdentist/superdentist-backend/lib/storage"
@@ -272,6 +268,15 @@ func UpdateReferralStatus(c *gin.Context) {
 			dsReferral.ToAddressID = toClinic.AddressID
 		}
 	}
+	statusChanged := dsReferral.Status != referralDetails.Status
+	if statusChanged {
+		// a status move restarts the SLA clock and clears any escalation
+		dsReferral.StatusChangedOn = time.Now()
+		dsReferral.Overdue = false
+		dsReferral.OverdueRule = ""
+		dsReferral.EscalationLevel = contracts.EscalationNone
+		dsReferral.LastEscalatedOn = time.Time{}
+	}
 	dsReferral.Status = referralDetails.Status
 
 	if err == nil && toClinic != nil {
@@ -296,6 +301,14 @@ func UpdateReferralStatus(c *gin.Context) {
 		)
 		return
 	}
+	if statusChanged {
+		publishClinicEvent(ctx, contracts.ClinicEvent{
+			Type:       contracts.EventReferralStatus,
+			ReferralID: dsReferral.ReferralID,
+			Status:     dsReferral.Status.SPStatus,
+		}, dsReferral.FromAddressID, dsReferral.ToAddressID)
+		pushReferralEvent(ctx, contracts.EventReferralStatus, *dsReferral, "", "")
+	}
 	if strings.ToLower(dsReferral.Status.SPStatus) == "completed" || strings.ToLower(dsReferral.Status.SPStatus) == "complete" {
 		sgClient := sendgrid.NewSendGridClient()
 		err = sgClient.InitializeSendGridClient()
@@ -328,8 +341,14 @@ func UpdateReferralStatus(c *gin.Context) {
 				sendPatientComments = append(sendPatientComments, comment.Text)
 			}
 		}
-		err = sgClient.SendCompletionEmailToGD(dsReferral.FromEmail, dsReferral.FromClinicName,
-			dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName, dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
+		err = notifyClinicEmail(ctx, contracts.EventReferralStatus, *dsReferral, dsReferral.FromAddressID, dsReferral.FromEmail, dsReferral.FromClinicName,
+			withClinicName("Your referral was completed", " at ", dsReferral.ToClinicName), func() error {
+				return sgClient.SendCompletionEmailToGD(dsReferral.FromEmail, dsReferral.FromClinicName,
+					dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName, dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
+			})
+		if err != nil {
+			log.Errorf("Failed to send email: %v", err.Error())
+		}
 	}
 	c.JSON(http.StatusOK, gin.H{
 		constants.RESPONSE_JSON_DATA:   dsReferral,
@@ -498,109 +517,26 @@ func UploadDocuments(c *gin.Context) {
 
 	// Stage 2 Upload files from
 	// parse request
-	const _24K = 256 << 20
-	if err = c.Request.ParseMultipartForm(_24K); err == nil {
-		for _, fheaders := range c.Request.MultipartForm.File {
-			for _, hdr := range fheaders {
-				// open uploaded
-				var infile multipart.File
-				if infile, err = hdr.Open(); err != nil {
-
-					c.AbortWithStatusJSON(
-						http.StatusBadRequest,
-						gin.H{
-							constants.RESPONSE_JSON_DATA:   nil,
-							constants.RESPONSDE_JSON_ERROR: fmt.Errorf("Bad files sent to backend"),
-						},
-					)
-					return
-				}
-				fileName := hdr.Filename
-				reader, err := storageC.DownloadSingleFile(ctx, referralID, constants.SD_REFERRAL_BUCKET, fileName)
-				if err == nil && reader != nil {
-					timeNow := time.Now()
-					stripFile := strings.Split(fileName, ".")
-					name := stripFile[0]
-					name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-					fileName = name + "." + stripFile[len(stripFile)-1]
-				}
-				bucketPath := referralID + "/" + fileName
-				buckerW, err := storageC.UploadToGCS(ctx, bucketPath)
-				if err != nil {
-					c.AbortWithStatusJSON(
-						http.StatusInternalServerError,
-						gin.H{
-							constants.RESPONSE_JSON_DATA:   nil,
-							constants.RESPONSDE_JSON_ERROR: err.Error(),
-						},
-					)
-					return
-				}
-				imageBuffer := bytes.NewBuffer(nil)
-				if _, err := io.Copy(imageBuffer, infile); err != nil {
-					c.AbortWithStatusJSON(
-						http.StatusInternalServerError,
-						gin.H{
-							constants.RESPONSE_JSON_DATA:   nil,
-							constants.RESPONSDE_JSON_ERROR: err.Error(),
-						},
-					)
-					return
-				}
-				currentBytes := imageBuffer.Bytes()
-				_, err = io.Copy(buckerW, bytes.NewReader(currentBytes))
-				if err != nil {
-					c.AbortWithStatusJSON(
-						http.StatusInternalServerError,
-						gin.H{
-							constants.RESPONSE_JSON_DATA:   nil,
-							constants.RESPONSDE_JSON_ERROR: err.Error(),
-						},
-					)
-					return
-				}
-				buckerW.Close()
-				extentionFile := strings.Split(fileName, ".")
-				ext := extentionFile[len(extentionFile)-1]
-				var docMedia contracts.Media
-				docMedia.Name = fileName
-				docMedia.Image = ""
-				switch strings.ToLower(ext) {
-				case "jpg", "jpeg":
-					img, err := jpeg.Decode(bytes.NewReader(currentBytes))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				case "png":
-					img, err := png.Decode(bytes.NewReader(currentBytes))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				}
-				docsMedia = append(docsMedia, docMedia)
-				docIDNames = append(docIDNames, fileName)
+	documentFiles, ok := parseUploads(c, uploadLimits(), contracts.DocumentSourceWeb, userEmail)
+	if !ok {
+		return
+	}
+	if len(documentFiles) > 0 {
+		pipeline := attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, uploadLimits())
+		for _, file := range documentFiles {
+			doc, err := pipeline.Ingest(ctx, referralID, file)
+			if err != nil {
+				c.AbortWithStatusJSON(
+					http.StatusInternalServerError,
+					gin.H{
+						constants.RESPONSE_JSON_DATA:   nil,
+						constants.RESPONSDE_JSON_ERROR: err.Error(),
+					},
+				)
+				return
 			}
-		}
-		err = storageC.ZipFile(ctx, referralID, constants.SD_REFERRAL_BUCKET)
-		if err != nil {
-			c.AbortWithStatusJSON(
-				http.StatusInternalServerError,
-				gin.H{
-					constants.RESPONSE_JSON_DATA:   nil,
-					constants.RESPONSDE_JSON_ERROR: err.Error(),
-				},
-			)
-			return
+			docsMedia = append(docsMedia, attachments.Media(*doc))
+			docIDNames = append(docIDNames, doc.Name)
 		}
 	}
 
@@ -616,6 +552,12 @@ func UploadDocuments(c *gin.Context) {
 		)
 		return
 	}
+	if len(docIDNames) > 0 {
+		publishClinicEvent(ctx, contracts.ClinicEvent{
+			Type:       contracts.EventDocumentUploaded,
+			ReferralID: dsReferral.ReferralID,
+		}, dsReferral.FromAddressID, dsReferral.ToAddressID)
+	}
 	var refComments contracts.ReferralComments
 	//commentReasons.Files = docIDNames
 	commentReasons.Media = docsMedia
@@ -638,12 +580,18 @@ func UploadDocuments(c *gin.Context) {
 	})
 }
 
-// DownloadDocumentsAsZip .....
+// DownloadDocumentsAsZip ..... streams a zip of the referral documents, all of them or those picked with
+// documentIds, built as it is sent. With signed=true the zip is stored in the bucket first and it responds
+// with a short lived URL of it.
 func DownloadDocumentsAsZip(c *gin.Context) {
 	log.Infof("Download Referral Documents")
 	ctx := c.Request.Context()
 	referralID := c.Param("referralId")
-	_, _, gproject, err := getUserDetails(ctx, c.Request)
+	referral, _, _, dsRefC, ok := loadReferralForUser(c, referralID)
+	if !ok {
+		return
+	}
+	docs, err := dsRefC.GetDocuments(ctx, referral.ReferralID)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -654,11 +602,15 @@ func DownloadDocumentsAsZip(c *gin.Context) {
 		)
 		return
 	}
-	storageC := storage.NewStorageHandler()
-	err = storageC.InitializeStorageClient(ctx, gproject)
+	versions, err := dsRefC.GetReferralDocumentVersions(ctx, referral.ReferralID)
+	if err != nil {
+		log.Errorf("Failed to get document versions of %s: %v", referral.ReferralID, err.Error())
+	}
+	documentIDs := documentIDsQuery(c)
+	entries, err := referralZipEntries(*referral, docs, versions, documentIDs)
 	if err != nil {
 		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
+			http.StatusNotFound,
 			gin.H{
 				constants.RESPONSE_JSON_DATA:   nil,
 				constants.RESPONSDE_JSON_ERROR: err.Error(),
@@ -666,7 +618,8 @@ func DownloadDocumentsAsZip(c *gin.Context) {
 		)
 		return
 	}
-	zipReader, err := storageC.DownloadAsZip(ctx, referralID, constants.SD_REFERRAL_BUCKET)
+	storageC := storage.NewStorageHandler()
+	err = storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -677,41 +630,35 @@ func DownloadDocumentsAsZip(c *gin.Context) {
 		)
 		return
 	}
-	fileNameDefault := referralID + ".zip"
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileNameDefault))
-	c.Header("Content-Type", "application/zip")
-
-	if _, err := io.Copy(c.Writer, zipReader); err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{
-				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
-			},
-		)
+	if c.Query("signed") == "true" {
+		sendSignedZip(c, storageC, referral.ReferralID, entries)
 		return
 	}
+	streamZip(c, storageC, constants.SD_REFERRAL_BUCKET, referral.ReferralID+".zip", entries)
 }
 
-// DownloadSingleFile .....
+// DownloadSingleFile ..... streams one document of the referral, or with signed=true responds with a
+// short lived URL of it
 func DownloadSingleFile(c *gin.Context) {
 	log.Infof("Download Referral Documents")
 	ctx := c.Request.Context()
 	referralID := c.Param("referralId")
 	fileName := c.Query("fileName")
-	_, _, gproject, err := getUserDetails(ctx, c.Request)
-	if err != nil {
+	if fileName == "" || strings.Contains(fileName, "/") {
 		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
+			http.StatusBadRequest,
 			gin.H{
 				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
+				constants.RESPONSDE_JSON_ERROR: fmt.Errorf("invalid file name %q", fileName).Error(),
 			},
 		)
 		return
 	}
+	if _, _, _, _, ok := loadReferralForUser(c, referralID); !ok {
+		return
+	}
 	storageC := storage.NewStorageHandler()
-	err = storageC.InitializeStorageClient(ctx, gproject)
+	err := storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -722,6 +669,10 @@ func DownloadSingleFile(c *gin.Context) {
 		)
 		return
 	}
+	if c.Query("signed") == "true" {
+		sendSignedDownload(c, storageC, constants.SD_REFERRAL_BUCKET, referralID+"/"+fileName, fileName)
+		return
+	}
 	fileReader, err := storageC.DownloadSingleFile(ctx, referralID, constants.SD_REFERRAL_BUCKET, fileName)
 	if err != nil {
 		c.AbortWithStatusJSON(
@@ -763,7 +714,7 @@ func GetAllReferralsGD(c *gin.Context) {
 		cursor, _ = helpers.DecryptAndDecode(cursor)
 	}
 	ctx := c.Request.Context()
-	_, _, gproject, err := getUserDetails(ctx, c.Request)
+	userEmail, _, gproject, err := getUserDetails(ctx, c.Request)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -836,6 +787,7 @@ func GetAllReferralsGD(c *gin.Context) {
 				dsReferrals = append(dsReferrals, ref)
 			}
 		}
+		listingUnreadCounts(ctx, dsRefC, dsReferrals, userEmail, false)
 		c.JSON(http.StatusOK, gin.H{
 			constants.RESPONSE_JSON_DATA:   dsReferrals,
 			constants.RESPONSDE_JSON_ERROR: nil,
@@ -866,6 +818,7 @@ func GetAllReferralsGD(c *gin.Context) {
 				dsReferrals = append(dsReferrals, ref)
 			}
 		}
+		listingUnreadCounts(ctx, dsRefC, dsReferrals, userEmail, false)
 		var allReferrals contracts.AllReferrals
 		allReferrals.Referralls = dsReferrals
 		allReferrals.CursorNext, _ = helpers.EncryptAndEncode(cursor)
@@ -891,7 +844,7 @@ func GetAllReferralsSP(c *gin.Context) {
 		cursor, _ = helpers.DecryptAndDecode(cursor)
 	}
 	ctx := c.Request.Context()
-	_, _, gproject, err := getUserDetails(ctx, c.Request)
+	userEmail, _, gproject, err := getUserDetails(ctx, c.Request)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -949,6 +902,7 @@ func GetAllReferralsSP(c *gin.Context) {
 			)
 			return
 		}
+		listingUnreadCounts(ctx, dsRefC, dsReferrals, userEmail, true)
 		c.JSON(http.StatusOK, gin.H{
 			constants.RESPONSE_JSON_DATA:   dsReferrals,
 			constants.RESPONSDE_JSON_ERROR: nil,
@@ -965,6 +919,7 @@ func GetAllReferralsSP(c *gin.Context) {
 			)
 			return
 		}
+		listingUnreadCounts(ctx, dsRefC, dsReferrals, userEmail, true)
 		var allReferrals contracts.AllReferrals
 		allReferrals.Referralls = dsReferrals
 		allReferrals.CursorNext, _ = helpers.EncryptAndEncode(cursor)
@@ -1019,6 +974,7 @@ func GetOneReferral(c *gin.Context) {
 		)
 		return
 	}
+	dsReferral.SMSConsent = smsConsent(ctx, dsRefC, dsReferral.PatientPhone)
 	c.JSON(http.StatusOK, gin.H{
 		constants.RESPONSE_JSON_DATA:   dsReferral,
 		constants.RESPONSDE_JSON_ERROR: nil,
@@ -1028,17 +984,14 @@ func GetOneReferral(c *gin.Context) {
 // ReceiveReferralMail ...
 func ReceiveReferralMail(c *gin.Context) {
 	log.Infof("Referral Email Receieved")
-	const _24K = 256 << 20
-	err := c.Request.ParseMultipartForm(_24K)
-	emails := c.Request.MultipartForm.Value["email"][0]
-	log.Errorf(emails)
-	parsedEmail, err := pe.Parse(strings.NewReader(emails))
-	fromEmail := parsedEmail.From[0].Address
-	subject := parsedEmail.Subject
+	emails, ok := inboundRawEmail(c)
+	if !ok {
+		return
+	}
 	ctx := c.Request.Context()
 	gproject := googleprojectlib.GetGoogleProjectID()
 	dsRefC := datastoredb.NewReferralHandler()
-	err = dsRefC.InitializeDataBase(ctx, gproject)
+	err := dsRefC.InitializeDataBase(ctx, gproject)
 	if err != nil {
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
@@ -1049,25 +1002,22 @@ func ReceiveReferralMail(c *gin.Context) {
 		)
 		return
 	}
-	dsReferral, err := dsRefC.GetReferral(ctx, subject)
+	parsedEmail, err := pe.Parse(strings.NewReader(emails))
+	if err != nil || len(parsedEmail.From) == 0 {
+		quarantineEmail(ctx, dsRefC, contracts.QuarantineReferralMail, emails, parsedEmail, fmt.Sprintf("cannot parse email: %v", err))
+		return
+	}
+	fromEmail := parsedEmail.From[0].Address
+	subject := parsedEmail.Subject
+	dsReferral, err := replyReferral(ctx, dsRefC, inboundRecipients(c, parsedEmail), subject, fromEmail)
 	if err != nil {
-		dsReferralAll, err := dsRefC.GetReferralFromEmail(ctx, fromEmail)
-		if err != nil {
-			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-			return
-		}
-		dsReferral = &dsReferralAll[0]
+		log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+		quarantineEmail(ctx, dsRefC, contracts.QuarantineReferralMail, emails, parsedEmail, err.Error())
+		return
 	}
-	currentBody := parsedEmail.TextBody
-	currentComments := make([]contracts.Comment, 0)
-	docIDNames := make([]string, 0)
-	docsMedia := make([]contracts.Media, 0)
-
-	// Stage 2 Upload files from
-	// parse request
-	storageC := storage.NewStorageHandler()
-	err = storageC.InitializeStorageClient(ctx, gproject)
+	err = processReferralMail(ctx, gproject, dsRefC, parsedEmail, dsReferral)
 	if err != nil {
+		log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
 			gin.H{
@@ -1075,128 +1025,63 @@ func ReceiveReferralMail(c *gin.Context) {
 				constants.RESPONSDE_JSON_ERROR: err.Error(),
 			},
 		)
-		return
 	}
-	for _, attach := range parsedEmail.Attachments {
-		fileName := attach.Filename
-		reader, err := storageC.DownloadSingleFile(ctx, dsReferral.ReferralID, constants.SD_REFERRAL_BUCKET, fileName)
-		if err == nil && reader != nil {
-			timeNow := time.Now()
-			stripFile := strings.Split(fileName, ".")
-			name := stripFile[0]
-			name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-			fileName = name + "." + stripFile[len(stripFile)-1]
-		}
-		bucketPath := dsReferral.ReferralID + "/" + fileName
-		buckerW, err := storageC.UploadToGCS(ctx, bucketPath)
-		if err != nil {
-			c.AbortWithStatusJSON(
-				http.StatusInternalServerError,
-				gin.H{
-					constants.RESPONSE_JSON_DATA:   nil,
-					constants.RESPONSDE_JSON_ERROR: err.Error(),
-				},
-			)
-			return
-		}
-		imageBuffer := bytes.NewBuffer(nil)
-		if _, err := io.Copy(imageBuffer, attach.Data); err != nil {
-			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+}
 
-		}
-		currentBytes := imageBuffer.Bytes()
-		_, err = io.Copy(buckerW, bytes.NewReader(currentBytes))
+// processReferralMail ... adds an email and its attachments to the referral it answers and lets the
+// other side know
+func processReferralMail(ctx context.Context, gproject string, dsRefC *datastoredb.DSReferral, parsedEmail pe.Email, dsReferral *contracts.DSReferral) error {
+	fromEmail := parsedEmail.From[0].Address
+	subject := parsedEmail.Subject
+	channel, senderID, senderName := replySender(*dsReferral, fromEmail)
+	currentBody := mailthread.StripQuoted(parsedEmail.TextBody)
+	currentComments := make([]contracts.Comment, 0)
+	docIDNames := make([]string, 0)
+	docsMedia := make([]contracts.Media, 0)
+
+	// Stage 2 Upload files from
+	// parse request
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, gproject)
+	if err != nil {
+		return err
+	}
+	pipeline := attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, inboundLimits())
+	for _, attach := range parsedEmail.Attachments {
+		currentBytes, err := ioutil.ReadAll(attach.Data)
 		if err != nil {
 			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+			continue
 		}
-		buckerW.Close()
-		extentionFile := strings.Split(fileName, ".")
-		ext := extentionFile[len(extentionFile)-1]
-		var docMedia contracts.Media
-		docMedia.Name = fileName
-		docMedia.Image = ""
-		switch strings.ToLower(ext) {
-		case "jpg", "jpeg":
-			img, err := jpeg.Decode(bytes.NewReader(currentBytes))
-			if err == nil {
-				resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-				buf := bytes.NewBuffer(nil)
-				err := jpeg.Encode(buf, resized, nil)
-				if err != nil {
-					docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-				}
-			}
-		case "png":
-			img, err := png.Decode(bytes.NewReader(currentBytes))
-			if err == nil {
-				resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-				buf := bytes.NewBuffer(nil)
-				err := jpeg.Encode(buf, resized, nil)
-				if err != nil {
-					docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-				}
-			}
+		doc, err := pipeline.Ingest(ctx, dsReferral.ReferralID, attachments.File{
+			Name:       attach.Filename,
+			Data:       currentBytes,
+			Source:     contracts.DocumentSourceEmail,
+			UploadedBy: fromEmail,
+		})
+		if _, refused := err.(*attachments.ValidationError); refused {
+			log.Errorf("Attachment refused from email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+			continue
 		}
-		docsMedia = append(docsMedia, docMedia)
-		docIDNames = append(docIDNames, fileName)
-	}
-	clinicMetaDB := datastoredb.NewClinicMetaHandler()
-	err = clinicMetaDB.InitializeDataBase(ctx, gproject)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{
-				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
-			},
-		)
-		return
-	}
-	currentDS := dsReferral.ToPlaceID
-	latLong := contracts.ClinicLocation{}
-	getClinic, err := clinicMetaDB.GetSingleClinicViaPlace(ctx, currentDS)
-	if err == nil && getClinic.PhysicalClinicsRegistration.Name != "" {
-		latLong = getClinic.Location
-	} else {
-		mapClient := gmaps.NewMapsHandler()
-		err = mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
 		if err != nil {
-			c.AbortWithStatusJSON(
-				http.StatusInternalServerError,
-				gin.H{
-					constants.RESPONSE_JSON_DATA:   nil,
-					constants.RESPONSDE_JSON_ERROR: err.Error(),
-				},
-			)
+			return err
 		}
-		details, _ := mapClient.FindPlaceFromID(currentDS)
-		latLong.Lat = details.Geometry.Location.Lat
-		latLong.Long = details.Geometry.Location.Lng
+		docsMedia = append(docsMedia, attachments.Media(*doc))
+		docIDNames = append(docIDNames, doc.Name)
 	}
-	zone, err := tz.GetZone(tz.Point{
-		Lon: latLong.Long, Lat: latLong.Lat,
-	})
-	location, _ := time.LoadLocation(zone[0])
+	location := placeTimeLocation(ctx, gproject, dsReferral.ToPlaceID)
 
 	if len(docIDNames) > 0 {
 		var uploadComment contracts.Comment
-		uploadComment.Channel = contracts.SPCBox
-		if dsReferral.PatientEmail != "" {
-			uploadComment.UserID = dsReferral.PatientEmail
-		} else {
-			uploadComment.UserID = dsReferral.PatientPhone
-		}
+		uploadComment.Channel = channel
+		uploadComment.UserID = senderID
 		id, _ := uuid.NewUUID()
 		uploadComment.MessageID = id.String()
 		uploadComment.Media = docsMedia
 		uploadComment.Files = docIDNames
-		uploadComment.Text = "New documents are uploaded by " + dsReferral.PatientFirstName + " " + dsReferral.PatientLastName
+		uploadComment.Text = "New documents are uploaded by " + senderName
 		uploadComment.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
 		currentComments = append(currentComments, uploadComment)
-		err = storageC.ZipFile(ctx, dsReferral.ReferralID, constants.SD_REFERRAL_BUCKET)
-		if err != nil {
-			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-		}
 	}
 
 	dsReferral.Documents = append(dsReferral.Documents, docIDNames...)
@@ -1204,12 +1089,8 @@ func ReceiveReferralMail(c *gin.Context) {
 	var comm contracts.Comment
 	id, _ := uuid.NewUUID()
 	comm.MessageID = id.String()
-	comm.Channel = contracts.SPCBox
-	if dsReferral.PatientEmail != "" {
-		comm.UserID = dsReferral.PatientEmail
-	} else {
-		comm.UserID = dsReferral.PatientPhone
-	}
+	comm.Channel = channel
+	comm.UserID = senderID
 	comm.Text = currentBody
 	comm.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
 	currentComments = append(currentComments, comm)
@@ -1217,6 +1098,8 @@ func ReceiveReferralMail(c *gin.Context) {
 	err = dsRefC.CreateMessage(ctx, *dsReferral, currentComments)
 	if err != nil {
 		log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+	} else {
+		publishComments(*dsReferral, currentComments)
 	}
 	dsReferral.ModifiedOn = time.Now().In(location)
 
@@ -1229,99 +1112,71 @@ func ReceiveReferralMail(c *gin.Context) {
 	if err != nil {
 		log.Errorf("Error processing sms error:%v ", err.Error())
 	}
-	if dsReferral.ToEmail != "" {
-		sgClient.SendClinicNotification(dsReferral.ToEmail, dsReferral.ToClinicName,
-			dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
-
+	// a clinic's reply goes to the other clinic, a patient's to the specialist
+	notifyEmail, notifyName, notifyAddressID := dsReferral.ToEmail, dsReferral.ToClinicName, dsReferral.ToAddressID
+	notifyText := withClinicName("New message on a referral", " from ", dsReferral.FromClinicName)
+	if strings.EqualFold(senderID, dsReferral.ToEmail) && channel == contracts.GDCBox {
+		notifyEmail, notifyName, notifyAddressID = dsReferral.FromEmail, dsReferral.FromClinicName, dsReferral.FromAddressID
+		notifyText = withClinicName("New message on a referral", " to ", dsReferral.ToClinicName)
+	}
+	if notifyEmail != "" {
+		err = notifyClinicEmail(ctx, contracts.EventMessageCreated, *dsReferral, notifyAddressID, notifyEmail, notifyName, notifyText, func() error {
+			return sgClient.SendClinicNotification(notifyEmail, notifyName,
+				dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
+		})
+		if err != nil {
+			log.Errorf("Failed to send email: %v", err.Error())
+		}
 	} else {
-		sgClient.SendClinicNotification(constants.SD_ADMIN_EMAIL, dsReferral.ToClinicName,
+		sgClient.SendClinicNotification(constants.SD_ADMIN_EMAIL, notifyName,
 			dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
 	}
+	return nil
 }
 
 // ReceiveAutoSummaryMail ...
 func ReceiveAutoSummaryMail(c *gin.Context) {
 	log.Infof("Referral Email Receieved")
-	const _24K = 256 << 20
-	err := c.Request.ParseMultipartForm(_24K)
-	emails := c.Request.MultipartForm.Value["email"][0]
-	log.Errorf(emails)
-	parsedEmail, err := pe.Parse(strings.NewReader(emails))
-	fromEmail := parsedEmail.From[0].Address
-	log.Info("From: %v", fromEmail)
-	toEmail := parsedEmail.To[0].Address
-	log.Info("To: %v", toEmail)
-	ccEmail := parsedEmail.Cc[0].Address
-	log.Info("CC %v", ccEmail)
-	subject := parsedEmail.Subject
+	emails, ok := inboundRawEmail(c)
+	if !ok {
+		return
+	}
 	ctx := c.Request.Context()
 	gproject := googleprojectlib.GetGoogleProjectID()
 	dsRefC := datastoredb.NewReferralHandler()
-	err = dsRefC.InitializeDataBase(ctx, gproject)
+	err := dsRefC.InitializeDataBase(ctx, gproject)
 	if err != nil {
 		log.Errorf("No clinics found for incoming email: %v", err.Error())
 		return
 	}
+	parsedEmail, err := pe.Parse(strings.NewReader(emails))
+	if err != nil || len(parsedEmail.From) == 0 {
+		quarantineEmail(ctx, dsRefC, contracts.QuarantineSummaryMail, emails, parsedEmail, fmt.Sprintf("cannot parse email: %v", err))
+		return
+	}
+	fromEmail := summarySenderEmail(parsedEmail)
+	log.Infof("From: %v", fromEmail)
 	clinicDB := datastoredb.NewClinicMetaHandler()
 	err = clinicDB.InitializeDataBase(ctx, gproject)
 	if err != nil {
 		log.Errorf("No clinics found for incoming email: %v", err.Error())
 		return
 	}
-	if strings.Contains(fromEmail, "cloud-protect.net") {
-		fromEmail = "info@penndios.com"
-	}
-	domainName := strings.Split(fromEmail, "@")[1]
-	var dsReferral contracts.DSReferral
-	dsReferral.IsSummary = true
-	currentClinicInbound, err := clinicDB.GetAllClinicsByEmail(ctx, fromEmail)
-	if err == nil && len(currentClinicInbound) > 0 {
-		oneClinicFrom := currentClinicInbound[0]
-		dsReferral.ToAddressID = oneClinicFrom.AddressID
-		dsReferral.ToPlaceID = oneClinicFrom.PlaceID
-		dsReferral.ToClinicAddress = oneClinicFrom.Address
-		dsReferral.ToClinicName = oneClinicFrom.Name
-		dsReferral.ToClinicPhone = oneClinicFrom.PhoneNumber
-		dsReferral.ToEmail = oneClinicFrom.EmailAddress
-	} else {
-		currentClinicInbound, err = clinicDB.GetAllClinicsByDomain(ctx, domainName)
-		if err != nil && len(currentClinicInbound) > 0 {
-			oneClinicFrom := currentClinicInbound[0]
-			dsReferral.ToAddressID = oneClinicFrom.AddressID
-			dsReferral.ToPlaceID = oneClinicFrom.PlaceID
-			dsReferral.ToClinicAddress = oneClinicFrom.Address
-			dsReferral.ToClinicName = oneClinicFrom.Name
-			dsReferral.ToClinicPhone = oneClinicFrom.PhoneNumber
-			dsReferral.ToEmail = oneClinicFrom.EmailAddress
-		} else {
-			log.Errorf("No clinics inbound found for incoming email: %v", err.Error())
-			return
-		}
+	sender, err := summarySenderClinic(ctx, clinicDB, fromEmail)
+	if err != nil {
+		log.Errorf("No clinics inbound found for incoming email: %v", fromEmail)
+		quarantineEmail(ctx, dsRefC, contracts.QuarantineSummaryMail, emails, parsedEmail, err.Error())
+		return
 	}
-	currentClinicOutBoud, err := clinicDB.GetAllClinicsByAutoEmail(ctx, toEmail)
+	dentist, err := summaryDentistClinic(ctx, clinicDB, inboundRecipients(c, parsedEmail))
 	if err != nil {
 		log.Errorf("No clinics outbound found for incoming email: %v", err.Error())
+		quarantineEmail(ctx, dsRefC, contracts.QuarantineSummaryMail, emails, parsedEmail, err.Error())
 		return
 	}
-	toClinic := currentClinicOutBoud[0]
-	dsReferral.FromAddressID = toClinic.AddressID
-	dsReferral.FromEmail = toClinic.EmailAddress
-	dsReferral.FromPlaceID = toClinic.PlaceID
-	dsReferral.FromClinicAddress = toClinic.Address
-	dsReferral.FromClinicName = toClinic.Name
-	dsReferral.FromClinicPhone = toClinic.PhoneNumber
-	currentRefUUID, _ := uuid.NewUUID()
-	uniqueRefID := currentRefUUID.String()
-	dsReferral.ReferralID = uniqueRefID
-	currentBody := parsedEmail.TextBody
-	currentComments := make([]contracts.Comment, 0)
-	docIDNames := make([]string, 0)
-	docsMedia := make([]contracts.Media, 0)
-	// Stage 2 Upload files from
-	// parse request
-	storageC := storage.NewStorageHandler()
-	err = storageC.InitializeStorageClient(ctx, gproject)
+	err = processSummaryMail(ctx, gproject, dsRefC, parsedEmail, fromEmail, *sender, *dentist)
 	if err != nil {
+		log.Errorf("Error processing email"+" "+fromEmail+" "+parsedEmail.Subject+" error:%v ", err.Error())
 		c.AbortWithStatusJSON(
 			http.StatusInternalServerError,
 			gin.H{
@@ -1329,247 +1184,58 @@ func ReceiveAutoSummaryMail(c *gin.Context) {
 				constants.RESPONSDE_JSON_ERROR: err.Error(),
 			},
 		)
-		return
 	}
-	foundOne := false
-	ocrText := ""
-	var res *docconv.Response
-	patientFirstName := ""
-	patientLastName := ""
-	for _, attch := range parsedEmail.Attachments {
-		fileName := attch.Filename
-		reader, err := storageC.DownloadSingleFile(ctx, dsReferral.ReferralID, constants.SD_REFERRAL_BUCKET, fileName)
-		if err == nil && reader != nil {
-			timeNow := time.Now()
-			stripFile := strings.Split(fileName, ".")
-			name := stripFile[0]
-			name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-			fileName = name + "." + stripFile[len(stripFile)-1]
-		}
-		bucketPath := dsReferral.ReferralID + "/" + fileName
-		saveFileReader, _ := ioutil.ReadAll(attch.Data)
-		buckerW, err := storageC.UploadToGCS(ctx, bucketPath)
-		if err != nil {
-			c.AbortWithStatusJSON(
-				http.StatusInternalServerError,
-				gin.H{
-					constants.RESPONSE_JSON_DATA:   nil,
-					constants.RESPONSDE_JSON_ERROR: err.Error(),
-				},
-			)
-			return
-		}
-		if !foundOne || patientFirstName == "" {
-			foundOne = true
-			res, err = docconv.Convert(bytes.NewReader(saveFileReader), "application/pdf", true)
-			if err != nil {
-				log.Errorf("deconv error: %v", err.Error())
-			}
-			if res != nil {
-				ocrText = res.Body
-				patientIndex := -1
-				wordFields := strings.Fields(ocrText)
-				for i, word := range wordFields {
-					if strings.ToLower(word) == "patient" {
-						patientIndex = i
-						break
-					}
-				}
-				if patientIndex >= 0 {
-					patientFirstName = strings.Title(strings.ToLower(wordFields[patientIndex+1]))
-					patientLastName = strings.Title(strings.ToLower(wordFields[patientIndex+2]))
-				}
-			}
-		}
-		_, err = io.Copy(buckerW, bytes.NewReader(saveFileReader))
-		if err != nil {
-			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-		}
-		buckerW.Close()
-		docIDNames = append(docIDNames, fileName)
-	}
-
-	if patientFirstName != "" {
-		dsReferral.PatientFirstName = patientFirstName
-		dsReferral.PatientLastName = patientLastName
-
-	} else {
-		dsReferral.PatientFirstName = "Treament"
-		dsReferral.PatientLastName = "Summary"
-	}
-	log.Infof("PatientName: %s", dsReferral.PatientFirstName+dsReferral.PatientLastName)
-	// try to find existing patient summary
-	var existingReferralMain *contracts.DSReferral
-	var existingSummary *contracts.DSReferral
-
-	if dsReferral.PatientFirstName != "Treament" {
-		existingReferrals, err := dsRefC.GetReferralUsingFields(ctx, dsReferral.FromEmail, dsReferral.PatientFirstName, dsReferral.PatientLastName)
-		if err != nil {
-			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-		} else {
-			for _, ref := range existingReferrals {
-				if !ref.IsSummary {
-					existingReferralMain = &ref
-				} else {
-					existingSummary = &ref
-				}
-			}
-		}
-		if existingReferralMain != nil {
-			for _, attch := range parsedEmail.Attachments {
-				fileName := attch.Filename
-				reader, err := storageC.DownloadSingleFile(ctx, existingReferralMain.ReferralID, constants.SD_REFERRAL_BUCKET, fileName)
-				if err == nil && reader != nil {
-					timeNow := time.Now()
-					stripFile := strings.Split(fileName, ".")
-					name := stripFile[0]
-					name += strconv.Itoa(timeNow.Year()) + timeNow.Month().String() + strconv.Itoa(timeNow.Day()) + strconv.Itoa(timeNow.Second())
-					fileName = name + "." + stripFile[len(stripFile)-1]
-				}
-				bucketPath := existingReferralMain.ReferralID + "/" + fileName
-				saveFileReader, _ := ioutil.ReadAll(attch.Data)
-				buckerW, err := storageC.UploadToGCS(ctx, bucketPath)
-				if err != nil {
-					c.AbortWithStatusJSON(
-						http.StatusInternalServerError,
-						gin.H{
-							constants.RESPONSE_JSON_DATA:   nil,
-							constants.RESPONSDE_JSON_ERROR: err.Error(),
-						},
-					)
-					return
-				}
-				_, err = io.Copy(buckerW, bytes.NewReader(saveFileReader))
-				if err != nil {
-					log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-				}
-				buckerW.Close()
-				extentionFile := strings.Split(fileName, ".")
-				ext := extentionFile[len(extentionFile)-1]
-				var docMedia contracts.Media
-				docMedia.Name = fileName
-				docMedia.Image = ""
-				switch strings.ToLower(ext) {
-				case "jpg", "jpeg":
-					img, err := jpeg.Decode(bytes.NewReader(saveFileReader))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				case "png":
-					img, err := png.Decode(bytes.NewReader(saveFileReader))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				}
-				docsMedia = append(docsMedia, docMedia)
-				docIDNames = append(docIDNames, fileName)
-			}
-			if len(docIDNames) > 0 {
-				existingReferralMain.Documents = append(existingReferralMain.Documents, docIDNames...)
-				err = storageC.ZipFile(ctx, existingReferralMain.ReferralID, constants.SD_REFERRAL_BUCKET)
-				if err != nil {
-					log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-				}
-			}
-		}
-	}
-	if existingSummary != nil {
-		dsReferral = *existingSummary
-	}
-	dsReferral.IsDirty = false
-	dsReferral.IsNew = false
-	dsReferral.SummaryText = ocrText
-	dsReferral.Status.GDStatus = "completed"
-	dsReferral.Status.SPStatus = "completed"
-	zone, err := tz.GetZone(tz.Point{
-		Lon: toClinic.Location.Long, Lat: toClinic.Location.Lat,
-	})
-	location, _ := time.LoadLocation(zone[0])
-	dsReferral.CreatedOn = time.Now().In(location)
-	dsReferral.ModifiedOn = time.Now().In(location)
-	if len(docIDNames) > 0 {
-		var uploadComment contracts.Comment
-		uploadComment.Channel = contracts.GDCBox
-		if dsReferral.PatientEmail != "" {
-			uploadComment.UserID = dsReferral.PatientEmail
-		} else {
-			uploadComment.UserID = dsReferral.PatientPhone
-		}
-		id, _ := uuid.NewUUID()
-		uploadComment.MessageID = id.String()
-		uploadComment.Media = docsMedia
-		uploadComment.Files = docIDNames
-		uploadComment.Text = "New documents are uploaded by " + dsReferral.ToClinicName
-		uploadComment.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
-		currentComments = append(currentComments, uploadComment)
-		err = storageC.ZipFile(ctx, dsReferral.ReferralID, constants.SD_REFERRAL_BUCKET)
-		if err != nil {
-			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-		}
-	}
-
-	dsReferral.Documents = append(dsReferral.Documents, docIDNames...)
-	var comm contracts.Comment
-	id, _ := uuid.NewUUID()
-	comm.MessageID = id.String()
-	comm.Channel = contracts.GDCBox
-	comm.UserID = dsReferral.ToEmail
-	comm.Text = currentBody
-	comm.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
-	currentComments = append(currentComments, comm)
+}
 
-	err = dsRefC.CreateMessage(ctx, dsReferral, currentComments)
+// processSummaryMail ... reads the patient of a treatment summary and files it, or queues it for
+// review when the patient cannot be read with confidence
+func processSummaryMail(ctx context.Context, gproject string, dsRefC *datastoredb.DSReferral, parsedEmail pe.Email, fromEmail string,
+	sender contracts.PhysicalClinicMapLocation, dentist contracts.PhysicalClinicMapLocation) error {
+	subject := parsedEmail.Subject
+	domainName := fromEmail[strings.LastIndex(fromEmail, "@")+1:]
+	dsReferral := summaryReferral(sender, dentist)
+	currentBody := parsedEmail.TextBody
+	// Stage 2 Upload files from
+	// parse request
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, gproject)
 	if err != nil {
-		log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+		return err
 	}
-	if existingReferralMain != nil {
-		err = dsRefC.CreateMessage(ctx, *existingReferralMain, currentComments)
+	pipeline := attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, inboundLimits())
+	validator := attachments.NewValidator(attachmentScanner)
+	// the attachments are read and validated once, they go to the summary and to the patient's referral
+	files := make([]attachments.File, 0)
+	for _, attch := range parsedEmail.Attachments {
+		data, err := ioutil.ReadAll(attch.Data)
 		if err != nil {
 			log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+			continue
 		}
-		existingReferralMain.ModifiedOn = time.Now()
-		err = dsRefC.CreateReferral(ctx, *existingReferralMain)
-	}
-	dsReferral.ModifiedOn = time.Now()
-
-	err = dsRefC.CreateReferral(ctx, dsReferral)
-	if err != nil {
-		log.Errorf("Error processing email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
-	}
-	sgClient := sendgrid.NewSendGridClient()
-	err = sgClient.InitializeSendGridClient()
-	if err != nil {
-		log.Errorf("Error processing sms error:%v ", err.Error())
-	}
-	sendPatientComments := make([]string, 0)
-	for _, comment := range currentComments {
-		if comment.Channel == contracts.GDCBox && dsReferral.ToEmail != "" && comment.UserID == dsReferral.ToEmail {
-			sendPatientComments = append(sendPatientComments, comment.Text)
+		file, err := validator.Check(ctx, inboundLimits(), attachments.File{
+			Name:       attch.Filename,
+			Data:       data,
+			Source:     contracts.DocumentSourceEmail,
+			Category:   contracts.DocumentCategorySummary,
+			UploadedBy: fromEmail,
+		})
+		if err != nil {
+			log.Errorf("Attachment refused from email"+" "+fromEmail+" "+subject+" error:%v ", err.Error())
+			continue
 		}
-	}
-	y, m, d := dsReferral.ModifiedOn.Date()
-	dateString := fmt.Sprintf("%d-%d-%d", y, int(m), d)
-	if dsReferral.FromEmail != "" {
-
-		sgClient.SendAutoEmailNotificationToGD(dsReferral.FromEmail, dsReferral.FromClinicName,
-			dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName, dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
-
-	} else {
-
-		sgClient.SendAutoEmailNotificationToGD(constants.SD_ADMIN_EMAIL, dsReferral.FromClinicName,
-			dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName, dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
-
-	}
+		files = append(files, file)
+	}
+	summaryText, extracted := extractSummary(domainName, files)
+	dsReferral.SummaryText = summaryText
+	dsReferral.Extraction = extracted
+	if extracted.Review {
+		// a summary filed under a misread name ends up with the wrong patient, a clinic confirms it first
+		log.Infof("Summary from %s queued for review, confidence %.2f", fromEmail, extracted.Confidence)
+		return queueSummaryReview(ctx, storageC, dsRefC, dsReferral, files, fromEmail, subject, currentBody)
+	}
+	setSummaryPatient(&dsReferral, extracted.FirstName.Value, extracted.LastName.Value, extractedDOB(extracted.DOB))
+	_, err = fileAutoSummary(ctx, dsRefC, pipeline, dsReferral, dentist, files, currentBody)
+	return err
 }
 
 // ScheduleDemo ...
@@ -1620,17 +1286,15 @@ func TextRecievedPatient(c *gin.Context) {
 		log.Errorf("Error parsing text recieve 2: %v", err.Error())
 	}
 	form := c.Request.Form
-	incomingPhone := form["From"][0]
-	receivingCustomPhone := form["To"][0]
-	receivingCustomPhone = strings.Replace(receivingCustomPhone, "-", "", -1)
-	receivingCustomPhone = strings.Replace(receivingCustomPhone, "(", "", -1)
-	receivingCustomPhone = strings.Replace(receivingCustomPhone, ")", "", -1)
-	receivingCustomPhone = strings.Replace(receivingCustomPhone, " ", "", -1)
-	incomingText := ""
-	if text, ok := form["Body"]; ok {
-		incomingText = text[0]
-	}
-	filePatients := make(map[string]*io.ReadCloser)
+	incomingPhone := form.Get("From")
+	if incomingPhone == "" {
+		log.Errorf("Text without a sender")
+		return
+	}
+	receivingCustomPhone := customPhone(form.Get("To"))
+	incomingText := form.Get("Body")
+	// read once, the provider's media URLs do not last
+	filePatients := make(map[string][]byte)
 	for key, formValue := range form {
 		if strings.Contains(strings.ToLower(key), "mediaurl") {
 			currentURL := formValue[0]
@@ -1639,74 +1303,72 @@ func TextRecievedPatient(c *gin.Context) {
 				log.Errorf("Error parsing text recieve 3: %v", err.Error())
 				continue
 			}
-			filePatients[fileName] = reader
+			currentBytes, err := ioutil.ReadAll(*reader)
+			(*reader).Close()
+			if err != nil {
+				log.Errorf("Error parsing text recieve 3: %v", err.Error())
+				continue
+			}
+			filePatients[fileName] = currentBytes
 		}
 	}
 	gproject := googleprojectlib.GetGoogleProjectID()
-	if err != nil {
-		log.Errorf("Error parsing text recieve 4: %v", err.Error())
-	}
 	dsRefC := datastoredb.NewReferralHandler()
 	err = dsRefC.InitializeDataBase(ctx, gproject)
 	if err != nil {
 		log.Errorf("Error parsing text recieve: %v", err.Error())
+		return
 	}
 	dsReferrals, err := dsRefC.ReferralFromPatientPhone(ctx, incomingPhone)
-	if err != nil || len(dsReferrals) <= 0 {
-		log.Errorf("Referral not gound: %v", err.Error())
+	matched := make([]contracts.DSReferral, 0)
+	for _, dsReferral := range dsReferrals {
+		if dsReferral.CommunicationPhone != "" && dsReferral.CommunicationPhone != receivingCustomPhone {
+			continue
+		}
+		matched = append(matched, dsReferral)
 	}
-	clinicMetaDB := datastoredb.NewClinicMetaHandler()
-	err = clinicMetaDB.InitializeDataBase(ctx, gproject)
-	if err != nil {
-		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
-			gin.H{
-				constants.RESPONSE_JSON_DATA:   nil,
-				constants.RESPONSDE_JSON_ERROR: err.Error(),
-			},
-		)
+	if keyword := sms.Keyword(incomingText); keyword != "" {
+		handleConsentKeyword(ctx, dsRefC, clientSMS, keyword, incomingPhone, receivingCustomPhone, matched)
 		return
 	}
-	currentDS := dsReferrals[0].ToPlaceID
-	latLong := contracts.ClinicLocation{}
-	getClinic, err := clinicMetaDB.GetSingleClinicViaPlace(ctx, currentDS)
-	if err == nil && getClinic.PhysicalClinicsRegistration.Name != "" {
-		latLong = getClinic.Location
-	} else {
-		mapClient := gmaps.NewMapsHandler()
-		err = mapClient.InitializeGoogleMapsAPIClient(ctx, gproject)
+	if len(matched) == 0 {
+		reason := fmt.Sprintf("no referral of %s texts %s", incomingPhone, receivingCustomPhone)
 		if err != nil {
-			c.AbortWithStatusJSON(
-				http.StatusInternalServerError,
-				gin.H{
-					constants.RESPONSE_JSON_DATA:   nil,
-					constants.RESPONSDE_JSON_ERROR: err.Error(),
-				},
-			)
+			reason = err.Error()
 		}
-		details, _ := mapClient.FindPlaceFromID(currentDS)
-		latLong.Lat = details.Geometry.Location.Lat
-		latLong.Long = details.Geometry.Location.Lng
+		log.Errorf("Referral not gound: %v", reason)
+		quarantineText(ctx, dsRefC, form, filePatients, reason)
+		return
 	}
-	zone, err := tz.GetZone(tz.Point{
-		Lon: latLong.Long, Lat: latLong.Lat,
-	})
-	location, _ := time.LoadLocation(zone[0])
+	routePatientText(ctx, gproject, dsRefC, clientSMS, incomingPhone, receivingCustomPhone, matched, incomingText, filePatients)
+}
+
+// processPatientText ... adds a patient's text and its media to each of the referrals and notifies
+// their specialists
+func processPatientText(ctx context.Context, gproject string, dsRefC *datastoredb.DSReferral, clientSMS *sms.ClientSMS,
+	dsReferrals []contracts.DSReferral, incomingText string, filePatients map[string][]byte, receivingCustomPhone string) {
+	var err error
+	location := placeTimeLocation(ctx, gproject, dsReferrals[0].ToPlaceID)
+	reply := appointmentReply(incomingText)
 	for _, dsReferral := range dsReferrals {
-		if dsReferral.CommunicationPhone != "" && dsReferral.CommunicationPhone != receivingCustomPhone {
-			continue
-		}
 		if incomingText != "" {
 			var commText contracts.Comment
 			commText.UserID = dsReferral.PatientEmail
 			commText.Channel = contracts.SPCBox
 			commText.Text = incomingText
+			// a C/R answer belongs to the one referral with an upcoming appointment
+			if reply != "" && recordAppointmentReply(ctx, &dsReferral, reply, receivingCustomPhone, clientSMS) {
+				commText.Text = incomingText + " (appointment " + reply + ")"
+				reply = ""
+			}
 			commText.TimeStamp = time.Now().In(location).UTC().UnixNano() / int64(time.Millisecond)
 			id, _ := uuid.NewUUID()
 			commText.MessageID = id.String()
 			err = dsRefC.CreateMessage(ctx, dsReferral, []contracts.Comment{commText})
 			if err != nil {
 				log.Errorf("Error processing sms error:%v ", err.Error())
+			} else {
+				publishComments(dsReferral, []contracts.Comment{commText})
 			}
 		}
 		docIDNames := make([]string, 0)
@@ -1730,56 +1392,20 @@ func TextRecievedPatient(c *gin.Context) {
 			if err != nil {
 				log.Errorf("Referral not gound: %v", err.Error())
 			}
-			var counter int64
-			for fileName, fileBytes := range filePatients {
-				currentBytes, err := ioutil.ReadAll(*fileBytes)
-				counter++
-				extension := strings.Split(fileName, ".")[1]
-				fileName = dsReferral.PatientFirstName + strconv.Itoa(int(time.Now().UTC().Unix()+counter)) + "." + extension
-				bucketPath := dsReferral.ReferralID + "/" + fileName
-				buckerW, err := storageC.UploadToGCS(ctx, bucketPath)
+			pipeline := attachmentPipeline(storageC, dsRefC, constants.SD_REFERRAL_BUCKET, inboundLimits())
+			for fileName, currentBytes := range filePatients {
+				doc, err := pipeline.Ingest(ctx, dsReferral.ReferralID, attachments.File{
+					Name:       dsReferral.PatientFirstName + filepath.Ext(fileName),
+					Data:       currentBytes,
+					Source:     contracts.DocumentSourceSMS,
+					UploadedBy: commText.UserID,
+				})
 				if err != nil {
 					log.Errorf("Error processing uploading text error:%v ", err.Error())
+					continue
 				}
-				_, err = io.Copy(buckerW, bytes.NewReader(currentBytes))
-				if err != nil {
-					log.Errorf("Error processing sms error:%v ", err.Error())
-				}
-				buckerW.Close()
-				extentionFile := strings.Split(fileName, ".")
-				ext := extentionFile[len(extentionFile)-1]
-				var docMedia contracts.Media
-				docMedia.Name = fileName
-				docMedia.Image = ""
-				switch strings.ToLower(ext) {
-				case "jpg", "jpeg":
-					img, err := jpeg.Decode(bytes.NewReader(currentBytes))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				case "png":
-					img, err := png.Decode(bytes.NewReader(currentBytes))
-					if err == nil {
-						resized := imaging.Resize(img, 200, 0, imaging.Lanczos)
-						buf := bytes.NewBuffer(nil)
-						err := jpeg.Encode(buf, resized, nil)
-						if err == nil {
-							docMedia.Image = base64.StdEncoding.EncodeToString(buf.Bytes())
-						}
-					}
-				}
-				docsMedia = append(docsMedia, docMedia)
-				(*fileBytes).Close()
-				docIDNames = append(docIDNames, fileName)
-			}
-			err = storageC.ZipFile(ctx, dsReferral.ReferralID, constants.SD_REFERRAL_BUCKET)
-			if err != nil {
-				log.Errorf("Error processing zipping text error:%v ", err.Error())
+				docsMedia = append(docsMedia, attachments.Media(*doc))
+				docIDNames = append(docIDNames, doc.Name)
 			}
 		}
 		if len(docIDNames) > 0 {
@@ -1788,6 +1414,8 @@ func TextRecievedPatient(c *gin.Context) {
 			err = dsRefC.CreateMessage(ctx, dsReferral, []contracts.Comment{commText})
 			if err != nil {
 				log.Errorf("Error processing sms error:%v ", err.Error())
+			} else {
+				publishComments(dsReferral, []contracts.Comment{commText})
 			}
 		}
 		dsReferral.ModifiedOn = time.Now().In(location)
@@ -1802,9 +1430,14 @@ func TextRecievedPatient(c *gin.Context) {
 			log.Errorf("Error processing sms error:%v ", err.Error())
 		}
 		if dsReferral.ToEmail != "" {
-			sgClient.SendClinicNotification(dsReferral.ToEmail, dsReferral.ToClinicName,
-				dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
-
+			err = notifyClinicEmail(ctx, contracts.EventMessageCreated, dsReferral, dsReferral.ToAddressID, dsReferral.ToEmail, dsReferral.ToClinicName,
+				"New message in a patient chat", func() error {
+					return sgClient.SendClinicNotification(dsReferral.ToEmail, dsReferral.ToClinicName,
+						dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
+				})
+			if err != nil {
+				log.Errorf("Failed to send email: %v", err.Error())
+			}
 		} else {
 			sgClient.SendClinicNotification(constants.SD_ADMIN_EMAIL, dsReferral.ToClinicName,
 				dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
@@ -1866,6 +1499,12 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 	for _, comm := range referralDetails.Comments {
 		currentID, _ := uuid.NewUUID()
 		comm.MessageID = currentID.String()
+		comm.Version = 0
+		comm.EditedOn = 0
+		comm.Retracted = false
+		// the referral SMS carries every first comment, later only the patient channel goes out
+		comm.PatientSMS = dsReferral.PatientPhone != "" &&
+			((dsReferral.IsNew && !dsReferral.SuppressPatientNotice) || (!dsReferral.IsNew && comm.Channel == contracts.SPCBox))
 		updatedComm = append(updatedComm, comm)
 
 	}
@@ -1873,6 +1512,7 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 	if err != nil {
 		return nil, err
 	}
+	publishComments(*dsReferral, updatedComm)
 	sgClient := sendgrid.NewSendGridClient()
 	err = sgClient.InitializeSendGridClient()
 	if err != nil {
@@ -1886,9 +1526,12 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 		y, m, d := dsReferral.CreatedOn.Date()
 		dateString := fmt.Sprintf("%d-%d-%d", y, int(m), d)
 		if dsReferral.ToEmail != "" {
-			err = sgClient.SendEmailNotificationSpecialist(dsReferral.ToEmail,
-				dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName,
-				dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
+			err = notifyClinicEmail(ctx, contracts.EventReferralCreated, *dsReferral, dsReferral.ToAddressID, dsReferral.ToEmail, dsReferral.ToClinicName,
+				withClinicName("You have a new referral", " from ", dsReferral.FromClinicName), func() error {
+					return sgClient.SendEmailNotificationSpecialist(dsReferral.ToEmail,
+						dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName,
+						dsReferral.PatientPhone, dsReferral.ReferralID, dateString, sendPatientComments)
+				})
 		} else {
 			err = sgClient.SendEmailNotificationSpecialist(constants.SD_ADMIN_EMAIL,
 				dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName,
@@ -1899,7 +1542,7 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 				log.Errorf("Failed to send email: %v", err.Error())
 			}
 		}
-		if dsReferral.PatientEmail != "" {
+		if dsReferral.PatientEmail != "" && !dsReferral.SuppressPatientNotice {
 			err = sgClient.SendEmailNotificationPatient(dsReferral.PatientEmail,
 				dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ToClinicName,
 				dsReferral.ToClinicPhone, dsReferral.ReferralID, dsReferral.ToClinicAddress, sendPatientComments)
@@ -1914,26 +1557,33 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 		if err != nil {
 			log.Errorf("Failed to send SMS: %v", err.Error())
 		}
-		if dsReferral.PatientPhone != "" {
-			message1 := ""
-			message1 = fmt.Sprintf(constants.PATIENT_MESSAGE, dsReferral.PatientFirstName+" "+dsReferral.PatientLastName,
-				dsReferral.ToClinicName, dsReferral.ToClinicAddress, dsReferral.ToClinicPhone, sendPatientComments)
+		if dsReferral.PatientPhone != "" && !dsReferral.SuppressPatientNotice {
+			message1 := patientMessage(ctx, *dsReferral, messages.KeyReferralCreated, map[string]string{
+				"Comments":   strings.Join(sendPatientComments, "\n"),
+				"ClinicText": dsReferral.CommunicationText,
+			})
 			fromPhone := ""
 			if dsReferral.CommunicationPhone == "" {
 				fromPhone = global.Options.ReferralPhone
 			} else {
 				fromPhone = dsReferral.CommunicationPhone
 			}
-			err = clientSMS.SendSMS(fromPhone, dsReferral.PatientPhone, message1)
-			message2 := "Please submit your insurance information here to receive an accurate co-pay: "
-			message2 += os.Getenv("SD_BASE_URL") + "/secure/insurance?referral=" + dsReferral.ReferralID
-			err = clientSMS.SendSMS(fromPhone, dsReferral.PatientPhone, message2)
+			if message1 != "" {
+				err = clientSMS.SendSMS(fromPhone, dsReferral.PatientPhone, message1)
+			}
+			message2 := patientMessage(ctx, *dsReferral, messages.KeyInsuranceLink, map[string]string{
+				"InsuranceURL": os.Getenv("SD_BASE_URL") + "/secure/insurance?referral=" + dsReferral.ReferralID,
+			})
+			if message2 != "" {
+				err = clientSMS.SendSMS(fromPhone, dsReferral.PatientPhone, message2)
+			}
 
 		}
 
 	}
 	wasNew := dsReferral.IsNew
 	dsReferral.IsNew = false
+	dsReferral.SuppressPatientNotice = false
 
 	err = dsRefC.CreateReferral(ctx, *dsReferral)
 	if err != nil {
@@ -1943,12 +1593,17 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 		for _, comm := range referralDetails.Comments {
 			if comm.Channel == contracts.GDCBox {
 				if dsReferral.ToEmail != "" && comm.UserID == dsReferral.FromEmail {
-					sgClient.SendClinicNotification(dsReferral.ToEmail, dsReferral.ToClinicName,
-						dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
-
+					err = notifyClinicEmail(ctx, contracts.EventMessageCreated, *dsReferral, dsReferral.ToAddressID, dsReferral.ToEmail, dsReferral.ToClinicName,
+						withClinicName("New message on a referral", " from ", dsReferral.FromClinicName), func() error {
+							return sgClient.SendClinicNotification(dsReferral.ToEmail, dsReferral.ToClinicName,
+								dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
+						})
 				} else if dsReferral.ToEmail != "" && comm.UserID == dsReferral.ToEmail {
-					sgClient.SendClinicNotification(dsReferral.FromEmail, dsReferral.FromClinicName,
-						dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
+					err = notifyClinicEmail(ctx, contracts.EventMessageCreated, *dsReferral, dsReferral.FromAddressID, dsReferral.FromEmail, dsReferral.FromClinicName,
+						withClinicName("New message on a referral", " to ", dsReferral.ToClinicName), func() error {
+							return sgClient.SendClinicNotification(dsReferral.FromEmail, dsReferral.FromClinicName,
+								dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
+						})
 				} else {
 					sgClient.SendClinicNotification(constants.SD_ADMIN_EMAIL, dsReferral.ToClinicName,
 						dsReferral.PatientFirstName+" "+dsReferral.PatientLastName, dsReferral.ReferralID)
@@ -1960,16 +1615,16 @@ func ProcessComments(ctx context.Context, gproject string, referralID string, re
 					return nil, err
 				}
 				if dsReferral.PatientPhone != "" {
-					message1 := ""
-					message1 = fmt.Sprintf(constants.PATIENT_MESSAGE_NOTICE, dsReferral.PatientFirstName+" "+dsReferral.PatientLastName,
-						dsReferral.ToClinicName, comm.Text)
+					message1 := patientMessage(ctx, *dsReferral, messages.KeyMessageNotice, map[string]string{"Message": comm.Text})
 					fromPhone := ""
 					if dsReferral.CommunicationPhone == "" {
 						fromPhone = global.Options.ReferralPhone
 					} else {
 						fromPhone = dsReferral.CommunicationPhone
 					}
-					err = clientSMS.SendSMS(fromPhone, dsReferral.PatientPhone, message1)
+					if message1 != "" {
+						err = clientSMS.SendSMS(fromPhone, dsReferral.PatientPhone, message1)
+					}
 				}
 				if dsReferral.PatientEmail != "" {
 					err = sgClient.SendCommentNotificationPatient(dsReferral.PatientFirstName+" "+dsReferral.PatientLastName,
@@ -0,0 +1,300 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"golang.org/x/image/webp"
+)
+
+const (
+	// ThumbnailWidth width of the base64 thumbnails shown in chats and document lists.
+	ThumbnailWidth = 200
+
+	// PreviewWidth maximum width of the first page preview of a PDF.
+	PreviewWidth = 1024
+
+	// PreviewFolder sub folder of the referral folder previews are written to, zips leave it out.
+	PreviewFolder = "previews"
+
+	// maxStemLength longest file name kept before the extension.
+	maxStemLength = 80
+
+	// maxNameAttempts numbered names tried before falling back to a random suffix.
+	maxNameAttempts = 50
+
+	// pdfRenderTimeout time allowed for pdftoppm to render a first page.
+	pdfRenderTimeout = 30 * time.Second
+)
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Store is where files are written, the cloud storage client in production.
+type Store interface {
+	// CreateFile writes the file only if path is free, created is false when it was taken.
+	CreateFile(ctx context.Context, bucket string, path string, data []byte, contentType string) (bool, error)
+	// WriteFile writes the file, replacing what was there.
+	WriteFile(ctx context.Context, bucket string, path string, data []byte, contentType string) error
+}
+
+// Catalog persists document metadata.
+type Catalog interface {
+	// SaveDocument records the document, or a new version of the owner's document with the same
+	// original name in which case DocumentID and Version are updated.
+	SaveDocument(ctx context.Context, doc *contracts.Document) error
+}
+
+// File is one attachment handed to the pipeline by an ingest path.
+type File struct {
+	Name       string
+	Data       []byte
+	Source     string
+	Category   string
+	UploadedBy string
+	// PatientID is set for patient documents, the folder is then the patient's
+	PatientID string
+	// ContentType is set by the Validator, files that have it are not checked again
+	ContentType string
+}
+
+// Pipeline stores the attachments of a referral or patient under its folder with a safe unique name,
+// renders thumbnails and PDF previews and records the document metadata.
+type Pipeline struct {
+	store     Store
+	catalog   Catalog
+	bucket    string
+	validator *Validator
+	limits    Limits
+}
+
+// NewPipeline .... catalog may be nil when only the files are wanted
+func NewPipeline(store Store, catalog Catalog, bucket string) *Pipeline {
+	return &Pipeline{store: store, catalog: catalog, bucket: bucket, validator: NewValidator(nil)}
+}
+
+// SetScanner ....
+func (p *Pipeline) SetScanner(scanner Scanner) {
+	p.validator = NewValidator(scanner)
+}
+
+// SetLimits .... limits files that were not validated before are checked against
+func (p *Pipeline) SetLimits(limits Limits) {
+	p.limits = limits
+}
+
+// Ingest .... stores one file in the folder of the referral, or of the patient, and returns its document. A file that was not validated
+// yet is checked first and refused with a ValidationError. Thumbnails and previews are best effort and
+// a metadata failure is logged, only a file that could not be stored is an error.
+func (p *Pipeline) Ingest(ctx context.Context, folder string, file File) (*contracts.Document, error) {
+	if file.ContentType == "" {
+		var err error
+		file, err = p.validator.Check(ctx, p.limits, file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	contentType := file.ContentType
+	name, err := p.create(ctx, folder, SafeName(file.Name, contentType), file.Data, contentType)
+	if err != nil {
+		return nil, err
+	}
+	checksum := sha256.Sum256(file.Data)
+	documentID, _ := uuid.NewUUID()
+	doc := contracts.Document{
+		DocumentID:   documentID.String(),
+		ReferralID:   folder,
+		Name:         name,
+		StoredKey:    folder + "/" + name,
+		OriginalName: file.Name,
+		ContentType:  contentType,
+		Size:         int64(len(file.Data)),
+		SHA256:       hex.EncodeToString(checksum[:]),
+		Source:       file.Source,
+		Category:     file.Category,
+		UploadedBy:   file.UploadedBy,
+		Version:      1,
+		CreatedOn:    time.Now(),
+	}
+	if file.PatientID != "" {
+		doc.ReferralID = ""
+		doc.PatientID = file.PatientID
+	}
+	if doc.Category == "" {
+		doc.Category = DefaultCategory(contentType)
+	}
+	img, err := decodeImage(contentType, file.Data)
+	if err != nil {
+		log.Infof("attachments: no thumbnail for %s: %v", name, err)
+	} else {
+		doc.Thumbnail, err = Thumbnail(img)
+		if err != nil {
+			log.Infof("attachments: no thumbnail for %s: %v", name, err)
+		}
+		if contentType == "application/pdf" {
+			doc.Preview, err = p.writePreview(ctx, folder, name, img)
+			if err != nil {
+				log.Infof("attachments: no preview for %s: %v", name, err)
+			}
+		}
+	}
+	if p.catalog != nil {
+		if err := p.catalog.SaveDocument(ctx, &doc); err != nil {
+			log.Errorf("attachments: failed to record %s of %s: %v", name, folder, err)
+		}
+	}
+	return &doc, nil
+}
+
+// writePreview stores the first page as a JPEG at most PreviewWidth wide and returns its path
+func (p *Pipeline) writePreview(ctx context.Context, folder string, name string, page image.Image) (string, error) {
+	if page.Bounds().Dx() > PreviewWidth {
+		page = imaging.Resize(page, PreviewWidth, 0, imaging.Lanczos)
+	}
+	buf := bytes.NewBuffer(nil)
+	err := jpeg.Encode(buf, page, nil)
+	if err != nil {
+		return "", err
+	}
+	previewPath := folder + "/" + PreviewFolder + "/" + name + ".jpg"
+	err = p.store.WriteFile(ctx, p.bucket, previewPath, buf.Bytes(), "image/jpeg")
+	if err != nil {
+		return "", err
+	}
+	return previewPath, nil
+}
+
+// create writes the file under the first free name, name, name-2, name-3 and so on
+func (p *Pipeline) create(ctx context.Context, folder string, name string, data []byte, contentType string) (string, error) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for attempt := 2; ; attempt++ {
+		created, err := p.store.CreateFile(ctx, p.bucket, folder+"/"+candidate, data, contentType)
+		if err != nil {
+			return "", err
+		}
+		if created {
+			return candidate, nil
+		}
+		if attempt > maxNameAttempts {
+			suffix, _ := uuid.NewUUID()
+			candidate = stem + "-" + suffix.String()[:8] + ext
+			continue
+		}
+		candidate = fmt.Sprintf("%s-%d%s", stem, attempt, ext)
+	}
+}
+
+// SafeName .... file name without folders or characters that break storage paths and zip entries,
+// known types get the extension of their content
+func SafeName(fileName string, contentType string) string {
+	base := filepath.Base(strings.Replace(fileName, "\\", "/", -1))
+	ext := strings.ToLower(filepath.Ext(base))
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	stem = strings.Trim(unsafeName.ReplaceAllString(stem, "_"), "._-")
+	if stem == "" {
+		stem = "document"
+	}
+	if len(stem) > maxStemLength {
+		stem = stem[:maxStemLength]
+	}
+	if known, ok := allowedTypes[contentType]; ok {
+		if !hasExtension(known, ext) {
+			ext = known[0]
+		}
+	} else {
+		ext = strings.Trim(unsafeName.ReplaceAllString(ext, ""), ".")
+		if ext != "" {
+			ext = "." + ext
+		}
+	}
+	return stem + ext
+}
+
+// Thumbnail .... base64 JPEG ThumbnailWidth wide, as used by contracts.Media
+func Thumbnail(img image.Image) (string, error) {
+	resized := imaging.Resize(img, ThumbnailWidth, 0, imaging.Lanczos)
+	buf := bytes.NewBuffer(nil)
+	err := jpeg.Encode(buf, resized, nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DefaultCategory .... category of an upload the client did not categorise
+func DefaultCategory(contentType string) string {
+	switch {
+	case contentType == "application/dicom":
+		return contracts.DocumentCategoryXray
+	case strings.HasPrefix(contentType, "image/"):
+		return contracts.DocumentCategoryPhoto
+	}
+	return contracts.DocumentCategoryReport
+}
+
+// Media .... chat attachment entry of a document
+func Media(doc contracts.Document) contracts.Media {
+	return contracts.Media{Name: doc.Name, Image: doc.Thumbnail}
+}
+
+// decodeImage .... the image, or the first page of a PDF
+func decodeImage(contentType string, data []byte) (image.Image, error) {
+	switch contentType {
+	case "image/jpeg":
+		return jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		return png.Decode(bytes.NewReader(data))
+	case "image/gif":
+		return gif.Decode(bytes.NewReader(data))
+	case "image/webp":
+		return webp.Decode(bytes.NewReader(data))
+	case "application/pdf":
+		page, err := RenderFirstPage(data)
+		if err != nil {
+			return nil, err
+		}
+		return png.Decode(bytes.NewReader(page))
+	}
+	return nil, fmt.Errorf("no preview for %s", contentType)
+}
+
+// RenderFirstPage .... PNG of the first page of a PDF, rendered by pdftoppm (poppler-utils)
+func RenderFirstPage(data []byte) ([]byte, error) {
+	workDir, err := ioutil.TempDir("", "sd-preview")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+	input := filepath.Join(workDir, "input.pdf")
+	if err := ioutil.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pdfRenderTimeout)
+	defer cancel()
+	output := filepath.Join(workDir, "page")
+	command := exec.CommandContext(ctx, "pdftoppm", "-f", "1", "-l", "1", "-r", "100", "-png", "-singlefile", input, output)
+	if out, err := command.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("pdftoppm: %v %s", err, strings.TrimSpace(string(out)))
+	}
+	return ioutil.ReadFile(output + ".png")
+}
@@ -0,0 +1,126 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+type memoryStore struct {
+	files map[string][]byte
+}
+
+func (s *memoryStore) CreateFile(ctx context.Context, bucket string, path string, data []byte, contentType string) (bool, error) {
+	if _, ok := s.files[path]; ok {
+		return false, nil
+	}
+	s.files[path] = data
+	return true, nil
+}
+
+func (s *memoryStore) WriteFile(ctx context.Context, bucket string, path string, data []byte, contentType string) error {
+	s.files[path] = data
+	return nil
+}
+
+type memoryCatalog struct {
+	docs []contracts.Document
+}
+
+func (c *memoryCatalog) SaveDocument(ctx context.Context, doc *contracts.Document) error {
+	for _, saved := range c.docs {
+		if saved.OriginalName == doc.OriginalName && saved.ReferralID == doc.ReferralID && saved.PatientID == doc.PatientID {
+			doc.DocumentID = saved.DocumentID
+			doc.Version = saved.Version + 1
+		}
+	}
+	c.docs = append(c.docs, *doc)
+	return nil
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for x := 0; x < 400; x++ {
+		img.Set(x, x%300, color.RGBA{R: 200, A: 255})
+	}
+	return img
+}
+
+func TestSafeName(t *testing.T) {
+	assert.Equal(t, "x-ray_1.png", SafeName("../../x-ray 1.png", "image/png"))
+	assert.Equal(t, "scan.jpg", SafeName(`C:\Users\dr\scan`, "image/jpeg"))
+	assert.Equal(t, "photo.jpeg", SafeName("photo.JPEG", "image/jpeg"))
+	assert.Equal(t, "report.pdf", SafeName("report.png", "application/pdf"), "the content decides the extension")
+	assert.Equal(t, "document.txt", SafeName("...txt", "text/plain"))
+	assert.Equal(t, "notes.txt", SafeName("notes.t$xt", "text/plain"))
+}
+
+func TestIngestUniqueNames(t *testing.T) {
+	store := &memoryStore{files: make(map[string][]byte)}
+	catalog := &memoryCatalog{}
+	pipeline := NewPipeline(store, catalog, "bucket")
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, png.Encode(buf, testImage()))
+	names := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		doc, err := pipeline.Ingest(context.Background(), "ref1", File{Name: "scan.png", Data: buf.Bytes(), Source: contracts.DocumentSourceWeb})
+		assert.NoError(t, err)
+		names = append(names, doc.Name)
+	}
+	assert.Equal(t, []string{"scan.png", "scan-2.png", "scan-3.png"}, names)
+	assert.Contains(t, store.files, "ref1/scan-3.png")
+	assert.Len(t, catalog.docs, 3)
+	assert.Equal(t, 3, catalog.docs[2].Version, "re-uploads are versions of the document")
+	assert.Equal(t, catalog.docs[0].DocumentID, catalog.docs[2].DocumentID)
+	assert.Equal(t, "ref1/scan-3.png", catalog.docs[2].StoredKey)
+	assert.Equal(t, contracts.DocumentCategoryPhoto, catalog.docs[0].Category)
+	assert.Equal(t, "image/png", catalog.docs[0].ContentType)
+	assert.Equal(t, int64(buf.Len()), catalog.docs[0].Size)
+	assert.Len(t, catalog.docs[0].SHA256, 64)
+	assert.Equal(t, contracts.DocumentSourceWeb, catalog.docs[0].Source)
+}
+
+func TestIngestThumbnails(t *testing.T) {
+	store := &memoryStore{files: make(map[string][]byte)}
+	pipeline := NewPipeline(store, nil, "bucket")
+	pngBuf := bytes.NewBuffer(nil)
+	assert.NoError(t, png.Encode(pngBuf, testImage()))
+	gifBuf := bytes.NewBuffer(nil)
+	assert.NoError(t, gif.Encode(gifBuf, testImage(), nil))
+	for name, data := range map[string][]byte{"a.png": pngBuf.Bytes(), "b.gif": gifBuf.Bytes()} {
+		doc, err := pipeline.Ingest(context.Background(), "ref1", File{Name: name, Data: data})
+		assert.NoError(t, err)
+		thumbnail, err := base64.StdEncoding.DecodeString(doc.Thumbnail)
+		assert.NoError(t, err)
+		img, err := jpeg.Decode(bytes.NewReader(thumbnail))
+		assert.NoError(t, err, name)
+		if err == nil {
+			assert.Equal(t, ThumbnailWidth, img.Bounds().Dx())
+		}
+		assert.Equal(t, doc.Thumbnail, Media(*doc).Image)
+	}
+
+	doc, err := pipeline.Ingest(context.Background(), "ref1", File{Name: "notes.docx", Data: officeDocument(t, "word/document.xml")})
+	assert.NoError(t, err, "files without a preview are still stored")
+	assert.Equal(t, "", doc.Thumbnail)
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.wordprocessingml.document", doc.ContentType)
+
+	doc, err = pipeline.Ingest(context.Background(), "patient1", File{Name: "card.pdf", Data: []byte("%PDF-1.4\n"), Category: contracts.DocumentCategoryInsurance, PatientID: "patient1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", doc.ReferralID)
+	assert.Equal(t, "patient1", doc.PatientID)
+	assert.Equal(t, contracts.DocumentCategoryInsurance, doc.Category)
+
+	_, err = pipeline.Ingest(context.Background(), "ref1", File{Name: "notes.txt", Data: []byte("plain notes")})
+	assert.IsType(t, &ValidationError{}, err, "files are validated when they were not before")
+	assert.NotContains(t, store.files, "ref1/notes.txt")
+}
@@ -0,0 +1,171 @@
+package attachments
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// gpsInfoTag IFD0 pointer to the GPS IFD
+const gpsInfoTag = 0x8825
+
+// sizes of the TIFF field types, by type id
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// StripGPS .... copy of the image with the GPS fields of its EXIF metadata zeroed, the rest of the
+// metadata is kept. Images without GPS data come back unchanged.
+func StripGPS(contentType string, data []byte) []byte {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGGPS(data)
+	case "image/png":
+		return stripPNGGPS(data)
+	case "image/webp":
+		return stripWebPGPS(data)
+	case "image/tiff":
+		clean := append([]byte(nil), data...)
+		clearGPS(clean)
+		return clean
+	}
+	return data
+}
+
+// stripJPEGGPS walks the segments up to the image data and clears the APP1 EXIF one
+func stripJPEGGPS(data []byte) []byte {
+	clean := append([]byte(nil), data...)
+	i := 2
+	for i+4 <= len(clean) && clean[i] == 0xff {
+		marker := clean[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		size := int(binary.BigEndian.Uint16(clean[i+2:]))
+		if size < 2 || i+2+size > len(clean) {
+			break
+		}
+		segment := clean[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) {
+			clearGPS(segment[len(exifHeader):])
+		}
+		i += 2 + size
+	}
+	return clean
+}
+
+// stripPNGGPS clears the eXIf chunk and recomputes its CRC
+func stripPNGGPS(data []byte) []byte {
+	clean := append([]byte(nil), data...)
+	i := 8
+	for i+12 <= len(clean) {
+		size := int(binary.BigEndian.Uint32(clean[i:]))
+		if i+12+size > len(clean) {
+			break
+		}
+		chunkType := string(clean[i+4 : i+8])
+		if chunkType == "eXIf" {
+			if clearGPS(clean[i+8 : i+8+size]) {
+				binary.BigEndian.PutUint32(clean[i+8+size:], crc32.ChecksumIEEE(clean[i+4:i+8+size]))
+			}
+		}
+		if chunkType == "IDAT" || chunkType == "IEND" {
+			// eXIf must come before the image data
+			break
+		}
+		i += 12 + size
+	}
+	return clean
+}
+
+// stripWebPGPS clears the EXIF chunk of the RIFF container
+func stripWebPGPS(data []byte) []byte {
+	clean := append([]byte(nil), data...)
+	i := 12
+	for i+8 <= len(clean) {
+		size := int(binary.LittleEndian.Uint32(clean[i+4:]))
+		if i+8+size > len(clean) {
+			break
+		}
+		if string(clean[i:i+4]) == "EXIF" {
+			chunk := clean[i+8 : i+8+size]
+			if bytes.HasPrefix(chunk, exifHeader) {
+				chunk = chunk[len(exifHeader):]
+			}
+			clearGPS(chunk)
+		}
+		// chunks are padded to an even size
+		i += 8 + size + size%2
+	}
+	return clean
+}
+
+// clearGPS zeroes the entries and values of the GPS IFD of a TIFF structure in place and leaves it
+// with no entries, it reports whether there was one
+func clearGPS(tiff []byte) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+	ifd := order.Uint32(tiff[4:])
+	if uint64(ifd)+2 > uint64(len(tiff)) {
+		return false
+	}
+	entries := uint32(order.Uint16(tiff[ifd:]))
+	found := false
+	for e := uint32(0); e < entries; e++ {
+		entry := uint64(ifd) + 2 + uint64(e)*12
+		if entry+12 > uint64(len(tiff)) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == gpsInfoTag {
+			found = clearIFD(tiff, order, order.Uint32(tiff[entry+8:])) || found
+		}
+	}
+	return found
+}
+
+func clearIFD(tiff []byte, order binary.ByteOrder, ifd uint32) bool {
+	if uint64(ifd)+2 > uint64(len(tiff)) {
+		return false
+	}
+	entries := uint32(order.Uint16(tiff[ifd:]))
+	for e := uint32(0); e < entries; e++ {
+		entry := uint64(ifd) + 2 + uint64(e)*12
+		if entry+12 > uint64(len(tiff)) {
+			break
+		}
+		size := uint64(tiffTypeSizes[order.Uint16(tiff[entry+2:])]) * uint64(order.Uint32(tiff[entry+4:]))
+		if size > 4 {
+			offset := uint64(order.Uint32(tiff[entry+8:]))
+			if offset+size <= uint64(len(tiff)) {
+				zero(tiff[offset : offset+size])
+			}
+		}
+		zero(tiff[entry : entry+12])
+	}
+	order.PutUint16(tiff[ifd:], 0)
+	return true
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
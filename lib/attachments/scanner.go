@@ -0,0 +1,28 @@
+package attachments
+
+import (
+	"bytes"
+	"context"
+)
+
+// Scanner checks file contents for malware, an antivirus service plugs in here.
+type Scanner interface {
+	// Scan returns the name of the threat found, empty when the file is clean. An error means the
+	// file could not be scanned and is refused.
+	Scan(ctx context.Context, name string, data []byte) (string, error)
+}
+
+// eicarSignature the antivirus test file, split so this source does not trip scanners itself
+var eicarSignature = []byte(`X5O!P%@AP[4\PZX54(P^)7CC)7}$` + `EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`)
+
+// LocalScanner .... stand-in until a real scanner is configured, it only knows the EICAR test file so
+// the rejection path can be exercised end to end
+type LocalScanner struct{}
+
+// Scan ....
+func (LocalScanner) Scan(ctx context.Context, name string, data []byte) (string, error) {
+	if bytes.Contains(data, eicarSignature) {
+		return "EICAR-Test-File", nil
+	}
+	return "", nil
+}
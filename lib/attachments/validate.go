@@ -0,0 +1,273 @@
+package attachments
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// codes of a ValidationError
+const (
+	CodeFileTooLarge    = "file_too_large"
+	CodeRequestTooLarge = "request_too_large"
+	CodeNotAllowed      = "type_not_allowed"
+	CodeTypeMismatch    = "type_mismatch"
+	CodeExecutable      = "executable"
+	CodeInfected        = "infected"
+)
+
+// content types that are accepted, with the extensions a file of the type may have. The first
+// extension is used when a name lacks one.
+var allowedTypes = map[string][]string{
+	"image/jpeg":                    {".jpg", ".jpeg", ".jpe", ".jfif"},
+	"image/png":                     {".png"},
+	"image/gif":                     {".gif"},
+	"image/webp":                    {".webp"},
+	"image/tiff":                    {".tif", ".tiff"},
+	"image/bmp":                     {".bmp"},
+	"application/pdf":               {".pdf"},
+	"application/dicom":             {".dcm", ".dicom"},
+	"application/msword":            {".doc", ".dot"},
+	"application/vnd.ms-excel":      {".xls", ".xlt"},
+	"application/vnd.ms-powerpoint": {".ppt", ".pps"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {".docx"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {".xlsx"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {".pptx"},
+	"application/rtf": {".rtf"},
+}
+
+// extensions that are refused whatever the content is
+var executableExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".com": true, ".scr": true, ".msi": true, ".bat": true, ".cmd": true,
+	".ps1": true, ".vbs": true, ".js": true, ".jar": true, ".sh": true, ".app": true, ".apk": true,
+}
+
+// magic numbers of executables and scripts
+var executableMagic = [][]byte{
+	[]byte("MZ"),             // windows PE
+	[]byte("\x7fELF"),        // linux
+	{0xfe, 0xed, 0xfa, 0xce}, // mach-o
+	{0xfe, 0xed, 0xfa, 0xcf}, // mach-o 64
+	{0xce, 0xfa, 0xed, 0xfe}, // mach-o, little endian
+	{0xcf, 0xfa, 0xed, 0xfe}, // mach-o 64, little endian
+	{0xca, 0xfe, 0xba, 0xbe}, // mach-o universal, java class
+	[]byte("#!"),             // scripts
+	[]byte("dex\n"),          // android
+}
+
+// oleMagic compound file of the pre 2007 office formats
+var oleMagic = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// Limits .... size limits of one route, zero means unlimited
+type Limits struct {
+	MaxFileSize    int64
+	MaxRequestSize int64
+}
+
+// ValidationError .... why a file was refused, sent to clients as is
+type ValidationError struct {
+	Code        string `json:"code"`
+	File        string `json:"file"`
+	ContentType string `json:"contentType,omitempty"`
+	Message     string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.File == "" {
+		return e.Message
+	}
+	return e.File + ": " + e.Message
+}
+
+// Validator .... checks uploads against the allow-list, the limits and the scanner
+type Validator struct {
+	scanner Scanner
+}
+
+// NewValidator .... a nil scanner uses the LocalScanner
+func NewValidator(scanner Scanner) *Validator {
+	if scanner == nil {
+		scanner = LocalScanner{}
+	}
+	return &Validator{scanner: scanner}
+}
+
+// CheckAll .... validates the files of one request, nothing is accepted unless all of them are
+func (v *Validator) CheckAll(ctx context.Context, limits Limits, files []File) ([]File, error) {
+	var total int64
+	for _, file := range files {
+		total += int64(len(file.Data))
+	}
+	if limits.MaxRequestSize > 0 && total > limits.MaxRequestSize {
+		return nil, &ValidationError{
+			Code:    CodeRequestTooLarge,
+			Message: fmt.Sprintf("uploads are limited to %s per request", formatSize(limits.MaxRequestSize)),
+		}
+	}
+	checked := make([]File, 0, len(files))
+	for _, file := range files {
+		file, err := v.Check(ctx, limits, file)
+		if err != nil {
+			return nil, err
+		}
+		checked = append(checked, file)
+	}
+	return checked, nil
+}
+
+// Check .... validates one file. The returned file has its ContentType set and GPS data removed from
+// image metadata.
+func (v *Validator) Check(ctx context.Context, limits Limits, file File) (File, error) {
+	if limits.MaxFileSize > 0 && int64(len(file.Data)) > limits.MaxFileSize {
+		return file, &ValidationError{
+			Code:    CodeFileTooLarge,
+			File:    file.Name,
+			Message: fmt.Sprintf("files are limited to %s", formatSize(limits.MaxFileSize)),
+		}
+	}
+	threat, err := v.scanner.Scan(ctx, file.Name, file.Data)
+	if err != nil {
+		return file, fmt.Errorf("cannot scan %s: %v", file.Name, err)
+	}
+	if threat != "" {
+		return file, &ValidationError{Code: CodeInfected, File: file.Name, Message: "file is infected with " + threat}
+	}
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	if executableExtensions[ext] || isExecutable(file.Data) {
+		return file, &ValidationError{Code: CodeExecutable, File: file.Name, Message: "executable files are not accepted"}
+	}
+	contentType := Sniff(file.Data)
+	known, ok := allowedTypes[contentType]
+	if !ok {
+		return file, &ValidationError{
+			Code:        CodeNotAllowed,
+			File:        file.Name,
+			ContentType: contentType,
+			Message:     "only images, PDF, DICOM and office documents are accepted",
+		}
+	}
+	// DICOM files are often named by their UIDs, which look like extensions
+	if ext != "" && contentType != "application/dicom" && !hasExtension(known, ext) {
+		return file, &ValidationError{
+			Code:        CodeTypeMismatch,
+			File:        file.Name,
+			ContentType: contentType,
+			Message:     fmt.Sprintf("content is %s but the name ends with %s", contentType, ext),
+		}
+	}
+	file.ContentType = contentType
+	file.Data = StripGPS(contentType, file.Data)
+	return file, nil
+}
+
+// Sniff .... content type from the magic bytes, application/octet-stream when unknown
+func Sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) > 14:
+		return "image/bmp"
+	case bytes.HasPrefix(data, []byte("%PDF-")):
+		return "application/pdf"
+	case len(data) >= 132 && string(data[128:132]) == "DICM":
+		return "application/dicom"
+	case bytes.HasPrefix(data, []byte("{\\rtf")):
+		return "application/rtf"
+	case bytes.HasPrefix(data, oleMagic):
+		return sniffOLE(data)
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return sniffOOXML(data)
+	}
+	return "application/octet-stream"
+}
+
+// sniffOLE .... the office application of a compound file, from the stream names in its directory
+func sniffOLE(data []byte) string {
+	switch {
+	case bytes.Contains(data, utf16Name("WordDocument")):
+		return "application/msword"
+	case bytes.Contains(data, utf16Name("Workbook")), bytes.Contains(data, utf16Name("Book")):
+		return "application/vnd.ms-excel"
+	case bytes.Contains(data, utf16Name("PowerPoint Document")):
+		return "application/vnd.ms-powerpoint"
+	}
+	return "application/x-ole-storage"
+}
+
+// sniffOOXML .... office documents are zips with a content types part and a folder per application,
+// any other zip is not accepted
+func sniffOOXML(data []byte) string {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "application/zip"
+	}
+	contentTypes := false
+	folder := ""
+	for _, part := range archive.File {
+		switch {
+		case part.Name == "[Content_Types].xml":
+			contentTypes = true
+		case strings.HasPrefix(part.Name, "word/"):
+			folder = "word"
+		case strings.HasPrefix(part.Name, "xl/"):
+			folder = "xl"
+		case strings.HasPrefix(part.Name, "ppt/"):
+			folder = "ppt"
+		}
+	}
+	if contentTypes {
+		switch folder {
+		case "word":
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		case "xl":
+			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case "ppt":
+			return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+		}
+	}
+	return "application/zip"
+}
+
+func utf16Name(name string) []byte {
+	encoded := make([]byte, 0, len(name)*2)
+	for _, r := range name {
+		encoded = append(encoded, byte(r), 0)
+	}
+	return encoded
+}
+
+func isExecutable(data []byte) bool {
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExtension(known []string, ext string) bool {
+	for _, knownExt := range known {
+		if ext == knownExt {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSize(size int64) string {
+	if size >= 1<<20 && size%(1<<20) == 0 {
+		return fmt.Sprintf("%d MB", size>>20)
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
@@ -0,0 +1,133 @@
+package attachments
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func officeDocument(t *testing.T, parts ...string) []byte {
+	buf := bytes.NewBuffer(nil)
+	archive := zip.NewWriter(buf)
+	for _, part := range append([]string{"[Content_Types].xml"}, parts...) {
+		w, err := archive.Create(part)
+		assert.NoError(t, err)
+		w.Write([]byte("<xml/>"))
+	}
+	assert.NoError(t, archive.Close())
+	return buf.Bytes()
+}
+
+// jpegWithGPS a JPEG whose EXIF has a GPS IFD with a latitude of 40 deg 44' 55"
+func jpegWithGPS(t *testing.T) []byte {
+	order := binary.LittleEndian
+	tiff := make([]byte, 80)
+	copy(tiff, "II")
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	// IFD0, one entry pointing at the GPS IFD
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], gpsInfoTag)
+	order.PutUint16(tiff[12:], 4)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint32(tiff[18:], 26)
+	// GPS IFD, latitude ref inline and latitude as three rationals at 56
+	order.PutUint16(tiff[26:], 2)
+	order.PutUint16(tiff[28:], 1)
+	order.PutUint16(tiff[30:], 2)
+	order.PutUint32(tiff[32:], 2)
+	copy(tiff[36:], "N")
+	order.PutUint16(tiff[40:], 2)
+	order.PutUint16(tiff[42:], 5)
+	order.PutUint32(tiff[44:], 3)
+	order.PutUint32(tiff[48:], 56)
+	for i, value := range []uint32{40, 44, 55} {
+		order.PutUint32(tiff[56+i*8:], value)
+		order.PutUint32(tiff[60+i*8:], 1)
+	}
+	segment := append(append([]byte(nil), exifHeader...), tiff...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	encoded := bytes.NewBuffer(nil)
+	assert.NoError(t, jpeg.Encode(encoded, testImage(), nil))
+	data := append([]byte{0xff, 0xd8}, app1...)
+	data = append(data, segment...)
+	return append(data, encoded.Bytes()[2:]...)
+}
+
+func TestSniff(t *testing.T) {
+	pngBuf := bytes.NewBuffer(nil)
+	assert.NoError(t, png.Encode(pngBuf, testImage()))
+	dicom := append(make([]byte, 128), []byte("DICM")...)
+	assert.Equal(t, "image/png", Sniff(pngBuf.Bytes()))
+	assert.Equal(t, "application/pdf", Sniff([]byte("%PDF-1.4\n")))
+	assert.Equal(t, "application/dicom", Sniff(dicom))
+	assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Sniff(officeDocument(t, "xl/workbook.xml")))
+	assert.Equal(t, "application/zip", Sniff(officeDocument(t, "payload.bin")))
+	assert.Equal(t, "application/octet-stream", Sniff([]byte("hello")))
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	validator := NewValidator(nil)
+	limits := Limits{MaxFileSize: 1 << 20, MaxRequestSize: 2 << 20}
+	pdf := []byte("%PDF-1.4\n")
+	codeOf := func(err error) string {
+		if validationErr, ok := err.(*ValidationError); ok {
+			return validationErr.Code
+		}
+		return ""
+	}
+
+	file, err := validator.Check(ctx, limits, File{Name: "referral.pdf", Data: pdf})
+	assert.NoError(t, err)
+	assert.Equal(t, "application/pdf", file.ContentType)
+	_, err = validator.Check(ctx, limits, File{Name: "1.2.840.10008", Data: append(make([]byte, 128), []byte("DICM")...)})
+	assert.NoError(t, err, "DICOM names are not checked against the content")
+
+	_, err = validator.Check(ctx, limits, File{Name: "referral.png", Data: pdf})
+	assert.Equal(t, CodeTypeMismatch, codeOf(err))
+	_, err = validator.Check(ctx, limits, File{Name: "setup.pdf", Data: []byte("MZ\x90\x00")})
+	assert.Equal(t, CodeExecutable, codeOf(err))
+	_, err = validator.Check(ctx, limits, File{Name: "install.exe", Data: pdf})
+	assert.Equal(t, CodeExecutable, codeOf(err))
+	_, err = validator.Check(ctx, limits, File{Name: "archive.zip", Data: officeDocument(t, "payload.bin")})
+	assert.Equal(t, CodeNotAllowed, codeOf(err))
+	_, err = validator.Check(ctx, limits, File{Name: "eicar.pdf", Data: append(pdf, eicarSignature...)})
+	assert.Equal(t, CodeInfected, codeOf(err))
+	_, err = validator.Check(ctx, limits, File{Name: "large.pdf", Data: append(pdf, make([]byte, 1<<20)...)})
+	assert.Equal(t, CodeFileTooLarge, codeOf(err))
+
+	large := File{Name: "large.pdf", Data: append(pdf, make([]byte, 1<<19)...)}
+	_, err = validator.CheckAll(ctx, limits, []File{large, large, large, large})
+	assert.Equal(t, CodeRequestTooLarge, codeOf(err))
+	files, err := validator.CheckAll(ctx, limits, []File{large, large})
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestStripGPS(t *testing.T) {
+	data := jpegWithGPS(t)
+	latitude := make([]byte, 8)
+	binary.LittleEndian.PutUint32(latitude, 40)
+	binary.LittleEndian.PutUint32(latitude[4:], 1)
+	assert.True(t, bytes.Contains(data, latitude))
+
+	file, err := NewValidator(nil).Check(context.Background(), Limits{}, File{Name: "photo.jpg", Data: data})
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(file.Data, latitude))
+	assert.Equal(t, len(data), len(file.Data))
+	assert.True(t, bytes.Contains(data, latitude), "the original is left alone")
+	_, err = jpeg.Decode(bytes.NewReader(file.Data))
+	assert.NoError(t, err, "the image still decodes")
+
+	plain := bytes.NewBuffer(nil)
+	assert.NoError(t, jpeg.Encode(plain, testImage(), nil))
+	assert.Equal(t, plain.Bytes(), StripGPS("image/jpeg", plain.Bytes()))
+}
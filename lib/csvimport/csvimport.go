@@ -0,0 +1,243 @@
+package csvimport
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/phonenumbers"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+// Fields that can be mapped to a CSV column
+const (
+	FieldFirstName     = "firstName"
+	FieldLastName      = "lastName"
+	FieldPhone         = "phone"
+	FieldEmail         = "email"
+	FieldDOB           = "dob"
+	FieldClinicPlaceID = "clinicPlaceId"
+	FieldClinic        = "clinic"
+	FieldReasons       = "reasons"
+	FieldHistory       = "history"
+	FieldTooth         = "tooth"
+	FieldNotes         = "notes"
+	FieldStatus        = "status"
+)
+
+var knownFields = map[string]bool{
+	FieldFirstName: true, FieldLastName: true, FieldPhone: true, FieldEmail: true, FieldDOB: true,
+	FieldClinicPlaceID: true, FieldClinic: true, FieldReasons: true, FieldHistory: true, FieldTooth: true,
+	FieldNotes: true, FieldStatus: true,
+}
+
+var dobLayouts = []string{
+	"2006-01-02",
+	"2006/01/02",
+	"01/02/2006",
+	"1/2/2006",
+	"01-02-2006",
+	"1-2-2006",
+	"Jan 2 2006",
+	"Jan 2, 2006",
+	"January 2 2006",
+	"January 2, 2006",
+}
+
+// Mapping ... field name to CSV header, e.g. {"firstName": "Patient First", "dob": "Birth Date"}
+type Mapping map[string]string
+
+// Row .... one CSV line mapped to referral fields, Err is set when the row failed validation
+type Row struct {
+	Line          int
+	FirstName     string
+	LastName      string
+	Phone         string
+	Email         string
+	DOB           contracts.DOB
+	ClinicPlaceID string
+	Clinic        string
+	Reasons       []string
+	History       []string
+	Tooth         []string
+	Notes         string
+	Status        string
+	Err           error
+}
+
+// ParseMapping ... decodes a JSON mapping spec, names and the other clinic are required
+func ParseMapping(data []byte) (Mapping, error) {
+	var mapping Mapping
+	err := json.Unmarshal(data, &mapping)
+	if err != nil {
+		return nil, fmt.Errorf("bad column mapping: %v", err)
+	}
+	for field, header := range mapping {
+		if !knownFields[field] {
+			return nil, fmt.Errorf("unknown field %q in column mapping", field)
+		}
+		if strings.TrimSpace(header) == "" {
+			delete(mapping, field)
+		}
+	}
+	if mapping[FieldFirstName] == "" || mapping[FieldLastName] == "" {
+		return nil, fmt.Errorf("column mapping needs %s and %s", FieldFirstName, FieldLastName)
+	}
+	if mapping[FieldClinicPlaceID] == "" && mapping[FieldClinic] == "" {
+		return nil, fmt.Errorf("column mapping needs %s or %s", FieldClinicPlaceID, FieldClinic)
+	}
+	return mapping, nil
+}
+
+// ReadRows ... reads the header and every row of the CSV, at most maxRows data rows are accepted.
+// Rows that fail validation are returned with Err set so they can be reported back.
+func ReadRows(r io.Reader, mapping Mapping, maxRows int) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read csv header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	fieldColumns := make(map[string]int)
+	for field, name := range mapping {
+		index, ok := columns[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("column %q mapped to %s is not in the csv header", name, field)
+		}
+		fieldColumns[field] = index
+	}
+	rows := make([]Row, 0)
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("unable to read csv line %d: %v", line, err)
+		}
+		if isBlank(record) {
+			continue
+		}
+		if len(rows) >= maxRows {
+			return nil, fmt.Errorf("csv has more than %d rows", maxRows)
+		}
+		value := func(field string) string {
+			index, ok := fieldColumns[field]
+			if !ok || index >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[index])
+		}
+		rows = append(rows, parseRow(line, value))
+	}
+	return rows, nil
+}
+
+func parseRow(line int, value func(string) string) Row {
+	row := Row{
+		Line:          line,
+		FirstName:     value(FieldFirstName),
+		LastName:      value(FieldLastName),
+		Email:         strings.ToLower(value(FieldEmail)),
+		ClinicPlaceID: value(FieldClinicPlaceID),
+		Clinic:        value(FieldClinic),
+		Reasons:       splitList(value(FieldReasons)),
+		History:       splitList(value(FieldHistory)),
+		Tooth:         splitList(value(FieldTooth)),
+		Notes:         value(FieldNotes),
+		Status:        value(FieldStatus),
+	}
+	if row.FirstName == "" || row.LastName == "" {
+		row.Err = fmt.Errorf("patient first and last name are required")
+		return row
+	}
+	if phone := value(FieldPhone); phone != "" {
+		normalized, err := NormalizePhone(phone, "US")
+		if err != nil {
+			row.Err = err
+			return row
+		}
+		row.Phone = normalized
+	}
+	if row.Phone == "" && row.Email == "" {
+		row.Err = fmt.Errorf("patient phone or email is required")
+		return row
+	}
+	if dob := value(FieldDOB); dob != "" {
+		parsed, err := ParseDOB(dob, time.Now())
+		if err != nil {
+			row.Err = err
+			return row
+		}
+		row.DOB = parsed
+	}
+	if row.ClinicPlaceID == "" && row.Clinic == "" {
+		row.Err = fmt.Errorf("clinic is required")
+	}
+	return row
+}
+
+// NormalizePhone ... returns the number as +<country code><national number>, the same shape
+// processReferral stores, defaultRegion is used for numbers without a country code
+func NormalizePhone(phone string, defaultRegion string) (string, error) {
+	pnum, err := phonenumbers.Parse(phone, defaultRegion)
+	if err != nil || pnum.NationalNumber == nil || !phonenumbers.IsValidNumber(pnum) {
+		return "", fmt.Errorf("invalid phone number %q", phone)
+	}
+	countryCode := "+1"
+	if pnum.CountryCode != nil {
+		countryCode = "+" + strconv.Itoa(int(*pnum.CountryCode))
+	}
+	return countryCode + strconv.FormatUint(pnum.GetNationalNumber(), 10), nil
+}
+
+// ParseDOB ... accepts the common date layouts, US month/day order is assumed for slashes
+func ParseDOB(value string, now time.Time) (contracts.DOB, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dobLayouts {
+		dob, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if dob.After(now) || dob.Year() < 1900 {
+			return contracts.DOB{}, fmt.Errorf("date of birth %q is out of range", value)
+		}
+		return contracts.DOB{
+			Year:  strconv.Itoa(dob.Year()),
+			Month: fmt.Sprintf("%02d", int(dob.Month())),
+			Day:   fmt.Sprintf("%02d", dob.Day()),
+		}, nil
+	}
+	return contracts.DOB{}, fmt.Errorf("unrecognized date of birth %q", value)
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '|' }) {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func isBlank(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
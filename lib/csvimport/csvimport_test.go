@@ -0,0 +1,63 @@
+package csvimport
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+func TestParseMapping(t *testing.T) {
+	_, err := ParseMapping([]byte(`{"firstName": "First", "lastName": "Last"}`))
+	assert.Error(t, err, "the other clinic must be mapped")
+	_, err = ParseMapping([]byte(`{"firstName": "First", "lastName": "Last", "clinic": "Specialist", "ssn": "SSN"}`))
+	assert.Error(t, err, "unknown fields are rejected")
+	mapping, err := ParseMapping([]byte(`{"firstName": "First", "lastName": "Last", "clinic": "Specialist", "dob": ""}`))
+	assert.NoError(t, err)
+	assert.NotContains(t, mapping, FieldDOB)
+}
+
+func TestReadRows(t *testing.T) {
+	mapping := Mapping{
+		FieldFirstName: "First",
+		FieldLastName:  "Last",
+		FieldPhone:     "Cell",
+		FieldDOB:       "Birth Date",
+		FieldClinic:    "Specialist",
+		FieldTooth:     "Teeth",
+	}
+	csv := "\ufefffirst,last,Cell,Birth Date,Specialist,Teeth\n" +
+		"Jane,Doe,(512) 555-0134,04/07/1985,Smile Endo Austin,3; 14\n" +
+		",,,,,\n" +
+		"John,Roe,12,1990-01-01,Smile Endo Austin,\n" +
+		"Ann,Poe,+44 20 7946 0958,31/12/1990,Smile Endo Austin,\n"
+	rows, err := ReadRows(strings.NewReader(csv), mapping, 10)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 3, "blank lines are skipped")
+
+	assert.NoError(t, rows[0].Err)
+	assert.Equal(t, 2, rows[0].Line)
+	assert.Equal(t, "+15125550134", rows[0].Phone)
+	assert.Equal(t, contracts.DOB{Year: "1985", Month: "04", Day: "07"}, rows[0].DOB)
+	assert.Equal(t, []string{"3", "14"}, rows[0].Tooth)
+
+	assert.Equal(t, 4, rows[1].Line)
+	assert.Error(t, rows[1].Err, "bad phone")
+	assert.Error(t, rows[2].Err, "day first dates are not accepted")
+
+	_, err = ReadRows(strings.NewReader(csv), mapping, 2)
+	assert.Error(t, err, "row limit")
+	_, err = ReadRows(strings.NewReader("first,last\nJane,Doe\n"), mapping, 10)
+	assert.Error(t, err, "mapped column missing from header")
+}
+
+func TestParseDOB(t *testing.T) {
+	now := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+	dob, err := ParseDOB("March 5, 1960", now)
+	assert.NoError(t, err)
+	assert.Equal(t, contracts.DOB{Year: "1960", Month: "03", Day: "05"}, dob)
+	_, err = ParseDOB("2021-04-01", now)
+	assert.Error(t, err, "future dates are rejected")
+}
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/superdentist/superdentist-backend/contracts"
 	"github.com/superdentist/superdentist-backend/global"
@@ -102,8 +105,7 @@ func (db *DSReferral) GetReferralFromEmail(ctx context.Context, emailID string)
 		return nil, fmt.Errorf("no referrals found: %v", err)
 	}
 	for _, ref := range returnedReferrals {
-		if strings.Contains(strings.ToLower(ref.Status.SPStatus), "complete") || strings.Contains(strings.ToLower(ref.Status.SPStatus), "finish") ||
-			strings.Contains(strings.ToLower(ref.Status.SPStatus), "close") {
+		if IsClosedStatus(ref.Status.SPStatus) || ref.ForwardedTo != "" {
 			continue
 		}
 		allReferrals = append(allReferrals, ref)
@@ -111,6 +113,12 @@ func (db *DSReferral) GetReferralFromEmail(ctx context.Context, emailID string)
 	return allReferrals, nil
 }
 
+// IsClosedStatus ..... whether the specialist status closes the referral, completed, finished or closed
+func IsClosedStatus(status string) bool {
+	status = strings.ToLower(status)
+	return strings.Contains(status, "complete") || strings.Contains(status, "finish") || strings.Contains(status, "close")
+}
+
 // GetReferralUsingFields .....
 func (db *DSReferral) GetReferralUsingFields(ctx context.Context, fromEmail string, pfName string, plName string) ([]contracts.DSReferral, error) {
 	returnedReferrals := make([]contracts.DSReferral, 0)
@@ -136,8 +144,7 @@ func (db *DSReferral) GetReferralUsingFields(ctx context.Context, fromEmail stri
 	}
 	for _, ref := range returnedReferrals {
 		if !ref.IsSummary {
-			if strings.Contains(strings.ToLower(ref.Status.SPStatus), "complete") || strings.Contains(strings.ToLower(ref.Status.SPStatus), "finish") ||
-				strings.Contains(strings.ToLower(ref.Status.SPStatus), "close") {
+			if IsClosedStatus(ref.Status.SPStatus) {
 				continue
 			}
 		}
@@ -162,8 +169,7 @@ func (db *DSReferral) ReferralFromPatientPhone(ctx context.Context, patientPhone
 	}
 	outputRef := make([]contracts.DSReferral, 0)
 	for _, ref := range returnedReferrals {
-		if strings.Contains(strings.ToLower(ref.Status.SPStatus), "complete") || strings.Contains(strings.ToLower(ref.Status.SPStatus), "finish") ||
-			strings.Contains(strings.ToLower(ref.Status.SPStatus), "close") {
+		if IsClosedStatus(ref.Status.SPStatus) || ref.ForwardedTo != "" {
 			continue
 		}
 		outputRef = append(outputRef, ref)
@@ -292,6 +298,175 @@ func (db *DSReferral) GetAllReferralsSPPaginate(ctx context.Context, addressID s
 	return returnedReferrals, nextCursor.String(), nil
 }
 
+// GetUpcomingAppointments ..... referrals sent to or from the clinic with a booked appointment after since
+func (db *DSReferral) GetUpcomingAppointments(ctx context.Context, placeID string, since time.Time) ([]contracts.DSReferral, error) {
+	returnedReferrals := make([]contracts.DSReferral, 0)
+	for _, field := range []string{"ToPlaceID =", "FromPlaceID ="} {
+		currentReferrals := make([]contracts.DSReferral, 0)
+		qP := datastore.NewQuery("ClinicReferrals")
+		if global.Options.DSName != "" {
+			qP = qP.Namespace(global.Options.DSName)
+		}
+		qP = qP.Filter(field, placeID).Filter("IsDirty =", false).Filter("Appointment.Start >=", since)
+		_, err := db.client.GetAll(ctx, qP, &currentReferrals)
+		if err != nil {
+			return returnedReferrals, fmt.Errorf("no appointments found: %v", err)
+		}
+		for _, ref := range currentReferrals {
+			if field == "FromPlaceID =" && ref.ToPlaceID == placeID {
+				continue
+			}
+			returnedReferrals = append(returnedReferrals, ref)
+		}
+	}
+	return returnedReferrals, nil
+}
+
+// GetBookedAppointmentsBetween ..... referrals with a booked appointment starting in [from, to)
+func (db *DSReferral) GetBookedAppointmentsBetween(ctx context.Context, from time.Time, to time.Time) ([]contracts.DSReferral, error) {
+	returnedReferrals := make([]contracts.DSReferral, 0)
+	qP := datastore.NewQuery("ClinicReferrals")
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	qP = qP.Filter("Appointment.Status =", contracts.AppointmentBooked).Filter("Appointment.Start >=", from).Filter("Appointment.Start <", to)
+	_, err := db.client.GetAll(ctx, qP, &returnedReferrals)
+	if err != nil {
+		return returnedReferrals, fmt.Errorf("no appointments found: %v", err)
+	}
+	outputRef := make([]contracts.DSReferral, 0)
+	for _, ref := range returnedReferrals {
+		if ref.IsDirty {
+			continue
+		}
+		outputRef = append(outputRef, ref)
+	}
+	return outputRef, nil
+}
+
+// ClaimAppointmentReminders ..... marks the reminder offsets as sent inside a transaction and returns the ones
+// this call claimed, so only one instance sends a given reminder. Nothing is claimed if the appointment moved.
+func (db *DSReferral) ClaimAppointmentReminders(ctx context.Context, refID string, sequence int, offsets []string) (*contracts.DSReferral, []string, error) {
+	primaryKey := datastore.NameKey("ClinicReferrals", refID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var referral contracts.DSReferral
+	var claimed []string
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		claimed = make([]string, 0)
+		if err := tx.Get(primaryKey, &referral); err != nil {
+			return err
+		}
+		if referral.Appointment.Status != contracts.AppointmentBooked || referral.Appointment.Sequence != sequence {
+			return nil
+		}
+		for _, offset := range offsets {
+			if !Find(referral.Appointment.RemindersSent, offset) {
+				claimed = append(claimed, offset)
+				referral.Appointment.RemindersSent = append(referral.Appointment.RemindersSent, offset)
+			}
+		}
+		if len(claimed) == 0 {
+			return nil
+		}
+		_, err := tx.Put(primaryKey, &referral)
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot claim reminders: %v", err)
+	}
+	return &referral, claimed, nil
+}
+
+// EscalateReferral ..... moves an overdue referral to the given escalation level inside a transaction,
+// returns false when another instance got there first or the status moved in the meantime
+func (db *DSReferral) EscalateReferral(ctx context.Context, refID string, statusChangedOn time.Time, rule string, level int) (*contracts.DSReferral, bool, error) {
+	primaryKey := datastore.NameKey("ClinicReferrals", refID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var referral contracts.DSReferral
+	escalated := false
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		escalated = false
+		if err := tx.Get(primaryKey, &referral); err != nil {
+			return err
+		}
+		if !referral.StatusChangedOn.Equal(statusChangedOn) || referral.EscalationLevel >= level {
+			return nil
+		}
+		referral.Overdue = true
+		referral.OverdueRule = rule
+		referral.EscalationLevel = level
+		referral.LastEscalatedOn = time.Now()
+		if _, err := tx.Put(primaryKey, &referral); err != nil {
+			return err
+		}
+		escalated = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot escalate referral: %v", err)
+	}
+	return &referral, escalated, nil
+}
+
+// ClaimForward ..... reserves the referral for a forward inside a transaction, so only one forward of it
+// goes ahead. Returns false when it was forwarded already or another forward started less than timeout ago.
+func (db *DSReferral) ClaimForward(ctx context.Context, refID string, now time.Time, timeout time.Duration) (*contracts.DSReferral, bool, error) {
+	primaryKey := datastore.NameKey("ClinicReferrals", refID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var referral contracts.DSReferral
+	claimed := false
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		claimed = false
+		if err := tx.Get(primaryKey, &referral); err != nil {
+			return err
+		}
+		if referral.ForwardedTo != "" || (!referral.ForwardingOn.IsZero() && now.Sub(referral.ForwardingOn) < timeout) {
+			return nil
+		}
+		// datastore keeps microseconds, ReleaseForward compares the claim it reads back
+		referral.ForwardingOn = now.Truncate(time.Microsecond)
+		if _, err := tx.Put(primaryKey, &referral); err != nil {
+			return err
+		}
+		claimed = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot claim forward: %v", err)
+	}
+	return &referral, claimed, nil
+}
+
+// ReleaseForward ..... drops the reservation ClaimForward made at claimedOn, for a forward that failed
+func (db *DSReferral) ReleaseForward(ctx context.Context, refID string, claimedOn time.Time) error {
+	primaryKey := datastore.NameKey("ClinicReferrals", refID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var referral contracts.DSReferral
+		if err := tx.Get(primaryKey, &referral); err != nil {
+			return err
+		}
+		if !referral.ForwardingOn.Equal(claimedOn) {
+			return nil
+		}
+		referral.ForwardingOn = time.Time{}
+		_, err := tx.Put(primaryKey, &referral)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot release forward: %v", err)
+	}
+	return nil
+}
+
 // DeleteReferral .....
 func (db *DSReferral) DeleteReferral(ctx context.Context, refID string) (*contracts.DSReferral, error) {
 	primaryKey := datastore.NameKey("ClinicReferrals", refID, nil)
@@ -306,25 +481,160 @@ func (db *DSReferral) DeleteReferral(ctx context.Context, refID string) (*contra
 	return &referral, nil
 }
 
-// CreateMessage .....
+// CreateMessage ..... saves new or changed messages of the referral and keeps its message index in step,
+// in one transaction
 func (db *DSReferral) CreateMessage(ctx context.Context, referral contracts.DSReferral, comms []contracts.Comment) error {
 	primaryKey := datastore.NameKey("ReferralMessages", referral.ReferralID, nil)
 	if global.Options.DSName != "" {
 		primaryKey.Namespace = global.Options.DSName
 	}
+	keys := make([]*datastore.Key, 0, len(comms))
 	for _, comment := range comms {
 		secondarKey := datastore.NameKey("ReferralMessages", comment.MessageID, primaryKey)
 		if global.Options.DSName != "" {
 			secondarKey.Namespace = global.Options.DSName
 		}
-		_, err := db.client.Put(ctx, secondarKey, &comment)
+		keys = append(keys, secondarKey)
+	}
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		index, err := db.txMessageIndex(ctx, tx, referral.ReferralID, &referral)
 		if err != nil {
-			return fmt.Errorf("cannot register clinic with sd: %v", err)
+			return err
+		}
+		// a message saved again is counted once, as it is now
+		existing := make([]contracts.Comment, len(comms))
+		err = tx.GetMulti(keys, existing)
+		multiErr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return err
 		}
+		for i := range existing {
+			if isMulti && multiErr[i] != nil {
+				if multiErr[i] != datastore.ErrNoSuchEntity {
+					return multiErr[i]
+				}
+				continue
+			}
+			index.Add(existing[i], -1)
+		}
+		for _, comment := range comms {
+			index.Add(comment, 1)
+		}
+		if _, err := tx.PutMulti(keys, comms); err != nil {
+			return err
+		}
+		_, err = tx.Put(messageIndexKey(referral.ReferralID), index)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create message: %v", err)
 	}
 	return nil
 }
 
+func messageIndexKey(referralID string) *datastore.Key {
+	key := datastore.NameKey("ReferralMessageIndex", referralID, nil)
+	if global.Options.DSName != "" {
+		key.Namespace = global.Options.DSName
+	}
+	return key
+}
+
+// txMessageIndex ..... the message index of the referral in the transaction, counted from its messages when it
+// has none yet. The referral is loaded for its clinic emails when it is nil.
+func (db *DSReferral) txMessageIndex(ctx context.Context, tx *datastore.Transaction, referralID string, referral *contracts.DSReferral) (*contracts.MessageIndex, error) {
+	var index contracts.MessageIndex
+	err := tx.Get(messageIndexKey(referralID), &index)
+	if err == nil {
+		if referral != nil && index.FromEmail == "" {
+			index.FromEmail = referral.FromEmail
+		}
+		if referral != nil && index.ToEmail == "" {
+			index.ToEmail = referral.ToEmail
+		}
+		return &index, nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if referral == nil {
+		refKey := datastore.NameKey("ClinicReferrals", referralID, nil)
+		if global.Options.DSName != "" {
+			refKey.Namespace = global.Options.DSName
+		}
+		referral = &contracts.DSReferral{}
+		if err := tx.Get(refKey, referral); err != nil && err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+	}
+	index = contracts.MessageIndex{ReferralID: referralID, FromEmail: referral.FromEmail, ToEmail: referral.ToEmail}
+	ancKey := datastore.NameKey("ReferralMessages", referralID, nil)
+	if global.Options.DSName != "" {
+		ancKey.Namespace = global.Options.DSName
+	}
+	comments := make([]contracts.Comment, 0)
+	qP := datastore.NewQuery("ReferralMessages").Ancestor(ancKey).Transaction(tx)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	if _, err := db.client.GetAll(ctx, qP, &comments); err != nil {
+		return nil, err
+	}
+	for _, comment := range comments {
+		index.Add(comment, 1)
+	}
+	return &index, nil
+}
+
+// BuildMessageIndex ..... counts the messages of a referral that has no message index yet into one
+func (db *DSReferral) BuildMessageIndex(ctx context.Context, referral contracts.DSReferral) (*contracts.MessageIndex, error) {
+	var index *contracts.MessageIndex
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var err error
+		index, err = db.txMessageIndex(ctx, tx, referral.ReferralID, &referral)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Put(messageIndexKey(referral.ReferralID), index)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot build message index: %v", err)
+	}
+	return index, nil
+}
+
+// GetMessageIndexes ..... message indexes of the referrals by referral id, referrals without one are left out
+func (db *DSReferral) GetMessageIndexes(ctx context.Context, referrals []contracts.DSReferral) (map[string]contracts.MessageIndex, error) {
+	byReferral := make(map[string]contracts.MessageIndex)
+	for start := 0; start < len(referrals); start += 500 {
+		end := start + 500
+		if end > len(referrals) {
+			end = len(referrals)
+		}
+		keys := make([]*datastore.Key, 0, end-start)
+		for _, referral := range referrals[start:end] {
+			keys = append(keys, messageIndexKey(referral.ReferralID))
+		}
+		indexes := make([]contracts.MessageIndex, len(keys))
+		err := db.client.GetMulti(ctx, keys, indexes)
+		multiErr, isMulti := err.(datastore.MultiError)
+		if err != nil && !isMulti {
+			return nil, fmt.Errorf("cannot get message indexes: %v", err)
+		}
+		for i, index := range indexes {
+			if isMulti && multiErr[i] != nil {
+				if multiErr[i] != datastore.ErrNoSuchEntity {
+					return nil, fmt.Errorf("cannot get message indexes: %v", multiErr[i])
+				}
+				continue
+			}
+			byReferral[keys[i].Name] = index
+		}
+	}
+	return byReferral, nil
+}
+
 // GetMessagesAll .....
 func (db *DSReferral) GetMessagesAll(ctx context.Context, referralID string) ([]contracts.Comment, error) {
 	ancKey := datastore.NameKey("ReferralMessages", referralID, nil)
@@ -381,3 +691,561 @@ func (db *DSReferral) GetOneMessage(ctx context.Context, referralID string, mess
 	}
 	return &returnedComments, nil
 }
+
+// ReviseMessage ..... applies revise to the message and keeps its previous content as a version, in one
+// transaction. Errors returned by revise are passed through unchanged.
+func (db *DSReferral) ReviseMessage(ctx context.Context, referralID string, messageID string, action string, revisedBy string,
+	revise func(comment *contracts.Comment) error) (*contracts.Comment, *contracts.Comment, error) {
+	pKey := datastore.NameKey("ReferralMessages", referralID, nil)
+	if global.Options.DSName != "" {
+		pKey.Namespace = global.Options.DSName
+	}
+	mainKey := datastore.NameKey("ReferralMessages", messageID, pKey)
+	if global.Options.DSName != "" {
+		mainKey.Namespace = global.Options.DSName
+	}
+	var previous, comment contracts.Comment
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		comment = contracts.Comment{}
+		if err := tx.Get(mainKey, &comment); err != nil {
+			return err
+		}
+		previous = comment
+		if err := revise(&comment); err != nil {
+			return err
+		}
+		index, err := db.txMessageIndex(ctx, tx, referralID, nil)
+		if err != nil {
+			return err
+		}
+		index.Add(previous, -1)
+		index.Add(comment, 1)
+		if _, err := tx.Put(messageIndexKey(referralID), index); err != nil {
+			return err
+		}
+		now := time.Now()
+		version := contracts.MessageVersion{
+			ReferralID: referralID,
+			MessageID:  messageID,
+			Version:    previous.Version,
+			Text:       previous.Text,
+			Channel:    previous.Channel,
+			Files:      previous.Files,
+			Action:     action,
+			RevisedBy:  revisedBy,
+			RevisedOn:  now,
+		}
+		versionKey := datastore.NameKey("ReferralMessageVersions", strconv.Itoa(previous.Version), mainKey)
+		if global.Options.DSName != "" {
+			versionKey.Namespace = global.Options.DSName
+		}
+		comment.Version = previous.Version + 1
+		comment.EditedOn = now.UnixNano() / int64(time.Millisecond)
+		if _, err := tx.Put(versionKey, &version); err != nil {
+			return err
+		}
+		_, err = tx.Put(mainKey, &comment)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &previous, &comment, nil
+}
+
+// GetMessageVersions ..... previous contents of a message, oldest first
+func (db *DSReferral) GetMessageVersions(ctx context.Context, referralID string, messageID string) ([]contracts.MessageVersion, error) {
+	pKey := datastore.NameKey("ReferralMessages", referralID, nil)
+	if global.Options.DSName != "" {
+		pKey.Namespace = global.Options.DSName
+	}
+	mainKey := datastore.NameKey("ReferralMessages", messageID, pKey)
+	if global.Options.DSName != "" {
+		mainKey.Namespace = global.Options.DSName
+	}
+	versions := make([]contracts.MessageVersion, 0)
+	qP := datastore.NewQuery("ReferralMessageVersions").Ancestor(mainKey)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &versions)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get message versions: %v", err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// GetMessagesAfter ..... messages of the referral posted after the given timestamp
+func (db *DSReferral) GetMessagesAfter(ctx context.Context, referralID string, after int64) ([]contracts.Comment, error) {
+	ancKey := datastore.NameKey("ReferralMessages", referralID, nil)
+	if global.Options.DSName != "" {
+		ancKey.Namespace = global.Options.DSName
+	}
+	returnedComments := make([]contracts.Comment, 0)
+	qP := datastore.NewQuery("ReferralMessages").Ancestor(ancKey).Filter("TimeStamp >", after)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &returnedComments)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get messages: %v", err)
+	}
+	return returnedComments, nil
+}
+
+// MarkMessagesRead ..... moves the user's read marker of the referral forward to upTo, a marker never moves back
+func (db *DSReferral) MarkMessagesRead(ctx context.Context, referralID string, userID string, upTo int64) (*contracts.ReadMarker, error) {
+	primaryKey := datastore.NameKey("ReferralReadMarkers", referralID+"/"+userID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var marker contracts.ReadMarker
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		marker = contracts.ReadMarker{}
+		if err := tx.Get(primaryKey, &marker); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if marker.ReferralID != "" && marker.LastRead >= upTo {
+			return nil
+		}
+		marker.ReferralID = referralID
+		marker.UserID = userID
+		marker.LastRead = upTo
+		marker.ReadOn = time.Now()
+		_, err := tx.Put(primaryKey, &marker)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot mark messages read: %v", err)
+	}
+	return &marker, nil
+}
+
+// GetReadMarkers ..... read markers of a user by referral id
+func (db *DSReferral) GetReadMarkers(ctx context.Context, userID string) (map[string]contracts.ReadMarker, error) {
+	markers := make([]contracts.ReadMarker, 0)
+	qP := datastore.NewQuery("ReferralReadMarkers").Filter("UserID =", userID)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &markers)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get read markers: %v", err)
+	}
+	byReferral := make(map[string]contracts.ReadMarker)
+	for _, marker := range markers {
+		byReferral[marker.ReferralID] = marker
+	}
+	return byReferral, nil
+}
+
+// documentName .... the document an owner's original name belongs to, claimed in the transaction that saves it
+type documentName struct {
+	DocumentID string
+}
+
+// SaveDocument .... records a document, an upload under the original name of a document the owner
+// already has becomes its next version and the current one is kept as a ReferralDocumentVersions child.
+// The owner and original name key a ReferralDocumentNames entity read and written in the same transaction,
+// so two uploads of one name cannot both become version 1.
+func (db *DSReferral) SaveDocument(ctx context.Context, doc *contracts.Document) error {
+	nameKey := datastore.NameKey("ReferralDocumentNames", doc.ReferralID+"/"+doc.PatientID+"/"+doc.OriginalName, nil)
+	if global.Options.DSName != "" {
+		nameKey.Namespace = global.Options.DSName
+	}
+	// documents saved before names were claimed are only found by query, their name is claimed below
+	qP := datastore.NewQuery("ReferralDocuments").
+		Filter("ReferralID =", doc.ReferralID).
+		Filter("PatientID =", doc.PatientID).
+		Filter("OriginalName =", doc.OriginalName).
+		Filter("Deleted =", false).
+		KeysOnly()
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	keys, err := db.client.GetAll(ctx, qP, nil)
+	if err != nil {
+		return fmt.Errorf("cannot save document: %v", err)
+	}
+	var unclaimedKey *datastore.Key
+	if len(keys) > 0 {
+		unclaimedKey = keys[0]
+	}
+	upload := *doc
+	_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		*doc = upload
+		mainKey := unclaimedKey
+		var name documentName
+		err := tx.Get(nameKey, &name)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil {
+			mainKey = datastore.NameKey("ReferralDocuments", name.DocumentID, nil)
+			if global.Options.DSName != "" {
+				mainKey.Namespace = global.Options.DSName
+			}
+		}
+		var current contracts.Document
+		if mainKey != nil {
+			if err := tx.Get(mainKey, &current); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		if current.DocumentID == "" || current.Deleted {
+			doc.Version = 1
+			primaryKey := datastore.NameKey("ReferralDocuments", doc.DocumentID, nil)
+			if global.Options.DSName != "" {
+				primaryKey.Namespace = global.Options.DSName
+			}
+			if _, err := tx.Put(primaryKey, doc); err != nil {
+				return err
+			}
+			_, err := tx.Put(nameKey, &documentName{DocumentID: doc.DocumentID})
+			return err
+		}
+		versionKey := datastore.NameKey("ReferralDocumentVersions", strconv.Itoa(current.Version), mainKey)
+		if global.Options.DSName != "" {
+			versionKey.Namespace = global.Options.DSName
+		}
+		if _, err := tx.Put(versionKey, &current); err != nil {
+			return err
+		}
+		doc.DocumentID = current.DocumentID
+		doc.Version = current.Version + 1
+		if _, err := tx.Put(mainKey, doc); err != nil {
+			return err
+		}
+		_, err = tx.Put(nameKey, &documentName{DocumentID: doc.DocumentID})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save document: %v", err)
+	}
+	return nil
+}
+
+// GetDocuments .... current documents of a referral, oldest first
+func (db *DSReferral) GetDocuments(ctx context.Context, referralID string) ([]contracts.Document, error) {
+	docs := make([]contracts.Document, 0)
+	qP := datastore.NewQuery("ReferralDocuments").Filter("ReferralID =", referralID)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &docs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get documents: %v", err)
+	}
+	current := make([]contracts.Document, 0)
+	for _, doc := range docs {
+		if !doc.Deleted {
+			current = append(current, doc)
+		}
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].CreatedOn.Before(current[j].CreatedOn) })
+	return current, nil
+}
+
+// GetDocument ....
+func (db *DSReferral) GetDocument(ctx context.Context, documentID string) (*contracts.Document, error) {
+	primaryKey := datastore.NameKey("ReferralDocuments", documentID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var doc contracts.Document
+	err := db.client.Get(ctx, primaryKey, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// GetDocumentVersions .... previous versions of a document, oldest first
+func (db *DSReferral) GetDocumentVersions(ctx context.Context, documentID string) ([]contracts.Document, error) {
+	mainKey := datastore.NameKey("ReferralDocuments", documentID, nil)
+	if global.Options.DSName != "" {
+		mainKey.Namespace = global.Options.DSName
+	}
+	versions := make([]contracts.Document, 0)
+	qP := datastore.NewQuery("ReferralDocumentVersions").Ancestor(mainKey)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &versions)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get document versions: %v", err)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// GetReferralDocumentVersions .... previous versions of every document of a referral
+func (db *DSReferral) GetReferralDocumentVersions(ctx context.Context, referralID string) ([]contracts.Document, error) {
+	versions := make([]contracts.Document, 0)
+	qP := datastore.NewQuery("ReferralDocumentVersions").Filter("ReferralID =", referralID)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &versions)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get document versions: %v", err)
+	}
+	return versions, nil
+}
+
+// DeleteDocument .... soft delete of a document and its previous versions, each is kept with who deleted it
+// and where its file went, storedKeys are by version
+func (db *DSReferral) DeleteDocument(ctx context.Context, documentID string, deletedBy string, storedKeys map[int]string) (*contracts.Document, error) {
+	primaryKey := datastore.NameKey("ReferralDocuments", documentID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var doc contracts.Document
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		doc = contracts.Document{}
+		if err := tx.Get(primaryKey, &doc); err != nil {
+			return err
+		}
+		versions := make([]contracts.Document, 0)
+		qP := datastore.NewQuery("ReferralDocumentVersions").Ancestor(primaryKey).Transaction(tx)
+		if global.Options.DSName != "" {
+			qP = qP.Namespace(global.Options.DSName)
+		}
+		keys, err := db.client.GetAll(ctx, qP, &versions)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, primaryKey)
+		docs := append(versions, doc)
+		now := time.Now()
+		for i := range docs {
+			docs[i].Deleted = true
+			docs[i].DeletedBy = deletedBy
+			docs[i].DeletedOn = now
+			if storedKey, ok := storedKeys[docs[i].Version]; ok {
+				docs[i].StoredKey = storedKey
+			}
+		}
+		if _, err := tx.PutMulti(keys, docs); err != nil {
+			return err
+		}
+		doc = docs[len(docs)-1]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// SaveImportJob ....
+func (db *DSReferral) SaveImportJob(ctx context.Context, job contracts.ReferralImportJob) error {
+	primaryKey := datastore.NameKey("ReferralImportJobs", job.JobID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.Put(ctx, primaryKey, &job)
+	if err != nil {
+		return fmt.Errorf("cannot save import job: %v", err)
+	}
+	return nil
+}
+
+// GetImportJob ....
+func (db *DSReferral) GetImportJob(ctx context.Context, jobID string) (*contracts.ReferralImportJob, error) {
+	primaryKey := datastore.NameKey("ReferralImportJobs", jobID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var job contracts.ReferralImportJob
+	err := db.client.Get(ctx, primaryKey, &job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// SaveSummaryReview ....
+func (db *DSReferral) SaveSummaryReview(ctx context.Context, review contracts.SummaryReview) error {
+	primaryKey := datastore.NameKey("SummaryReviews", review.ReviewID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.Put(ctx, primaryKey, &review)
+	if err != nil {
+		return fmt.Errorf("cannot save summary review: %v", err)
+	}
+	return nil
+}
+
+// GetSummaryReview ....
+func (db *DSReferral) GetSummaryReview(ctx context.Context, reviewID string) (*contracts.SummaryReview, error) {
+	primaryKey := datastore.NameKey("SummaryReviews", reviewID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var review contracts.SummaryReview
+	err := db.client.Get(ctx, primaryKey, &review)
+	if err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// GetPendingSummaryReviews .... reviews waiting on a clinic, as the receiver or as the sender of the
+// summaries, oldest first
+func (db *DSReferral) GetPendingSummaryReviews(ctx context.Context, addressID string) ([]contracts.SummaryReview, error) {
+	reviews := make([]contracts.SummaryReview, 0)
+	seen := make(map[string]bool)
+	for _, side := range []string{"FromAddressID =", "ToAddressID ="} {
+		sideReviews := make([]contracts.SummaryReview, 0)
+		qP := datastore.NewQuery("SummaryReviews").Filter(side, addressID).Filter("Status =", contracts.SummaryReviewPending)
+		if global.Options.DSName != "" {
+			qP = qP.Namespace(global.Options.DSName)
+		}
+		_, err := db.client.GetAll(ctx, qP, &sideReviews)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get summary reviews: %v", err)
+		}
+		for _, review := range sideReviews {
+			if !seen[review.ReviewID] {
+				seen[review.ReviewID] = true
+				reviews = append(reviews, review)
+			}
+		}
+	}
+	sort.Slice(reviews, func(i, j int) bool { return reviews[i].CreatedOn.Before(reviews[j].CreatedOn) })
+	return reviews, nil
+}
+
+// SaveQuarantinedMessage ....
+func (db *DSReferral) SaveQuarantinedMessage(ctx context.Context, message contracts.QuarantinedMessage) error {
+	primaryKey := datastore.NameKey("QuarantinedMessages", message.QuarantineID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.Put(ctx, primaryKey, &message)
+	if err != nil {
+		return fmt.Errorf("cannot save quarantined message: %v", err)
+	}
+	return nil
+}
+
+// GetQuarantinedMessage ....
+func (db *DSReferral) GetQuarantinedMessage(ctx context.Context, quarantineID string) (*contracts.QuarantinedMessage, error) {
+	primaryKey := datastore.NameKey("QuarantinedMessages", quarantineID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var message contracts.QuarantinedMessage
+	err := db.client.Get(ctx, primaryKey, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// GetQuarantinedMessages .... messages with the status, newest first
+func (db *DSReferral) GetQuarantinedMessages(ctx context.Context, status string, limit int) ([]contracts.QuarantinedMessage, error) {
+	messages := make([]contracts.QuarantinedMessage, 0)
+	qP := datastore.NewQuery("QuarantinedMessages").Filter("Status =", status).Order("-CreatedOn").Limit(limit)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &messages)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get quarantined messages: %v", err)
+	}
+	return messages, nil
+}
+
+// SaveSMSConversation ....
+func (db *DSReferral) SaveSMSConversation(ctx context.Context, conversation contracts.SMSConversation) error {
+	primaryKey := datastore.NameKey("SMSConversations", conversation.ConversationID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.Put(ctx, primaryKey, &conversation)
+	if err != nil {
+		return fmt.Errorf("cannot save sms conversation: %v", err)
+	}
+	return nil
+}
+
+// GetSMSConversation ....
+func (db *DSReferral) GetSMSConversation(ctx context.Context, conversationID string) (*contracts.SMSConversation, error) {
+	primaryKey := datastore.NameKey("SMSConversations", conversationID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var conversation contracts.SMSConversation
+	err := db.client.Get(ctx, primaryKey, &conversation)
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// GetSMSConsent ....
+func (db *DSReferral) GetSMSConsent(ctx context.Context, phone string) (*contracts.SMSConsent, error) {
+	primaryKey := datastore.NameKey("SMSConsents", phone, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	var consent contracts.SMSConsent
+	err := db.client.Get(ctx, primaryKey, &consent)
+	if err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+// SMSOptedOut .... a phone without a consent record has not opted out
+func (db *DSReferral) SMSOptedOut(ctx context.Context, phone string) (bool, error) {
+	consent, err := db.GetSMSConsent(ctx, phone)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return consent.Status == contracts.SMSOptedOut, nil
+}
+
+// RecordSMSConsent .... sets the consent of the phone and keeps the change as a SMSConsentEvents child.
+// An opt in other than by keyword does not undo an opt out, the consent on record is returned then.
+func (db *DSReferral) RecordSMSConsent(ctx context.Context, consent contracts.SMSConsent) (*contracts.SMSConsent, error) {
+	primaryKey := datastore.NameKey("SMSConsents", consent.Phone, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	eventKey := datastore.IncompleteKey("SMSConsentEvents", primaryKey)
+	if global.Options.DSName != "" {
+		eventKey.Namespace = global.Options.DSName
+	}
+	consent.UpdatedOn = time.Now()
+	recorded := consent
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var current contracts.SMSConsent
+		err := tx.Get(primaryKey, &current)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && current.Status == contracts.SMSOptedOut &&
+			consent.Status == contracts.SMSOptedIn && consent.Source != contracts.ConsentSourceKeyword {
+			recorded = current
+			return nil
+		}
+		recorded = consent
+		if _, err := tx.Put(eventKey, &consent); err != nil {
+			return err
+		}
+		_, err = tx.Put(primaryKey, &consent)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot record sms consent: %v", err)
+	}
+	return &recorded, nil
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/google/uuid"
@@ -529,6 +530,98 @@ func (db *DSClinicMeta) GetClinicPracticeCodesHistory(ctx context.Context, clini
 	return &codeData, nil
 }
 
+// AddClinicSLA ......
+func (db *DSClinicMeta) AddClinicSLA(ctx context.Context, clinicSLA contracts.ClinicSLA) error {
+	parentKey := datastore.NameKey("ClinicSLA", clinicSLA.AddressID, nil)
+	if global.Options.DSName != "" {
+		parentKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.Put(ctx, parentKey, &clinicSLA)
+	if err != nil {
+		return fmt.Errorf("cannot register clinic sla: %v", err)
+	}
+	return nil
+}
+
+// GetClinicSLA ......
+func (db *DSClinicMeta) GetClinicSLA(ctx context.Context, clinicAddessID string) (*contracts.ClinicSLA, error) {
+	parentKey := datastore.NameKey("ClinicSLA", clinicAddessID, nil)
+	if global.Options.DSName != "" {
+		parentKey.Namespace = global.Options.DSName
+	}
+	var slaData contracts.ClinicSLA
+	err := db.client.Get(ctx, parentKey, &slaData)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get clinic sla: %v", err)
+	}
+	return &slaData, nil
+}
+
+// GetAllClinicSLAs ......
+func (db *DSClinicMeta) GetAllClinicSLAs(ctx context.Context) ([]contracts.ClinicSLA, error) {
+	returnedSLAs := make([]contracts.ClinicSLA, 0)
+	qP := datastore.NewQuery("ClinicSLA")
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &returnedSLAs)
+	if err != nil {
+		return returnedSLAs, fmt.Errorf("cannot get clinic slas: %v", err)
+	}
+	return returnedSLAs, nil
+}
+
+// AddClinicEvent ......
+func (db *DSClinicMeta) AddClinicEvent(ctx context.Context, event contracts.ClinicEvent) error {
+	primaryKey := datastore.NameKey("ClinicEvents", event.AddressID+"/"+event.EventID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	_, err := db.client.Put(ctx, primaryKey, &event)
+	if err != nil {
+		return fmt.Errorf("cannot add clinic event: %v", err)
+	}
+	return nil
+}
+
+// GetClinicEventsAfter ...... events of the clinic newer than afterID, oldest first
+func (db *DSClinicMeta) GetClinicEventsAfter(ctx context.Context, addressID string, afterID string, limit int) ([]contracts.ClinicEvent, error) {
+	returnedEvents := make([]contracts.ClinicEvent, 0)
+	qP := datastore.NewQuery("ClinicEvents").Filter("AddressID =", addressID).Filter("EventID >", afterID).Order("EventID").Limit(limit)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &returnedEvents)
+	if err != nil {
+		return returnedEvents, fmt.Errorf("cannot get clinic events: %v", err)
+	}
+	return returnedEvents, nil
+}
+
+// DeleteClinicEventsBefore ...... removes the events of every clinic recorded before the cutoff, the number removed
+func (db *DSClinicMeta) DeleteClinicEventsBefore(ctx context.Context, cutoff time.Time) (int, error) {
+	deleted := 0
+	for {
+		// datastore deletes at most 500 keys at a time
+		qP := datastore.NewQuery("ClinicEvents").Filter("CreatedOn <", cutoff).KeysOnly().Limit(500)
+		if global.Options.DSName != "" {
+			qP = qP.Namespace(global.Options.DSName)
+		}
+		keys, err := db.client.GetAll(ctx, qP, nil)
+		if err != nil {
+			return deleted, fmt.Errorf("cannot get expired clinic events: %v", err)
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		err = db.client.DeleteMulti(ctx, keys)
+		if err != nil {
+			return deleted, fmt.Errorf("cannot delete expired clinic events: %v", err)
+		}
+		deleted += len(keys)
+	}
+}
+
 // AddPMSAuthDetails ......
 func (db *DSClinicMeta) AddPMSAuthDetails(ctx context.Context, clinicEmailID string, clinicFBID string, pmsInformation contracts.PostPMSAuthDetails) error {
 	parentKey := datastore.NameKey("ClinicAdmin", clinicFBID, nil)
@@ -718,7 +811,6 @@ func (db *DSClinicMeta) GetAllClinicsByEmail(ctx context.Context, clinicEmailID
 	return returnedAddresses, nil
 }
 
-
 // SearchClinics ....
 func (db *DSClinicMeta) SearchClinics(ctx context.Context, nameSearch string) ([]contracts.PhysicalClinicMapLocation, error) {
 	returnedAddresses := make([]contracts.PhysicalClinicMapLocation, 0)
@@ -734,6 +826,7 @@ func (db *DSClinicMeta) SearchClinics(ctx context.Context, nameSearch string) ([
 	}
 	return returnedAddresses, nil
 }
+
 // GetAllClinicsMeta ....
 func (db *DSClinicMeta) GetAllClinicsMeta(ctx context.Context) ([]contracts.PhysicalClinicMapLocation, error) {
 	returnedAddresses := make([]contracts.PhysicalClinicMapLocation, 0)
@@ -1049,3 +1142,270 @@ func (d *DynEnt) Save() (props []datastore.Property, err error) {
 	}
 	return
 }
+
+func messageOverrideKey(addressID string, locale string, key string) *datastore.Key {
+	primaryKey := datastore.NameKey("ClinicMessageTemplates", addressID+"/"+locale+"/"+key, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	return primaryKey
+}
+
+// SaveMessageOverride ...... replaces the clinic's wording of the message in the locale
+func (db *DSClinicMeta) SaveMessageOverride(ctx context.Context, override contracts.MessageTemplateOverride) error {
+	_, err := db.client.Put(ctx, messageOverrideKey(override.AddressID, override.Locale, override.Key), &override)
+	if err != nil {
+		return fmt.Errorf("cannot save message template: %v", err)
+	}
+	return nil
+}
+
+// DeleteMessageOverride ...... the clinic goes back to the catalog's wording of the message
+func (db *DSClinicMeta) DeleteMessageOverride(ctx context.Context, addressID string, locale string, key string) error {
+	err := db.client.Delete(ctx, messageOverrideKey(addressID, locale, key))
+	if err != nil {
+		return fmt.Errorf("cannot delete message template: %v", err)
+	}
+	return nil
+}
+
+// GetMessageOverrides ...... every message the clinic wrote, of all locales
+func (db *DSClinicMeta) GetMessageOverrides(ctx context.Context, addressID string) ([]contracts.MessageTemplateOverride, error) {
+	returnedOverrides := make([]contracts.MessageTemplateOverride, 0)
+	qP := datastore.NewQuery("ClinicMessageTemplates").Filter("AddressID =", addressID)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &returnedOverrides)
+	if err != nil {
+		return returnedOverrides, fmt.Errorf("cannot get message templates: %v", err)
+	}
+	return returnedOverrides, nil
+}
+
+// MessageOverride ...... text of the clinic's wording of the message, empty when it has none
+func (db *DSClinicMeta) MessageOverride(ctx context.Context, addressID string, locale string, key string) (string, error) {
+	var override contracts.MessageTemplateOverride
+	err := db.client.Get(ctx, messageOverrideKey(addressID, locale, key), &override)
+	if err == datastore.ErrNoSuchEntity {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot get message template: %v", err)
+	}
+	return override.Text, nil
+}
+
+func deviceTokenKey(token string) *datastore.Key {
+	primaryKey := datastore.NameKey("ClinicDeviceTokens", token, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	return primaryKey
+}
+
+// SaveDeviceToken ...... registers the device, or replaces its registration
+func (db *DSClinicMeta) SaveDeviceToken(ctx context.Context, device contracts.DeviceToken) error {
+	_, err := db.client.Put(ctx, deviceTokenKey(device.Token), &device)
+	if err != nil {
+		return fmt.Errorf("cannot save device token: %v", err)
+	}
+	return nil
+}
+
+// GetDeviceToken ...... the registration of the device, nil when it has none
+func (db *DSClinicMeta) GetDeviceToken(ctx context.Context, token string) (*contracts.DeviceToken, error) {
+	var device contracts.DeviceToken
+	err := db.client.Get(ctx, deviceTokenKey(token), &device)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot get device token: %v", err)
+	}
+	return &device, nil
+}
+
+// DeleteDeviceToken ......
+func (db *DSClinicMeta) DeleteDeviceToken(ctx context.Context, token string) error {
+	err := db.client.Delete(ctx, deviceTokenKey(token))
+	if err != nil {
+		return fmt.Errorf("cannot delete device token: %v", err)
+	}
+	return nil
+}
+
+// GetUserDeviceTokens ...... the devices the user registered
+func (db *DSClinicMeta) GetUserDeviceTokens(ctx context.Context, userID string) ([]contracts.DeviceToken, error) {
+	returnedDevices := make([]contracts.DeviceToken, 0)
+	qP := datastore.NewQuery("ClinicDeviceTokens").Filter("UserID =", userID)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &returnedDevices)
+	if err != nil {
+		return returnedDevices, fmt.Errorf("cannot get device tokens: %v", err)
+	}
+	return returnedDevices, nil
+}
+
+func notificationPreferencesKey(addressID string, userID string) *datastore.Key {
+	primaryKey := datastore.NameKey("ClinicNotificationPreferences", addressID+"/"+userID, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	return primaryKey
+}
+
+// SaveNotificationPreferences ...... the preferences of the clinic, or of its staff user when UserID is set
+func (db *DSClinicMeta) SaveNotificationPreferences(ctx context.Context, prefs contracts.NotificationPreferences) error {
+	_, err := db.client.Put(ctx, notificationPreferencesKey(prefs.AddressID, prefs.UserID), &prefs)
+	if err != nil {
+		return fmt.Errorf("cannot save notification preferences: %v", err)
+	}
+	return nil
+}
+
+// GetNotificationPreferences ...... nil when the clinic, or its staff user when userID is set, has none
+func (db *DSClinicMeta) GetNotificationPreferences(ctx context.Context, addressID string, userID string) (*contracts.NotificationPreferences, error) {
+	var prefs contracts.NotificationPreferences
+	err := db.client.Get(ctx, notificationPreferencesKey(addressID, userID), &prefs)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot get notification preferences: %v", err)
+	}
+	return &prefs, nil
+}
+
+// GetStaffNotificationPreferences ...... the preferences of the clinic's staff that have their own
+func (db *DSClinicMeta) GetStaffNotificationPreferences(ctx context.Context, addressID string) ([]contracts.NotificationPreferences, error) {
+	allPrefs := make([]contracts.NotificationPreferences, 0)
+	qP := datastore.NewQuery("ClinicNotificationPreferences").Filter("AddressID =", addressID)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &allPrefs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get notification preferences: %v", err)
+	}
+	staffPrefs := make([]contracts.NotificationPreferences, 0, len(allPrefs))
+	for _, prefs := range allPrefs {
+		if prefs.UserID != "" {
+			staffPrefs = append(staffPrefs, prefs)
+		}
+	}
+	return staffPrefs, nil
+}
+
+// DeleteNotificationPreferences ...... the clinic, or its staff user, goes back to the defaults
+func (db *DSClinicMeta) DeleteNotificationPreferences(ctx context.Context, addressID string, userID string) error {
+	err := db.client.Delete(ctx, notificationPreferencesKey(addressID, userID))
+	if err != nil {
+		return fmt.Errorf("cannot delete notification preferences: %v", err)
+	}
+	return nil
+}
+
+func pendingNotificationKey(id string) *datastore.Key {
+	primaryKey := datastore.NameKey("ClinicPendingNotifications", id, nil)
+	if global.Options.DSName != "" {
+		primaryKey.Namespace = global.Options.DSName
+	}
+	return primaryKey
+}
+
+// AddPendingNotification ...... holds the notification until it is due
+func (db *DSClinicMeta) AddPendingNotification(ctx context.Context, pending contracts.PendingNotification) error {
+	_, err := db.client.Put(ctx, pendingNotificationKey(pending.ID), &pending)
+	if err != nil {
+		return fmt.Errorf("cannot save pending notification: %v", err)
+	}
+	return nil
+}
+
+// GetDuePendingNotifications ...... the held notifications due by now
+func (db *DSClinicMeta) GetDuePendingNotifications(ctx context.Context, now time.Time) ([]contracts.PendingNotification, error) {
+	returnedPending := make([]contracts.PendingNotification, 0)
+	qP := datastore.NewQuery("ClinicPendingNotifications").Filter("DueOn <=", now)
+	if global.Options.DSName != "" {
+		qP = qP.Namespace(global.Options.DSName)
+	}
+	_, err := db.client.GetAll(ctx, qP, &returnedPending)
+	if err != nil {
+		return returnedPending, fmt.Errorf("cannot get pending notifications: %v", err)
+	}
+	return returnedPending, nil
+}
+
+// ClaimPendingNotifications ...... marks the notifications as being sent by claimedBy inside a transaction and
+// returns them, skipping those already sent and those another instance claimed less than timeout ago
+func (db *DSClinicMeta) ClaimPendingNotifications(ctx context.Context, ids []string, claimedBy string, now time.Time, timeout time.Duration) ([]contracts.PendingNotification, error) {
+	claimed := make([]contracts.PendingNotification, 0, len(ids))
+	// a transaction takes at most 500 entities
+	for start := 0; start < len(ids); start += 500 {
+		end := start + 500
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]*datastore.Key, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, pendingNotificationKey(id))
+		}
+		var batch []contracts.PendingNotification
+		_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			batch = make([]contracts.PendingNotification, 0, len(keys))
+			pending := make([]contracts.PendingNotification, len(keys))
+			err := tx.GetMulti(keys, pending)
+			multiErr, isMulti := err.(datastore.MultiError)
+			if err != nil && !isMulti {
+				return err
+			}
+			claimKeys := make([]*datastore.Key, 0, len(keys))
+			for i := range pending {
+				if isMulti && multiErr[i] != nil {
+					if multiErr[i] != datastore.ErrNoSuchEntity {
+						return multiErr[i]
+					}
+					continue
+				}
+				if pending[i].ClaimedBy != "" && pending[i].ClaimedBy != claimedBy && now.Sub(pending[i].ClaimedOn) < timeout {
+					continue
+				}
+				pending[i].ClaimedBy = claimedBy
+				pending[i].ClaimedOn = now
+				claimKeys = append(claimKeys, keys[i])
+				batch = append(batch, pending[i])
+			}
+			if len(claimKeys) == 0 {
+				return nil
+			}
+			_, err = tx.PutMulti(claimKeys, batch)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot claim pending notifications: %v", err)
+		}
+		claimed = append(claimed, batch...)
+	}
+	return claimed, nil
+}
+
+// DeletePendingNotifications ...... datastore deletes at most 500 keys at a time
+func (db *DSClinicMeta) DeletePendingNotifications(ctx context.Context, ids []string) error {
+	keys := make([]*datastore.Key, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, pendingNotificationKey(id))
+	}
+	for start := 0; start < len(keys); start += 500 {
+		end := start + 500
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := db.client.DeleteMulti(ctx, keys[start:end]); err != nil {
+			return fmt.Errorf("cannot delete pending notifications: %v", err)
+		}
+	}
+	return nil
+}
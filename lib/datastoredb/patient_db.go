@@ -986,6 +986,7 @@ func (db DSPatient) ParsePatient(ctx context.Context, patientData contracts.Pati
 	patientStore.AppointmentTime = patientData.AppointmentTime
 	patientStore.CreatedOn = patientData.CreatedOn
 	patientStore.CreationDate = patientData.CreationDate
+	patientStore.PreferredLanguage = patientData.PreferredLanguage
 	patientStore.PatientID = patientData.PatientID
 	for _, id := range patientData.DentalInsuraceID {
 		insurance := db.GetDentalInsurance(ctx, id)
@@ -1094,6 +1095,7 @@ func (db DSPatient) GetPatientByAgentInsurances(ctx context.Context, pID string)
 	patientStore.AppointmentTime = patientData.AppointmentTime
 	patientStore.CreatedOn = patientData.CreatedOn
 	patientStore.CreationDate = patientData.CreationDate
+	patientStore.PreferredLanguage = patientData.PreferredLanguage
 	patientStore.PatientID = patientData.PatientID
 	patientStore.VisitCount = patientData.VisitCount
 	patientStore.LastAppointment = patientData.LastAppointment
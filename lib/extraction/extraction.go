@@ -0,0 +1,395 @@
+package extraction
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+// Fields a template can require
+const (
+	FieldFirstName = "firstName"
+	FieldLastName  = "lastName"
+	FieldDOB       = "dob"
+	FieldVisitDate = "visitDate"
+)
+
+// DefaultMinConfidence below it a summary goes to review, for templates that do not set their own
+const DefaultMinConfidence = 0.7
+
+var defaultDateLayouts = []string{
+	"01/02/2006",
+	"1/2/2006",
+	"01/02/06",
+	"1/2/06",
+	"01-02-2006",
+	"2006-01-02",
+	"2006/01/02",
+	"Jan 2, 2006",
+	"Jan 2 2006",
+	"January 2, 2006",
+	"January 2 2006",
+}
+
+// words that labels and letters put where a name is expected
+var nameStopWords = map[string]bool{
+	"name": true, "patient": true, "dob": true, "date": true, "birth": true, "summary": true,
+	"treatment": true, "first": true, "last": true, "to": true, "our": true, "the": true, "a": true,
+	"of": true, "for": true, "and": true, "was": true, "is": true, "has": true, "information": true,
+	"chart": true, "id": true, "mr": true, "mrs": true, "ms": true, "dr": true,
+}
+
+var (
+	namePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z'\-]*$`)
+	cdtPattern  = regexp.MustCompile(`^D\d{4}$`)
+)
+
+// Rule .... how a field is found in the text. Pattern is matched line by line, the value is its first
+// group, or the groups first and last for names and code and tooth for procedures. After and Before
+// are layout anchors that limit the lines searched to a section, with NextLine the value is read by
+// Value from the line below the one Pattern matches, for labels printed above their values.
+type Rule struct {
+	Pattern    string  `json:"pattern"`
+	Value      string  `json:"value"`
+	After      string  `json:"after"`
+	Before     string  `json:"before"`
+	NextLine   bool    `json:"nextLine"`
+	Confidence float64 `json:"confidence"`
+
+	pattern *regexp.Regexp
+	value   *regexp.Regexp
+}
+
+// Template .... extraction rules of the summaries of one sender, picked by the domain of the clinic
+// sending them. A template with the domain * is used for senders without one.
+type Template struct {
+	Name          string   `json:"name"`
+	Domains       []string `json:"domains"`
+	DateLayouts   []string `json:"dateLayouts"`
+	MinConfidence float64  `json:"minConfidence"`
+	Required      []string `json:"required"`
+	PatientName   []Rule   `json:"patientName"`
+	DOB           []Rule   `json:"dob"`
+	VisitDate     []Rule   `json:"visitDate"`
+	Procedures    []Rule   `json:"procedures"`
+	Teeth         []Rule   `json:"teeth"`
+}
+
+// Set .... templates by the domains they cover
+type Set struct {
+	domains  map[string]*Template
+	fallback *Template
+}
+
+// LoadTemplates .... reads every .json template of the folder
+func LoadTemplates(dir string) (*Set, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no extraction templates in %s", dir)
+	}
+	templates := make([]*Template, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		template := &Template{}
+		if err := json.Unmarshal(data, template); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		templates = append(templates, template)
+	}
+	return NewSet(templates...)
+}
+
+// NewSet .... compiles the rules of the templates
+func NewSet(templates ...*Template) (*Set, error) {
+	set := &Set{domains: make(map[string]*Template)}
+	for _, template := range templates {
+		if err := template.compile(); err != nil {
+			return nil, fmt.Errorf("template %s: %v", template.Name, err)
+		}
+		for _, domain := range template.Domains {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain == "*" {
+				set.fallback = template
+				continue
+			}
+			if _, ok := set.domains[domain]; ok {
+				return nil, fmt.Errorf("template %s: domain %s has another template", template.Name, domain)
+			}
+			set.domains[domain] = template
+		}
+	}
+	return set, nil
+}
+
+// ForDomain .... template of the sender's domain or of a parent domain, the fallback otherwise
+func (s *Set) ForDomain(domain string) *Template {
+	domain = strings.ToLower(domain)
+	for domain != "" {
+		if template, ok := s.domains[domain]; ok {
+			return template
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
+	}
+	return s.fallback
+}
+
+// Extract .... reads the summary text with the template of the sender's domain. Without a template
+// nothing is read and the summary goes to review.
+func (s *Set) Extract(domain string, text string, now time.Time) contracts.SummaryExtraction {
+	var template *Template
+	if s != nil {
+		template = s.ForDomain(domain)
+	}
+	if template == nil {
+		return contracts.SummaryExtraction{Review: true}
+	}
+	return template.Extract(text, now)
+}
+
+func (t *Template) compile() error {
+	if len(t.DateLayouts) == 0 {
+		t.DateLayouts = defaultDateLayouts
+	}
+	if t.MinConfidence == 0 {
+		t.MinConfidence = DefaultMinConfidence
+	}
+	if len(t.Required) == 0 {
+		t.Required = []string{FieldFirstName, FieldLastName}
+	}
+	for _, field := range t.Required {
+		switch field {
+		case FieldFirstName, FieldLastName, FieldDOB, FieldVisitDate:
+		default:
+			return fmt.Errorf("unknown required field %s", field)
+		}
+	}
+	for _, rules := range [][]Rule{t.PatientName, t.DOB, t.VisitDate, t.Procedures, t.Teeth} {
+		for i := range rules {
+			var err error
+			if rules[i].pattern, err = regexp.Compile(rules[i].Pattern); err != nil {
+				return err
+			}
+			if rules[i].Value == "" {
+				rules[i].Value = `(.+)`
+			}
+			if rules[i].value, err = regexp.Compile(rules[i].Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Extract .... the fields found with the best confidence each. The result is marked for review when a
+// required field is missing or below the template's minimum.
+func (t *Template) Extract(text string, now time.Time) contracts.SummaryExtraction {
+	lines := strings.Split(strings.Replace(text, "\r", "", -1), "\n")
+	result := contracts.SummaryExtraction{
+		Template:   t.Name,
+		Procedures: make([]contracts.ExtractedProcedure, 0),
+		Teeth:      make([]string, 0),
+	}
+	for _, rule := range t.PatientName {
+		for _, match := range rule.matches(lines) {
+			first, last := titleName(match["first"]), titleName(match["last"])
+			if first == "" || last == "" {
+				continue
+			}
+			if rule.Confidence > result.FirstName.Confidence {
+				result.FirstName = contracts.ExtractedField{Value: first, Confidence: rule.Confidence}
+				result.LastName = contracts.ExtractedField{Value: last, Confidence: rule.Confidence}
+			}
+			break
+		}
+	}
+	result.DOB = t.date(t.DOB, lines)
+	result.VisitDate = t.date(t.VisitDate, lines)
+	if result.DOB.Value != "" {
+		dob, _ := time.Parse("2006-01-02", result.DOB.Value)
+		if dob.After(now) || dob.Year() < 1900 {
+			result.DOB.Confidence /= 2
+		}
+	}
+	if result.VisitDate.Value != "" {
+		visit, _ := time.Parse("2006-01-02", result.VisitDate.Value)
+		if visit.After(now.AddDate(0, 0, 1)) || (result.DOB.Value != "" && result.VisitDate.Value < result.DOB.Value) {
+			result.VisitDate.Confidence /= 2
+		}
+	}
+	seen := make(map[string]bool)
+	for _, rule := range t.Procedures {
+		for _, match := range rule.matches(lines) {
+			code := match["code"]
+			if code == "" {
+				code = match["value"]
+			}
+			code = strings.ToUpper(code)
+			if !cdtPattern.MatchString(code) {
+				continue
+			}
+			confidence := rule.Confidence
+			tooth := match["tooth"]
+			if tooth != "" && !validTooth(tooth) {
+				tooth = ""
+				confidence *= 0.8
+			}
+			if seen[code+"/"+tooth] {
+				continue
+			}
+			seen[code+"/"+tooth] = true
+			result.Procedures = append(result.Procedures, contracts.ExtractedProcedure{Code: code, Tooth: tooth, Confidence: confidence})
+			result.Teeth = addTooth(result.Teeth, tooth)
+		}
+	}
+	for _, rule := range t.Teeth {
+		for _, match := range rule.matches(lines) {
+			if tooth := match["value"]; validTooth(tooth) {
+				result.Teeth = addTooth(result.Teeth, tooth)
+			}
+		}
+	}
+	result.Confidence = 1
+	for _, field := range t.Required {
+		confidence := map[string]float64{
+			FieldFirstName: result.FirstName.Confidence,
+			FieldLastName:  result.LastName.Confidence,
+			FieldDOB:       result.DOB.Confidence,
+			FieldVisitDate: result.VisitDate.Confidence,
+		}[field]
+		if confidence < result.Confidence {
+			result.Confidence = confidence
+		}
+	}
+	result.Review = result.Confidence < t.MinConfidence
+	return result
+}
+
+// date is the best date the rules find, normalized to 2006-01-02
+func (t *Template) date(rules []Rule, lines []string) contracts.ExtractedField {
+	best := contracts.ExtractedField{}
+	for _, rule := range rules {
+		for _, match := range rule.matches(lines) {
+			date, ok := parseDate(match["value"], t.DateLayouts)
+			if !ok {
+				continue
+			}
+			if rule.Confidence > best.Confidence {
+				best = contracts.ExtractedField{Value: date.Format("2006-01-02"), Confidence: rule.Confidence}
+			}
+			break
+		}
+	}
+	return best
+}
+
+// matches are the groups of each match of the rule in its section, the first group is also value
+func (r Rule) matches(lines []string) []map[string]string {
+	matches := make([]map[string]string, 0)
+	section := r.section(lines)
+	for i, line := range section {
+		found := r.pattern.FindAllStringSubmatch(line, -1)
+		re := r.pattern
+		if r.NextLine {
+			if len(found) == 0 || i+1 >= len(section) {
+				continue
+			}
+			found = r.value.FindAllStringSubmatch(strings.TrimSpace(section[i+1]), -1)
+			re = r.value
+		}
+		for _, groups := range found {
+			match := make(map[string]string)
+			for g, name := range re.SubexpNames() {
+				if g == 0 {
+					continue
+				}
+				value := strings.TrimSpace(groups[g])
+				if name != "" {
+					match[name] = value
+				}
+				if _, ok := match["value"]; !ok && g == 1 {
+					match["value"] = value
+				}
+			}
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+// section are the lines between the After and Before anchors
+func (r Rule) section(lines []string) []string {
+	start, end := 0, len(lines)
+	if r.After != "" {
+		start = end
+		for i, line := range lines {
+			if strings.Contains(strings.ToLower(line), strings.ToLower(r.After)) {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if r.Before != "" {
+		for i := start; i < len(lines); i++ {
+			if strings.Contains(strings.ToLower(lines[i]), strings.ToLower(r.Before)) {
+				end = i
+				break
+			}
+		}
+	}
+	return lines[start:end]
+}
+
+func titleName(name string) string {
+	if !namePattern.MatchString(name) || len(name) < 2 || nameStopWords[strings.ToLower(name)] {
+		return ""
+	}
+	return strings.Title(strings.ToLower(name))
+}
+
+func parseDate(value string, layouts []string) (time.Time, bool) {
+	value = strings.TrimRight(strings.TrimSpace(value), ".,;")
+	for _, layout := range layouts {
+		date, err := time.Parse(layout, value)
+		if err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// validTooth accepts universal numbers 1 to 32 and primary teeth A to T
+func validTooth(tooth string) bool {
+	if number, err := strconv.Atoi(tooth); err == nil {
+		return number >= 1 && number <= 32
+	}
+	return len(tooth) == 1 && tooth >= "A" && tooth <= "T"
+}
+
+func addTooth(teeth []string, tooth string) []string {
+	if tooth == "" {
+		return teeth
+	}
+	for _, known := range teeth {
+		if known == tooth {
+			return teeth
+		}
+	}
+	return append(teeth, tooth)
+}
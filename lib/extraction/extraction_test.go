@@ -0,0 +1,98 @@
+package extraction
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+var testNow = time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+
+func sampleText(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	assert.NoError(t, err)
+	text, err := PDFText(data)
+	assert.NoError(t, err)
+	return text
+}
+
+func TestPDFText(t *testing.T) {
+	text := sampleText(t, "penndios_summary.pdf")
+	assert.Contains(t, text, "Patient Name: DOE, JANE Chart #: 10442\n", "cells of a row are one line")
+	assert.Contains(t, text, "D7140 Extraction, erupted tooth (Smith's technique) #14\n")
+
+	content := []byte("BT /F1 11 Tf 72 700 Td (Tooth \\(#3\\)) Tj 0 -14 Td [(D2) 20 (740) -400 (crown)] TJ T* (next\\051) Tj ET")
+	assert.Equal(t, "Tooth (#3)\nD2740 crown\nnext)", contentText(content))
+
+	_, err := PDFText([]byte("GIF89a"))
+	assert.Error(t, err)
+}
+
+func TestExtract(t *testing.T) {
+	set, err := LoadTemplates("../../templates/extraction")
+	assert.NoError(t, err)
+
+	result := set.Extract("mail.penndios.com", sampleText(t, "penndios_summary.pdf"), testNow)
+	assert.Equal(t, "penndios", result.Template, "subdomains use the template of their domain")
+	assert.Equal(t, "Jane", result.FirstName.Value)
+	assert.Equal(t, "Doe", result.LastName.Value)
+	assert.Equal(t, "1985-04-12", result.DOB.Value)
+	assert.Equal(t, "2021-09-30", result.VisitDate.Value)
+	assert.Equal(t, []contracts.ExtractedProcedure{
+		{Code: "D7140", Tooth: "14", Confidence: 0.95},
+		{Code: "D6010", Tooth: "14", Confidence: 0.95},
+		{Code: "D0330", Confidence: 0.95},
+		{Code: "D9999", Confidence: 0.95 * 0.8},
+	}, result.Procedures, "#40 is not a tooth")
+	assert.Equal(t, []string{"14"}, result.Teeth)
+	assert.False(t, result.Review)
+
+	result = set.Extract("endo.example.com", sampleText(t, "generic_summary.pdf"), testNow)
+	assert.Equal(t, "default", result.Template)
+	assert.Equal(t, "John Smith", result.FirstName.Value+" "+result.LastName.Value)
+	assert.Equal(t, "1990-02-01", result.DOB.Value)
+	assert.Equal(t, "2021-03-03", result.VisitDate.Value)
+	assert.Len(t, result.Procedures, 2)
+	assert.Equal(t, []string{"3"}, result.Teeth)
+	assert.False(t, result.Review)
+
+	result = set.Extract("example.com", sampleText(t, "letter_summary.pdf"), testNow)
+	assert.Equal(t, "", result.FirstName.Value, `"patient to our" is not a name`)
+	assert.True(t, result.Review)
+
+	result = set.Extract("example.com", "Re: Maria Lopez\nDOB: 01/02/2030", testNow)
+	assert.Equal(t, "Maria", result.FirstName.Value)
+	assert.Equal(t, 0.45, result.DOB.Confidence, "births in the future are doubtful")
+	assert.True(t, result.Review, "names from a subject line are not trusted alone")
+
+	assert.True(t, (*Set)(nil).Extract("example.com", "Patient: Ann Lee", testNow).Review)
+}
+
+func TestTemplateRules(t *testing.T) {
+	template := &Template{
+		Name:    "labels above values",
+		Domains: []string{"example.com"},
+		PatientName: []Rule{{
+			Pattern:    `^Patient$`,
+			Value:      `^(?P<last>\w+), (?P<first>\w+)$`,
+			NextLine:   true,
+			Confidence: 0.9,
+		}},
+		Teeth: []Rule{{Pattern: `#(\d+)`, After: "Treatment", Before: "Notes", Confidence: 0.9}},
+	}
+	set, err := NewSet(template)
+	assert.NoError(t, err)
+	assert.Nil(t, set.ForDomain("other.com"))
+	result := set.Extract("example.com", "Patient\nLee, Ann\nReferred for #2\nTreatment\n#19 and #30\nNotes\n#31", testNow)
+	assert.Equal(t, "Ann", result.FirstName.Value)
+	assert.Equal(t, "Lee", result.LastName.Value)
+	assert.Equal(t, []string{"19", "30"}, result.Teeth, "only the section between the anchors is read")
+
+	_, err = NewSet(&Template{Name: "broken", PatientName: []Rule{{Pattern: `(`}}})
+	assert.Error(t, err)
+	_, err = NewSet(&Template{Name: "a", Domains: []string{"example.com"}}, &Template{Name: "b", Domains: []string{"EXAMPLE.com"}})
+	assert.Error(t, err)
+}
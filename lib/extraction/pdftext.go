@@ -0,0 +1,344 @@
+package extraction
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PDFText .... text of the pages of a PDF, a line of output per line of a page. Only text drawn with
+// text operators is found, scans have none and need OCR.
+func PDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "", fmt.Errorf("not a PDF")
+	}
+	pages := make([]string, 0)
+	pos := 0
+	for {
+		start := bytes.Index(data[pos:], []byte("stream"))
+		if start < 0 {
+			break
+		}
+		start += pos
+		pos = start + len("stream")
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+		dictStart := bytes.LastIndex(data[:start], []byte(" obj"))
+		if dictStart < 0 {
+			continue
+		}
+		dict := string(data[dictStart:start])
+		end := bytes.Index(data[pos:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content := bytes.TrimLeft(data[pos:pos+end], "\r\n")
+		pos += end + len("endstream")
+		if !isContentStream(dict) {
+			continue
+		}
+		if strings.Contains(dict, "/FlateDecode") {
+			reader, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// streams are sometimes cut short by a few bytes, what was inflated is still used
+			content, _ = ioutil.ReadAll(reader)
+		}
+		if text := contentText(content); text != "" {
+			pages = append(pages, text)
+		}
+	}
+	return strings.Join(pages, "\n"), nil
+}
+
+// isContentStream leaves out images, fonts and streams in encodings other than flate
+func isContentStream(dict string) bool {
+	for _, other := range []string{"/Image", "/Length1", "/Length2", "/FontFile", "/XRef", "/ObjStm", "/Metadata"} {
+		if strings.Contains(dict, other) {
+			return false
+		}
+	}
+	if strings.Contains(dict, "/Filter") && !strings.Contains(dict, "/FlateDecode") {
+		return false
+	}
+	// chains of filters are not decoded
+	return !strings.Contains(dict, "/Filter [") && !strings.Contains(dict, "/Filter[")
+}
+
+// token of a content stream, strings are already decoded
+type token struct {
+	kind  byte // o operator, s string, n number, [ and ] arrays, x anything else
+	text  string
+	value float64
+}
+
+// textState follows the text position to tell where lines break
+type textState struct {
+	out     strings.Builder
+	x, y    float64
+	lastY   float64
+	started bool
+	moved   bool
+	newLine bool
+}
+
+func (ts *textState) show(text string) {
+	if text == "" {
+		return
+	}
+	if ts.started {
+		switch {
+		case ts.newLine || math.Abs(ts.y-ts.lastY) > 1:
+			ts.out.WriteString("\n")
+		case ts.moved && !strings.HasSuffix(ts.out.String(), " ") && !strings.HasPrefix(text, " "):
+			ts.out.WriteString(" ")
+		}
+	}
+	ts.out.WriteString(text)
+	ts.lastY = ts.y
+	ts.started = true
+	ts.moved = false
+	ts.newLine = false
+}
+
+func contentText(content []byte) string {
+	if !bytes.Contains(content, []byte("BT")) {
+		return ""
+	}
+	ts := &textState{}
+	operands := make([]token, 0)
+	for _, tok := range tokenize(content) {
+		if tok.kind != 'o' {
+			operands = append(operands, tok)
+			continue
+		}
+		switch tok.text {
+		case "BT":
+			ts.x, ts.y = 0, 0
+			ts.moved = true
+		case "Td", "TD":
+			if n := numbers(operands); len(n) >= 2 {
+				ts.x += n[len(n)-2]
+				ts.y += n[len(n)-1]
+				ts.moved = true
+			}
+		case "Tm":
+			if n := numbers(operands); len(n) >= 6 {
+				ts.x, ts.y = n[len(n)-2], n[len(n)-1]
+				ts.moved = true
+			}
+		case "T*":
+			ts.newLine = true
+		case "Tj":
+			ts.show(lastString(operands))
+		case "'", "\"":
+			ts.newLine = true
+			ts.show(lastString(operands))
+		case "TJ":
+			ts.show(arrayText(operands))
+		}
+		operands = operands[:0]
+	}
+	return strings.TrimSpace(ts.out.String())
+}
+
+func numbers(operands []token) []float64 {
+	values := make([]float64, 0, len(operands))
+	for _, operand := range operands {
+		if operand.kind == 'n' {
+			values = append(values, operand.value)
+		}
+	}
+	return values
+}
+
+func lastString(operands []token) string {
+	for i := len(operands) - 1; i >= 0; i-- {
+		if operands[i].kind == 's' {
+			return operands[i].text
+		}
+	}
+	return ""
+}
+
+// arrayText joins the strings of a TJ array, large negative adjustments are gaps between words
+func arrayText(operands []token) string {
+	var text strings.Builder
+	for _, operand := range operands {
+		switch {
+		case operand.kind == 's':
+			text.WriteString(operand.text)
+		case operand.kind == 'n' && operand.value < -250:
+			text.WriteString(" ")
+		}
+	}
+	return text.String()
+}
+
+func tokenize(content []byte) []token {
+	tokens := make([]token, 0)
+	i := 0
+	for i < len(content) {
+		ch := content[i]
+		switch {
+		case isSpace(ch):
+			i++
+		case ch == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case ch == '(':
+			text, next := literalString(content, i+1)
+			tokens = append(tokens, token{kind: 's', text: text})
+			i = next
+		case ch == '<' && i+1 < len(content) && content[i+1] == '<':
+			tokens = append(tokens, token{kind: 'x'})
+			i += 2
+		case ch == '>' && i+1 < len(content) && content[i+1] == '>':
+			tokens = append(tokens, token{kind: 'x'})
+			i += 2
+		case ch == '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return tokens
+			}
+			tokens = append(tokens, token{kind: 's', text: hexString(content[i+1 : i+end])})
+			i += end + 1
+		case ch == '[' || ch == ']':
+			tokens = append(tokens, token{kind: ch})
+			i++
+		case ch == '/':
+			start := i
+			i++
+			for i < len(content) && !isSpace(content[i]) && !isDelimiter(content[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: 'x', text: string(content[start:i])})
+		default:
+			start := i
+			for i < len(content) && !isSpace(content[i]) && !isDelimiter(content[i]) {
+				i++
+			}
+			if i == start {
+				i++
+				continue
+			}
+			word := string(content[start:i])
+			if value, err := strconv.ParseFloat(word, 64); err == nil {
+				tokens = append(tokens, token{kind: 'n', value: value})
+				continue
+			}
+			tokens = append(tokens, token{kind: 'o', text: word})
+			if word == "ID" {
+				// inline image data runs up to EI
+				end := bytes.Index(content[i:], []byte("EI"))
+				if end < 0 {
+					return tokens
+				}
+				i += end + 2
+			}
+		}
+	}
+	return tokens
+}
+
+// literalString decodes a (string) starting after its parenthesis, it returns the text and where
+// the string ends
+func literalString(content []byte, i int) (string, int) {
+	var text []byte
+	depth := 1
+	for i < len(content) {
+		ch := content[i]
+		i++
+		switch ch {
+		case '\\':
+			if i >= len(content) {
+				continue
+			}
+			escaped := content[i]
+			i++
+			switch escaped {
+			case 'n':
+				text = append(text, '\n')
+			case 'r':
+				text = append(text, '\r')
+			case 't':
+				text = append(text, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					value := int(escaped - '0')
+					for n := 0; n < 2 && i < len(content) && content[i] >= '0' && content[i] <= '7'; n++ {
+						value = value*8 + int(content[i]-'0')
+						i++
+					}
+					text = append(text, byte(value))
+				} else {
+					text = append(text, escaped)
+				}
+			}
+		case '(':
+			depth++
+			text = append(text, ch)
+		case ')':
+			depth--
+			if depth == 0 {
+				return latin1(text), i
+			}
+			text = append(text, ch)
+		default:
+			text = append(text, ch)
+		}
+	}
+	return latin1(text), i
+}
+
+// hexString decodes <hex> strings of single byte fonts, two byte glyph ids come back empty
+func hexString(hex []byte) string {
+	digits := make([]byte, 0, len(hex))
+	for _, ch := range hex {
+		if !isSpace(ch) {
+			digits = append(digits, ch)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	text := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		value, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		if err != nil {
+			return ""
+		}
+		if value < 0x20 && value != '\t' {
+			return ""
+		}
+		text = append(text, byte(value))
+	}
+	return latin1(text)
+}
+
+// latin1 is close enough to the WinAnsi encoding of the standard fonts
+func latin1(text []byte) string {
+	runes := make([]rune, len(text))
+	for i, ch := range text {
+		runes[i] = rune(ch)
+	}
+	return string(runes)
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t' || ch == '\f' || ch == 0
+}
+
+func isDelimiter(ch byte) bool {
+	return strings.IndexByte("()<>[]{}/%", ch) >= 0
+}
@@ -0,0 +1,69 @@
+package fcm
+
+import (
+	"context"
+	"sync"
+)
+
+// Push .... a notification Fake was asked to send
+type Push struct {
+	Topic        string
+	Notification Notification
+}
+
+// Fake .... a Sender for tests, it records pushes and subscriptions. Tokens in Invalid are refused as
+// FCM refuses the ones it does not know.
+type Fake struct {
+	mu            sync.Mutex
+	Invalid       map[string]bool
+	Pushes        []Push
+	Subscriptions map[string]map[string]bool
+}
+
+// NewFake ....
+func NewFake() *Fake {
+	return &Fake{Invalid: make(map[string]bool), Subscriptions: make(map[string]map[string]bool)}
+}
+
+// SendToTopic ....
+func (f *Fake) SendToTopic(ctx context.Context, topic string, notification Notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Pushes = append(f.Pushes, Push{Topic: topic, Notification: notification})
+	return nil
+}
+
+// Subscribe ....
+func (f *Fake) Subscribe(ctx context.Context, topic string, tokens []string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	invalid := make([]string, 0)
+	for _, token := range tokens {
+		if f.Invalid[token] {
+			invalid = append(invalid, token)
+			continue
+		}
+		if f.Subscriptions[topic] == nil {
+			f.Subscriptions[topic] = make(map[string]bool)
+		}
+		f.Subscriptions[topic][token] = true
+	}
+	return invalid, nil
+}
+
+// Unsubscribe ....
+func (f *Fake) Unsubscribe(ctx context.Context, topic string, tokens []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, token := range tokens {
+		delete(f.Subscriptions[topic], token)
+	}
+	return nil
+}
+
+// Subscribed .... whether the token is subscribed to the topic
+func (f *Fake) Subscribed(topic string, token string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Subscriptions[topic][token]
+}
@@ -4,14 +4,35 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
-	"github.com/NaySoftware/go-fcm"
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"github.com/superdentist/superdentist-backend/lib/helpers"
+	"google.golang.org/api/option"
 )
 
-// ClientFCM ....
+// Sender pushes notifications to devices subscribed to topics. ClientFCM sends through Firebase Cloud
+// Messaging, Fake records what it is asked for tests.
+type Sender interface {
+	SendToTopic(ctx context.Context, topic string, notification Notification) error
+	// Subscribe returns the tokens FCM does not know, they are not subscribed
+	Subscribe(ctx context.Context, topic string, tokens []string) ([]string, error)
+	Unsubscribe(ctx context.Context, topic string, tokens []string) error
+}
+
+// Notification .... a push to clinic staff, Link opens what it is about in the app
+type Notification struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Link  string            `json:"link"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+// ClientFCM .... sends through the FCM HTTP v1 API with the backend's service account
 type ClientFCM struct {
 	projectID string
-	client    *fcm.FcmClient
+	client    *messaging.Client
 }
 
 // NewFCMHanlder return new database action
@@ -21,26 +42,95 @@ func NewFCMHanlder() *ClientFCM {
 
 // InitializeFCMClient ....
 func (cfc *ClientFCM) InitializeFCMClient(ctx context.Context, projectID string) error {
-	gcpAPIKey := os.Getenv("GCP_API_KEY")
-	if gcpAPIKey == "" {
-		return fmt.Errorf("Failed to get api key superdentist backend")
+	serviceAccountSD := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if serviceAccountSD == "" {
+		return fmt.Errorf("Missing service account file for backend server")
+	}
+	targetScopes := []string{
+		"https://www.googleapis.com/auth/cloud-platform",
+		"https://www.googleapis.com/auth/firebase.messaging",
+	}
+	currentCreds, _, err := helpers.ReadCredentialsFile(ctx, serviceAccountSD, targetScopes)
+	if err != nil {
+		return fmt.Errorf("Failed to read service account for fcm: %v", err)
 	}
-	fcmClient := fcm.NewFcmClient(gcpAPIKey)
-	cfc.client = fcmClient
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: projectID}, option.WithCredentials(currentCreds))
+	if err != nil {
+		return fmt.Errorf("Failed to initialize fcm client: %v", err)
+	}
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to initialize fcm client: %v", err)
+	}
+	cfc.client = client
 	cfc.projectID = projectID
 	return nil
 }
 
-// SendNotificationToUser ...
-func (cfc *ClientFCM) SendNotificationToUser(ctx context.Context, topic string, message map[string]string) error {
-	topicFull := fmt.Sprintf("/topics/%s", topic)
-	cfc.client.NewFcmMsgTo(topicFull, message)
-	status, err := cfc.client.Send()
+// SendToTopic .... pushes the notification to every device subscribed to the topic
+func (cfc *ClientFCM) SendToTopic(ctx context.Context, topic string, notification Notification) error {
+	message := fcmMessage(notification)
+	message.Topic = topic
+	_, err := cfc.client.Send(ctx, message)
+	if err != nil {
+		return fmt.Errorf("Error in sending notification to %s: %v", topic, err)
+	}
+	return nil
+}
+
+// Subscribe ....
+func (cfc *ClientFCM) Subscribe(ctx context.Context, topic string, tokens []string) ([]string, error) {
+	response, err := cfc.client.SubscribeToTopic(ctx, tokens, topic)
+	if err != nil {
+		return nil, fmt.Errorf("Error in subscribing to %s: %v", topic, err)
+	}
+	invalid := make([]string, 0)
+	for _, failure := range response.Errors {
+		if !invalidTokenReason(failure.Reason) {
+			return invalid, fmt.Errorf("Error in subscribing to %s: %s", topic, failure.Reason)
+		}
+		invalid = append(invalid, tokens[failure.Index])
+	}
+	return invalid, nil
+}
+
+// Unsubscribe ....
+func (cfc *ClientFCM) Unsubscribe(ctx context.Context, topic string, tokens []string) error {
+	response, err := cfc.client.UnsubscribeFromTopic(ctx, tokens, topic)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error in unsubscribing from %s: %v", topic, err)
 	}
-	if !status.Ok {
-		return fmt.Errorf("Error in sending notification: %s", status.Err)
+	for _, failure := range response.Errors {
+		// a token FCM forgot is no longer subscribed to anything
+		if !invalidTokenReason(failure.Reason) {
+			return fmt.Errorf("Error in unsubscribing from %s: %s", topic, failure.Reason)
+		}
 	}
 	return nil
 }
+
+// invalidTokenReason .... whether topic management failed because of the token, reasons end with the code
+func invalidTokenReason(reason string) bool {
+	return strings.HasSuffix(reason, "registration-token-not-registered") || strings.HasSuffix(reason, "invalid-argument")
+}
+
+// fcmMessage .... the notification for every platform, the link is in the data for the apps and the
+// click target of web pushes
+func fcmMessage(notification Notification) *messaging.Message {
+	data := map[string]string{"link": notification.Link}
+	for key, value := range notification.Data {
+		data[key] = value
+	}
+	message := &messaging.Message{
+		Data: data,
+		Notification: &messaging.Notification{
+			Title: notification.Title,
+			Body:  notification.Body,
+		},
+		Android: &messaging.AndroidConfig{Priority: "high"},
+	}
+	if strings.HasPrefix(notification.Link, "https://") {
+		message.Webpush = &messaging.WebpushConfig{FcmOptions: &messaging.WebpushFcmOptions{Link: notification.Link}}
+	}
+	return message
+}
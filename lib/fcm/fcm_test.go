@@ -0,0 +1,72 @@
+package fcm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+func TestClinicTopic(t *testing.T) {
+	assert.Equal(t, "clinic-7f3c2a10-9b1e", ClinicTopic("7f3c2a10-9b1e"))
+	assert.Equal(t, "clinic-a_b_c", ClinicTopic("a/b c"))
+	assert.Equal(t, "clinic-7f3c-staff-u_1", StaffTopic("7f3c", "u 1"))
+	assert.Equal(t, "https://app.superdentist.io/referrals/a1b2?message=m%2F1", ReferralLink("https://app.superdentist.io/", "a1b2", "m/1"))
+}
+
+func TestRegister(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+	assert.NoError(t, Register(ctx, fake, "token-1", []string{ClinicTopic("clinic-a"), ClinicTopic("clinic-b")}, nil))
+	assert.True(t, fake.Subscribed(ClinicTopic("clinic-a"), "token-1"))
+	assert.True(t, fake.Subscribed(ClinicTopic("clinic-b"), "token-1"))
+
+	assert.NoError(t, Register(ctx, fake, "token-1", []string{ClinicTopic("clinic-b")}, []string{ClinicTopic("clinic-a"), ClinicTopic("clinic-b")}))
+	assert.False(t, fake.Subscribed(ClinicTopic("clinic-a"), "token-1"), "clinics the user left are unsubscribed")
+	assert.True(t, fake.Subscribed(ClinicTopic("clinic-b"), "token-1"))
+
+	fake.Invalid["stale"] = true
+	assert.Equal(t, ErrInvalidToken, Register(ctx, fake, "stale", []string{ClinicTopic("clinic-a")}, nil))
+	assert.False(t, fake.Subscribed(ClinicTopic("clinic-a"), "stale"))
+
+	assert.NoError(t, Unregister(ctx, fake, "token-1", []string{ClinicTopic("clinic-b")}))
+	assert.False(t, fake.Subscribed(ClinicTopic("clinic-b"), "token-1"))
+}
+
+func TestReferralNotifications(t *testing.T) {
+	referral := contracts.DSReferral{
+		ReferralID:       "ref-1",
+		FromAddressID:    "gd",
+		FromClinicName:   "Downtown Family Dental",
+		ToAddressID:      "sp",
+		ToClinicName:     "Bright Smile Endodontics",
+		PatientFirstName: "Maria",
+		PatientLastName:  "Garcia",
+	}
+	referral.Status.SPStatus = "scheduled"
+
+	notifications := ReferralNotifications(contracts.EventReferralCreated, referral, "", "", "https://app.superdentist.io")
+	assert.Len(t, notifications, 1)
+	push := notifications["sp"]
+	assert.Equal(t, "You have a new referral from Downtown Family Dental", push.Body)
+	assert.Equal(t, "https://app.superdentist.io/referrals/ref-1", push.Link)
+	assert.Equal(t, "ref-1", push.Data["referralId"])
+	assert.NotContains(t, push.Body, "Maria", "pushes never name the patient")
+
+	notifications = ReferralNotifications(contracts.EventReferralStatus, referral, "", "", "https://app.superdentist.io")
+	assert.Len(t, notifications, 1)
+	assert.Equal(t, "Your referral is now scheduled at Bright Smile Endodontics", notifications["gd"].Body)
+
+	notifications = ReferralNotifications(contracts.EventMessageCreated, referral, contracts.GDCBox, "msg-1", "https://app.superdentist.io")
+	assert.Len(t, notifications, 2)
+	for _, push := range notifications {
+		assert.Equal(t, "https://app.superdentist.io/referrals/ref-1?message=msg-1", push.Link)
+	}
+
+	notifications = ReferralNotifications(contracts.EventMessageCreated, referral, contracts.SPCBox, "msg-2", "https://app.superdentist.io")
+	assert.Len(t, notifications, 1, "the patient chat is the specialist's")
+	assert.Contains(t, notifications, "sp")
+
+	assert.Empty(t, ReferralNotifications(contracts.EventDocumentDeleted, referral, "", "", "https://app.superdentist.io"))
+}
@@ -0,0 +1,124 @@
+package fcm
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+// ErrInvalidToken is returned by Register for a token FCM does not know
+var ErrInvalidToken = errors.New("fcm: device token is not registered")
+
+// ClinicTopic .... topic the devices of a clinic's staff are subscribed to. Topic names only take
+// letters, digits and -_.~%, anything else is replaced.
+func ClinicTopic(addressID string) string {
+	return "clinic-" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-_.~%", r) {
+			return r
+		}
+		return '_'
+	}, addressID)
+}
+
+// StaffTopic .... topic the devices of a clinic's staff user with their own notification preferences are
+// subscribed to, instead of the clinic's
+func StaffTopic(addressID string, userID string) string {
+	return ClinicTopic(addressID) + "-staff-" + ClinicTopic(userID)[len("clinic-"):]
+}
+
+// ReferralLink .... deep link to the referral in the app at baseURL, to one of its messages when messageID is set
+func ReferralLink(baseURL string, referralID string, messageID string) string {
+	link := strings.TrimRight(baseURL, "/") + "/referrals/" + url.PathEscape(referralID)
+	if messageID != "" {
+		link += "?message=" + url.QueryEscape(messageID)
+	}
+	return link
+}
+
+// Register .... subscribes the token to the topics and unsubscribes it from the previous ones it no longer
+// has. A token FCM does not know is ErrInvalidToken and stays unsubscribed.
+func Register(ctx context.Context, sender Sender, token string, topics []string, previous []string) error {
+	current := make(map[string]bool)
+	for _, topic := range topics {
+		current[topic] = true
+		invalid, err := sender.Subscribe(ctx, topic, []string{token})
+		if len(invalid) > 0 {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, topic := range previous {
+		if current[topic] {
+			continue
+		}
+		if err := sender.Unsubscribe(ctx, topic, []string{token}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unregister .... unsubscribes the token from the topics
+func Unregister(ctx context.Context, sender Sender, token string, topics []string) error {
+	for _, topic := range topics {
+		if err := sender.Unsubscribe(ctx, topic, []string{token}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReferralNotifications .... the pushes of a referral event by the clinic they go to: a new referral to
+// the specialist, a status change to the referring clinic, a message to both, or only the specialist for
+// the patient chat. Pushes go through Google and Apple, they name clinics but never the patient.
+func ReferralNotifications(eventType string, referral contracts.DSReferral, channel contracts.ChatBox, messageID string, baseURL string) map[string]Notification {
+	notifications := make(map[string]Notification)
+	add := func(addressID string, title string, body string) {
+		if addressID == "" {
+			return
+		}
+		notifications[addressID] = ReferralNotification(eventType, referral, addressID, title, body, messageID, baseURL)
+	}
+	switch eventType {
+	case contracts.EventReferralCreated:
+		add(referral.ToAddressID, "New referral", withClinic("You have a new referral", " from ", referral.FromClinicName))
+	case contracts.EventReferralStatus:
+		add(referral.FromAddressID, "Referral updated", withClinic("Your referral is now "+referral.Status.SPStatus, " at ", referral.ToClinicName))
+	case contracts.EventMessageCreated:
+		if channel == contracts.SPCBox {
+			add(referral.ToAddressID, "New message", "New message in a patient chat")
+			break
+		}
+		add(referral.ToAddressID, "New message", withClinic("New message on a referral", " from ", referral.FromClinicName))
+		add(referral.FromAddressID, "New message", withClinic("New message on a referral", " to ", referral.ToClinicName))
+	}
+	return notifications
+}
+
+// ReferralNotification .... the push of a referral event to the clinic at addressID, opening the referral
+func ReferralNotification(eventType string, referral contracts.DSReferral, addressID string, title string, body string, messageID string, baseURL string) Notification {
+	return Notification{
+		Title: title,
+		Body:  body,
+		Link:  ReferralLink(baseURL, referral.ReferralID, messageID),
+		Data: map[string]string{
+			"type":       eventType,
+			"addressId":  addressID,
+			"referralId": referral.ReferralID,
+			"messageId":  messageID,
+			"status":     referral.Status.SPStatus,
+		},
+	}
+}
+
+func withClinic(text string, joiner string, clinicName string) string {
+	if clinicName == "" {
+		return text
+	}
+	return text + joiner + clinicName
+}
@@ -0,0 +1,271 @@
+// Package ical renders RFC 5545 calendar objects for referral appointments.
+// It only covers what we send out: VEVENTs with a VTIMEZONE for the clinic
+// zone, REQUEST/CANCEL/PUBLISH methods and attendee lists.
+package ical
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Calendar methods used by SuperDentist
+const (
+	MethodPublish = "PUBLISH"
+	MethodRequest = "REQUEST"
+	MethodCancel  = "CANCEL"
+)
+
+// Event statuses
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusCancelled = "CANCELLED"
+)
+
+const (
+	productID     = "-//SuperDentist//Referral Appointments//EN"
+	dateTimeLocal = "20060102T150405"
+	dateTimeUTC   = "20060102T150405Z"
+	maxLineOctets = 75
+)
+
+// Person ....
+type Person struct {
+	Name  string
+	Email string
+}
+
+// Event ....
+type Event struct {
+	UID          string
+	Summary      string
+	Description  string
+	Location     string
+	Start        time.Time
+	End          time.Time
+	Sequence     int
+	Status       string
+	LastModified time.Time
+	Organizer    Person
+	Attendees    []Person
+}
+
+// Calendar ....
+type Calendar struct {
+	Name     string
+	Method   string
+	Location *time.Location
+	Events   []Event
+}
+
+// NewCalendar ... calendar in the given zone, nil zone means UTC
+func NewCalendar(name string, method string, location *time.Location) *Calendar {
+	if location == nil {
+		location = time.UTC
+	}
+	return &Calendar{Name: name, Method: method, Location: location, Events: make([]Event, 0)}
+}
+
+// AddEvent ....
+func (cal *Calendar) AddEvent(event Event) {
+	cal.Events = append(cal.Events, event)
+}
+
+// Bytes renders the calendar with CRLF line endings and folded lines
+func (cal *Calendar) Bytes() []byte {
+	var buf bytes.Buffer
+	writeLine(&buf, "BEGIN:VCALENDAR")
+	writeLine(&buf, "VERSION:2.0")
+	writeLine(&buf, "PRODID:"+productID)
+	writeLine(&buf, "CALSCALE:GREGORIAN")
+	if cal.Method != "" {
+		writeLine(&buf, "METHOD:"+cal.Method)
+	}
+	if cal.Name != "" {
+		writeLine(&buf, "X-WR-CALNAME:"+escapeText(cal.Name))
+	}
+	useZone := cal.Location != time.UTC && len(cal.Events) > 0
+	if useZone {
+		writeLine(&buf, "X-WR-TIMEZONE:"+cal.Location.String())
+		cal.writeTimeZone(&buf)
+	}
+	for _, event := range cal.Events {
+		cal.writeEvent(&buf, event, useZone)
+	}
+	writeLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+func (cal *Calendar) writeEvent(buf *bytes.Buffer, event Event, useZone bool) {
+	stamp := event.LastModified
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+	status := event.Status
+	if status == "" {
+		status = StatusConfirmed
+	}
+	writeLine(buf, "BEGIN:VEVENT")
+	writeLine(buf, "UID:"+event.UID)
+	writeLine(buf, "DTSTAMP:"+stamp.UTC().Format(dateTimeUTC))
+	writeLine(buf, "LAST-MODIFIED:"+stamp.UTC().Format(dateTimeUTC))
+	if useZone {
+		tzid := cal.Location.String()
+		writeLine(buf, "DTSTART;TZID="+tzid+":"+event.Start.In(cal.Location).Format(dateTimeLocal))
+		writeLine(buf, "DTEND;TZID="+tzid+":"+event.End.In(cal.Location).Format(dateTimeLocal))
+	} else {
+		writeLine(buf, "DTSTART:"+event.Start.UTC().Format(dateTimeUTC))
+		writeLine(buf, "DTEND:"+event.End.UTC().Format(dateTimeUTC))
+	}
+	writeLine(buf, fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+	writeLine(buf, "STATUS:"+status)
+	writeLine(buf, "SUMMARY:"+escapeText(event.Summary))
+	if event.Description != "" {
+		writeLine(buf, "DESCRIPTION:"+escapeText(event.Description))
+	}
+	if event.Location != "" {
+		writeLine(buf, "LOCATION:"+escapeText(event.Location))
+	}
+	if event.Organizer.Email != "" {
+		writeLine(buf, "ORGANIZER;CN="+quoteParam(event.Organizer.Name)+":mailto:"+event.Organizer.Email)
+	}
+	for _, attendee := range event.Attendees {
+		if attendee.Email == "" {
+			continue
+		}
+		partStat := "NEEDS-ACTION"
+		if status == StatusCancelled {
+			partStat = "DECLINED"
+		}
+		writeLine(buf, "ATTENDEE;CN="+quoteParam(attendee.Name)+";ROLE=REQ-PARTICIPANT;PARTSTAT="+partStat+":mailto:"+attendee.Email)
+	}
+	writeLine(buf, "TRANSP:OPAQUE")
+	writeLine(buf, "END:VEVENT")
+}
+
+// writeTimeZone emits a VTIMEZONE with every offset transition in the years
+// covered by the events, clients need it to resolve the TZID on DTSTART/DTEND
+func (cal *Calendar) writeTimeZone(buf *bytes.Buffer) {
+	firstYear, lastYear := cal.Events[0].Start.In(cal.Location).Year(), cal.Events[0].End.In(cal.Location).Year()
+	for _, event := range cal.Events {
+		if y := event.Start.In(cal.Location).Year(); y < firstYear {
+			firstYear = y
+		}
+		if y := event.End.In(cal.Location).Year(); y > lastYear {
+			lastYear = y
+		}
+	}
+	writeLine(buf, "BEGIN:VTIMEZONE")
+	writeLine(buf, "TZID:"+cal.Location.String())
+	startOfRange := time.Date(firstYear, time.January, 1, 0, 0, 0, 0, cal.Location)
+	endOfRange := time.Date(lastYear+1, time.January, 1, 0, 0, 0, 0, cal.Location)
+	transitions := zoneTransitions(startOfRange, endOfRange)
+	if len(transitions) == 0 {
+		name, offset := startOfRange.Zone()
+		writeObservance(buf, "STANDARD", time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), name, offset, offset)
+	}
+	for _, transition := range transitions {
+		kind := "STANDARD"
+		if transition.to > transition.from {
+			kind = "DAYLIGHT"
+		}
+		// DTSTART of an observance is expressed in the offset in effect before the change
+		localStart := transition.at.UTC().Add(time.Duration(transition.from) * time.Second)
+		writeObservance(buf, kind, localStart, transition.name, transition.from, transition.to)
+	}
+	writeLine(buf, "END:VTIMEZONE")
+}
+
+type transition struct {
+	at   time.Time
+	name string
+	from int
+	to   int
+}
+
+// zoneTransitions walks the range a day at a time and narrows every offset
+// change down to the second
+func zoneTransitions(start time.Time, end time.Time) []transition {
+	result := make([]transition, 0)
+	_, previousOffset := start.Zone()
+	for day := start; day.Before(end); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		_, nextOffset := next.Zone()
+		if nextOffset == previousOffset {
+			continue
+		}
+		low, high := day, next
+		for high.Sub(low) > time.Second {
+			middle := low.Add(high.Sub(low) / 2)
+			if _, offset := middle.Zone(); offset == previousOffset {
+				low = middle
+			} else {
+				high = middle
+			}
+		}
+		name, _ := high.Zone()
+		result = append(result, transition{at: high, name: name, from: previousOffset, to: nextOffset})
+		previousOffset = nextOffset
+	}
+	return result
+}
+
+func writeObservance(buf *bytes.Buffer, kind string, start time.Time, name string, from int, to int) {
+	writeLine(buf, "BEGIN:"+kind)
+	writeLine(buf, "DTSTART:"+start.Format(dateTimeLocal))
+	writeLine(buf, "TZOFFSETFROM:"+formatOffset(from))
+	writeLine(buf, "TZOFFSETTO:"+formatOffset(to))
+	if name != "" {
+		writeLine(buf, "TZNAME:"+name)
+	}
+	writeLine(buf, "END:"+kind)
+}
+
+func formatOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, (seconds%3600)/60)
+}
+
+// escapeText escapes TEXT values per RFC 5545 section 3.3.11
+func escapeText(value string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	)
+	return replacer.Replace(value)
+}
+
+func quoteParam(value string) string {
+	value = strings.Replace(value, `"`, "'", -1)
+	return `"` + value + `"`
+}
+
+// writeLine folds content lines longer than 75 octets without splitting
+// multi-byte characters, continuation lines count their leading space
+func writeLine(buf *bytes.Buffer, line string) {
+	limit := maxLineOctets
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		limit = maxLineOctets - 1
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
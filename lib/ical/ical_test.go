@@ -0,0 +1,86 @@
+package ical
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEvent(location *time.Location) Event {
+	return Event{
+		UID:          "ref-1@superdentist.io",
+		Summary:      "Jane Doe - Smile Endo",
+		Description:  "Referral ID: ref-1\nNotes; bring x-rays, insurance card",
+		Location:     "1 Main St, Austin, TX",
+		Start:        time.Date(2021, time.March, 20, 9, 30, 0, 0, location),
+		End:          time.Date(2021, time.March, 20, 10, 30, 0, 0, location),
+		Sequence:     2,
+		LastModified: time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC),
+		Organizer:    Person{Name: "Smile Endo", Email: "endo@example.com"},
+		Attendees:    []Person{{Name: "Jane Doe", Email: "jane@example.com"}},
+	}
+}
+
+func TestCalendarRequest(t *testing.T) {
+	location, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Skip("zoneinfo not available")
+	}
+	cal := NewCalendar("", MethodRequest, location)
+	cal.AddEvent(testEvent(location))
+	out := string(cal.Bytes())
+
+	assert.True(t, strings.HasPrefix(out, "BEGIN:VCALENDAR\r\n"))
+	assert.True(t, strings.HasSuffix(out, "END:VCALENDAR\r\n"))
+	assert.Contains(t, out, "METHOD:REQUEST\r\n")
+	assert.Contains(t, out, "SEQUENCE:2\r\n")
+	assert.Contains(t, out, "STATUS:CONFIRMED\r\n")
+	assert.Contains(t, out, "DTSTART;TZID=America/Chicago:20210320T093000\r\n")
+	assert.Contains(t, out, "DESCRIPTION:Referral ID: ref-1\\nNotes\\; bring x-rays\\, insurance card\r\n")
+	// 2021 has both the spring forward and fall back transitions
+	assert.Contains(t, out, "BEGIN:DAYLIGHT\r\nDTSTART:20210314T020000\r\nTZOFFSETFROM:-0600\r\nTZOFFSETTO:-0500\r\n")
+	assert.Contains(t, out, "BEGIN:STANDARD\r\nDTSTART:20211107T020000\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0600\r\n")
+}
+
+func TestCalendarCancel(t *testing.T) {
+	cal := NewCalendar("", MethodCancel, nil)
+	event := testEvent(time.UTC)
+	event.Status = StatusCancelled
+	cal.AddEvent(event)
+	out := string(cal.Bytes())
+
+	assert.Contains(t, out, "METHOD:CANCEL\r\n")
+	assert.Contains(t, out, "STATUS:CANCELLED\r\n")
+	assert.Contains(t, out, "DTSTART:20210320T093000Z\r\n")
+	assert.NotContains(t, out, "VTIMEZONE")
+	assert.Contains(t, out, "PARTSTAT=DECLINED")
+}
+
+func TestLineFolding(t *testing.T) {
+	cal := NewCalendar("", MethodPublish, nil)
+	event := testEvent(time.UTC)
+	event.Description = strings.Repeat("é", 100)
+	cal.AddEvent(event)
+	for _, line := range strings.Split(string(cal.Bytes()), "\r\n") {
+		assert.True(t, len(line) <= maxLineOctets, line)
+	}
+	assert.Contains(t, string(cal.Bytes()), "\r\n é")
+}
+
+func TestLineFoldingContinuation(t *testing.T) {
+	cal := NewCalendar("", MethodPublish, nil)
+	event := testEvent(time.UTC)
+	// one octet characters fill continuation lines to the limit, the multi-byte ones must not be split
+	event.Description = strings.Repeat("a", 150) + strings.Repeat("日本", 40) + strings.Repeat("b", 75)
+	cal.AddEvent(event)
+	output := string(cal.Bytes())
+	for _, line := range strings.Split(output, "\r\n") {
+		assert.True(t, len(line) <= maxLineOctets, "%d octets: %q", len(line), line)
+		assert.True(t, utf8.ValidString(line), line)
+	}
+	unfolded := strings.Replace(output, "\r\n ", "", -1)
+	assert.Contains(t, unfolded, "DESCRIPTION:"+event.Description)
+}
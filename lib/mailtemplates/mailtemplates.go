@@ -0,0 +1,176 @@
+package mailtemplates
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Kinds of transactional email, named as the options of their SendGrid template IDs
+const (
+	KindPatientConfirmation    = "pct"
+	KindPatientNotification    = "pnn"
+	KindSpecialistConfirmation = "sct"
+	KindReferralCompleted      = "gdc"
+	KindReferralAuto           = "gdcauto"
+	KindClinicNotification     = "cnn"
+	KindVerification           = "verify"
+	KindPasswordReset          = "reset"
+)
+
+// layoutFile wraps the HTML of every kind, it defines "layout" and calls the kind's "content"
+const layoutFile = "layout.html"
+
+// Samples .... dynamic data of each kind as the Send* functions pass it, for previews and tests
+var Samples = map[string]map[string]interface{}{
+	KindPatientConfirmation: {
+		"subject":  "Your Referral to Bright Smile Endodontics",
+		"pname":    "Maria Garcia",
+		"refid":    "a1b2c3d4",
+		"spname":   "Bright Smile Endodontics",
+		"address":  "100 Main St, Springfield, IL 62701",
+		"phone":    "+12175550100",
+		"comments": []string{"Evaluate #30 for root canal.", "Patient is anxious, please call first."},
+	},
+	KindPatientNotification: {
+		"subject":  "Your Referral to Bright Smile Endodontics",
+		"pname":    "Maria Garcia",
+		"refid":    "a1b2c3d4",
+		"cname":    "Bright Smile Endodontics",
+		"comments": "We have an opening on Thursday at 10 AM, does that work for you?",
+	},
+	KindSpecialistConfirmation: {
+		"subject":  "You have recieved a New Patient Referral on SuperDentist! Referral ID: a1b2c3d4",
+		"pname":    "Maria Garcia",
+		"refid":    "a1b2c3d4",
+		"spname":   "Bright Smile Endodontics",
+		"pphone":   "+12175550199",
+		"rdate":    "03/01/2021",
+		"comments": []string{"Evaluate #30 for root canal."},
+	},
+	KindReferralCompleted: {
+		"subject":  "Your Patient Referral has been Completed on SuperDentist! Referral ID: a1b2c3d4",
+		"pname":    "Maria Garcia",
+		"refid":    "a1b2c3d4",
+		"spname":   "Downtown Family Dental",
+		"pphone":   "+12175550199",
+		"cdate":    "03/09/2021",
+		"comments": []string{"Root canal on #30 completed, crown recommended."},
+	},
+	KindReferralAuto: {
+		"subject":  "You have a new attachement for a referral! Referral ID: a1b2c3d4",
+		"pname":    "Maria Garcia",
+		"refid":    "a1b2c3d4",
+		"spname":   "Downtown Family Dental",
+		"pphone":   "+12175550199",
+		"cdate":    "03/09/2021",
+		"comments": []string{"Treatment summary attached."},
+	},
+	KindClinicNotification: {
+		"subject": "You have a new notification on SuperDentist! Referral ID: a1b2c3d4",
+		"pname":   "Maria Garcia",
+		"refid":   "a1b2c3d4",
+		"cname":   "Bright Smile Endodontics",
+	},
+	KindVerification: {
+		"subject":    "Verify your SuperDentist email",
+		"verify_url": "https://superdentist.io/verify?oobCode=sample",
+	},
+	KindPasswordReset: {
+		"subject":    "Reset your SuperDentist password",
+		"verify_url": "https://superdentist.io/reset?oobCode=sample",
+	},
+}
+
+// Email .... a rendered email
+type Email struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+type kindTemplates struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// Set .... the local templates of the kinds that have them
+type Set struct {
+	kinds map[string]kindTemplates
+}
+
+// Load .... reads <kind>.html and <kind>.txt of every kind from dir. A kind may have no files, its
+// emails then only go out through SendGrid, but it needs both to be rendered locally. Each template is
+// rendered with the kind's sample data, a template using data the kind does not pass does not load.
+func Load(dir string) (*Set, error) {
+	set := &Set{kinds: make(map[string]kindTemplates)}
+	layout := filepath.Join(dir, layoutFile)
+	for kind, sample := range Samples {
+		htmlPath := filepath.Join(dir, kind+".html")
+		textPath := filepath.Join(dir, kind+".txt")
+		_, htmlErr := os.Stat(htmlPath)
+		_, textErr := os.Stat(textPath)
+		if os.IsNotExist(htmlErr) && os.IsNotExist(textErr) {
+			continue
+		}
+		if htmlErr != nil || textErr != nil {
+			return nil, fmt.Errorf("email %s needs both %s.html and %s.txt", kind, kind, kind)
+		}
+		html, err := htmltemplate.New(kind).Option("missingkey=error").ParseFiles(layout, htmlPath)
+		if err != nil {
+			return nil, fmt.Errorf("email %s: %v", kind, err)
+		}
+		text, err := texttemplate.New(filepath.Base(textPath)).Option("missingkey=error").ParseFiles(textPath)
+		if err != nil {
+			return nil, fmt.Errorf("email %s: %v", kind, err)
+		}
+		templates := kindTemplates{html: html, text: text}
+		if _, err := templates.render(sample); err != nil {
+			return nil, fmt.Errorf("email %s: %v", kind, err)
+		}
+		set.kinds[kind] = templates
+	}
+	return set, nil
+}
+
+func (t kindTemplates) render(data map[string]interface{}) (Email, error) {
+	var html, text bytes.Buffer
+	if err := t.html.ExecuteTemplate(&html, "layout", data); err != nil {
+		return Email{}, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return Email{}, err
+	}
+	subject, _ := data["subject"].(string)
+	return Email{Subject: subject, HTML: html.String(), Text: strings.TrimSpace(text.String()) + "\n"}, nil
+}
+
+// Has .... whether the kind has local templates
+func (s *Set) Has(kind string) bool {
+	_, ok := s.kinds[kind]
+	return ok
+}
+
+// Kinds .... kinds with local templates, sorted
+func (s *Set) Kinds() []string {
+	kinds := make([]string, 0, len(s.kinds))
+	for kind := range s.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Render .... the email of the kind with its dynamic data, the subject is the data's subject
+func (s *Set) Render(kind string, data map[string]interface{}) (Email, error) {
+	templates, ok := s.kinds[kind]
+	if !ok {
+		return Email{}, fmt.Errorf("no local templates for email %s", kind)
+	}
+	return templates.render(data)
+}
@@ -0,0 +1,66 @@
+package mailtemplates
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the email templates")
+
+func TestGolden(t *testing.T) {
+	set, err := Load("../../templates/email")
+	assert.NoError(t, err)
+	assert.Equal(t, len(Samples), len(set.Kinds()), "every kind has local templates")
+	for _, kind := range set.Kinds() {
+		email, err := set.Render(kind, Samples[kind])
+		assert.NoError(t, err, kind)
+		assert.Equal(t, Samples[kind]["subject"], email.Subject)
+		for name, got := range map[string]string{kind + ".html": email.HTML, kind + ".txt": email.Text} {
+			golden := filepath.Join("testdata", "golden", name)
+			if *update {
+				assert.NoError(t, ioutil.WriteFile(golden, []byte(got), 0644))
+				continue
+			}
+			want, err := ioutil.ReadFile(golden)
+			assert.NoError(t, err, golden)
+			assert.Equal(t, string(want), got, "%s changed, run go test ./lib/mailtemplates -update if that is intended", name)
+		}
+	}
+}
+
+func TestRenderEscapes(t *testing.T) {
+	set, err := Load("../../templates/email")
+	assert.NoError(t, err)
+	data := map[string]interface{}{}
+	for key, value := range Samples[KindPatientNotification] {
+		data[key] = value
+	}
+	data["comments"] = `<script>alert("x")</script>`
+	email, err := set.Render(KindPatientNotification, data)
+	assert.NoError(t, err)
+	assert.NotContains(t, email.HTML, "<script>")
+	assert.Contains(t, email.Text, "<script>", "the text part is not HTML")
+
+	delete(data, "cname")
+	_, err = set.Render(KindPatientNotification, data)
+	assert.Error(t, err, "data the template uses is missing")
+}
+
+func TestLoadRejectsUnknownData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailtemplates")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, layoutFile), []byte(`{{define "layout"}}{{template "content" .}}{{end}}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cnn.html"), []byte(`{{define "content"}}{{.cname}}{{end}}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cnn.txt"), []byte(`{{.spname}}`), 0644))
+	_, err = Load(dir)
+	assert.Error(t, err, "cnn does not pass spname")
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cnn.txt"), []byte(`{{.cname}}`), 0644))
+	set, err := Load(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{KindClinicNotification}, set.Kinds())
+}
@@ -0,0 +1,115 @@
+// Package mailthread ties inbound email to the referral it answers. Outbound
+// referral emails carry a Reply-To with the referral in a plus address and an
+// HMAC of it, so replies are routed without trusting the subject or sender.
+package mailthread
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"regexp"
+	"strings"
+)
+
+const (
+	tokenPrefix = "ref."
+	// 10 base32 characters are 50 bits, enough to make guessing a token pointless
+	signatureLength = 10
+)
+
+var signatureEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ReplyAddress .... Reply-To of a referral's emails, replyTo with the referral and its signature in a
+// plus address: referrals+ref.<referralID>.<signature>@example.com. Without a key, a referral or an
+// address to extend replyTo is returned as is.
+func ReplyAddress(replyTo string, referralID string, key []byte) string {
+	at := strings.LastIndex(replyTo, "@")
+	if at <= 0 || referralID == "" || len(key) == 0 {
+		return replyTo
+	}
+	local := replyTo[:at]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return local + "+" + tokenPrefix + strings.ToLower(referralID) + "." + signature(referralID, key) + replyTo[at:]
+}
+
+// ReferralID .... referral of a reply address, ok is false for addresses without a token and for
+// tokens whose signature does not match
+func ReferralID(address string, key []byte) (string, bool) {
+	if len(key) == 0 {
+		return "", false
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(address, "@")
+	if at <= 0 {
+		return "", false
+	}
+	local := address[:at]
+	plus := strings.Index(local, "+")
+	if plus < 0 {
+		return "", false
+	}
+	token := local[plus+1:]
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", false
+	}
+	token = strings.TrimPrefix(token, tokenPrefix)
+	dot := strings.LastIndex(token, ".")
+	if dot <= 0 {
+		return "", false
+	}
+	referralID, sig := token[:dot], token[dot+1:]
+	// mail servers may change the case of the local part, so both sides are compared lowercased
+	if !hmac.Equal([]byte(sig), []byte(signature(referralID, key))) {
+		return "", false
+	}
+	return referralID, true
+}
+
+func signature(referralID string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.ToLower(referralID)))
+	return strings.ToLower(signatureEncoding.EncodeToString(mac.Sum(nil))[:signatureLength])
+}
+
+var (
+	// "On Tue, Mar 2, 2021 at 9:14 AM Jane Doe <jane@example.com> wrote:", often wrapped over two lines
+	wrotePattern   = regexp.MustCompile(`(?i)^on\s.+\bwrote:\s*$`)
+	onPattern      = regexp.MustCompile(`(?i)^on\s`)
+	headerPattern  = regexp.MustCompile(`(?i)^(from|sent|date|to|subject):\s`)
+	outlookPattern = regexp.MustCompile(`^(_{10,}|-{2,}\s*original message\s*-{2,})`)
+	devicePattern  = regexp.MustCompile(`(?i)^sent from my \w+`)
+)
+
+// StripQuoted .... text the sender wrote, the quoted history below it and the signature are cut.
+// A body that is nothing but a quote is returned whole rather than emptied.
+func StripQuoted(body string) string {
+	lines := strings.Split(strings.Replace(body, "\r\n", "\n", -1), "\n")
+	end := len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		lower := strings.ToLower(trimmed)
+		switch {
+		case strings.HasPrefix(trimmed, ">"),
+			line == "-- ",
+			wrotePattern.MatchString(trimmed),
+			outlookPattern.MatchString(lower),
+			devicePattern.MatchString(trimmed):
+			end = i
+		case onPattern.MatchString(trimmed) && i+1 < len(lines) && strings.HasSuffix(strings.TrimSpace(lines[i+1]), "wrote:"):
+			end = i
+		case headerPattern.MatchString(trimmed) && i+1 < len(lines) && headerPattern.MatchString(strings.TrimSpace(lines[i+1])):
+			// a forwarded or Outlook style quote starts with a block of headers
+			end = i
+		default:
+			continue
+		}
+		break
+	}
+	text := strings.TrimSpace(strings.Join(lines[:end], "\n"))
+	if text == "" {
+		return strings.TrimSpace(body)
+	}
+	return text
+}
@@ -0,0 +1,94 @@
+package mailthread
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyAddress(t *testing.T) {
+	key := []byte("secret")
+	referralID := "6f1c2a9e-8b1d-11eb-8dcd-0242ac130003"
+	address := ReplyAddress("referrals@mail.superdentist.io", referralID, key)
+	assert.True(t, strings.HasPrefix(address, "referrals+ref."+referralID+"."))
+	assert.True(t, strings.HasSuffix(address, "@mail.superdentist.io"))
+	assert.True(t, len(address[:strings.Index(address, "@")]) <= 64, "local parts are limited to 64 characters")
+
+	found, ok := ReferralID(address, key)
+	assert.True(t, ok)
+	assert.Equal(t, referralID, found)
+	found, ok = ReferralID(strings.ToUpper(address), key)
+	assert.True(t, ok, "the case of the local part may change in transit")
+	assert.Equal(t, referralID, found)
+
+	_, ok = ReferralID(address, []byte("other"))
+	assert.False(t, ok)
+	_, ok = ReferralID(strings.Replace(address, referralID, "6f1c2a9e-8b1d-11eb-8dcd-0242ac130004", 1), key)
+	assert.False(t, ok, "a token cannot be moved to another referral")
+	_, ok = ReferralID("referrals@mail.superdentist.io", key)
+	assert.False(t, ok)
+	_, ok = ReferralID("referrals+ref."+referralID+"@mail.superdentist.io", key)
+	assert.False(t, ok)
+
+	assert.Equal(t, address, ReplyAddress("referrals+old@mail.superdentist.io", referralID, key), "an existing tag is replaced")
+	assert.Equal(t, "referrals@mail.superdentist.io", ReplyAddress("referrals@mail.superdentist.io", referralID, nil))
+	assert.Equal(t, "", ReplyAddress("", referralID, key))
+}
+
+func TestStripQuoted(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		text string
+	}{
+		{
+			name: "gmail",
+			body: "Thanks, see you Tuesday.\n\nOn Tue, Mar 2, 2021 at 9:14 AM SuperDentist <referrals@superdentist.io> wrote:\n> Your referral to Smile Endo\n",
+			text: "Thanks, see you Tuesday.",
+		},
+		{
+			name: "wrapped attribution",
+			body: "Sounds good\r\n\r\nOn Tue, Mar 2, 2021 at 9:14 AM SuperDentist <\r\nreferrals@superdentist.io> wrote:\r\n\r\n> hello",
+			text: "Sounds good",
+		},
+		{
+			name: "outlook",
+			body: "X-rays attached.\n\n________________________________\nFrom: SuperDentist Admin\nSent: Tuesday, March 2, 2021 9:14 AM\nSubject: Your referral",
+			text: "X-rays attached.",
+		},
+		{
+			name: "original message",
+			body: "Please call me back\n-----Original Message-----\nFrom: SuperDentist",
+			text: "Please call me back",
+		},
+		{
+			name: "header block",
+			body: "Forwarding the report\n\nFrom: Jane Doe <jane@example.com>\nDate: Mar 2, 2021\nlast visit",
+			text: "Forwarding the report",
+		},
+		{
+			name: "signature and device",
+			body: "Is parking available?\n\nSent from my iPhone",
+			text: "Is parking available?",
+		},
+		{
+			name: "signature delimiter",
+			body: "Running late\n-- \nJane Doe\n555 0100",
+			text: "Running late",
+		},
+		{
+			name: "only a quote",
+			body: "> Your referral to Smile Endo",
+			text: "> Your referral to Smile Endo",
+		},
+		{
+			name: "plain",
+			body: "On my way.\nFrom: the parking lot",
+			text: "On my way.\nFrom: the parking lot",
+		},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.text, StripQuoted(tc.body), tc.name)
+	}
+}
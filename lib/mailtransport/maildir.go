@@ -0,0 +1,67 @@
+package mailtransport
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+var deliveries uint64
+
+// Maildir .... writes each email as a file into a maildir, for environments that must not send any.
+// Any mail client reading maildirs shows them, a Delivered-To header keeps the Bcc recipients.
+type Maildir struct {
+	dir string
+}
+
+// NewMaildir .... a maildir transport into dir, its tmp, new and cur directories are created
+func NewMaildir(dir string) (*Maildir, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("maildir: no directory")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, fmt.Errorf("maildir: %v", err)
+		}
+	}
+	return &Maildir{dir: dir}, nil
+}
+
+// Send .... writes each email of the mail to tmp, then moves it to new so readers never see half of one
+func (m *Maildir) Send(message *mail.SGMailV3) error {
+	envelopes, err := Build(message)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	for _, envelope := range envelopes {
+		var data bytes.Buffer
+		for _, recipient := range envelope.Recipients {
+			writeHeader(&data, "Delivered-To", recipient)
+		}
+		data.Write(envelope.Data)
+		name := fmt.Sprintf("%d.P%dQ%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddUint64(&deliveries, 1), hostname)
+		tmp := filepath.Join(m.dir, "tmp", name)
+		if err := ioutil.WriteFile(tmp, data.Bytes(), 0600); err != nil {
+			return fmt.Errorf("maildir: %v", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(m.dir, "new", name)); err != nil {
+			return fmt.Errorf("maildir: %v", err)
+		}
+	}
+	return nil
+}
+
+// RendersTemplates .... a maildir keeps what it is given
+func (m *Maildir) RendersTemplates() bool {
+	return false
+}
@@ -0,0 +1,44 @@
+package mailtransport
+
+import (
+	"fmt"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/superdentist/superdentist-backend/options"
+)
+
+// Transports Options.MailTransport selects between
+const (
+	NameSendGrid = "sendgrid"
+	NameSMTP     = "smtp"
+	NameFile     = "file"
+)
+
+// Transport delivers emails. Emails are built as SendGrid v3 mails, each personalization is a
+// separate email to its own recipients.
+type Transport interface {
+	Send(message *mail.SGMailV3) error
+	// RendersTemplates is whether the transport renders SendGrid dynamic templates, emails sent
+	// through one that does not must carry their own content
+	RendersTemplates() bool
+}
+
+// New .... the transport the options select, SendGrid when they name none
+func New(opts *options.Options) (Transport, error) {
+	var transport Transport
+	var err error
+	switch opts.MailTransport {
+	case "", NameSendGrid:
+		transport, err = NewSendGrid()
+	case NameSMTP:
+		transport, err = NewSMTP(opts.SMTPAddr, opts.SMTPUser, opts.SMTPPassword, opts.SMTPStartTLS)
+	case NameFile:
+		transport, err = NewMaildir(opts.MailDir)
+	default:
+		err = fmt.Errorf("unknown mail transport %q, it is one of %s, %s or %s", opts.MailTransport, NameSendGrid, NameSMTP, NameFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
@@ -0,0 +1,185 @@
+package mailtransport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func sampleMail() *mail.SGMailV3 {
+	message := mail.NewV3Mail()
+	message.SetFrom(mail.NewEmail("SuperDentist Admin", "admin@superdentist.io"))
+	message.SetReplyTo(mail.NewEmail("Referral Manager", "referrals+a1b2@superdentist.io"))
+	message.Subject = "Votre rendez-vous à 10h"
+	p := mail.NewPersonalization()
+	p.AddTos(mail.NewEmail("Maria Garcia", "maria@example.com"))
+	p.AddBCCs(mail.NewEmail("", "audit@example.com"))
+	message.AddPersonalizations(p)
+	message.AddContent(mail.NewContent("text/plain", "See you Thursday.\nBright Smile"), mail.NewContent("text/html", "<p>See you Thursday.</p>"))
+	return message
+}
+
+func TestBuild(t *testing.T) {
+	message := sampleMail()
+	attachment := mail.NewAttachment()
+	attachment.SetContent(base64.StdEncoding.EncodeToString([]byte("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")))
+	attachment.SetType("text/calendar; charset=UTF-8; method=REQUEST")
+	attachment.SetFilename("invite.ics")
+	message.AddAttachment(attachment)
+
+	envelopes, err := Build(message)
+	assert.NoError(t, err)
+	assert.Len(t, envelopes, 1)
+	envelope := envelopes[0]
+	assert.Equal(t, "admin@superdentist.io", envelope.From)
+	assert.Equal(t, []string{"maria@example.com", "audit@example.com"}, envelope.Recipients)
+
+	parsed, err := netmail.ReadMessage(bytes.NewReader(envelope.Data))
+	assert.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Votre rendez-vous à 10h", subject)
+	assert.Equal(t, `"Maria Garcia" <maria@example.com>`, parsed.Header.Get("To"))
+	assert.Empty(t, parsed.Header.Get("Bcc"), "Bcc recipients are only on the envelope")
+	assert.Contains(t, parsed.Header.Get("Reply-To"), "referrals+a1b2@superdentist.io")
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+	mixed := multipart.NewReader(parsed.Body, params["boundary"])
+	body, err := mixed.NextPart()
+	assert.NoError(t, err)
+	mediaType, params, _ = mime.ParseMediaType(body.Header.Get("Content-Type"))
+	assert.Equal(t, "multipart/alternative", mediaType)
+	alternative := multipart.NewReader(body, params["boundary"])
+	plain, err := alternative.NextPart()
+	assert.NoError(t, err)
+	text, _ := ioutil.ReadAll(plain)
+	assert.Equal(t, "See you Thursday.\r\nBright Smile", string(text))
+	html, err := alternative.NextPart()
+	assert.NoError(t, err)
+	assert.Contains(t, html.Header.Get("Content-Type"), "text/html")
+
+	invite, err := mixed.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, "invite.ics", invite.FileName())
+	assert.Equal(t, "text/calendar; charset=UTF-8; method=REQUEST", invite.Header.Get("Content-Type"))
+	encoded, _ := ioutil.ReadAll(invite)
+	decoded, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+	assert.NoError(t, err)
+	assert.Equal(t, "BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n", string(decoded))
+}
+
+func TestBuildRejectsTemplates(t *testing.T) {
+	message := sampleMail()
+	message.Content = nil
+	message.SetTemplateID("d-123")
+	_, err := Build(message)
+	assert.Error(t, err, "a SendGrid template cannot be rendered elsewhere")
+
+	message = sampleMail()
+	message.Personalizations = nil
+	_, err = Build(message)
+	assert.Error(t, err)
+}
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	maildir, err := NewMaildir(dir)
+	assert.NoError(t, err)
+	assert.False(t, maildir.RendersTemplates())
+
+	assert.NoError(t, maildir.Send(sampleMail()))
+	delivered, _ := filepath.Glob(filepath.Join(dir, "new", "*"))
+	assert.Len(t, delivered, 1)
+	pending, _ := filepath.Glob(filepath.Join(dir, "tmp", "*"))
+	assert.Empty(t, pending)
+	data, err := ioutil.ReadFile(delivered[0])
+	assert.NoError(t, err)
+	parsed, err := netmail.ReadMessage(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"maria@example.com", "audit@example.com"}, parsed.Header["Delivered-To"])
+}
+
+// fakeSMTP .... a server taking one email without STARTTLS or auth, the session is sent on the channel
+func fakeSMTP(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	session := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var received strings.Builder
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte("220 fake ESMTP\r\n"))
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				session <- received.String()
+				return
+			}
+			received.WriteString(line)
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case inData:
+				if command == "." {
+					inData = false
+					conn.Write([]byte("250 queued\r\n"))
+				}
+			case strings.HasPrefix(command, "EHLO"):
+				conn.Write([]byte("250-fake\r\n250 8BITMIME\r\n"))
+			case command == "DATA":
+				inData = true
+				conn.Write([]byte("354 go ahead\r\n"))
+			case command == "QUIT":
+				conn.Write([]byte("221 bye\r\n"))
+				session <- received.String()
+				return
+			default:
+				conn.Write([]byte("250 ok\r\n"))
+			}
+		}
+	}()
+	return listener.Addr().String(), session
+}
+
+func TestSMTP(t *testing.T) {
+	addr, session := fakeSMTP(t)
+	smtp, err := NewSMTP(addr, "", "", StartTLSOff)
+	assert.NoError(t, err)
+	assert.NoError(t, smtp.Send(sampleMail()))
+	received := <-session
+	assert.Contains(t, received, "MAIL FROM:<admin@superdentist.io>")
+	assert.Contains(t, received, "RCPT TO:<maria@example.com>")
+	assert.Contains(t, received, "RCPT TO:<audit@example.com>")
+	assert.Contains(t, received, "See you Thursday.")
+
+	addr, _ = fakeSMTP(t)
+	smtp, err = NewSMTP(addr, "", "", StartTLSRequire)
+	assert.NoError(t, err)
+	assert.Error(t, smtp.Send(sampleMail()), "a server without STARTTLS is refused")
+
+	_, err = NewSMTP("smtp.example.com", "", "", "")
+	assert.Error(t, err, "the address has a port")
+	_, err = NewSMTP("smtp.example.com:587", "", "", "maybe")
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package mailtransport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// Envelope .... one email of a mail as an SMTP server takes it
+type Envelope struct {
+	From       string
+	Recipients []string
+	Data       []byte
+}
+
+// entity is a MIME part, or the body of the email with its content headers
+type entity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Build .... the emails of the mail, one per personalization, with their MIME message. A mail
+// that names a SendGrid template has no content of its own and cannot be built.
+func Build(message *mail.SGMailV3) ([]Envelope, error) {
+	if message.From == nil || message.From.Address == "" {
+		return nil, fmt.Errorf("mail has no sender")
+	}
+	if len(message.Content) == 0 {
+		if message.TemplateID != "" {
+			return nil, fmt.Errorf("mail uses SendGrid template %s, it has no content of its own", message.TemplateID)
+		}
+		return nil, fmt.Errorf("mail has no content")
+	}
+	body, err := mailBody(message)
+	if err != nil {
+		return nil, err
+	}
+	envelopes := make([]Envelope, 0, len(message.Personalizations))
+	for _, p := range message.Personalizations {
+		from := message.From
+		if p.From != nil {
+			from = p.From
+		}
+		subject := message.Subject
+		if p.Subject != "" {
+			subject = p.Subject
+		}
+		var recipients []string
+		for _, emails := range [][]*mail.Email{p.To, p.CC, p.BCC} {
+			for _, email := range emails {
+				recipients = append(recipients, email.Address)
+			}
+		}
+		if len(recipients) == 0 {
+			return nil, fmt.Errorf("mail %q has no recipients", subject)
+		}
+		var data bytes.Buffer
+		writeHeader(&data, "From", address(from))
+		if len(p.To) > 0 {
+			writeHeader(&data, "To", addressList(p.To))
+		}
+		if len(p.CC) > 0 {
+			writeHeader(&data, "Cc", addressList(p.CC))
+		}
+		if message.ReplyTo != nil && message.ReplyTo.Address != "" {
+			writeHeader(&data, "Reply-To", address(message.ReplyTo))
+		}
+		writeHeader(&data, "Subject", mime.QEncoding.Encode("utf-8", subject))
+		writeHeader(&data, "Date", time.Now().Format(time.RFC1123Z))
+		writeHeader(&data, "Message-ID", messageID(from.Address))
+		writeHeader(&data, "MIME-Version", "1.0")
+		writeCustomHeaders(&data, message.Headers)
+		writeCustomHeaders(&data, p.Headers)
+		writeEntity(&data, body)
+		envelopes = append(envelopes, Envelope{From: from.Address, Recipients: recipients, Data: data.Bytes()})
+	}
+	if len(envelopes) == 0 {
+		return nil, fmt.Errorf("mail has no recipients")
+	}
+	return envelopes, nil
+}
+
+// mailBody .... the contents as alternatives of each other, in the order the mail has them (plain text
+// before HTML, the last is the preferred one), with the attachments after them
+func mailBody(message *mail.SGMailV3) (entity, error) {
+	alternatives := make([]entity, 0, len(message.Content))
+	for _, content := range message.Content {
+		alternatives = append(alternatives, textEntity(content))
+	}
+	body := alternatives[0]
+	if len(alternatives) > 1 {
+		body = multipartEntity("alternative", alternatives)
+	}
+	if len(message.Attachments) == 0 {
+		return body, nil
+	}
+	parts := []entity{body}
+	for _, attachment := range message.Attachments {
+		part, err := attachmentEntity(attachment)
+		if err != nil {
+			return entity{}, err
+		}
+		parts = append(parts, part)
+	}
+	return multipartEntity("mixed", parts), nil
+}
+
+func textEntity(content *mail.Content) entity {
+	contentType := content.Type
+	if !strings.Contains(strings.ToLower(contentType), "charset=") {
+		contentType += "; charset=UTF-8"
+	}
+	var body bytes.Buffer
+	writer := quotedprintable.NewWriter(&body)
+	writer.Write([]byte(content.Value))
+	writer.Close()
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		},
+		body: body.Bytes(),
+	}
+}
+
+// attachmentEntity .... the attachment, its content is already base64 as SendGrid takes it
+func attachmentEntity(attachment *mail.Attachment) (entity, error) {
+	content := strings.Join(strings.Fields(attachment.Content), "")
+	if _, err := base64.StdEncoding.DecodeString(content); err != nil {
+		return entity{}, fmt.Errorf("attachment %s: %v", attachment.Filename, err)
+	}
+	contentType := attachment.Type
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := attachment.Disposition
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename})},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if attachment.ContentID != "" {
+		header.Set("Content-ID", "<"+attachment.ContentID+">")
+	}
+	var body bytes.Buffer
+	for len(content) > 76 {
+		body.WriteString(content[:76] + "\r\n")
+		content = content[76:]
+	}
+	body.WriteString(content + "\r\n")
+	return entity{header: header, body: body.Bytes()}, nil
+}
+
+func multipartEntity(subtype string, parts []entity) entity {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		partWriter, _ := writer.CreatePart(part.header)
+		partWriter.Write(part.body)
+	}
+	writer.Close()
+	return entity{
+		header: textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": writer.Boundary()})},
+		},
+		body: body.Bytes(),
+	}
+}
+
+// writeEntity .... the content headers, sorted, then the body
+func writeEntity(data *bytes.Buffer, e entity) {
+	keys := make([]string, 0, len(e.header))
+	for key := range e.header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeHeader(data, key, e.header.Get(key))
+	}
+	data.WriteString("\r\n")
+	data.Write(e.body)
+}
+
+func writeCustomHeaders(data *bytes.Buffer, headers map[string]string) {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeHeader(data, textproto.CanonicalMIMEHeaderKey(key), mime.QEncoding.Encode("utf-8", headers[key]))
+	}
+}
+
+// writeHeader .... a header field, line breaks in the value would start headers of their own
+func writeHeader(data *bytes.Buffer, key string, value string) {
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	data.WriteString(key + ": " + value + "\r\n")
+}
+
+func address(email *mail.Email) string {
+	return (&netmail.Address{Name: email.Name, Address: email.Address}).String()
+}
+
+func addressList(emails []*mail.Email) string {
+	addresses := make([]string, 0, len(emails))
+	for _, email := range emails {
+		addresses = append(addresses, address(email))
+	}
+	return strings.Join(addresses, ", ")
+}
+
+// messageID .... a unique Message-ID in the domain of the sender
+func messageID(from string) string {
+	domain := "superdentist.io"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+	}
+	random := make([]byte, 16)
+	rand.Read(random)
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">"
+}
@@ -0,0 +1,43 @@
+package mailtransport
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// SendGrid .... sends through the SendGrid v3 API
+type SendGrid struct {
+	apiKey string
+}
+
+// NewSendGrid .... a SendGrid transport with the key of SENDGRID_API_KEY
+func NewSendGrid() (*SendGrid, error) {
+	apiKey := os.Getenv("SENDGRID_API_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("Sendgrid api key not found")
+	}
+	return &SendGrid{apiKey: apiKey}, nil
+}
+
+// Send .... posts the mail to SendGrid, a response other than 2xx is an error
+func (s *SendGrid) Send(message *mail.SGMailV3) error {
+	request := sendgrid.GetRequest(s.apiKey, "/v3/mail/send", "https://api.sendgrid.com")
+	request.Method = "POST"
+	request.Body = mail.GetRequestBody(message)
+	response, err := sendgrid.API(request)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("sendgrid: %d %s", response.StatusCode, response.Body)
+	}
+	return nil
+}
+
+// RendersTemplates .... SendGrid renders the dynamic templates mails name
+func (s *SendGrid) RendersTemplates() bool {
+	return true
+}
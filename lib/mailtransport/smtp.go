@@ -0,0 +1,109 @@
+package mailtransport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// Values of Options.SMTPStartTLS
+const (
+	StartTLSRequire = "require"
+	StartTLSOff     = "off"
+)
+
+// SMTP .... sends through an SMTP server. The connection is upgraded with STARTTLS unless it is off,
+// and a server that does not offer it is refused. With a user the transport authenticates with
+// PLAIN, which net/smtp only does over TLS or to localhost.
+type SMTP struct {
+	addr      string
+	host      string
+	auth      smtp.Auth
+	startTLS  bool
+	tlsConfig *tls.Config
+}
+
+// NewSMTP .... an SMTP transport to addr, host:port
+func NewSMTP(addr string, user string, password string, startTLS string) (*SMTP, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("smtp: no server address")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: %v", err)
+	}
+	transport := &SMTP{addr: addr, host: host, tlsConfig: &tls.Config{ServerName: host}}
+	switch startTLS {
+	case "", StartTLSRequire:
+		transport.startTLS = true
+	case StartTLSOff:
+	default:
+		return nil, fmt.Errorf("smtp: starttls is %s or %s, not %q", StartTLSRequire, StartTLSOff, startTLS)
+	}
+	if user != "" {
+		transport.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return transport, nil
+}
+
+// Send .... delivers each email of the mail in a session of its own
+func (s *SMTP) Send(message *mail.SGMailV3) error {
+	envelopes, err := Build(message)
+	if err != nil {
+		return err
+	}
+	for _, envelope := range envelopes {
+		if err := s.deliver(envelope); err != nil {
+			return fmt.Errorf("smtp: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *SMTP) deliver(envelope Envelope) error {
+	client, err := smtp.Dial(s.addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if s.startTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", s.addr)
+		}
+		if err := client.StartTLS(s.tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if err := client.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(envelope.From); err != nil {
+		return err
+	}
+	for _, recipient := range envelope.Recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(envelope.Data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// RendersTemplates .... an SMTP server only sends what it is given
+func (s *SMTP) RendersTemplates() bool {
+	return false
+}
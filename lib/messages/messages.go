@@ -0,0 +1,292 @@
+package messages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultLocale every key has a text in, the text of any locale missing a key
+const DefaultLocale = "en"
+
+// Keys of the patient text in the catalog
+const (
+	KeyReferralCreated          = "referral_created"
+	KeyInsuranceLink            = "insurance_link"
+	KeyMessageNotice            = "message_notice"
+	KeyMessageCorrection        = "message_correction"
+	KeyMessageRetracted         = "message_retracted"
+	KeyAppointmentReminder      = "appointment_reminder"
+	KeyReminderEmailSubject     = "appointment_reminder_email_subject"
+	KeyReminderEmail            = "appointment_reminder_email"
+	KeyAppointmentInviteSubject = "appointment_invite_subject"
+	KeyAppointmentInvite        = "appointment_invite"
+	KeyAppointmentConfirmed     = "appointment_confirmed"
+	KeyAppointmentReschedule    = "appointment_reschedule"
+	KeyReferralMenu             = "referral_menu"
+	KeyReferralMenuItem         = "referral_menu_item"
+	KeyReferralMenuChosen       = "referral_menu_chosen"
+	KeySMSStop                  = "sms_stop"
+	KeySMSStart                 = "sms_start"
+	KeySMSHelp                  = "sms_help"
+)
+
+// Variables .... the variables each key may use, a template using any other does not load
+var Variables = map[string][]string{
+	KeyReferralCreated:          {"PatientName", "ClinicName", "ClinicAddress", "ClinicPhone", "Comments", "ClinicText"},
+	KeyInsuranceLink:            {"PatientName", "ClinicName", "InsuranceURL"},
+	KeyMessageNotice:            {"PatientName", "ClinicName", "Message"},
+	KeyMessageCorrection:        {"PatientName", "ClinicName", "Message"},
+	KeyMessageRetracted:         {"PatientName", "ClinicName"},
+	KeyAppointmentReminder:      {"PatientName", "ClinicName", "ClinicAddress", "ClinicPhone", "When", "ClinicText"},
+	KeyReminderEmailSubject:     {"PatientName", "ClinicName", "When"},
+	KeyReminderEmail:            {"PatientName", "ClinicName", "ClinicAddress", "ClinicPhone", "When", "ClinicText"},
+	KeyAppointmentInviteSubject: {"PatientName", "ClinicName", "ReferralID", "Cancelled"},
+	KeyAppointmentInvite:        {"PatientName", "ClinicName", "ClinicAddress", "ClinicPhone", "When", "Cancelled", "Notes"},
+	KeyAppointmentConfirmed:     {"PatientName", "ClinicName", "When"},
+	KeyAppointmentReschedule:    {"PatientName", "ClinicName"},
+	KeyReferralMenu:             {"PatientName", "Items"},
+	KeyReferralMenuItem:         {"Number", "ClinicName", "ReferredOn", "ReferredBy"},
+	KeyReferralMenuChosen:       {"PatientName", "ClinicName"},
+	KeySMSStop:                  {"ClinicName"},
+	KeySMSStart:                 {"ClinicName"},
+	KeySMSHelp:                  {"ClinicName", "HelpEmail"},
+}
+
+// values templates are checked and previewed with
+var sampleValues = map[string]string{
+	"PatientName":   "Maria Garcia",
+	"ClinicName":    "Bright Smile Endodontics",
+	"ClinicAddress": "100 Main St, Springfield, IL 62701",
+	"ClinicPhone":   "+12175550100",
+	"ClinicText":    "Please bring your insurance card and a photo ID.",
+	"Comments":      "Evaluate #30 for root canal.",
+	"InsuranceURL":  "https://superdentist.io/secure/insurance?referral=sample",
+	"Message":       "We have an opening on Thursday at 10 AM, does that work for you?",
+	"When":          "Thu Mar 4 at 10:00 AM CST",
+	"ReferralID":    "sample",
+	"Cancelled":     "",
+	"Notes":         "",
+	"Items":         "\n1 for Bright Smile Endodontics\n2 for Lakeside Oral Surgery",
+	"Number":        "1",
+	"ReferredOn":    "Mar 1",
+	"ReferredBy":    "Downtown Family Dental",
+	"HelpEmail":     "referrals@superdentist.io",
+}
+
+// Sample .... values of the variables of the key as previews fill them in
+func Sample(key string) map[string]string {
+	vars := make(map[string]string)
+	for _, name := range Variables[key] {
+		vars[name] = sampleValues[name]
+	}
+	return vars
+}
+
+// Locale .... the catalog locale of a preferred language, "es-MX" and "ES" are "es". An empty
+// language is the default locale.
+func Locale(language string) string {
+	locale := strings.ToLower(strings.TrimSpace(language))
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	if locale == "" {
+		return DefaultLocale
+	}
+	return locale
+}
+
+// Parse .... compiles the text of a key. Variables other than the key's, or a text that does not
+// render with them, are errors, so a clinic cannot save a template that fails when it is sent.
+func Parse(key string, text string) (*template.Template, error) {
+	names, ok := Variables[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %s", key)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, fmt.Errorf("message %s: text is empty", key)
+	}
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("message %s: %v", key, err)
+	}
+	if _, err := execute(tmpl, Sample(key)); err != nil {
+		return nil, fmt.Errorf("message %s: %v, it may use %s", key, err, strings.Join(names, ", "))
+	}
+	return tmpl, nil
+}
+
+// Preview .... the text of the key rendered with the sample values, vars replace the samples they
+// have a value for
+func Preview(key string, text string, vars map[string]string) (string, error) {
+	tmpl, err := Parse(key, text)
+	if err != nil {
+		return "", err
+	}
+	values := Sample(key)
+	for name, value := range vars {
+		if _, ok := values[name]; ok && value != "" {
+			values[name] = value
+		}
+	}
+	return execute(tmpl, values)
+}
+
+func execute(tmpl *template.Template, vars map[string]string) (string, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Catalog .... the texts of every key, per locale
+type Catalog struct {
+	texts     map[string]map[string]string
+	templates map[string]map[string]*template.Template
+}
+
+// LoadCatalog .... reads <locale>.json files of key to text from dir. The default locale must have
+// every key, other locales fall back to it for the keys they leave out.
+func LoadCatalog(dir string) (*Catalog, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	locales := make(map[string]map[string]string)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		texts := make(map[string]string)
+		if err := json.Unmarshal(data, &texts); err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+		}
+		locales[strings.TrimSuffix(filepath.Base(path), ".json")] = texts
+	}
+	return NewCatalog(locales)
+}
+
+// NewCatalog .... compiles the texts, of locale to key to text
+func NewCatalog(locales map[string]map[string]string) (*Catalog, error) {
+	catalog := &Catalog{
+		texts:     make(map[string]map[string]string),
+		templates: make(map[string]map[string]*template.Template),
+	}
+	for locale, texts := range locales {
+		locale = Locale(locale)
+		catalog.texts[locale] = texts
+		catalog.templates[locale] = make(map[string]*template.Template)
+		for key, text := range texts {
+			tmpl, err := Parse(key, text)
+			if err != nil {
+				return nil, fmt.Errorf("locale %s: %v", locale, err)
+			}
+			catalog.templates[locale][key] = tmpl
+		}
+	}
+	for key := range Variables {
+		if _, ok := catalog.templates[DefaultLocale][key]; !ok {
+			return nil, fmt.Errorf("locale %s: message %s is missing", DefaultLocale, key)
+		}
+	}
+	return catalog, nil
+}
+
+// Locales .... locales of the catalog, sorted
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.texts))
+	for locale := range c.texts {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// HasLocale .... whether the catalog has texts of the locale
+func (c *Catalog) HasLocale(locale string) bool {
+	_, ok := c.texts[Locale(locale)]
+	return ok
+}
+
+// Text .... the text of the key in the locale, the default locale's when the locale has none
+func (c *Catalog) Text(locale string, key string) string {
+	if text, ok := c.texts[Locale(locale)][key]; ok {
+		return text
+	}
+	return c.texts[DefaultLocale][key]
+}
+
+// Render .... the key in the locale filled in with vars, in the default locale when the locale has none
+func (c *Catalog) Render(locale string, key string, vars map[string]string) (string, error) {
+	tmpl, ok := c.templates[Locale(locale)][key]
+	if !ok {
+		tmpl, ok = c.templates[DefaultLocale][key]
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown message %s", key)
+	}
+	return execute(tmpl, withDefaults(key, vars))
+}
+
+// withDefaults .... variables the caller leaves out are empty rather than errors, a clinic without
+// custom text still gets its reminders
+func withDefaults(key string, vars map[string]string) map[string]string {
+	filled := make(map[string]string)
+	for _, name := range Variables[key] {
+		filled[name] = vars[name]
+	}
+	return filled
+}
+
+// OverrideStore has the texts clinics wrote over the catalog
+type OverrideStore interface {
+	MessageOverride(ctx context.Context, addressID string, locale string, key string) (string, error)
+}
+
+var (
+	catalog   *Catalog
+	overrides OverrideStore
+)
+
+// SetCatalog .... the catalog Render uses
+func SetCatalog(c *Catalog) {
+	catalog = c
+}
+
+// CurrentCatalog .... the catalog Render uses, nil before one is set
+func CurrentCatalog() *Catalog {
+	return catalog
+}
+
+// SetOverrideStore .... Render looks for a clinic's own text in the store first
+func SetOverrideStore(store OverrideStore) {
+	overrides = store
+}
+
+// Render .... the key for a patient of the clinic with addressID: the clinic's text in the locale
+// when it wrote one, otherwise the catalog's
+func Render(ctx context.Context, addressID string, locale string, key string, vars map[string]string) (string, error) {
+	locale = Locale(locale)
+	if overrides != nil && addressID != "" {
+		text, err := overrides.MessageOverride(ctx, addressID, locale, key)
+		if err == nil && text != "" {
+			if tmpl, err := Parse(key, text); err == nil {
+				if out, err := execute(tmpl, withDefaults(key, vars)); err == nil {
+					return out, nil
+				}
+			}
+		}
+	}
+	if catalog == nil {
+		return "", fmt.Errorf("message catalog is not loaded")
+	}
+	return catalog.Render(locale, key, vars)
+}
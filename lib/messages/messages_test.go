@@ -0,0 +1,81 @@
+package messages
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeOverrides map[string]string
+
+func (f fakeOverrides) MessageOverride(ctx context.Context, addressID string, locale string, key string) (string, error) {
+	return f[addressID+"/"+locale+"/"+key], nil
+}
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := LoadCatalog("../../templates/messages")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"en", "es"}, catalog.Locales())
+	for key := range Variables {
+		_, err := catalog.Render("es", key, Sample(key))
+		assert.NoError(t, err, key)
+	}
+	text, err := catalog.Render("fr", KeyMessageRetracted, map[string]string{"PatientName": "Ana", "ClinicName": "Endo"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi Ana, Endo retracted an earlier message, please disregard it.", text, "locales without a catalog are sent in English")
+}
+
+func TestParse(t *testing.T) {
+	_, err := Parse(KeyMessageRetracted, "Hi {{.PatientName}}, {{.Message}}")
+	assert.Error(t, err, "a variable the key does not have")
+	_, err = Parse(KeyMessageRetracted, "Hi {{.PatientName}")
+	assert.Error(t, err)
+	_, err = Parse("unknown", "Hi")
+	assert.Error(t, err)
+	_, err = Parse(KeyMessageRetracted, "Hola {{.PatientName}}")
+	assert.NoError(t, err)
+
+	_, err = NewCatalog(map[string]map[string]string{"en": {KeyMessageRetracted: "Hi"}})
+	assert.Error(t, err, "the default locale needs every key")
+}
+
+func TestRender(t *testing.T) {
+	catalog, err := LoadCatalog("../../templates/messages")
+	assert.NoError(t, err)
+	defer SetCatalog(nil)
+	defer SetOverrideStore(nil)
+	SetCatalog(catalog)
+	SetOverrideStore(fakeOverrides{
+		"clinic1/es/" + KeyMessageRetracted: "{{.ClinicName}}: ignore el mensaje anterior, {{.PatientName}}.",
+		"clinic1/en/" + KeyMessageRetracted: "{{.Unknown}}",
+	})
+	vars := map[string]string{"PatientName": "Ana", "ClinicName": "Endo"}
+
+	text, err := Render(context.Background(), "clinic1", "es-MX", KeyMessageRetracted, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "Endo: ignore el mensaje anterior, Ana.", text)
+
+	text, err = Render(context.Background(), "clinic1", "", KeyMessageRetracted, vars)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi Ana, Endo retracted an earlier message, please disregard it.", text, "a broken override falls back to the catalog")
+
+	text, err = Render(context.Background(), "clinic2", "ES", KeyAppointmentReminder, map[string]string{"PatientName": "Ana"})
+	assert.NoError(t, err)
+	assert.NotContains(t, text, "\n\n\n", "variables left out are empty")
+}
+
+func TestLocale(t *testing.T) {
+	assert.Equal(t, "es", Locale("es-MX"))
+	assert.Equal(t, "es", Locale(" ES "))
+	assert.Equal(t, "pt", Locale("pt_BR"))
+	assert.Equal(t, DefaultLocale, Locale(""))
+}
+
+func TestFormatTime(t *testing.T) {
+	when := time.Date(2021, time.March, 4, 15, 30, 0, 0, time.UTC)
+	assert.Equal(t, "Thu Mar 4 at 3:30 PM UTC", FormatTime(when, "en"))
+	assert.Equal(t, "jue 4 de mar a las 15:30 UTC", FormatTime(when, "es"))
+	assert.Equal(t, "4 mar", FormatDate(when, "es"))
+}
@@ -0,0 +1,30 @@
+package messages
+
+import (
+	"time"
+)
+
+var (
+	spanishDays   = []string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"}
+	spanishMonths = []string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sep", "oct", "nov", "dic"}
+)
+
+// FormatTime .... an appointment time the way patients of the locale read it, already in the zone it
+// is shown in
+func FormatTime(t time.Time, locale string) string {
+	switch Locale(locale) {
+	case "es":
+		return spanishDays[t.Weekday()] + " " + t.Format("2") + " de " + spanishMonths[t.Month()-1] +
+			" a las " + t.Format("15:04 MST")
+	}
+	return t.Format("Mon Jan 2 at 3:04 PM MST")
+}
+
+// FormatDate .... a day without its time, as FormatTime writes it
+func FormatDate(t time.Time, locale string) string {
+	switch Locale(locale) {
+	case "es":
+		return t.Format("2") + " " + spanishMonths[t.Month()-1]
+	}
+	return t.Format("Jan 2")
+}
@@ -0,0 +1,320 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/fcm"
+)
+
+// Store has the preferences of clinics and their staff, and the notifications held for later
+type Store interface {
+	// GetNotificationPreferences is nil when the clinic, or the user of it, has none
+	GetNotificationPreferences(ctx context.Context, addressID string, userID string) (*contracts.NotificationPreferences, error)
+	// GetStaffNotificationPreferences are the preferences of the clinic's staff that have their own
+	GetStaffNotificationPreferences(ctx context.Context, addressID string) ([]contracts.NotificationPreferences, error)
+	AddPendingNotification(ctx context.Context, pending contracts.PendingNotification) error
+	GetDuePendingNotifications(ctx context.Context, now time.Time) ([]contracts.PendingNotification, error)
+	// ClaimPendingNotifications marks the notifications as being sent by claimedBy and returns those it got,
+	// the ones another instance claimed less than timeout ago are left out
+	ClaimPendingNotifications(ctx context.Context, ids []string, claimedBy string, now time.Time, timeout time.Duration) ([]contracts.PendingNotification, error)
+	DeletePendingNotifications(ctx context.Context, ids []string) error
+}
+
+// TextSender sends texts, sms.ClientSMS is one
+type TextSender interface {
+	SendSMS(fromPhone string, toPhone string, messageBody string) error
+}
+
+// EmailSender sends digests by email, sendgrid.ClientSendGrid is one
+type EmailSender interface {
+	SendNotificationDigest(email string, name string, subject string, body string) error
+}
+
+// claimTimeout .... a claim of an instance that stopped before sending is taken over after this long
+const claimTimeout = 15 * time.Minute
+
+// claimant .... this instance, in the claims of the notifications it sends
+var claimant = uuid.New().String()
+
+var (
+	store      Store
+	pushSender fcm.Sender
+	textSender TextSender
+)
+
+// SetStore .... without one every clinic has the default preferences and nothing is held
+func SetStore(s Store) {
+	store = s
+}
+
+// SetPushSender .... without one nothing is pushed
+func SetPushSender(sender fcm.Sender) {
+	pushSender = sender
+}
+
+// PushSender .... the sender pushes go through, nil when pushes are off
+func PushSender() fcm.Sender {
+	return pushSender
+}
+
+// SetTextSender .... without one staff are not texted
+func SetTextSender(sender TextSender) {
+	textSender = sender
+}
+
+// Notice .... a referral event to tell a clinic about, on the channels it carries
+type Notice struct {
+	Event      string
+	AddressID  string
+	ReferralID string
+	// Text is one line for texts and digests, it never names the patient
+	Text string
+	Link string
+	// Email is the address SendEmail sends the email to, the preferences of the staff with that address
+	// apply to it, the clinic's otherwise
+	Email     string
+	Name      string
+	SendEmail func() error
+	// Push goes to the devices of the clinic's staff when it is set
+	Push *fcm.Notification
+	// SMS texts the clinic and staff that take texts
+	SMS bool
+}
+
+// Preferences .... the preferences of the clinic, its defaults when it has none, and of the staff with their own
+func Preferences(ctx context.Context, addressID string) (contracts.NotificationPreferences, []contracts.NotificationPreferences) {
+	if store == nil || addressID == "" {
+		return Defaults(addressID), nil
+	}
+	clinic := Defaults(addressID)
+	prefs, err := store.GetNotificationPreferences(ctx, addressID, "")
+	if err != nil {
+		log.Errorf("Failed to get notification preferences of %s: %v", addressID, err.Error())
+	} else if prefs != nil {
+		clinic = *prefs
+	}
+	staff, err := store.GetStaffNotificationPreferences(ctx, addressID)
+	if err != nil {
+		log.Errorf("Failed to get staff notification preferences of %s: %v", addressID, err.Error())
+	}
+	return clinic, staff
+}
+
+// Dispatch .... sends the notice on each of its channels as the preferences of the clinic and its staff say:
+// now, held for a digest or the end of quiet hours, or not at all. Every channel is tried, the first
+// failure is returned.
+func Dispatch(ctx context.Context, notice Notice) error {
+	clinic, staff := Preferences(ctx, notice.AddressID)
+	now := time.Now()
+	var firstErr error
+	deliver := func(prefs contracts.NotificationPreferences, channel string, recipient string, name string, send func() error) {
+		decision, due := Decide(prefs, channel, notice.Event, now)
+		var err error
+		switch decision {
+		case Send:
+			err = send()
+		case Hold:
+			err = hold(ctx, notice, prefs, channel, recipient, name, now, due)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s of %s by %s: %v", notice.Event, notice.ReferralID, channel, err)
+		}
+	}
+	if notice.SendEmail != nil {
+		prefs := clinic
+		for _, member := range staff {
+			if member.Email != "" && strings.EqualFold(member.Email, notice.Email) {
+				prefs = member
+				break
+			}
+		}
+		deliver(prefs, ChannelEmail, notice.Email, notice.Name, notice.SendEmail)
+	}
+	if notice.Push != nil && pushSender != nil {
+		push := *notice.Push
+		deliver(clinic, ChannelPush, fcm.ClinicTopic(notice.AddressID), notice.Name, func() error {
+			return pushSender.SendToTopic(ctx, fcm.ClinicTopic(notice.AddressID), push)
+		})
+		for _, member := range staff {
+			topic := fcm.StaffTopic(notice.AddressID, member.UserID)
+			deliver(member, ChannelPush, topic, member.Email, func() error {
+				return pushSender.SendToTopic(ctx, topic, push)
+			})
+		}
+	}
+	if notice.SMS && textSender != nil {
+		for _, prefs := range append([]contracts.NotificationPreferences{clinic}, staff...) {
+			if prefs.SMSPhone == "" {
+				continue
+			}
+			phone := prefs.SMSPhone
+			deliver(prefs, ChannelSMS, phone, prefs.Email, func() error {
+				return textSender.SendSMS(global.Options.ReferralPhone, phone, notice.Text)
+			})
+		}
+	}
+	return firstErr
+}
+
+func hold(ctx context.Context, notice Notice, prefs contracts.NotificationPreferences, channel string, recipient string, name string, now time.Time, due time.Time) error {
+	if store == nil {
+		return nil
+	}
+	id, _ := uuid.NewUUID()
+	return store.AddPendingNotification(ctx, contracts.PendingNotification{
+		ID:         id.String(),
+		AddressID:  notice.AddressID,
+		UserID:     prefs.UserID,
+		Channel:    channel,
+		Recipient:  recipient,
+		Name:       name,
+		Event:      notice.Event,
+		ReferralID: notice.ReferralID,
+		Text:       notice.Text,
+		Link:       notice.Link,
+		CreatedOn:  now,
+		DueOn:      due,
+	})
+}
+
+// Digest .... the held notifications of one recipient on one channel, sent together
+type Digest struct {
+	Channel   string
+	Recipient string
+	Name      string
+	AddressID string
+	Items     []contracts.PendingNotification
+}
+
+// Digests .... the notifications grouped by channel and recipient, each in the order they were held
+func Digests(pending []contracts.PendingNotification) []Digest {
+	sorted := make([]contracts.PendingNotification, len(pending))
+	copy(sorted, pending)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].CreatedOn.Before(sorted[j].CreatedOn) })
+	digests := make([]Digest, 0)
+	index := make(map[string]int)
+	for _, item := range sorted {
+		key := item.Channel + "\x00" + item.Recipient
+		i, ok := index[key]
+		if !ok {
+			i = len(digests)
+			index[key] = i
+			digests = append(digests, Digest{Channel: item.Channel, Recipient: item.Recipient, Name: item.Name, AddressID: item.AddressID})
+		}
+		digests[i].Items = append(digests[i].Items, item)
+	}
+	return digests
+}
+
+// Subject .... "3 notifications on SuperDentist"
+func (d Digest) Subject() string {
+	if len(d.Items) == 1 {
+		return "1 notification on SuperDentist"
+	}
+	return fmt.Sprintf("%d notifications on SuperDentist", len(d.Items))
+}
+
+// Body .... every notification with its referral and link, one per paragraph
+func (d Digest) Body() string {
+	var body strings.Builder
+	for _, item := range d.Items {
+		body.WriteString("- " + item.Text)
+		if item.ReferralID != "" {
+			body.WriteString(" (Referral ID: " + item.ReferralID + ")")
+		}
+		body.WriteString("\n")
+		if item.Link != "" {
+			body.WriteString("  " + item.Link + "\n")
+		}
+	}
+	return body.String()
+}
+
+// Push .... the digest as one push, opening the notification when there is only one
+func (d Digest) Push() fcm.Notification {
+	notification := fcm.Notification{Title: d.Subject(), Body: d.Items[0].Text}
+	if len(d.Items) == 1 {
+		notification.Link = d.Items[0].Link
+	} else {
+		notification.Body = fmt.Sprintf("%s and %d more", d.Items[0].Text, len(d.Items)-1)
+	}
+	return notification
+}
+
+// Text .... the digest as one text, the texts of the first notifications that fit
+func (d Digest) Text() string {
+	text := d.Subject() + ":"
+	for i, item := range d.Items {
+		line := " " + item.Text + "."
+		if len(text)+len(line) > 300 {
+			return text + fmt.Sprintf(" and %d more.", len(d.Items)-i)
+		}
+		text += line
+	}
+	return text
+}
+
+// Flush .... sends the digests of the notifications due by now. The notifications of each digest are claimed
+// first so that no other instance sends them too, and deleted once the digest went out, or had no sender to go
+// out with. Those of a digest that failed stay held and go out with the next flush.
+func Flush(ctx context.Context, emails EmailSender, now time.Time) error {
+	if store == nil {
+		return nil
+	}
+	pending, err := store.GetDuePendingNotifications(ctx, now)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(pending))
+	for _, due := range Digests(pending) {
+		dueIDs := make([]string, 0, len(due.Items))
+		for _, item := range due.Items {
+			dueIDs = append(dueIDs, item.ID)
+		}
+		claimed, err := store.ClaimPendingNotifications(ctx, dueIDs, claimant, now, claimTimeout)
+		if err != nil {
+			log.Errorf("Failed to claim %s digest of %s: %v", due.Channel, due.AddressID, err.Error())
+			continue
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+		digest := Digests(claimed)[0]
+		switch digest.Channel {
+		case ChannelEmail:
+			if emails != nil {
+				err = emails.SendNotificationDigest(digest.Recipient, digest.Name, digest.Subject(), digest.Body())
+			}
+		case ChannelPush:
+			if pushSender != nil {
+				err = pushSender.SendToTopic(ctx, digest.Recipient, digest.Push())
+			}
+		case ChannelSMS:
+			if textSender != nil {
+				err = textSender.SendSMS(global.Options.ReferralPhone, digest.Recipient, digest.Text())
+			}
+		}
+		if err != nil {
+			log.Errorf("Failed to send %s digest of %s: %v", digest.Channel, digest.AddressID, err.Error())
+			continue
+		}
+		for _, item := range digest.Items {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return store.DeletePendingNotifications(ctx, ids)
+}
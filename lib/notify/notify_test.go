@@ -0,0 +1,283 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/fcm"
+)
+
+type fakeStore struct {
+	prefs   map[string]contracts.NotificationPreferences
+	pending []contracts.PendingNotification
+}
+
+func newFakeStore(prefs ...contracts.NotificationPreferences) *fakeStore {
+	store := &fakeStore{prefs: make(map[string]contracts.NotificationPreferences)}
+	for _, p := range prefs {
+		store.prefs[p.AddressID+"/"+p.UserID] = p
+	}
+	return store
+}
+
+func (f *fakeStore) GetNotificationPreferences(ctx context.Context, addressID string, userID string) (*contracts.NotificationPreferences, error) {
+	prefs, ok := f.prefs[addressID+"/"+userID]
+	if !ok {
+		return nil, nil
+	}
+	return &prefs, nil
+}
+
+func (f *fakeStore) GetStaffNotificationPreferences(ctx context.Context, addressID string) ([]contracts.NotificationPreferences, error) {
+	staff := make([]contracts.NotificationPreferences, 0)
+	for _, prefs := range f.prefs {
+		if prefs.AddressID == addressID && prefs.UserID != "" {
+			staff = append(staff, prefs)
+		}
+	}
+	sort.Slice(staff, func(i, j int) bool { return staff[i].UserID < staff[j].UserID })
+	return staff, nil
+}
+
+func (f *fakeStore) AddPendingNotification(ctx context.Context, pending contracts.PendingNotification) error {
+	f.pending = append(f.pending, pending)
+	return nil
+}
+
+func (f *fakeStore) GetDuePendingNotifications(ctx context.Context, now time.Time) ([]contracts.PendingNotification, error) {
+	due := make([]contracts.PendingNotification, 0)
+	for _, pending := range f.pending {
+		if !pending.DueOn.After(now) {
+			due = append(due, pending)
+		}
+	}
+	return due, nil
+}
+
+func (f *fakeStore) ClaimPendingNotifications(ctx context.Context, ids []string, claimedBy string, now time.Time, timeout time.Duration) ([]contracts.PendingNotification, error) {
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	claimed := make([]contracts.PendingNotification, 0)
+	for i, pending := range f.pending {
+		if !wanted[pending.ID] || (pending.ClaimedBy != "" && pending.ClaimedBy != claimedBy && now.Sub(pending.ClaimedOn) < timeout) {
+			continue
+		}
+		f.pending[i].ClaimedBy = claimedBy
+		f.pending[i].ClaimedOn = now
+		claimed = append(claimed, f.pending[i])
+	}
+	return claimed, nil
+}
+
+func (f *fakeStore) DeletePendingNotifications(ctx context.Context, ids []string) error {
+	deleted := make(map[string]bool)
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	kept := make([]contracts.PendingNotification, 0)
+	for _, pending := range f.pending {
+		if !deleted[pending.ID] {
+			kept = append(kept, pending)
+		}
+	}
+	f.pending = kept
+	return nil
+}
+
+type sentText struct {
+	to   string
+	body string
+}
+
+type fakeTexts struct {
+	sent []sentText
+}
+
+func (f *fakeTexts) SendSMS(fromPhone string, toPhone string, messageBody string) error {
+	f.sent = append(f.sent, sentText{to: toPhone, body: messageBody})
+	return nil
+}
+
+type sentDigest struct {
+	email   string
+	subject string
+	body    string
+}
+
+type fakeEmails struct {
+	sent []sentDigest
+	err  error
+}
+
+func (f *fakeEmails) SendNotificationDigest(email string, name string, subject string, body string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, sentDigest{email: email, subject: subject, body: body})
+	return nil
+}
+
+func TestNormalize(t *testing.T) {
+	prefs := contracts.NotificationPreferences{
+		Channels: []contracts.ChannelPreference{{Channel: " Email ", Enabled: true, Events: []string{contracts.EventReferralCreated}}},
+	}
+	assert.NoError(t, Normalize(&prefs))
+	assert.Len(t, prefs.Channels, 3, "every channel is listed")
+	assert.Equal(t, ChannelEmail, prefs.Channels[0].Channel)
+	assert.Equal(t, DeliveryImmediate, prefs.Channels[0].Delivery)
+	assert.False(t, Channel(prefs, ChannelSMS).Enabled)
+	assert.True(t, Channel(prefs, ChannelPush).Enabled)
+	assert.Equal(t, DefaultDigestTime, prefs.DigestTime)
+
+	bad := []contracts.NotificationPreferences{
+		{Channels: []contracts.ChannelPreference{{Channel: "fax", Enabled: true}}},
+		{Channels: []contracts.ChannelPreference{{Channel: ChannelEmail}, {Channel: ChannelEmail}}},
+		{Channels: []contracts.ChannelPreference{{Channel: ChannelEmail, Delivery: "weekly"}}},
+		{Channels: []contracts.ChannelPreference{{Channel: ChannelEmail, Events: []string{"referral.deleted"}}}},
+		{QuietHours: contracts.QuietHours{Start: "22:00"}},
+		{QuietHours: contracts.QuietHours{Start: "10pm", End: "07:00"}},
+		{DigestTime: "25:00"},
+		{Channels: []contracts.ChannelPreference{{Channel: ChannelSMS, Enabled: true}}},
+	}
+	for _, prefs := range bad {
+		assert.Error(t, Normalize(&prefs), "%+v", prefs)
+	}
+
+	texts := contracts.NotificationPreferences{
+		Channels: []contracts.ChannelPreference{{Channel: ChannelSMS, Enabled: true}},
+		SMSPhone: "+1 (555) 123-4567",
+	}
+	assert.NoError(t, Normalize(&texts))
+	assert.Equal(t, "+15551234567", texts.SMSPhone)
+}
+
+func TestDecide(t *testing.T) {
+	prefs := Defaults("gd")
+	prefs.TimeZone = "America/New_York"
+	prefs.QuietHours = contracts.QuietHours{Start: "22:00", End: "07:00"}
+	prefs.Channels[0].Events = []string{contracts.EventReferralCreated}
+	location, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	noon := time.Date(2026, 3, 10, 12, 0, 0, 0, location)
+	night := time.Date(2026, 3, 10, 23, 30, 0, 0, location)
+
+	decision, _ := Decide(prefs, ChannelEmail, contracts.EventReferralCreated, noon)
+	assert.Equal(t, Send, decision)
+	decision, _ = Decide(prefs, ChannelEmail, contracts.EventMessageCreated, noon)
+	assert.Equal(t, Drop, decision, "email only carries the events it lists")
+	decision, _ = Decide(prefs, ChannelSMS, contracts.EventReferralCreated, noon)
+	assert.Equal(t, Drop, decision, "texts are off by default")
+
+	decision, due := Decide(prefs, ChannelPush, contracts.EventMessageCreated, night)
+	assert.Equal(t, Hold, decision)
+	assert.True(t, due.Equal(time.Date(2026, 3, 11, 7, 0, 0, 0, location)), "held until quiet hours end the next morning, not %s", due)
+	early := time.Date(2026, 3, 11, 6, 59, 0, 0, location)
+	_, due = Decide(prefs, ChannelPush, contracts.EventMessageCreated, early)
+	assert.True(t, due.Equal(time.Date(2026, 3, 11, 7, 0, 0, 0, location)))
+
+	prefs.Channels[2].Delivery = DeliveryDigest
+	prefs.DigestTime = "06:00"
+	decision, due = Decide(prefs, ChannelPush, contracts.EventMessageCreated, noon)
+	assert.Equal(t, Hold, decision)
+	assert.True(t, due.Equal(time.Date(2026, 3, 11, 7, 0, 0, 0, location)), "a digest due in quiet hours waits for their end, not %s", due)
+	prefs.DigestTime = "17:30"
+	_, due = Decide(prefs, ChannelPush, contracts.EventMessageCreated, noon)
+	assert.True(t, due.Equal(time.Date(2026, 3, 10, 17, 30, 0, 0, location)))
+}
+
+func TestDispatch(t *testing.T) {
+	defer SetStore(nil)
+	defer SetPushSender(nil)
+	defer SetTextSender(nil)
+	ctx := context.Background()
+
+	clinic := Defaults("sp")
+	clinic.Channels[1] = contracts.ChannelPreference{Channel: ChannelSMS, Enabled: true, Delivery: DeliveryImmediate}
+	clinic.SMSPhone = "+15550001111"
+	// the user takes only new referrals by email, and pushes in a digest
+	staff := Defaults("sp")
+	staff.UserID = "user-1"
+	staff.Email = "front@brightsmile.com"
+	staff.Channels[0].Events = []string{contracts.EventReferralCreated}
+	staff.Channels[2].Delivery = DeliveryDigest
+	store := newFakeStore(clinic, staff)
+	SetStore(store)
+	pushes := fcm.NewFake()
+	SetPushSender(pushes)
+	texts := &fakeTexts{}
+	SetTextSender(texts)
+
+	emailed := 0
+	notice := Notice{
+		Event:      contracts.EventMessageCreated,
+		AddressID:  "sp",
+		ReferralID: "ref-1",
+		Text:       "New message on a referral",
+		Link:       "https://app.superdentist.io/referrals/ref-1",
+		Email:      "front@brightsmile.com",
+		Name:       "Bright Smile",
+		SendEmail:  func() error { emailed++; return nil },
+		Push:       &fcm.Notification{Title: "New message", Body: "New message on a referral"},
+		SMS:        true,
+	}
+	assert.NoError(t, Dispatch(ctx, notice))
+	assert.Equal(t, 0, emailed, "the user's own preferences leave messages out of email")
+	assert.Len(t, pushes.Pushes, 1)
+	assert.Equal(t, fcm.ClinicTopic("sp"), pushes.Pushes[0].Topic)
+	assert.Equal(t, []sentText{{to: "+15550001111", body: "New message on a referral"}}, texts.sent)
+	assert.Len(t, store.pending, 1, "the user's push waits for the digest")
+	assert.Equal(t, fcm.StaffTopic("sp", "user-1"), store.pending[0].Recipient)
+	assert.Equal(t, ChannelPush, store.pending[0].Channel)
+
+	notice.Email = "office@brightsmile.com"
+	assert.NoError(t, Dispatch(ctx, notice))
+	assert.Equal(t, 1, emailed, "other addresses follow the clinic's preferences")
+
+	notice.SendEmail = func() error { return errors.New("mail server down") }
+	assert.Error(t, Dispatch(ctx, notice))
+	assert.Len(t, pushes.Pushes, 3, "the other channels go out when one fails")
+}
+
+func TestFlush(t *testing.T) {
+	defer SetStore(nil)
+	defer SetPushSender(nil)
+	ctx := context.Background()
+	now := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	store := newFakeStore()
+	SetStore(store)
+	pushes := fcm.NewFake()
+	SetPushSender(pushes)
+	store.pending = []contracts.PendingNotification{
+		{ID: "1", Channel: ChannelEmail, Recipient: "front@brightsmile.com", ReferralID: "ref-2", Text: "New message on a referral", CreatedOn: now.Add(-time.Hour), DueOn: now},
+		{ID: "2", Channel: ChannelEmail, Recipient: "front@brightsmile.com", ReferralID: "ref-1", Text: "You have a new referral", Link: "https://app.superdentist.io/referrals/ref-1", CreatedOn: now.Add(-2 * time.Hour), DueOn: now},
+		{ID: "3", Channel: ChannelPush, Recipient: fcm.StaffTopic("sp", "user-1"), Text: "New message on a referral", Link: "https://app.superdentist.io/referrals/ref-2", CreatedOn: now, DueOn: now},
+		{ID: "4", Channel: ChannelEmail, Recipient: "front@brightsmile.com", Text: "Later", CreatedOn: now, DueOn: now.Add(time.Hour)},
+		{ID: "5", Channel: ChannelEmail, Recipient: "sp@ortho.com", Text: "Being sent", CreatedOn: now, DueOn: now, ClaimedBy: "other", ClaimedOn: now.Add(-time.Minute)},
+	}
+	emails := &fakeEmails{err: errors.New("mail server down")}
+	assert.NoError(t, Flush(ctx, emails, now))
+	assert.Len(t, pushes.Pushes, 1)
+	assert.Len(t, store.pending, 4, "a digest that failed stays held")
+
+	emails.err = nil
+	assert.NoError(t, Flush(ctx, emails, now))
+	assert.Len(t, emails.sent, 1, "what another instance is sending is left to it")
+	assert.Equal(t, "2 notifications on SuperDentist", emails.sent[0].subject)
+	assert.Equal(t, "- You have a new referral (Referral ID: ref-1)\n  https://app.superdentist.io/referrals/ref-1\n"+
+		"- New message on a referral (Referral ID: ref-2)\n", emails.sent[0].body)
+	assert.Len(t, pushes.Pushes, 1, "the push that went out is not sent again")
+	assert.Equal(t, "https://app.superdentist.io/referrals/ref-2", pushes.Pushes[0].Notification.Link, "a single push opens its referral")
+	assert.Len(t, store.pending, 2, "what is not due yet stays held")
+	assert.Equal(t, "4", store.pending[0].ID)
+
+	assert.NoError(t, Flush(ctx, emails, now.Add(claimTimeout)))
+	assert.Len(t, emails.sent, 2, "the claim of an instance that stopped is taken over")
+	assert.Equal(t, "sp@ortho.com", emails.sent[1].email)
+}
@@ -0,0 +1,244 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+)
+
+// Channels staff are notified on
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+	ChannelPush  = "push"
+)
+
+// Deliveries of a channel
+const (
+	DeliveryImmediate = "immediate"
+	DeliveryDigest    = "digest"
+)
+
+// DefaultDigestTime .... local time digests go out at when the preferences name none
+const DefaultDigestTime = "08:00"
+
+// Channels .... every channel, in the order preferences list them
+var Channels = []string{ChannelEmail, ChannelSMS, ChannelPush}
+
+// Events .... the referral events staff are notified of
+var Events = []string{
+	contracts.EventReferralCreated,
+	contracts.EventReferralStatus,
+	contracts.EventMessageCreated,
+	contracts.EventMessageUpdated,
+	contracts.EventSummaryReview,
+	contracts.EventSLAEscalation,
+}
+
+// Decision .... what becomes of a notification
+type Decision int
+
+// Decisions
+const (
+	Drop Decision = iota
+	Send
+	Hold
+)
+
+// Defaults .... the preferences of a clinic that set none, email and push of every event right away as
+// before there were preferences, and no texts
+func Defaults(addressID string) contracts.NotificationPreferences {
+	return contracts.NotificationPreferences{
+		AddressID:  addressID,
+		Channels:   []contracts.ChannelPreference{defaultChannel(ChannelEmail), defaultChannel(ChannelSMS), defaultChannel(ChannelPush)},
+		DigestTime: DefaultDigestTime,
+	}
+}
+
+func defaultChannel(channel string) contracts.ChannelPreference {
+	return contracts.ChannelPreference{
+		Channel:  channel,
+		Enabled:  channel != ChannelSMS,
+		Events:   []string{},
+		Delivery: DeliveryImmediate,
+	}
+}
+
+// Channel .... the preference of the channel, its default when the preferences leave it out
+func Channel(prefs contracts.NotificationPreferences, channel string) contracts.ChannelPreference {
+	for _, preference := range prefs.Channels {
+		if preference.Channel == channel {
+			return preference
+		}
+	}
+	return defaultChannel(channel)
+}
+
+// Normalize .... checks the preferences as a clinic sent them and fills in what they leave out: every channel
+// is listed, deliveries are immediate unless they are digests
+func Normalize(prefs *contracts.NotificationPreferences) error {
+	known := make(map[string]bool)
+	for _, event := range Events {
+		known[event] = true
+	}
+	channels := make(map[string]contracts.ChannelPreference)
+	for _, preference := range prefs.Channels {
+		preference.Channel = strings.ToLower(strings.TrimSpace(preference.Channel))
+		if preference.Channel != ChannelEmail && preference.Channel != ChannelSMS && preference.Channel != ChannelPush {
+			return fmt.Errorf("unknown channel %q, it is one of %s", preference.Channel, strings.Join(Channels, ", "))
+		}
+		if _, ok := channels[preference.Channel]; ok {
+			return fmt.Errorf("channel %s is listed twice", preference.Channel)
+		}
+		switch preference.Delivery {
+		case "":
+			preference.Delivery = DeliveryImmediate
+		case DeliveryImmediate, DeliveryDigest:
+		default:
+			return fmt.Errorf("delivery is %s or %s, not %q", DeliveryImmediate, DeliveryDigest, preference.Delivery)
+		}
+		if preference.Events == nil {
+			preference.Events = []string{}
+		}
+		for _, event := range preference.Events {
+			if !known[event] {
+				return fmt.Errorf("unknown event %q, it is one of %s", event, strings.Join(Events, ", "))
+			}
+		}
+		channels[preference.Channel] = preference
+	}
+	prefs.Channels = make([]contracts.ChannelPreference, 0, len(Channels))
+	for _, channel := range Channels {
+		preference, ok := channels[channel]
+		if !ok {
+			preference = defaultChannel(channel)
+		}
+		prefs.Channels = append(prefs.Channels, preference)
+	}
+	if (prefs.QuietHours.Start == "") != (prefs.QuietHours.End == "") {
+		return fmt.Errorf("quiet hours need both a start and an end")
+	}
+	if prefs.QuietHours.Start != "" {
+		if _, err := clock(prefs.QuietHours.Start); err != nil {
+			return err
+		}
+		if _, err := clock(prefs.QuietHours.End); err != nil {
+			return err
+		}
+	}
+	if prefs.DigestTime == "" {
+		prefs.DigestTime = DefaultDigestTime
+	}
+	if _, err := clock(prefs.DigestTime); err != nil {
+		return err
+	}
+	prefs.SMSPhone = sms.NormalizePhone(prefs.SMSPhone)
+	if Channel(*prefs, ChannelSMS).Enabled && prefs.SMSPhone == "" {
+		return fmt.Errorf("texts need a phone number")
+	}
+	return nil
+}
+
+// clock .... minutes into the day of a "15:04" time
+func clock(value string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day like 22:00", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// Location .... the time zone of the preferences, UTC when they have none
+func Location(prefs contracts.NotificationPreferences) *time.Location {
+	if prefs.TimeZone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(prefs.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// QuietUntil .... the end of the quiet hours now is in, zero when it is not in them
+func QuietUntil(prefs contracts.NotificationPreferences, now time.Time) time.Time {
+	if prefs.QuietHours.Start == "" || prefs.QuietHours.End == "" {
+		return time.Time{}
+	}
+	start, err := clock(prefs.QuietHours.Start)
+	if err != nil {
+		return time.Time{}
+	}
+	end, err := clock(prefs.QuietHours.End)
+	if err != nil || start == end {
+		return time.Time{}
+	}
+	local := now.In(Location(prefs))
+	minute := local.Hour()*60 + local.Minute()
+	quiet := minute >= start && minute < end
+	if start > end {
+		// overnight, 22:00 to 07:00
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}
+	}
+	until := atMinute(local, end)
+	if !until.After(local) {
+		until = atMinute(local.AddDate(0, 0, 1), end)
+	}
+	return until
+}
+
+func atMinute(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minute/60, minute%60, 0, 0, day.Location())
+}
+
+// NextDigest .... when the next digest goes out, at the digest time unless that is in quiet hours, then
+// at their end
+func NextDigest(prefs contracts.NotificationPreferences, now time.Time) time.Time {
+	digest, err := clock(prefs.DigestTime)
+	if err != nil {
+		digest, _ = clock(DefaultDigestTime)
+	}
+	local := now.In(Location(prefs))
+	due := atMinute(local, digest)
+	if !due.After(local) {
+		due = atMinute(local.AddDate(0, 0, 1), digest)
+	}
+	if until := QuietUntil(prefs, due); !until.IsZero() {
+		return until
+	}
+	return due
+}
+
+// Decide .... whether a notification of the event on the channel goes out now, is held until the returned
+// time, for the digest or the end of quiet hours, or is not sent at all
+func Decide(prefs contracts.NotificationPreferences, channel string, event string, now time.Time) (Decision, time.Time) {
+	preference := Channel(prefs, channel)
+	if !preference.Enabled {
+		return Drop, time.Time{}
+	}
+	if len(preference.Events) > 0 {
+		wanted := false
+		for _, wantedEvent := range preference.Events {
+			if wantedEvent == event {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			return Drop, time.Time{}
+		}
+	}
+	if preference.Delivery == DeliveryDigest {
+		return Hold, NextDigest(prefs, now)
+	}
+	if until := QuietUntil(prefs, now); !until.IsZero() {
+		return Hold, until
+	}
+	return Send, time.Time{}
+}
@@ -2,38 +2,119 @@ package sendgrid
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"os"
+	"strings"
 
-	"github.com/sendgrid/sendgrid-go"
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	"github.com/superdentist/superdentist-backend/constants"
 	"github.com/superdentist/superdentist-backend/contracts"
 	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/mailtemplates"
+	"github.com/superdentist/superdentist-backend/lib/mailthread"
+	"github.com/superdentist/superdentist-backend/lib/mailtransport"
+)
+
+var (
+	localTemplates *mailtemplates.Set
+	transport      mailtransport.Transport
 )
 
 // ClientSendGrid ....
 type ClientSendGrid struct {
-	client *sendgrid.Client
+	transport mailtransport.Transport
 }
 
 // NewSendGridClient return new database action
 func NewSendGridClient() *ClientSendGrid {
-	return &ClientSendGrid{client: nil}
+	return &ClientSendGrid{transport: nil}
 }
 
-// InitializeSendGridClient ....
+// InitializeSendGridClient .... the client sends through the transport set with SetTransport, or the one
+// the options select when none is set
 func (sgc *ClientSendGrid) InitializeSendGridClient() error {
-	sgAPIKey := os.Getenv("SENDGRID_API_KEY")
-	if sgAPIKey == "" {
-		return fmt.Errorf("Sendgrid api key not found")
+	if transport != nil {
+		sgc.transport = transport
+		return nil
+	}
+	selected, err := mailtransport.New(global.Options)
+	if err != nil {
+		return err
 	}
-	client := sendgrid.NewSendClient(sgAPIKey)
-	sgc.client = client
+	sgc.transport = selected
 	return nil
 }
 
+// SetTransport .... the transport every client sends through
+func SetTransport(t mailtransport.Transport) {
+	transport = t
+}
+
+// referralReplyTo .... Reply-To of a referral's emails, replies to it are routed back to the referral
+func referralReplyTo(refid string) *mail.Email {
+	return mail.NewEmail("Referral Manager", mailthread.ReplyAddress(global.Options.ReplyTo, refid, []byte(global.Options.ReplySigningKey)))
+}
+
+// setReferralReplyTo .... for emails that went out without a Reply-To before, they keep going out
+// without one when no reply address is configured
+func setReferralReplyTo(mailSetup *mail.SGMailV3, refid string) {
+	if global.Options.ReplyTo == "" {
+		return
+	}
+	mailSetup.SetReplyTo(referralReplyTo(refid))
+}
+
+// SetLocalTemplates .... the templates emails are rendered from, for the kinds Options.LocalEmails names
+func SetLocalTemplates(set *mailtemplates.Set) {
+	localTemplates = set
+}
+
+// LocalTemplates .... the templates emails are rendered from, nil before they are set
+func LocalTemplates() *mailtemplates.Set {
+	return localTemplates
+}
+
+// RendersLocally .... whether emails of the kind are rendered from our templates rather than by SendGrid,
+// Options.LocalEmails lists the kinds, or is * for every kind with templates. Every kind with templates is
+// when the transport does not render SendGrid templates.
+func RendersLocally(kind string) bool {
+	if localTemplates == nil || !localTemplates.Has(kind) {
+		return false
+	}
+	if transport != nil && !transport.RendersTemplates() {
+		return true
+	}
+	for _, local := range strings.Split(global.Options.LocalEmails, ",") {
+		if local = strings.TrimSpace(local); local == "*" || local == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// sendTemplated .... sends the email with the dynamic data of its kind, rendered from our templates when the
+// kind renders locally and by the SendGrid template templateID otherwise
+func (sgc *ClientSendGrid) sendTemplated(mailSetup *mail.SGMailV3, p *mail.Personalization, kind string, templateID string, data map[string]interface{}) error {
+	if RendersLocally(kind) {
+		email, err := localTemplates.Render(kind, data)
+		if err != nil {
+			return err
+		}
+		mailSetup.Subject = email.Subject
+		mailSetup.AddContent(mail.NewContent("text/plain", email.Text), mail.NewContent("text/html", email.HTML))
+	} else if sgc.transport.RendersTemplates() {
+		mailSetup.SetTemplateID(templateID)
+		for key, value := range data {
+			p.SetDynamicTemplateData(key, value)
+		}
+	} else {
+		return fmt.Errorf("email %s has no local templates and the mail transport does not render SendGrid's", kind)
+	}
+	mailSetup.AddPersonalizations(p)
+	return sgc.transport.Send(mailSetup)
+}
+
 // SendLiveDemoRequest ....
 func (sgc *ClientSendGrid) SendLiveDemoRequest(data map[string]interface{}) {
 	from := mail.NewEmail("Landing Page", "superdentist.admin@superdentist.io")
@@ -47,7 +128,7 @@ func (sgc *ClientSendGrid) SendLiveDemoRequest(data map[string]interface{}) {
 		currentString += "\n"
 	}
 	message := mail.NewSingleEmail(from, subject, to, currentString, "")
-	sgc.client.Send(message)
+	sgc.transport.Send(message)
 }
 
 // SendPatientDetailsToParth ....
@@ -65,7 +146,7 @@ func (sgc *ClientSendGrid) SendPatientDetailsToParth(data contracts.Patient) {
 	} else {
 		message = mail.NewSingleEmail(from, subject, to, string(prettyJSON.Bytes()), "")
 	}
-	sgc.client.Send(message)
+	sgc.transport.Send(message)
 }
 
 // SendEmailNotificationPatient ......
@@ -78,32 +159,24 @@ func (sgc *ClientSendGrid) SendEmailNotificationPatient(pemail string,
 	comments []string) error {
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
-	replyTo := mail.NewEmail("Referral Manager", global.Options.ReplyTo)
+	replyTo := referralReplyTo(refid)
 	mailSetup.SetFrom(from)
 	mailSetup.SetReplyTo(replyTo)
-	mailSetup.SetTemplateID(global.Options.PatientConfTemp)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(pname, pemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("subject", "Your Referral to "+spname)
-	p.SetDynamicTemplateData("pname", pname)
-	p.SetDynamicTemplateData("refid", refid)
-	p.SetDynamicTemplateData("spname", spname)
-	p.SetDynamicTemplateData("address", spaddress)
-	p.SetDynamicTemplateData("phone", spphone)
-	p.SetDynamicTemplateData("comments", comments)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject":  "Your Referral to " + spname,
+		"pname":    pname,
+		"refid":    refid,
+		"spname":   spname,
+		"address":  spaddress,
+		"phone":    spphone,
+		"comments": comments,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindPatientConfirmation, global.Options.PatientConfTemp, data)
 }
 
 // SendCommentNotificationPatient ......
@@ -115,29 +188,21 @@ func (sgc *ClientSendGrid) SendCommentNotificationPatient(pname string,
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(global.Options.PatientNotificationNew)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(pname, pemail),
 	}
-	replyTo := mail.NewEmail("Referral Manager", global.Options.ReplyTo)
+	replyTo := referralReplyTo(refid)
 	mailSetup.SetReplyTo(replyTo)
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("subject", "Your Referral to "+spname)
-	p.SetDynamicTemplateData("pname", pname)
-	p.SetDynamicTemplateData("refid", refid)
-	p.SetDynamicTemplateData("cname", spname)
-	p.SetDynamicTemplateData("comments", comments)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject":  "Your Referral to " + spname,
+		"pname":    pname,
+		"refid":    refid,
+		"cname":    spname,
+		"comments": comments,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindPatientNotification, global.Options.PatientNotificationNew, data)
 }
 
 // SendEmailNotificationSpecialist ......
@@ -151,29 +216,22 @@ func (sgc *ClientSendGrid) SendEmailNotificationSpecialist(spemail string,
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(global.Options.SpecialistConfTemp)
+	setReferralReplyTo(mailSetup, refid)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(spname, spemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("subject", "You have recieved a New Patient Referral on SuperDentist! Referral ID: "+refid)
-	p.SetDynamicTemplateData("pname", pname)
-	p.SetDynamicTemplateData("refid", refid)
-	p.SetDynamicTemplateData("spname", spname)
-	p.SetDynamicTemplateData("pphone", pphone)
-	p.SetDynamicTemplateData("rdate", rdate)
-	p.SetDynamicTemplateData("comments", comments)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject":  "You have recieved a New Patient Referral on SuperDentist! Referral ID: " + refid,
+		"pname":    pname,
+		"refid":    refid,
+		"spname":   spname,
+		"pphone":   pphone,
+		"rdate":    rdate,
+		"comments": comments,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindSpecialistConfirmation, global.Options.SpecialistConfTemp, data)
 }
 
 // SendCompletionEmailToGD ......
@@ -187,29 +245,22 @@ func (sgc *ClientSendGrid) SendCompletionEmailToGD(gdemail string, gdname string
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(global.Options.GDReferralComp)
+	setReferralReplyTo(mailSetup, refid)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(spname, gdemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("subject", "Your Patient Referral has been Completed on SuperDentist! Referral ID: "+refid)
-	p.SetDynamicTemplateData("pname", pname)
-	p.SetDynamicTemplateData("refid", refid)
-	p.SetDynamicTemplateData("spname", spname)
-	p.SetDynamicTemplateData("pphone", pphone)
-	p.SetDynamicTemplateData("cdate", cdate)
-	p.SetDynamicTemplateData("comments", comments)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject":  "Your Patient Referral has been Completed on SuperDentist! Referral ID: " + refid,
+		"pname":    pname,
+		"refid":    refid,
+		"spname":   spname,
+		"pphone":   pphone,
+		"cdate":    cdate,
+		"comments": comments,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindReferralCompleted, global.Options.GDReferralComp, data)
 }
 
 // SendClinicNotification ....
@@ -217,26 +268,19 @@ func (sgc *ClientSendGrid) SendClinicNotification(cemail string, cname string, p
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(global.Options.ClinicNotificatioNew)
+	setReferralReplyTo(mailSetup, refid)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(cname, cemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("subject", "You have a new notification on SuperDentist! Referral ID: "+refid)
-	p.SetDynamicTemplateData("pname", pname)
-	p.SetDynamicTemplateData("refid", refid)
-	p.SetDynamicTemplateData("cname", cname)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject": "You have a new notification on SuperDentist! Referral ID: " + refid,
+		"pname":   pname,
+		"refid":   refid,
+		"cname":   cname,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindClinicNotification, global.Options.ClinicNotificatioNew, data)
 }
 
 // SendVerificationEmail ......
@@ -246,23 +290,16 @@ func (sgc *ClientSendGrid) SendVerificationEmail(
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", "noreply@superdentist.io")
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(constants.VERIFICATION_EMAIL_NEW)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(pemail, pemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("verify_url", verifyURL)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject":    "Verify your SuperDentist email",
+		"verify_url": verifyURL,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindVerification, constants.VERIFICATION_EMAIL_NEW, data)
 }
 
 // SendPasswordResetEmail ......
@@ -272,23 +309,16 @@ func (sgc *ClientSendGrid) SendPasswordResetEmail(
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", "noreply@superdentist.io")
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(constants.PASSWORD_RESET_EMAIL)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(pemail, pemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("verify_url", verifyURL)
-	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	data := map[string]interface{}{
+		"subject":    "Reset your SuperDentist password",
+		"verify_url": verifyURL,
 	}
-	return nil
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindPasswordReset, constants.PASSWORD_RESET_EMAIL, data)
 }
 
 // SendAutoEmailNotificationToGD ......
@@ -302,27 +332,135 @@ func (sgc *ClientSendGrid) SendAutoEmailNotificationToGD(gdemail string, gdname
 	mailSetup := mail.NewV3Mail()
 	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
 	mailSetup.SetFrom(from)
-	mailSetup.SetTemplateID(global.Options.GDReferralAuto)
+	setReferralReplyTo(mailSetup, refid)
 	p := mail.NewPersonalization()
 	tos := []*mail.Email{
 		mail.NewEmail(spname, gdemail),
 	}
 	p.AddTos(tos...)
-	p.SetDynamicTemplateData("subject", "You have a new attachement for a referral! Referral ID: "+refid)
-	p.SetDynamicTemplateData("pname", pname)
-	p.SetDynamicTemplateData("refid", refid)
-	p.SetDynamicTemplateData("spname", spname)
-	p.SetDynamicTemplateData("pphone", pphone)
-	p.SetDynamicTemplateData("cdate", cdate)
-	p.SetDynamicTemplateData("comments", comments)
+	data := map[string]interface{}{
+		"subject":  "You have a new attachement for a referral! Referral ID: " + refid,
+		"pname":    pname,
+		"refid":    refid,
+		"spname":   spname,
+		"pphone":   pphone,
+		"cdate":    cdate,
+		"comments": comments,
+	}
+	return sgc.sendTemplated(mailSetup, p, mailtemplates.KindReferralAuto, global.Options.GDReferralAuto, data)
+}
+
+// SendAppointmentInvite ...... method is the iTIP method of the attached calendar (REQUEST or CANCEL)
+func (sgc *ClientSendGrid) SendAppointmentInvite(toemail string,
+	toname string,
+	refid string,
+	subject string,
+	body string,
+	method string,
+	invite []byte) error {
+	mailSetup := mail.NewV3Mail()
+	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
+	replyTo := referralReplyTo(refid)
+	mailSetup.SetFrom(from)
+	mailSetup.SetReplyTo(replyTo)
+	mailSetup.Subject = subject
+	p := mail.NewPersonalization()
+	tos := []*mail.Email{
+		mail.NewEmail(toname, toemail),
+	}
+	p.AddTos(tos...)
 	mailSetup.AddPersonalizations(p)
-	request := sendgrid.GetRequest(os.Getenv("SENDGRID_API_KEY"), "/v3/mail/send", "https://api.sendgrid.com")
-	request.Method = "POST"
-	var Body = mail.GetRequestBody(mailSetup)
-	request.Body = Body
-	_, err := sendgrid.API(request)
-	if err != nil {
-		return err
+	mailSetup.AddContent(mail.NewContent("text/plain", body))
+	attachment := mail.NewAttachment()
+	attachment.SetContent(base64.StdEncoding.EncodeToString(invite))
+	attachment.SetType("text/calendar; charset=UTF-8; method=" + method)
+	attachment.SetFilename("invite.ics")
+	attachment.SetDisposition("attachment")
+	mailSetup.AddAttachment(attachment)
+	return sgc.transport.Send(mailSetup)
+}
+
+// SendAppointmentReminder ......
+func (sgc *ClientSendGrid) SendAppointmentReminder(pemail string,
+	pname string,
+	refid string,
+	subject string,
+	body string) error {
+	mailSetup := mail.NewV3Mail()
+	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
+	replyTo := referralReplyTo(refid)
+	mailSetup.SetFrom(from)
+	mailSetup.SetReplyTo(replyTo)
+	mailSetup.Subject = subject
+	p := mail.NewPersonalization()
+	tos := []*mail.Email{
+		mail.NewEmail(pname, pemail),
 	}
-	return nil
+	p.AddTos(tos...)
+	mailSetup.AddPersonalizations(p)
+	mailSetup.AddContent(mail.NewContent("text/plain", body))
+	return sgc.transport.Send(mailSetup)
+}
+
+// SendSLAEscalation ......
+func (sgc *ClientSendGrid) SendSLAEscalation(cemail string,
+	cname string,
+	refid string,
+	body string) error {
+	mailSetup := mail.NewV3Mail()
+	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
+	mailSetup.SetFrom(from)
+	setReferralReplyTo(mailSetup, refid)
+	mailSetup.Subject = "Referral overdue on SuperDentist! Referral ID: " + refid
+	p := mail.NewPersonalization()
+	tos := []*mail.Email{
+		mail.NewEmail(cname, cemail),
+	}
+	p.AddTos(tos...)
+	mailSetup.AddPersonalizations(p)
+	mailSetup.AddContent(mail.NewContent("text/plain", body))
+	return sgc.transport.Send(mailSetup)
+}
+
+// SendMessageRevision ...... tells a clinic a message on the referral was corrected, or withdrawn when retracted
+func (sgc *ClientSendGrid) SendMessageRevision(cemail string,
+	cname string,
+	refid string,
+	retracted bool,
+	body string) error {
+	mailSetup := mail.NewV3Mail()
+	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
+	mailSetup.SetFrom(from)
+	setReferralReplyTo(mailSetup, refid)
+	mailSetup.Subject = "A message was corrected on SuperDentist! Referral ID: " + refid
+	if retracted {
+		mailSetup.Subject = "A message was withdrawn on SuperDentist! Referral ID: " + refid
+	}
+	p := mail.NewPersonalization()
+	tos := []*mail.Email{
+		mail.NewEmail(cname, cemail),
+	}
+	p.AddTos(tos...)
+	mailSetup.AddPersonalizations(p)
+	mailSetup.AddContent(mail.NewContent("text/plain", body))
+	return sgc.transport.Send(mailSetup)
+}
+
+// SendNotificationDigest ...... notifications held for a digest or the end of quiet hours
+func (sgc *ClientSendGrid) SendNotificationDigest(cemail string,
+	cname string,
+	subject string,
+	body string) error {
+	mailSetup := mail.NewV3Mail()
+	from := mail.NewEmail("SuperDentist Admin", constants.SD_ADMIN_EMAIL)
+	mailSetup.SetFrom(from)
+	mailSetup.Subject = subject
+	p := mail.NewPersonalization()
+	tos := []*mail.Email{
+		mail.NewEmail(cname, cemail),
+	}
+	p.AddTos(tos...)
+	mailSetup.AddPersonalizations(p)
+	mailSetup.AddContent(mail.NewContent("text/plain", body))
+	return sgc.transport.Send(mailSetup)
 }
@@ -0,0 +1,86 @@
+package sendgrid
+
+import (
+	"testing"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/mailtemplates"
+)
+
+func TestRendersLocally(t *testing.T) {
+	set, err := mailtemplates.Load("../../templates/email")
+	assert.NoError(t, err)
+	defer SetLocalTemplates(nil)
+	previous := global.Options.LocalEmails
+	defer func() { global.Options.LocalEmails = previous }()
+
+	global.Options.LocalEmails = "pct, cnn"
+	assert.False(t, RendersLocally(mailtemplates.KindPatientConfirmation), "nothing renders locally without templates")
+	SetLocalTemplates(set)
+	assert.True(t, RendersLocally(mailtemplates.KindPatientConfirmation))
+	assert.True(t, RendersLocally(mailtemplates.KindClinicNotification))
+	assert.False(t, RendersLocally(mailtemplates.KindSpecialistConfirmation))
+
+	global.Options.LocalEmails = "*"
+	assert.True(t, RendersLocally(mailtemplates.KindSpecialistConfirmation))
+	assert.False(t, RendersLocally("unknown"))
+
+	global.Options.LocalEmails = ""
+	assert.False(t, RendersLocally(mailtemplates.KindPatientConfirmation))
+}
+
+type fakeTransport struct {
+	templates bool
+	sent      []*mail.SGMailV3
+}
+
+func (f *fakeTransport) Send(message *mail.SGMailV3) error {
+	f.sent = append(f.sent, message)
+	return nil
+}
+
+func (f *fakeTransport) RendersTemplates() bool {
+	return f.templates
+}
+
+func TestSendThroughTransport(t *testing.T) {
+	set, err := mailtemplates.Load("../../templates/email")
+	assert.NoError(t, err)
+	defer SetLocalTemplates(nil)
+	defer SetTransport(nil)
+	previous := global.Options.LocalEmails
+	defer func() { global.Options.LocalEmails = previous }()
+	global.Options.LocalEmails = ""
+
+	sendGrid := &fakeTransport{templates: true}
+	SetTransport(sendGrid)
+	SetLocalTemplates(set)
+	client := NewSendGridClient()
+	assert.NoError(t, client.InitializeSendGridClient())
+	assert.NoError(t, client.SendClinicNotification("clinic@example.com", "Bright Smile", "Maria Garcia", "a1b2c3d4"))
+	assert.Len(t, sendGrid.sent, 1)
+	assert.Equal(t, global.Options.ClinicNotificatioNew, sendGrid.sent[0].TemplateID)
+	assert.Empty(t, sendGrid.sent[0].Content)
+
+	smtp := &fakeTransport{}
+	SetTransport(smtp)
+	assert.True(t, RendersLocally(mailtemplates.KindClinicNotification), "every kind with templates renders locally off SendGrid")
+	client = NewSendGridClient()
+	assert.NoError(t, client.InitializeSendGridClient())
+	assert.NoError(t, client.SendClinicNotification("clinic@example.com", "Bright Smile", "Maria Garcia", "a1b2c3d4"))
+	assert.Len(t, smtp.sent, 1)
+	assert.Empty(t, smtp.sent[0].TemplateID)
+	assert.Len(t, smtp.sent[0].Content, 2)
+	assert.NoError(t, client.SendSLAEscalation("clinic@example.com", "Bright Smile", "a1b2c3d4", "Overdue"))
+	assert.Len(t, smtp.sent, 2)
+	assert.NoError(t, client.SendMessageRevision("clinic@example.com", "Bright Smile", "a1b2c3d4", true, "Withdrawn"))
+	assert.Len(t, smtp.sent, 3)
+	assert.Equal(t, "A message was withdrawn on SuperDentist! Referral ID: a1b2c3d4", smtp.sent[2].Subject)
+
+	SetLocalTemplates(nil)
+	assert.Error(t, client.SendClinicNotification("clinic@example.com", "Bright Smile", "Maria Garcia", "a1b2c3d4"),
+		"without templates nothing can render the email")
+	assert.Len(t, smtp.sent, 3)
+}
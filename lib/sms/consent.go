@@ -0,0 +1,79 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Consent keywords, the variants carriers expect a sender to honour are mapped onto these
+const (
+	KeywordStop  = "stop"
+	KeywordStart = "start"
+	KeywordHelp  = "help"
+)
+
+var keywords = map[string]string{
+	"STOP":        KeywordStop,
+	"STOPALL":     KeywordStop,
+	"UNSUBSCRIBE": KeywordStop,
+	"CANCEL":      KeywordStop,
+	"END":         KeywordStop,
+	"QUIT":        KeywordStop,
+	"START":       KeywordStart,
+	"UNSTOP":      KeywordStart,
+	"HELP":        KeywordHelp,
+	"INFO":        KeywordHelp,
+}
+
+// ErrOptedOut is returned by SendSMS for numbers that replied STOP
+var ErrOptedOut = errors.New("sms: recipient opted out")
+
+// ConsentStore tells whether a number opted out of texts
+type ConsentStore interface {
+	SMSOptedOut(ctx context.Context, phone string) (bool, error)
+}
+
+var consentStore ConsentStore
+
+// SetConsentStore .... every SendSMS checks the store first, without one texts are sent unchecked
+func SetConsentStore(store ConsentStore) {
+	consentStore = store
+}
+
+// Keyword .... the consent keyword a text is, "" for any other text. Only a text that is nothing but
+// the keyword counts, "please stop by tomorrow" is a message.
+func Keyword(text string) string {
+	return keywords[strings.ToUpper(strings.Trim(strings.TrimSpace(text), ".!"))]
+}
+
+// NormalizePhone .... the number as consent is kept for it, digits with a leading + when it has one
+func NormalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	normalized := ""
+	if strings.HasPrefix(phone, "+") {
+		normalized = "+"
+	}
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			normalized += string(r)
+		}
+	}
+	return normalized
+}
+
+// checkConsent .... a number that opted out, or whose consent cannot be read, is not texted
+func checkConsent(toPhone string) error {
+	if consentStore == nil {
+		return nil
+	}
+	optedOut, err := consentStore.SMSOptedOut(context.Background(), NormalizePhone(toPhone))
+	if err != nil {
+		return fmt.Errorf("sms: cannot check consent of %s: %v", toPhone, err)
+	}
+	if optedOut {
+		return ErrOptedOut
+	}
+	return nil
+}
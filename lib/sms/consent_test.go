@@ -0,0 +1,43 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConsent struct {
+	optedOut map[string]bool
+	err      error
+}
+
+func (f *fakeConsent) SMSOptedOut(ctx context.Context, phone string) (bool, error) {
+	return f.optedOut[phone], f.err
+}
+
+func TestKeyword(t *testing.T) {
+	assert.Equal(t, KeywordStop, Keyword("STOP"))
+	assert.Equal(t, KeywordStop, Keyword(" stop. "))
+	assert.Equal(t, KeywordStop, Keyword("Unsubscribe"))
+	assert.Equal(t, KeywordStart, Keyword("unstop"))
+	assert.Equal(t, KeywordHelp, Keyword("Help!"))
+	assert.Equal(t, "", Keyword("please stop by tomorrow"))
+	assert.Equal(t, "", Keyword("C"), "appointment replies are not consent keywords")
+}
+
+func TestNormalizePhone(t *testing.T) {
+	assert.Equal(t, "+15551234567", NormalizePhone("+1 (555) 123-4567"))
+	assert.Equal(t, "5551234567", NormalizePhone("555.123.4567"))
+}
+
+func TestSendSMSOptedOut(t *testing.T) {
+	defer SetConsentStore(nil)
+	SetConsentStore(&fakeConsent{optedOut: map[string]bool{"+15551234567": true}})
+	client := NewSMSClient()
+	assert.Equal(t, ErrOptedOut, client.SendSMS("+15550000000", "+1 555 123 4567", "hello"))
+
+	SetConsentStore(&fakeConsent{err: errors.New("unavailable")})
+	assert.Error(t, client.SendSMS("+15550000000", "+15551234567", "hello"), "a number is not texted when its consent is unknown")
+}
@@ -80,8 +80,21 @@ func (twiC *ClientSMS) GetMedia(ctx context.Context, url string) (string, *io.Re
 	}
 }
 
-// SendSMS ....
+// SendSMS .... numbers that opted out are not texted, ErrOptedOut is returned for them
 func (twiC *ClientSMS) SendSMS(fromPhone string, toPhone string, messageBody string) error {
+	if err := checkConsent(toPhone); err != nil {
+		return err
+	}
+	_, err := twiC.client.Messages.SendMessage(fromPhone, toPhone, messageBody, nil)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SendConsentReply .... answer to a STOP, START or HELP, sent whatever the consent of the number as
+// carriers require a confirmation of the opt out itself
+func (twiC *ClientSMS) SendConsentReply(fromPhone string, toPhone string, messageBody string) error {
 	_, err := twiC.client.Messages.SendMessage(fromPhone, toPhone, messageBody, nil)
 	if err != nil {
 		return err
@@ -6,20 +6,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/superdentist/superdentist-backend/constants"
 	"github.com/superdentist/superdentist-backend/lib/helpers"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
 // Client ....
 type Client struct {
-	projectID string
-	client    *storage.Client
+	projectID   string
+	client      *storage.Client
+	signerEmail string
+	signerKey   []byte
 }
 
 // NewStorageHandler return new database action
@@ -37,10 +43,15 @@ func (sc *Client) InitializeStorageClient(ctx context.Context, projectID string)
 		"https://www.googleapis.com/auth/cloud-platform",
 		"https://www.googleapis.com/auth/userinfo.email",
 	}
-	currentCreds, _, err := helpers.ReadCredentialsFile(ctx, serviceAccountSD, targetScopes)
+	currentCreds, credsJSON, err := helpers.ReadCredentialsFile(ctx, serviceAccountSD, targetScopes)
 	if err != nil {
 		return err
 	}
+	// only service account keys can sign URLs, other credentials leave SignedURL unavailable
+	if jwtConfig, err := google.JWTConfigFromJSON(credsJSON); err == nil {
+		sc.signerEmail = jwtConfig.Email
+		sc.signerKey = jwtConfig.PrivateKey
+	}
 	client, err := storage.NewClient(ctx, option.WithCredentials(currentCreds))
 	if err != nil {
 		return err
@@ -92,87 +103,155 @@ func (sc *Client) UploadQRtoGCS(ctx context.Context, fileName string) (*storage.
 	return bucketWriter, nil
 }
 
-// ZipFile ....ZipFile
-func (sc *Client) ZipFile(ctx context.Context, folderPath string, bucket string) error {
+// CreateFile .... writes the file only if nothing is stored at path yet, created is false when it was taken
+func (sc *Client) CreateFile(ctx context.Context, bucket string, path string, data []byte, contentType string) (bool, error) {
+	currentBucket, err := sc.CreateBucket(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+	storageWriter := currentBucket.Object(path).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	storageWriter.ContentType = contentType
+	if _, err := storageWriter.Write(data); err != nil {
+		storageWriter.Close()
+		return false, err
+	}
+	err = storageWriter.Close()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WriteFile .... writes the file, replacing what is stored at path
+func (sc *Client) WriteFile(ctx context.Context, bucket string, path string, data []byte, contentType string) error {
 	currentBucket, err := sc.CreateBucket(ctx, bucket)
 	if err != nil {
 		return err
 	}
-	currentFolder := fmt.Sprintf("%v/", folderPath)
-	storageQuery := &storage.Query{Prefix: currentFolder, Delimiter: "/"}
-
-	zipFileURI := currentFolder + "zip/zipped.zip"
-	err = currentBucket.Object(zipFileURI).Delete(ctx)
-	storageWriter := currentBucket.Object(zipFileURI).NewWriter(ctx)
-	storageWriter.ContentType = "application/zip"
-	defer storageWriter.Close()
-	zipWriter := zip.NewWriter(storageWriter)
-	// go through each file in the prefix
-	refDocsIterator := currentBucket.Objects(ctx, storageQuery)
-	objects := []*storage.ObjectAttrs{}
+	storageWriter := currentBucket.Object(path).NewWriter(ctx)
+	storageWriter.ContentType = contentType
+	if _, err := storageWriter.Write(data); err != nil {
+		storageWriter.Close()
+		return err
+	}
+	return storageWriter.Close()
+}
+
+// ZipEntry .... object to put in a zip and its path inside the archive
+type ZipEntry struct {
+	Object string
+	Name   string
+}
 
+// FolderEntries .... zip entries of every object under the folder, nested folders included, named
+// relative to it. Archives stored by earlier versions under zip/ are left out.
+func (sc *Client) FolderEntries(ctx context.Context, folderPath string, bucket string) ([]ZipEntry, error) {
+	currentBucket, err := sc.CreateBucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	currentFolder := fmt.Sprintf("%v/", folderPath)
+	entries := make([]ZipEntry, 0)
+	objectsIterator := currentBucket.Objects(ctx, &storage.Query{Prefix: currentFolder})
 	for {
-		objectAttrs, err := refDocsIterator.Next()
+		objectAttrs, err := objectsIterator.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-		objects = append(objects, objectAttrs)
-	}
-	if len(objects) < 1 {
-		return fmt.Errorf("No document is associated with current referral")
+		name := objectAttrs.Name[len(currentFolder):]
+		if name == "" || strings.HasSuffix(name, "/") || strings.HasPrefix(name, "zip/") {
+			// folder placeholders and old archives
+			continue
+		}
+		entries = append(entries, ZipEntry{Object: objectAttrs.Name, Name: name})
 	}
-	for _, obj := range objects {
-		log.Printf("Packing file %v of size %v to zip file", obj.Name, obj.Size)
+	return entries, nil
+}
 
-		storageReader, rerr := currentBucket.Object(obj.Name).NewReader(ctx)
-		if rerr != nil {
-			return err
+// StreamZip .... writes a zip of the entries to w as the objects are read, nothing is buffered or
+// stored. Objects that no longer exist are left out.
+func (sc *Client) StreamZip(ctx context.Context, w io.Writer, bucket string, entries []ZipEntry) error {
+	currentBucket, err := sc.CreateBucket(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	zipWriter := zip.NewWriter(w)
+	for _, entry := range entries {
+		storageReader, err := currentBucket.Object(entry.Object).NewReader(ctx)
+		if err == storage.ErrObjectNotExist {
+			log.Printf("Skipping missing file %v of zip", entry.Object)
+			continue
 		}
-
-		// make all paths relative
-		relativeFilename, rerr := filepath.Rel("/"+currentFolder, "/"+obj.Name)
-		if rerr != nil {
+		if err != nil {
 			return err
 		}
-
-		// add filename to zip
-		zipFile, zerr := zipWriter.Create(relativeFilename)
-		if zerr != nil {
-			return err
+		header := &zip.FileHeader{Name: entry.Name, Method: zip.Deflate}
+		header.Modified = storageReader.Attrs.LastModified
+		zipFile, err := zipWriter.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(zipFile, storageReader)
 		}
-
-		// copy from storage reader to zip writer
-		_, cerr := io.Copy(zipFile, storageReader)
-		if cerr != nil {
+		storageReader.Close()
+		if err != nil {
 			return err
 		}
-
-		storageReader.Close()
 	}
+	return zipWriter.Close()
+}
 
-	err = zipWriter.Close()
+// WriteZip .... stores a zip of the entries as the object, built as StreamZip builds it. Nothing is stored
+// when it fails.
+func (sc *Client) WriteZip(ctx context.Context, bucket string, object string, entries []ZipEntry) error {
+	currentBucket, err := sc.CreateBucket(ctx, bucket)
 	if err != nil {
 		return err
 	}
-	storageWriter.Close() // we should be uploaded by here
-	return nil
+	// cancelling the write before Close discards what was uploaded so far
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := currentBucket.Object(object).NewWriter(writeCtx)
+	writer.ContentType = "application/zip"
+	err = sc.StreamZip(ctx, writer, bucket, entries)
+	if err != nil {
+		cancel()
+		writer.Close()
+		return err
+	}
+	return writer.Close()
 }
 
-// DownloadAsZip ....
-func (sc *Client) DownloadAsZip(ctx context.Context, folderPath string, bucket string) (*storage.Reader, error) {
+// DeleteObjectsBefore .... deletes the objects under prefix created before the given time, returns how many
+func (sc *Client) DeleteObjectsBefore(ctx context.Context, bucket string, prefix string, before time.Time) (int, error) {
 	currentBucket, err := sc.CreateBucket(ctx, bucket)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	zipFileURI := folderPath + "/zip/zipped.zip"
-	storageReader, err := currentBucket.Object(zipFileURI).NewReader(ctx)
-	if err != nil {
-		return nil, err
+	deleted := 0
+	objectsIterator := currentBucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		objectAttrs, err := objectsIterator.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if !objectAttrs.Created.Before(before) {
+			continue
+		}
+		err = currentBucket.Object(objectAttrs.Name).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return deleted, err
+		}
+		deleted++
 	}
-	return storageReader, nil
+	return deleted, nil
 }
 
 // DownloadSingleFile ....
@@ -188,3 +267,50 @@ func (sc *Client) DownloadSingleFile(ctx context.Context, folderPath string, buc
 	}
 	return storageReader, nil
 }
+
+// CopyFolder .... copies the documents of one folder into another in the same bucket, the zip is left out
+func (sc *Client) CopyFolder(ctx context.Context, fromFolder string, toFolder string, bucket string) ([]string, error) {
+	currentBucket, err := sc.CreateBucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	sourceFolder := fmt.Sprintf("%v/", fromFolder)
+	storageQuery := &storage.Query{Prefix: sourceFolder, Delimiter: "/"}
+	copiedFiles := make([]string, 0)
+	refDocsIterator := currentBucket.Objects(ctx, storageQuery)
+	for {
+		objectAttrs, err := refDocsIterator.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return copiedFiles, err
+		}
+		if objectAttrs.Name == "" {
+			// synthetic prefix entries for sub folders
+			continue
+		}
+		fileName := objectAttrs.Name[len(sourceFolder):]
+		destination := currentBucket.Object(toFolder + "/" + fileName)
+		_, err = destination.CopierFrom(currentBucket.Object(objectAttrs.Name)).Run(ctx)
+		if err != nil {
+			return copiedFiles, err
+		}
+		copiedFiles = append(copiedFiles, fileName)
+	}
+	return copiedFiles, nil
+}
+
+// MoveFile .... moves a file within the bucket
+func (sc *Client) MoveFile(ctx context.Context, bucket string, fromPath string, toPath string) error {
+	currentBucket, err := sc.CreateBucket(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	source := currentBucket.Object(fromPath)
+	_, err = currentBucket.Object(toPath).CopierFrom(source).Run(ctx)
+	if err != nil {
+		return err
+	}
+	return source.Delete(ctx)
+}
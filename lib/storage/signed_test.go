@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkSigner(t *testing.T) {
+	signer := NewLinkSigner([]byte("secret"))
+	expires := time.Unix(1700000000, 0)
+	link := SignedLink{Bucket: "referrals", Object: "ref1/cbct scan.dcm", DownloadName: "cbct scan.dcm", Expires: expires}
+	values, err := url.ParseQuery(signer.Sign(link))
+	assert.NoError(t, err)
+
+	verified, err := signer.Verify(values, expires.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, link.Object, verified.Object)
+	assert.True(t, link.Expires.Equal(verified.Expires))
+
+	_, err = signer.Verify(values, expires.Add(time.Second))
+	assert.Equal(t, ErrLinkExpired, err)
+	_, err = NewLinkSigner([]byte("other")).Verify(values, expires.Add(-time.Minute))
+	assert.Equal(t, ErrLinkInvalid, err)
+	_, err = NewLinkSigner(nil).Verify(values, expires.Add(-time.Minute))
+	assert.Equal(t, ErrLinkInvalid, err, "links cannot be verified without a key")
+
+	values.Set("object", "ref2/cbct scan.dcm")
+	_, err = signer.Verify(values, expires.Add(-time.Minute))
+	assert.Equal(t, ErrLinkInvalid, err)
+	values.Set("object", link.Object)
+	values.Set("expires", "1800000000")
+	_, err = signer.Verify(values, expires.Add(-time.Minute))
+	assert.Equal(t, ErrLinkInvalid, err, "the expiry is signed")
+
+}
+
+func TestSignedURL(t *testing.T) {
+	_, err := NewStorageHandler().SignedURL("referrals", "ref1/scan.pdf", "scan.pdf", time.Now().Add(time.Minute))
+	assert.Equal(t, ErrSigningUnavailable, err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	sc := &Client{
+		signerEmail: "backend@project.iam.gserviceaccount.com",
+		signerKey:   pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+	signedURL, err := sc.SignedURL("referrals", "ref1/scan.pdf", "scan.pdf", time.Now().Add(5*time.Minute))
+	assert.NoError(t, err)
+	parsed, err := url.Parse(signedURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "/referrals/ref1/scan.pdf", parsed.Path)
+	assert.Equal(t, "GOOG4-RSA-SHA256", parsed.Query().Get("X-Goog-Algorithm"))
+	assert.NotEmpty(t, parsed.Query().Get("X-Goog-Signature"))
+	assert.Equal(t, `attachment; filename="scan.pdf"`, parsed.Query().Get("response-content-disposition"))
+}
@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"context"
+)
+
+// BrokerMessage ... a published message as relayed between replicas
+type BrokerMessage struct {
+	Origin  string `json:"origin"`
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+}
+
+// Broker relays messages published on one replica to the pools of the others
+type Broker interface {
+	// Publish hands message to the other replicas
+	Publish(ctx context.Context, message BrokerMessage) error
+	// Listen calls deliver for messages published by any replica, including this one, until ctx is done
+	Listen(ctx context.Context, deliver func(BrokerMessage)) error
+}
+
+// LocalBroker ... broker for a single replica, the pool already delivered everything locally
+type LocalBroker struct{}
+
+// NewLocalBroker ....
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+// Publish ....
+func (b *LocalBroker) Publish(ctx context.Context, message BrokerMessage) error {
+	return nil
+}
+
+// Listen ....
+func (b *LocalBroker) Listen(ctx context.Context, deliver func(BrokerMessage)) error {
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,175 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxNotifyPayload postgres rejects NOTIFY payloads of 8000 bytes or more
+const maxNotifyPayload = 7999
+
+// storedMessageTTL messages too large to notify are kept this long for the replicas to read
+const storedMessageTTL = 5 * time.Minute
+
+// PostgresBroker ... relays messages between replicas with postgres LISTEN/NOTIFY. Messages that do
+// not fit in a notification payload are saved in the <channel>_messages table and only their key is
+// notified, the replicas read them back from there.
+type PostgresBroker struct {
+	pool    *pgx.ConnPool
+	config  pgx.ConnConfig
+	channel string
+
+	tableMu    sync.Mutex
+	tableReady bool
+}
+
+// notifyEnvelope ... a notification payload, the message itself or Ref, the key of a stored one
+type notifyEnvelope struct {
+	BrokerMessage
+	Ref string `json:"ref,omitempty"`
+}
+
+// NewPostgresBroker ... publishes through pool and listens on its own connection made from config
+func NewPostgresBroker(pool *pgx.ConnPool, config pgx.ConnConfig, channel string) *PostgresBroker {
+	return &PostgresBroker{pool: pool, config: config, channel: channel}
+}
+
+// Publish ....
+func (b *PostgresBroker) Publish(ctx context.Context, message BrokerMessage) error {
+	payload, err := encodeNotification(ctx, message, b.storeMessage)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.ExecEx(ctx, "select pg_notify($1, $2)", nil, b.channel, payload)
+	return err
+}
+
+// encodeNotification ... the message as a notification payload, one too large is saved with store and
+// only its key is sent
+func encodeNotification(ctx context.Context, message BrokerMessage, store func(context.Context, string, []byte) error) (string, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) <= maxNotifyPayload {
+		return string(payload), nil
+	}
+	key, err := uuid.NewUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := store(ctx, key.String(), payload); err != nil {
+		return "", fmt.Errorf("websocket: cannot store message on %s (%d bytes): %v", message.Topic, len(payload), err)
+	}
+	ref, err := json.Marshal(notifyEnvelope{Ref: key.String()})
+	if err != nil {
+		return "", err
+	}
+	return string(ref), nil
+}
+
+// decodeNotification ... the message of a notification payload, read with load when it was stored
+func decodeNotification(ctx context.Context, payload string, load func(context.Context, string) ([]byte, error)) (BrokerMessage, error) {
+	var envelope notifyEnvelope
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		return BrokerMessage{}, err
+	}
+	if envelope.Ref == "" {
+		return envelope.BrokerMessage, nil
+	}
+	stored, err := load(ctx, envelope.Ref)
+	if err != nil {
+		return BrokerMessage{}, fmt.Errorf("cannot load stored message %s: %v", envelope.Ref, err)
+	}
+	var message BrokerMessage
+	if err := json.Unmarshal(stored, &message); err != nil {
+		return BrokerMessage{}, err
+	}
+	return message, nil
+}
+
+func (b *PostgresBroker) messageTable() string {
+	return b.channel + "_messages"
+}
+
+// storeMessage ... saves the message under key and drops those older than storedMessageTTL
+func (b *PostgresBroker) storeMessage(ctx context.Context, key string, payload []byte) error {
+	b.tableMu.Lock()
+	if !b.tableReady {
+		_, err := b.pool.ExecEx(ctx, "create table if not exists "+b.messageTable()+
+			" (key text primary key, payload bytea not null, created_on timestamptz not null default now())", nil)
+		if err != nil {
+			b.tableMu.Unlock()
+			return err
+		}
+		b.tableReady = true
+	}
+	b.tableMu.Unlock()
+	_, err := b.pool.ExecEx(ctx, "insert into "+b.messageTable()+" (key, payload) values ($1, $2)", nil, key, payload)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.ExecEx(ctx, "delete from "+b.messageTable()+" where created_on < now() - $1::interval", nil,
+		fmt.Sprintf("%d seconds", int(storedMessageTTL.Seconds())))
+	if err != nil {
+		log.Errorf("websocket: cannot drop old stored messages: %v", err)
+	}
+	return nil
+}
+
+func (b *PostgresBroker) loadMessage(ctx context.Context, key string) ([]byte, error) {
+	var payload []byte
+	err := b.pool.QueryRowEx(ctx, "select payload from "+b.messageTable()+" where key = $1", nil, key).Scan(&payload)
+	return payload, err
+}
+
+// Listen ... reconnects until ctx is done
+func (b *PostgresBroker) Listen(ctx context.Context, deliver func(BrokerMessage)) error {
+	backoff := time.Second
+	for {
+		err := b.listenOnce(ctx, deliver)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Errorf("websocket: postgres broker listen failed, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *PostgresBroker) listenOnce(ctx context.Context, deliver func(BrokerMessage)) error {
+	conn, err := pgx.Connect(b.config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.Listen(b.channel)
+	if err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		message, err := decodeNotification(ctx, notification.Payload, b.loadMessage)
+		if err != nil {
+			log.Errorf("websocket: bad broker message: %v", err)
+			continue
+		}
+		deliver(message)
+	}
+}
@@ -2,6 +2,8 @@ package websocket
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,10 +16,7 @@ import (
 // ReadAddressString ....
 func (c *Client) ReadAddressString() {
 	defer func() {
-		c.CurrentPool.Unregister <- &UnRegisterChannel{
-			ClientID:  c.CurrentConnID,
-			WebClient: c,
-		}
+		c.CurrentPool.Unregister(c)
 		c.CurrentConn.Close()
 	}()
 	c.CurrentConn.SetReadLimit(MaxMessageSize)
@@ -43,10 +42,7 @@ func (c *Client) ReadAddressString() {
 			break
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.CurrentPool.Broadcast <- BroadCastChannel{
-			ClientID: c.CurrentConnID,
-			Message:  message,
-		}
+		c.CurrentPool.SendTo(c, message)
 
 	}
 }
@@ -98,12 +94,60 @@ func (c *Client) WriteAdderessJSON(mapClient *gmaps.ClientGMaps) {
 	}
 }
 
-// ReadChatPayload ...
-func(c *Client) ReadChatPayload(){
-
+// ReadChatPayload ... reads chat frames from the peer and hands them to handle, errors are sent back to the peer
+func (c *Client) ReadChatPayload(handle func(message []byte) error) {
+	defer func() {
+		c.CurrentPool.Unregister(c)
+		c.CurrentConn.Close()
+	}()
+	c.CurrentConn.SetReadLimit(MaxChatMessageSize)
+	c.CurrentConn.SetReadDeadline(time.Now().Add(PongWait))
+	c.CurrentConn.SetPongHandler(func(string) error { c.CurrentConn.SetReadDeadline(time.Now().Add(PongWait)); return nil })
+	for {
+		messageType, message, err := c.CurrentConn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Errorf("error: %v", err)
+			}
+			break
+		}
+		if messageType != websocket.TextMessage {
+			err = fmt.Errorf("Websocket only accepts text message")
+		} else {
+			err = handle(bytes.TrimSpace(message))
+		}
+		if err != nil {
+			errorFrame, _ := json.Marshal(contracts.ChatEvent{Type: contracts.ChatEventError, Error: err.Error()})
+			c.CurrentPool.SendTo(c, errorFrame)
+		}
+	}
 }
 
-// WritePingsToChat ...
-func(c *Client) WritePingsToChat(){
-
+// WritePingsToChat ... writes queued chat events to the peer and keeps the connection alive with pings
+func (c *Client) WritePingsToChat() {
+	ticker := time.NewTicker(PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.CurrentConn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-c.Send:
+			c.CurrentConn.SetWriteDeadline(time.Now().Add(WriteWait))
+			if !ok {
+				// The pool closed the channel.
+				c.CurrentConn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.CurrentConn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Errorf("error writing chat message: %v", err.Error())
+				return
+			}
+		case <-ticker.C:
+			c.CurrentConn.SetWriteDeadline(time.Now().Add(WriteWait))
+			if err := c.CurrentConn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
 }
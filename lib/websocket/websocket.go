@@ -1,11 +1,14 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 )
@@ -22,6 +25,15 @@ const (
 
 	// MaxMessageSize Maximum message size allowed from peer.
 	MaxMessageSize = 512
+
+	// MaxChatMessageSize Maximum chat payload size allowed from peer.
+	MaxChatMessageSize = 16384
+
+	// ClientBufferSize Outbound messages queued per client before it is evicted as a slow consumer.
+	ClientBufferSize = 256
+
+	// poolQueueSize Requests queued for the pool loop.
+	poolQueueSize = 1024
 )
 
 var (
@@ -29,37 +41,45 @@ var (
 	space   = []byte{' '}
 )
 
-// Pool maintains clients and monitor connections.
+// Pool is a topic based hub. Clients subscribe to topics such as a clinic or a referral and every
+// message published to a topic is fanned out to its subscribers, locally and through the broker to
+// the pools of the other replicas. Only the pool loop writes to or closes a client's Send channel.
 type Pool struct {
-	// Registered clients.
-	Clients map[string]*Client
+	// clients registered clients by connection id.
+	clients map[string]*Client
 
-	// Inbound messages from the clients.
-	Broadcast chan BroadCastChannel
+	// topics subscribed clients by topic and connection id.
+	topics map[string]map[string]*Client
 
-	// Register requests from the clients.
-	Register chan *RegisterChannel
+	// requests register, unregister, subscribe and deliver requests for the pool loop.
+	requests chan poolRequest
 
-	// Unregister requests from clients.
-	Unregister chan *UnRegisterChannel
-}
+	// broker relays published messages between replicas.
+	broker Broker
 
-// BroadCastChannel ...
-type BroadCastChannel struct {
-	ClientID string
-	Message  []byte
-}
+	// origin identifies this pool in broker messages.
+	origin string
 
-// RegisterChannel ...
-type RegisterChannel struct {
-	ClientID  string
-	WebClient *Client
+	// done is closed once the pool stopped.
+	done chan struct{}
 }
 
-// UnRegisterChannel ...
-type UnRegisterChannel struct {
-	ClientID  string
-	WebClient *Client
+type poolAction int
+
+const (
+	actionRegister poolAction = iota
+	actionUnregister
+	actionSubscribe
+	actionUnsubscribe
+	actionPublish
+	actionSendTo
+)
+
+type poolRequest struct {
+	action  poolAction
+	client  *Client
+	topics  []string
+	message []byte
 }
 
 // Client is a middleman between the websocket connection and the backend.
@@ -73,8 +93,11 @@ type Client struct {
 	//CurrentConnID ... the id of connection established
 	CurrentConnID string
 
-	// Send Buffered channel of outbound messages.
+	// Send Buffered channel of outbound messages, closed by the pool when the client is dropped.
 	Send chan []byte
+
+	// topics the client is subscribed to, owned by the pool loop.
+	topics map[string]bool
 }
 
 var wsupgrader = websocket.Upgrader{
@@ -82,36 +105,218 @@ var wsupgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-// NewPool .. this will handle all websocket connections needed by SD
-func NewPool() *Pool {
+// NewPool .. this will handle all websocket connections needed by SD, a nil broker keeps messages on this replica
+func NewPool(broker Broker) *Pool {
+	if broker == nil {
+		broker = NewLocalBroker()
+	}
+	originID, _ := uuid.NewUUID()
 	return &Pool{
-		Broadcast:  make(chan BroadCastChannel),
-		Register:   make(chan *RegisterChannel),
-		Unregister: make(chan *UnRegisterChannel),
-		Clients:    make(map[string]*Client),
+		clients:  make(map[string]*Client),
+		topics:   make(map[string]map[string]*Client),
+		requests: make(chan poolRequest, poolQueueSize),
+		broker:   broker,
+		origin:   originID.String(),
+		done:     make(chan struct{}),
 	}
 }
 
-// RunPool .... let just run it always
-func (h *Pool) RunPool() {
+// NewClient ... client with a bounded outbound buffer
+func NewClient(pool *Pool, conn *websocket.Conn, connID string) *Client {
+	return &Client{
+		CurrentPool:   pool,
+		CurrentConn:   conn,
+		CurrentConnID: connID,
+		Send:          make(chan []byte, ClientBufferSize),
+		topics:        make(map[string]bool),
+	}
+}
+
+// ChatTopic ... topic of one chat channel (c2c or c2p) of a referral
+func ChatTopic(referralID string, channel string) string {
+	return "chat/" + referralID + "/" + channel
+}
+
+// ClinicTopic ... topic of everything happening at a clinic
+func ClinicTopic(addressID string) string {
+	return "clinic/" + addressID
+}
+
+// ReferralTopic ... topic of everything happening on a referral
+func ReferralTopic(referralID string) string {
+	return "referral/" + referralID
+}
+
+// RunPool .... runs the pool until ctx is done, then drops every client
+func (h *Pool) RunPool(ctx context.Context) {
+	go func() {
+		err := h.broker.Listen(ctx, func(message BrokerMessage) {
+			if message.Origin == h.origin {
+				return
+			}
+			h.enqueue(poolRequest{action: actionPublish, topics: []string{message.Topic}, message: message.Payload})
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("websocket: broker stopped: %v", err)
+		}
+	}()
 	for {
 		select {
-		case client := <-h.Register:
-			h.Clients[client.ClientID] = client.WebClient
-		case client := <-h.Unregister:
-			if _, ok := h.Clients[client.ClientID]; ok {
-				delete(h.Clients, client.ClientID)
-				close(client.WebClient.Send)
-			}
-		case message := <-h.Broadcast:
-			clientID := message.ClientID
-			if client, ok := h.Clients[clientID]; ok {
-				client.Send <- message.Message
+		case <-ctx.Done():
+			close(h.done)
+			h.shutdown()
+			log.Infof("websocket: pool stopped")
+			return
+		case request := <-h.requests:
+			h.handle(request)
+		}
+	}
+}
+
+// shutdown drops every client, including the ones whose registration was still queued
+func (h *Pool) shutdown() {
+	for {
+		select {
+		case request := <-h.requests:
+			if request.action == actionRegister {
+				h.handle(request)
 			}
+			continue
+		default:
+		}
+		break
+	}
+	for _, client := range h.clients {
+		h.drop(client)
+	}
+}
+
+func (h *Pool) handle(request poolRequest) {
+	client := request.client
+	switch request.action {
+	case actionRegister:
+		h.clients[client.CurrentConnID] = client
+		h.subscribe(client, request.topics)
+	case actionUnregister:
+		h.drop(client)
+	case actionSubscribe:
+		if _, ok := h.clients[client.CurrentConnID]; ok {
+			h.subscribe(client, request.topics)
+		}
+	case actionUnsubscribe:
+		for _, topic := range request.topics {
+			h.unsubscribe(client, topic)
+		}
+	case actionPublish:
+		for _, subscriber := range h.topics[request.topics[0]] {
+			h.deliver(subscriber, request.message)
+		}
+	case actionSendTo:
+		if _, ok := h.clients[client.CurrentConnID]; ok {
+			h.deliver(client, request.message)
 		}
 	}
 }
 
+func (h *Pool) subscribe(client *Client, topics []string) {
+	for _, topic := range topics {
+		if _, ok := h.topics[topic]; !ok {
+			h.topics[topic] = make(map[string]*Client)
+		}
+		h.topics[topic][client.CurrentConnID] = client
+		client.topics[topic] = true
+	}
+}
+
+func (h *Pool) unsubscribe(client *Client, topic string) {
+	delete(client.topics, topic)
+	delete(h.topics[topic], client.CurrentConnID)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+}
+
+// deliver never blocks the pool, a client whose buffer is full is evicted
+func (h *Pool) deliver(client *Client, message []byte) {
+	select {
+	case client.Send <- message:
+	default:
+		log.Errorf("websocket: evicting slow client %s", client.CurrentConnID)
+		h.drop(client)
+	}
+}
+
+// drop removes the client and closes its Send channel, the writer then closes the connection
+func (h *Pool) drop(client *Client) {
+	if _, ok := h.clients[client.CurrentConnID]; !ok {
+		return
+	}
+	delete(h.clients, client.CurrentConnID)
+	for topic := range client.topics {
+		h.unsubscribe(client, topic)
+	}
+	close(client.Send)
+}
+
+func (h *Pool) enqueue(request poolRequest) bool {
+	select {
+	case <-h.done:
+		return false
+	default:
+	}
+	select {
+	case h.requests <- request:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Register ... adds the client to the pool subscribed to topics
+func (h *Pool) Register(client *Client, topics ...string) {
+	if !h.enqueue(poolRequest{action: actionRegister, client: client, topics: topics}) {
+		// the pool is gone and never saw this client
+		close(client.Send)
+	}
+}
+
+// Unregister ... removes the client from the pool, safe to call more than once
+func (h *Pool) Unregister(client *Client) {
+	h.enqueue(poolRequest{action: actionUnregister, client: client})
+}
+
+// Subscribe ....
+func (h *Pool) Subscribe(client *Client, topics ...string) {
+	h.enqueue(poolRequest{action: actionSubscribe, client: client, topics: topics})
+}
+
+// Unsubscribe ....
+func (h *Pool) Unsubscribe(client *Client, topics ...string) {
+	h.enqueue(poolRequest{action: actionUnsubscribe, client: client, topics: topics})
+}
+
+// SendTo ... queues a message for a single client
+func (h *Pool) SendTo(client *Client, message []byte) {
+	h.enqueue(poolRequest{action: actionSendTo, client: client, message: message})
+}
+
+// Publish ... fans message out to the subscribers of topic on this and every other replica
+func (h *Pool) Publish(ctx context.Context, topic string, message []byte) error {
+	if !h.enqueue(poolRequest{action: actionPublish, topics: []string{topic}, message: message}) {
+		return nil
+	}
+	return h.broker.Publish(ctx, BrokerMessage{Origin: h.origin, Topic: topic, Payload: message})
+}
+
+// PublishJSON ... Publish of v encoded as JSON
+func (h *Pool) PublishJSON(ctx context.Context, topic string, v interface{}) error {
+	message, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.Publish(ctx, topic, message)
+}
+
 // UpgradeWebSocket ....
 func UpgradeWebSocket(c *gin.Context) (*websocket.Conn, error) {
 	webSocketWriter := c.Writer
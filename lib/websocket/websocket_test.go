@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recvOrClosed waits for the next message, ok is false when Send was closed
+func recvOrClosed(t *testing.T, client *Client) ([]byte, bool) {
+	select {
+	case message, ok := <-client.Send:
+		return message, ok
+	case <-time.After(time.Second):
+		t.Fatalf("no message for %s", client.CurrentConnID)
+		return nil, false
+	}
+}
+
+func TestPoolFanOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewPool(nil)
+	go pool.RunPool(ctx)
+	first := NewClient(pool, nil, "first")
+	second := NewClient(pool, nil, "second")
+	pool.Register(first, ReferralTopic("r1"))
+	pool.Register(second, ReferralTopic("r1"), ReferralTopic("r2"))
+
+	assert.NoError(t, pool.Publish(ctx, ReferralTopic("r1"), []byte("one")))
+	message, _ := recvOrClosed(t, first)
+	assert.Equal(t, "one", string(message))
+	message, _ = recvOrClosed(t, second)
+	assert.Equal(t, "one", string(message))
+
+	pool.Unsubscribe(second, ReferralTopic("r1"))
+	pool.Publish(ctx, ReferralTopic("r1"), []byte("two"))
+	pool.Publish(ctx, ReferralTopic("r2"), []byte("three"))
+	message, _ = recvOrClosed(t, first)
+	assert.Equal(t, "two", string(message))
+	message, _ = recvOrClosed(t, second)
+	assert.Equal(t, "three", string(message), "unsubscribed topics are not delivered")
+
+	pool.Unregister(first)
+	pool.Unregister(first)
+	_, ok := recvOrClosed(t, first)
+	assert.False(t, ok)
+}
+
+func TestPoolEvictsSlowClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewPool(nil)
+	go pool.RunPool(ctx)
+	slow := NewClient(pool, nil, "slow")
+	pool.Register(slow, ClinicTopic("a1"))
+	probe := NewClient(pool, nil, "probe")
+	pool.Register(probe)
+	for i := 0; i <= ClientBufferSize; i++ {
+		pool.Publish(ctx, ClinicTopic("a1"), []byte("event"))
+	}
+	// requests are handled in order, once the probe hears back every publish was fanned out
+	pool.SendTo(probe, []byte("sync"))
+	recvOrClosed(t, probe)
+	received := 0
+	for {
+		_, ok := recvOrClosed(t, slow)
+		if !ok {
+			break
+		}
+		received++
+	}
+	assert.Equal(t, ClientBufferSize, received)
+}
+
+func TestPoolShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewPool(nil)
+	stopped := make(chan struct{})
+	go func() {
+		pool.RunPool(ctx)
+		close(stopped)
+	}()
+	client := NewClient(pool, nil, "client")
+	pool.Register(client, ClinicTopic("a1"))
+	cancel()
+	<-stopped
+	_, ok := recvOrClosed(t, client)
+	assert.False(t, ok)
+
+	late := NewClient(pool, nil, "late")
+	pool.Register(late)
+	_, ok = recvOrClosed(t, late)
+	assert.False(t, ok, "clients registered after shutdown are closed right away")
+	assert.NoError(t, pool.Publish(context.Background(), ClinicTopic("a1"), []byte("ignored")))
+}
+
+type relayBroker struct {
+	deliver chan BrokerMessage
+}
+
+func (b *relayBroker) Publish(ctx context.Context, message BrokerMessage) error {
+	b.deliver <- message
+	return nil
+}
+
+func (b *relayBroker) Listen(ctx context.Context, deliver func(BrokerMessage)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case message := <-b.deliver:
+			deliver(message)
+			// what another replica would have published
+			message.Origin = "other"
+			deliver(message)
+		}
+	}
+}
+
+func TestPoolBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewPool(&relayBroker{deliver: make(chan BrokerMessage, 1)})
+	go pool.RunPool(ctx)
+	client := NewClient(pool, nil, "client")
+	pool.Register(client, ChatTopic("r1", "c2c"))
+	pool.Publish(ctx, ChatTopic("r1", "c2c"), []byte("hello"))
+	message, _ := recvOrClosed(t, client)
+	assert.Equal(t, "hello", string(message), "local delivery")
+	message, _ = recvOrClosed(t, client)
+	assert.Equal(t, "hello", string(message), "remote delivery")
+	select {
+	case message := <-client.Send:
+		t.Fatalf("own broker message delivered twice: %s", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNotificationPayload(t *testing.T) {
+	ctx := context.Background()
+	stored := make(map[string][]byte)
+	store := func(ctx context.Context, key string, payload []byte) error {
+		stored[key] = payload
+		return nil
+	}
+	load := func(ctx context.Context, key string) ([]byte, error) {
+		payload, ok := stored[key]
+		if !ok {
+			return nil, errors.New("no such message")
+		}
+		return payload, nil
+	}
+
+	small := BrokerMessage{Origin: "a", Topic: ChatTopic("r1", "c2c"), Payload: []byte("hello")}
+	payload, err := encodeNotification(ctx, small, store)
+	assert.NoError(t, err)
+	assert.Empty(t, stored, "messages that fit are sent as they are")
+	message, err := decodeNotification(ctx, payload, load)
+	assert.NoError(t, err)
+	assert.Equal(t, small, message)
+
+	large := BrokerMessage{Origin: "a", Topic: ChatTopic("r1", "c2c"), Payload: []byte(strings.Repeat("x", 2*maxNotifyPayload))}
+	payload, err = encodeNotification(ctx, large, store)
+	assert.NoError(t, err)
+	assert.True(t, len(payload) <= maxNotifyPayload, "only the key of a large message is sent")
+	assert.Len(t, stored, 1)
+	message, err = decodeNotification(ctx, payload, load)
+	assert.NoError(t, err)
+	assert.Equal(t, large, message)
+
+	_, err = encodeNotification(ctx, large, func(ctx context.Context, key string, payload []byte) error {
+		return errors.New("database down")
+	})
+	assert.Error(t, err)
+	_, err = decodeNotification(ctx, `{"ref":"gone"}`, load)
+	assert.Error(t, err)
+}
@@ -14,6 +14,11 @@ var Default = []byte(`
 	"pnn": "d-7c54cb4262a64e10a344551c77a56ec9",
 	"curi": "https://dev.superdentist.io",
 	"refphone": "+17373772180",
+	"reminders": "48h,2h",
+	"wsbroker": "local",
+	"mailtransport": "sendgrid",
+	"smtpstarttls": "require",
+	"maildir": "./mail",
 	"dbhost":"34.123.130.172",
 	"dbport": 5432,
 	"dbname": "superdentistpg",
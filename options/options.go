@@ -35,6 +35,19 @@ type Options struct {
 	RootCA                 string `json:"sslRootCert,omitempty"`
 	SSLKey                 string `json:"sslKey,omitempty"`
 	SSLCert                string `json:"sslCert,omitempty"`
+	APIBaseURL             string `json:"apiuri,omitempty"`
+	ReminderOffsets        string `json:"reminders,omitempty"`
+	WebsocketBroker        string `json:"wsbroker,omitempty"`
+	URLSigningKey          string `json:"urlsigningkey,omitempty"`
+	ReplySigningKey        string `json:"replysigningkey,omitempty"`
+	PlatformAdmins         string `json:"platformadmins,omitempty"`
+	LocalEmails            string `json:"localemails,omitempty"`
+	MailTransport          string `json:"mailtransport,omitempty"`
+	SMTPAddr               string `json:"smtpaddr,omitempty"`
+	SMTPUser               string `json:"smtpuser,omitempty"`
+	SMTPPassword           string `json:"smtppassword,omitempty"`
+	SMTPStartTLS           string `json:"smtpstarttls,omitempty"`
+	MailDir                string `json:"maildir,omitempty"`
 }
 
 // New .. create a new instance
@@ -60,6 +73,34 @@ func InitOptions() (*Options, error) {
 		options.ContinueURL = os.Getenv("CONTINUE_URL")
 		options.ReferralPhone = os.Getenv("SD_REFERRAL_PHONE")
 		options.EncryptionKeyQR = os.Getenv("QR_ENC_KEY")
+		options.APIBaseURL = os.Getenv("SD_API_URL")
+		options.URLSigningKey = os.Getenv("SD_URL_SIGNING_KEY")
+		options.ReplySigningKey = os.Getenv("SD_REPLY_SIGNING_KEY")
+		options.PlatformAdmins = os.Getenv("SD_PLATFORM_ADMINS")
+		options.LocalEmails = os.Getenv("SD_LOCAL_EMAILS")
+		options.SMTPAddr = os.Getenv("SD_SMTP_ADDR")
+		options.SMTPUser = os.Getenv("SD_SMTP_USER")
+		options.SMTPPassword = os.Getenv("SD_SMTP_PASSWORD")
+		mailTransport := os.Getenv("SD_MAIL_TRANSPORT")
+		if mailTransport != "" {
+			options.MailTransport = mailTransport
+		}
+		smtpStartTLS := os.Getenv("SD_SMTP_STARTTLS")
+		if smtpStartTLS != "" {
+			options.SMTPStartTLS = smtpStartTLS
+		}
+		mailDir := os.Getenv("SD_MAIL_DIR")
+		if mailDir != "" {
+			options.MailDir = mailDir
+		}
+		reminderOffsets := os.Getenv("SD_APPOINTMENT_REMINDERS")
+		if reminderOffsets != "" {
+			options.ReminderOffsets = reminderOffsets
+		}
+		websocketBroker := os.Getenv("SD_WEBSOCKET_BROKER")
+		if websocketBroker != "" {
+			options.WebsocketBroker = websocketBroker
+		}
 		if options.EncryptionKeyQR != "" {
 			key, _ := base64.StdEncoding.DecodeString(options.EncryptionKeyQR)
 			c, err := aes.NewCipher(key)
@@ -1,18 +1,81 @@
 package router
 
 import (
+	"context"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
 	"github.com/superdentist/superdentist-backend/global"
 	"github.com/superdentist/superdentist-backend/handlers"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/fcm"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/mailtemplates"
+	"github.com/superdentist/superdentist-backend/lib/mailtransport"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+	"github.com/superdentist/superdentist-backend/lib/notify"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"github.com/superdentist/superdentist-backend/lib/sms"
 	"github.com/superdentist/superdentist-backend/lib/websocket"
 )
 
 // SDRouter ... superdentist backend router to handle various APIs
-func SDRouter() (*gin.Engine, error) {
-	// Initialize and run websocket pool manager
-	poolConnections := websocket.NewPool()
-	go poolConnections.RunPool()
+func SDRouter(ctx context.Context) (*gin.Engine, error) {
+	// Initialize and run websocket pool manager, it stops with the server context
+	poolConnections := websocket.NewPool(websocketBroker())
+	go poolConnections.RunPool(ctx)
+	handlers.SetWebsocketPool(poolConnections)
+	// every SMS, of the handlers and the scheduler, checks the consent of its recipient first
+	consentDB := datastoredb.NewReferralHandler()
+	err := consentDB.InitializeDataBase(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		return nil, err
+	}
+	sms.SetConsentStore(consentDB)
+	// patient texts and emails are rendered from the catalog, with the wording clinics wrote over it
+	catalog, err := messages.LoadCatalog(constants.MESSAGE_TEMPLATES_DIR)
+	if err != nil {
+		return nil, err
+	}
+	messages.SetCatalog(catalog)
+	templatesDB := datastoredb.NewClinicMetaHandler()
+	err = templatesDB.InitializeDataBase(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		return nil, err
+	}
+	messages.SetOverrideStore(templatesDB)
+	// transactional emails listed in Options.LocalEmails are rendered from our templates instead of SendGrid's
+	emailTemplates, err := mailtemplates.Load(constants.EMAIL_TEMPLATES_DIR)
+	if err != nil {
+		return nil, err
+	}
+	sendgrid.SetLocalTemplates(emailTemplates)
+	// emails go out through the transport Options.MailTransport selects, SendGrid, an SMTP server or a maildir
+	mailTransport, err := mailtransport.New(global.Options)
+	if err != nil {
+		log.Errorf("Mail transport %s not available, emails are not sent: %v", global.Options.MailTransport, err.Error())
+	} else {
+		sendgrid.SetTransport(mailTransport)
+	}
+	// staff devices get pushes of referral events through FCM, without it pushes are off
+	pushClient := fcm.NewFCMHanlder()
+	err = pushClient.InitializeFCMClient(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		log.Errorf("Push notifications are off: %v", err.Error())
+	} else {
+		notify.SetPushSender(pushClient)
+	}
+	// staff notifications follow the preferences of their clinic, or their own, held ones are kept with them
+	notify.SetStore(templatesDB)
+	staffSMS := sms.NewSMSClient()
+	err = staffSMS.InitializeSMSClient()
+	if err != nil {
+		log.Errorf("Staff texts are off: %v", err.Error())
+	} else {
+		notify.SetTextSender(staffSMS)
+	}
 	restRouter := gin.Default()
 	// configure cors as needed for FE/BE interactions: For now defaults
 
@@ -66,6 +129,21 @@ func SDRouter() (*gin.Engine, error) {
 		clinicGroup.GET("/practiceCodes/:addressId", handlers.GetClinicPracticeCodes)
 		clinicGroup.POST("/practiceCodesHistory/:addressId", handlers.AddClinicPracticeCodesHistory)
 		clinicGroup.GET("/practiceCodesHistory/:addressId", handlers.GetClinicPracticeCodesHistory)
+		clinicGroup.POST("/calendarFeed/:addressId", handlers.RotateCalendarFeedToken)
+		clinicGroup.GET("/calendar/:addressId/feed.ics", handlers.GetClinicCalendarFeed)
+		clinicGroup.PUT("/sla/:addressId", handlers.AddClinicSLA)
+		clinicGroup.GET("/sla/:addressId", handlers.GetClinicSLA)
+		clinicGroup.GET("/messageTemplates/:addressId", handlers.GetClinicMessageTemplates)
+		clinicGroup.PUT("/messageTemplates/:addressId", handlers.SaveClinicMessageTemplate)
+		clinicGroup.POST("/messageTemplates/:addressId/preview", handlers.PreviewClinicMessageTemplate)
+		clinicGroup.DELETE("/messageTemplates/:addressId/:locale/:key", handlers.DeleteClinicMessageTemplate)
+		clinicGroup.POST("/devices", handlers.RegisterDevice)
+		clinicGroup.DELETE("/devices/:token", handlers.UnregisterDevice)
+		clinicGroup.GET("/notifications/:addressId", handlers.GetClinicNotificationPreferences)
+		clinicGroup.PUT("/notifications/:addressId", handlers.SaveClinicNotificationPreferences)
+		clinicGroup.GET("/notifications/:addressId/me", handlers.GetMyNotificationPreferences)
+		clinicGroup.PUT("/notifications/:addressId/me", handlers.SaveMyNotificationPreferences)
+		clinicGroup.DELETE("/notifications/:addressId/me", handlers.DeleteMyNotificationPreferences)
 	}
 	referralGroup := version1.Group("/")
 	{
@@ -78,20 +156,46 @@ func SDRouter() (*gin.Engine, error) {
 		referralGroup.POST("/referrals/:referralId/messages", handlers.AddCommentsToReferral)
 		referralGroup.GET("/referrals/:referralId/messages", handlers.GetAllMessages)
 		referralGroup.GET("/referrals/:referralId/messages/:messageId", handlers.GetOneMessage)
+		referralGroup.PUT("/referrals/:referralId/messages/:messageId", handlers.EditMessage)
+		referralGroup.DELETE("/referrals/:referralId/messages/:messageId", handlers.RetractMessage)
+		referralGroup.GET("/referrals/:referralId/messages/:messageId/versions", handlers.GetMessageVersions)
+		referralGroup.POST("/referrals/:referralId/messages/:messageId/refile", handlers.RefileMessage)
+		referralGroup.POST("/referrals/:referralId/messages/read", handlers.MarkMessagesRead)
+		referralGroup.GET("/inbox/unread", handlers.GetUnreadInbox)
 		referralGroup.PUT("/referrals/:referralId/status", handlers.UpdateReferralStatus)
 		referralGroup.DELETE("/referrals/:referralId", handlers.DeleteReferral)
 		referralGroup.POST("/referrals/:referralId/documents", handlers.UploadDocuments)
 		referralGroup.GET("/referrals/:referralId/documents", handlers.DownloadDocumentsAsZip)
+		referralGroup.GET("/referrals/:referralId/documents/list", handlers.ListDocuments)
+		referralGroup.DELETE("/referrals/:referralId/documents/:documentId", handlers.DeleteDocument)
 		referralGroup.GET("/referrals/:referralId/document", handlers.DownloadSingleFile)
+		referralGroup.GET("/files/signed", handlers.DownloadSignedFile)
 		referralGroup.GET("/referrals-by-clinic/dentist", handlers.GetAllReferralsGD)
 		referralGroup.GET("/referrals-by-clinic/specialist", handlers.GetAllReferralsSP)
 		referralGroup.GET("/referrals/:referralId", handlers.GetOneReferral)
+		referralGroup.PUT("/referrals/:referralId/appointment", handlers.BookReferralAppointment)
+		referralGroup.DELETE("/referrals/:referralId/appointment", handlers.CancelReferralAppointment)
+		referralGroup.POST("/referrals/:referralId/forward", handlers.ForwardReferral)
+		// gin cannot mix /referrals/import with the :referralId wildcard
+		referralGroup.POST("/referrals-import", handlers.ImportReferrals)
+		referralGroup.GET("/referrals-import/:jobId", handlers.GetReferralImport)
+		referralGroup.GET("/summary-reviews", handlers.ListSummaryReviews)
+		referralGroup.GET("/summary-reviews/:reviewId", handlers.GetSummaryReview)
+		referralGroup.POST("/summary-reviews/:reviewId/approve", handlers.ApproveSummaryReview)
+		referralGroup.POST("/summary-reviews/:reviewId/reject", handlers.RejectSummaryReview)
 
 	}
 	adminGroup := version1.Group("/admin")
 	{
 		// All data entry related APIs: Basic Stuff C & U
 		adminGroup.POST("/addFavorites/:addressId", handlers.AddFavoriteClinics)
+		adminGroup.GET("/quarantine", handlers.ListQuarantinedMessages)
+		adminGroup.GET("/quarantine/:quarantineId", handlers.GetQuarantinedMessage)
+		adminGroup.GET("/quarantine/:quarantineId/raw", handlers.DownloadQuarantinedMessage)
+		adminGroup.POST("/quarantine/:quarantineId/assign", handlers.AssignQuarantinedMessage)
+		adminGroup.POST("/quarantine/:quarantineId/discard", handlers.DiscardQuarantinedMessage)
+		adminGroup.GET("/emailTemplates", handlers.ListEmailTemplates)
+		adminGroup.GET("/emailTemplates/:kind/preview", handlers.PreviewEmailTemplate)
 
 	}
 	patientGroup := version1.Group("/patient")
@@ -125,7 +229,25 @@ func SDRouter() (*gin.Engine, error) {
 		})
 
 		clinicGroup.GET("/getAddressList", handlers.GetAddressListRest)
+
+		referralGroup.GET("/referrals/:referralId/chat/:channel", func(c *gin.Context) {
+			handlers.ChatWebSocketHandler(poolConnections, c)
+		})
+
+		// server-sent events for dashboards behind proxies that block websockets
+		referralGroup.GET("/events", handlers.StreamClinicEvents)
 	}
 	// Derive groups from version group to consolidate our APIs in a better way
 	return restRouter, nil
 }
+
+// websocketBroker ... postgres relays websocket messages between replicas, local keeps them on this one
+func websocketBroker() websocket.Broker {
+	if global.Options.WebsocketBroker == "postgres" {
+		if global.PGXConn != nil && global.PGXConfig != nil {
+			return websocket.NewPostgresBroker(global.PGXConn, *global.PGXConfig, "sd_websocket")
+		}
+		log.Errorf("Postgres websocket broker requested without a database, using local broker")
+	}
+	return websocket.NewLocalBroker()
+}
@@ -0,0 +1,39 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/lib/notify"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+)
+
+// RunNotificationDigests ... periodically sends the staff notifications held for a digest or the end of
+// quiet hours once they are due
+func RunNotificationDigests(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(constants.DIGEST_POLL_INTERVAL) * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := sendDueDigests(ctx, time.Now())
+		if err != nil {
+			log.Errorf("Notification digests failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infof("Notification digests stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sendDueDigests(ctx context.Context, now time.Time) error {
+	sgClient := sendgrid.NewSendGridClient()
+	err := sgClient.InitializeSendGridClient()
+	if err != nil {
+		return err
+	}
+	return notify.Flush(ctx, sgClient, now)
+}
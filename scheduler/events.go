@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+)
+
+// RunClinicEventSweep ... periodically removes clinic dashboard events older than the retention window,
+// reconnecting dashboards only replay recent events
+func RunClinicEventSweep(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(constants.EVENT_SWEEP_INTERVAL) * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := sweepClinicEvents(ctx, time.Now())
+		if err != nil {
+			log.Errorf("Clinic event sweep failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infof("Clinic event sweep stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepClinicEvents(ctx context.Context, now time.Time) error {
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err := clinicDB.InitializeDataBase(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		return err
+	}
+	defer clinicDB.Close()
+	deleted, err := clinicDB.DeleteClinicEventsBefore(ctx, now.AddDate(0, 0, -constants.EVENT_RETENTION_DAYS))
+	if deleted > 0 {
+		log.Infof("Removed %d expired clinic events", deleted)
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/storage"
+)
+
+// RunZipExportSweep ... periodically removes the zips stored for signed downloads once their URLs have
+// long expired
+func RunZipExportSweep(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(constants.ZIP_SWEEP_INTERVAL) * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := sweepZipExports(ctx, time.Now())
+		if err != nil {
+			log.Errorf("Zip export sweep failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infof("Zip export sweep stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepZipExports(ctx context.Context, now time.Time) error {
+	storageC := storage.NewStorageHandler()
+	err := storageC.InitializeStorageClient(ctx, googleprojectlib.GetGoogleProjectID())
+	if err != nil {
+		return err
+	}
+	deleted, err := storageC.DeleteObjectsBefore(ctx, constants.SD_REFERRAL_BUCKET, constants.ZIP_EXPORT_FOLDER+"/",
+		now.Add(-constants.ZIP_EXPORT_RETENTION*time.Minute))
+	if deleted > 0 {
+		log.Infof("Removed %d expired zip exports", deleted)
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/messages"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"github.com/superdentist/superdentist-backend/lib/sms"
+)
+
+// RunAppointmentReminders ... polls for upcoming appointments and sends the patient
+// reminders configured in Options.ReminderOffsets until ctx is done
+func RunAppointmentReminders(ctx context.Context) {
+	offsets := ParseReminderOffsets(global.Options.ReminderOffsets)
+	if len(offsets) == 0 {
+		log.Infof("Appointment reminders disabled")
+		return
+	}
+	ticker := time.NewTicker(time.Duration(constants.REMINDER_POLL_INTERVAL) * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := sendDueReminders(ctx, offsets, time.Now())
+		if err != nil {
+			log.Errorf("Appointment reminders failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infof("Appointment reminders stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ParseReminderOffsets ... parses "48h,2h" into offsets sorted largest first, bad entries are skipped
+func ParseReminderOffsets(value string) []time.Duration {
+	offsets := make([]time.Duration, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		offset, err := time.ParseDuration(part)
+		if err != nil || offset <= 0 {
+			log.Errorf("Ignoring bad reminder offset %q", part)
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+	return offsets
+}
+
+func sendDueReminders(ctx context.Context, offsets []time.Duration, now time.Time) error {
+	gproject := googleprojectlib.GetGoogleProjectID()
+	dsRefC := datastoredb.NewReferralHandler()
+	err := dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		return err
+	}
+	referrals, err := dsRefC.GetBookedAppointmentsBetween(ctx, now, now.Add(offsets[0]))
+	if err != nil {
+		return err
+	}
+	if len(referrals) == 0 {
+		return nil
+	}
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err = clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		return err
+	}
+	for _, referral := range referrals {
+		// every offset whose send time has passed is claimed together so an appointment booked
+		// late only gets the closest reminder instead of all of them at once
+		due := make([]string, 0)
+		for _, offset := range offsets {
+			if !now.Before(referral.Appointment.Start.Add(-offset)) {
+				due = append(due, offset.String())
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+		current, claimed, err := dsRefC.ClaimAppointmentReminders(ctx, referral.ReferralID, referral.Appointment.Sequence, due)
+		if err != nil {
+			log.Errorf("Failed to claim reminder for %s: %v", referral.ReferralID, err)
+			continue
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+		toClinic, err := clinicDB.GetSingleClinicViaPlace(ctx, current.ToPlaceID)
+		if err != nil {
+			toClinic = nil
+		}
+		sendReminder(ctx, *current, toClinic)
+	}
+	return nil
+}
+
+func sendReminder(ctx context.Context, referral contracts.DSReferral, toClinic *contracts.PhysicalClinicMapLocation) {
+	location := time.UTC
+	if referral.Appointment.TimeZone != "" {
+		if loaded, err := time.LoadLocation(referral.Appointment.TimeZone); err == nil {
+			location = loaded
+		}
+	}
+	fromPhone := global.Options.ReferralPhone
+	customText := ""
+	if toClinic != nil && toClinic.TwilioNumber != "" {
+		fromPhone = toClinic.TwilioNumber
+		customText = toClinic.CustomText
+	}
+	patientName := referral.PatientFirstName + " " + referral.PatientLastName
+	vars := map[string]string{
+		"PatientName":   patientName,
+		"ClinicName":    referral.ToClinicName,
+		"ClinicAddress": referral.ToClinicAddress,
+		"ClinicPhone":   referral.ToClinicPhone,
+		"When":          messages.FormatTime(referral.Appointment.Start.In(location), referral.PreferredLanguage),
+		"ClinicText":    customText,
+	}
+	render := func(key string) string {
+		text, err := messages.Render(ctx, referral.ToAddressID, referral.PreferredLanguage, key, vars)
+		if err != nil {
+			log.Errorf("Failed to render %s for %s: %v", key, referral.ReferralID, err)
+			return ""
+		}
+		return text
+	}
+	if referral.PatientPhone != "" {
+		clientSMS := sms.NewSMSClient()
+		err := clientSMS.InitializeSMSClient()
+		if err != nil {
+			log.Errorf("Failed to send reminder SMS: %v", err.Error())
+		} else if message := render(messages.KeyAppointmentReminder); message != "" {
+			err = clientSMS.SendSMS(fromPhone, referral.PatientPhone, message)
+			if err != nil {
+				log.Errorf("Failed to send reminder SMS for %s: %v", referral.ReferralID, err.Error())
+			}
+		}
+	}
+	if referral.PatientEmail != "" {
+		subject, body := render(messages.KeyReminderEmailSubject), render(messages.KeyReminderEmail)
+		if subject == "" || body == "" {
+			return
+		}
+		sgClient := sendgrid.NewSendGridClient()
+		err := sgClient.InitializeSendGridClient()
+		if err != nil {
+			log.Errorf("Failed to send reminder email: %v", err.Error())
+			return
+		}
+		err = sgClient.SendAppointmentReminder(referral.PatientEmail, patientName, referral.ReferralID, subject, body)
+		if err != nil {
+			log.Errorf("Failed to send reminder email for %s: %v", referral.ReferralID, err.Error())
+		}
+	}
+}
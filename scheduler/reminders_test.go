@@ -0,0 +1,26 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReminderOffsets(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []time.Duration
+	}{
+		{"48h,2h", []time.Duration{48 * time.Hour, 2 * time.Hour}},
+		{"2h, 48h", []time.Duration{48 * time.Hour, 2 * time.Hour}},
+		{" 30m ,,90m", []time.Duration{90 * time.Minute, 30 * time.Minute}},
+		{"48h,two hours,2h", []time.Duration{48 * time.Hour, 2 * time.Hour}},
+		{"-2h,0s,2h", []time.Duration{2 * time.Hour}},
+		{"48", []time.Duration{}},
+		{"", []time.Duration{}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, ParseReminderOffsets(test.value), test.value)
+	}
+}
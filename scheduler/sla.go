@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/superdentist/superdentist-backend/constants"
+	"github.com/superdentist/superdentist-backend/contracts"
+	"github.com/superdentist/superdentist-backend/global"
+	"github.com/superdentist/superdentist-backend/lib/datastoredb"
+	"github.com/superdentist/superdentist-backend/lib/fcm"
+	"github.com/superdentist/superdentist-backend/lib/googleprojectlib"
+	"github.com/superdentist/superdentist-backend/lib/notify"
+	"github.com/superdentist/superdentist-backend/lib/sendgrid"
+	"gopkg.in/ugjka/go-tz.v2/tz"
+)
+
+// RunSLAEvaluator ... periodically flags referrals that broke their clinic's SLA and escalates
+// them from the specialist to the referring dentist and then to SuperDentist admin
+func RunSLAEvaluator(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(constants.SLA_POLL_INTERVAL) * time.Minute)
+	defer ticker.Stop()
+	for {
+		err := evaluateSLAs(ctx, time.Now())
+		if err != nil {
+			log.Errorf("SLA evaluation failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Infof("SLA evaluator stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AddBusinessDays ... adds n working days skipping saturdays and sundays in t's location
+func AddBusinessDays(t time.Time, n int) time.Time {
+	for n > 0 {
+		t = t.AddDate(0, 0, 1)
+		if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday {
+			n--
+		}
+	}
+	return t
+}
+
+// NextEscalation ... returns the escalation level the referral should be at now under the rule,
+// moving at most one level past its current one per evaluation
+func NextEscalation(referral contracts.DSReferral, rule contracts.SLARule, location *time.Location, now time.Time) int {
+	since := referral.StatusChangedOn
+	if since.IsZero() {
+		since = referral.CreatedOn
+	}
+	deadline := AddBusinessDays(since.In(location), rule.BusinessDays)
+	if now.Before(deadline) {
+		return contracts.EscalationNone
+	}
+	if referral.EscalationLevel == contracts.EscalationNone {
+		return contracts.EscalationSpecialist
+	}
+	if referral.EscalationLevel >= contracts.EscalationAdmin {
+		return referral.EscalationLevel
+	}
+	step := rule.EscalateAfterDays
+	if step <= 0 {
+		step = 1
+	}
+	if now.Before(AddBusinessDays(referral.LastEscalatedOn.In(location), step)) {
+		return referral.EscalationLevel
+	}
+	return referral.EscalationLevel + 1
+}
+
+func evaluateSLAs(ctx context.Context, now time.Time) error {
+	gproject := googleprojectlib.GetGoogleProjectID()
+	clinicDB := datastoredb.NewClinicMetaHandler()
+	err := clinicDB.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		return err
+	}
+	clinicSLAs, err := clinicDB.GetAllClinicSLAs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(clinicSLAs) == 0 {
+		return nil
+	}
+	dsRefC := datastoredb.NewReferralHandler()
+	err = dsRefC.InitializeDataBase(ctx, gproject)
+	if err != nil {
+		return err
+	}
+	sgClient := sendgrid.NewSendGridClient()
+	err = sgClient.InitializeSendGridClient()
+	if err != nil {
+		return err
+	}
+	for _, clinicSLA := range clinicSLAs {
+		if len(clinicSLA.Rules) == 0 || clinicSLA.PlaceID == "" {
+			continue
+		}
+		location := time.UTC
+		clinic, err := clinicDB.GetSingleClinic(ctx, clinicSLA.AddressID)
+		if err == nil {
+			zone, err := tz.GetZone(tz.Point{Lon: clinic.Location.Long, Lat: clinic.Location.Lat})
+			if err == nil && len(zone) > 0 {
+				if loaded, err := time.LoadLocation(zone[0]); err == nil {
+					location = loaded
+				}
+			}
+		}
+		referrals, err := dsRefC.GetAllReferralsSP(ctx, clinicSLA.PlaceID, "")
+		if err != nil {
+			log.Errorf("SLA: failed to load referrals for %s: %v", clinicSLA.AddressID, err)
+			continue
+		}
+		for _, referral := range referrals {
+			if datastoredb.IsClosedStatus(referral.Status.SPStatus) || referral.ForwardedTo != "" {
+				continue
+			}
+			for _, rule := range clinicSLA.Rules {
+				if !strings.EqualFold(strings.TrimSpace(rule.SPStatus), strings.TrimSpace(referral.Status.SPStatus)) {
+					continue
+				}
+				level := NextEscalation(referral, rule, location, now)
+				if level <= referral.EscalationLevel {
+					continue
+				}
+				escalatedReferral, escalated, err := dsRefC.EscalateReferral(ctx, referral.ReferralID, referral.StatusChangedOn, rule.Name, level)
+				if err != nil {
+					log.Errorf("SLA: failed to escalate %s: %v", referral.ReferralID, err)
+					continue
+				}
+				if escalated {
+					notifyEscalation(ctx, sgClient, *escalatedReferral, rule, location)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func notifyEscalation(ctx context.Context, sgClient *sendgrid.ClientSendGrid, referral contracts.DSReferral, rule contracts.SLARule, location *time.Location) {
+	since := referral.StatusChangedOn
+	if since.IsZero() {
+		since = referral.CreatedOn
+	}
+	body := fmt.Sprintf("Referral %s for %s %s from %s to %s has been in status %q since %s, breaking the %q SLA of %d business days.",
+		referral.ReferralID, referral.PatientFirstName, referral.PatientLastName, referral.FromClinicName, referral.ToClinicName,
+		referral.Status.SPStatus, since.In(location).Format("Jan 2 2006 3:04 PM MST"), rule.Name, rule.BusinessDays)
+	toEmail, toName, toAddressID := constants.SD_ADMIN_EMAIL, "SuperDentist Admin", ""
+	switch referral.EscalationLevel {
+	case contracts.EscalationSpecialist:
+		if referral.ToEmail != "" {
+			toEmail, toName, toAddressID = referral.ToEmail, referral.ToClinicName, referral.ToAddressID
+		}
+	case contracts.EscalationDentist:
+		if referral.FromEmail != "" {
+			toEmail, toName, toAddressID = referral.FromEmail, referral.FromClinicName, referral.FromAddressID
+		}
+	}
+	send := func() error {
+		return sgClient.SendSLAEscalation(toEmail, toName, referral.ReferralID, body)
+	}
+	var err error
+	if toAddressID == "" {
+		// the admin inbox gets every escalation
+		err = send()
+	} else {
+		text := fmt.Sprintf("A referral broke the %q SLA of %d business days", rule.Name, rule.BusinessDays)
+		push := fcm.ReferralNotification(contracts.EventSLAEscalation, referral, toAddressID, "Referral overdue", text, "", global.Options.ContinueURL)
+		err = notify.Dispatch(ctx, notify.Notice{
+			Event:      contracts.EventSLAEscalation,
+			AddressID:  toAddressID,
+			ReferralID: referral.ReferralID,
+			Text:       text,
+			Link:       push.Link,
+			Email:      toEmail,
+			Name:       toName,
+			SendEmail:  send,
+			Push:       &push,
+			SMS:        true,
+		})
+	}
+	if err != nil {
+		log.Errorf("SLA: failed to notify %s for %s: %v", toEmail, referral.ReferralID, err)
+	}
+}
@@ -0,0 +1,83 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superdentist/superdentist-backend/contracts"
+)
+
+func TestAddBusinessDays(t *testing.T) {
+	friday := time.Date(2026, time.March, 6, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		start time.Time
+		days  int
+		want  time.Time
+	}{
+		{"none", friday, 0, friday},
+		{"friday to monday", friday, 1, time.Date(2026, time.March, 9, 10, 0, 0, 0, time.UTC)},
+		{"friday to wednesday", friday, 3, time.Date(2026, time.March, 11, 10, 0, 0, 0, time.UTC)},
+		{"thursday over the weekend", friday.AddDate(0, 0, -1), 2, time.Date(2026, time.March, 9, 10, 0, 0, 0, time.UTC)},
+		{"saturday", friday.AddDate(0, 0, 1), 1, time.Date(2026, time.March, 9, 10, 0, 0, 0, time.UTC)},
+		{"sunday", friday.AddDate(0, 0, 2), 1, time.Date(2026, time.March, 9, 10, 0, 0, 0, time.UTC)},
+		{"two weeks", friday, 10, time.Date(2026, time.March, 20, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		assert.True(t, test.want.Equal(AddBusinessDays(test.start, test.days)), test.name)
+	}
+}
+
+func TestAddBusinessDaysTimeZone(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	// friday evening in New York is already saturday in UTC
+	fridayNight := time.Date(2026, time.March, 6, 22, 0, 0, 0, location)
+	inClinic := AddBusinessDays(fridayNight, 1)
+	assert.Equal(t, time.Monday, inClinic.Weekday())
+	assert.Equal(t, 22, inClinic.Hour(), "the wall clock holds over the change to daylight saving time")
+	inUTC := AddBusinessDays(fridayNight.UTC(), 1)
+	assert.True(t, inUTC.Before(inClinic), "business days are counted in the clinic's time zone")
+}
+
+func TestNextEscalation(t *testing.T) {
+	monday := time.Date(2026, time.March, 2, 9, 0, 0, 0, time.UTC)
+	deadline := time.Date(2026, time.March, 4, 9, 0, 0, 0, time.UTC)
+	rule := contracts.SLARule{Name: "schedule", SPStatus: "referred", BusinessDays: 2, EscalateAfterDays: 1}
+	referral := func(level int, lastEscalated time.Time) contracts.DSReferral {
+		return contracts.DSReferral{StatusChangedOn: monday, EscalationLevel: level, LastEscalatedOn: lastEscalated}
+	}
+	tests := []struct {
+		name     string
+		referral contracts.DSReferral
+		rule     contracts.SLARule
+		now      time.Time
+		want     int
+	}{
+		{"before the deadline", referral(contracts.EscalationNone, time.Time{}), rule, deadline.Add(-time.Minute), contracts.EscalationNone},
+		{"at the deadline", referral(contracts.EscalationNone, time.Time{}), rule, deadline, contracts.EscalationSpecialist},
+		{"long after the deadline moves one level", referral(contracts.EscalationNone, time.Time{}), rule, deadline.AddDate(0, 0, 20), contracts.EscalationSpecialist},
+		{"specialist within a day", referral(contracts.EscalationSpecialist, deadline), rule, deadline.Add(9 * time.Hour), contracts.EscalationSpecialist},
+		{"specialist to dentist", referral(contracts.EscalationSpecialist, deadline), rule, deadline.AddDate(0, 0, 1), contracts.EscalationDentist},
+		{"dentist over the weekend", referral(contracts.EscalationDentist, time.Date(2026, time.March, 6, 9, 0, 0, 0, time.UTC)), rule,
+			time.Date(2026, time.March, 8, 12, 0, 0, 0, time.UTC), contracts.EscalationDentist},
+		{"dentist to admin", referral(contracts.EscalationDentist, time.Date(2026, time.March, 6, 9, 0, 0, 0, time.UTC)), rule,
+			time.Date(2026, time.March, 9, 9, 0, 0, 0, time.UTC), contracts.EscalationAdmin},
+		{"admin is the last level", referral(contracts.EscalationAdmin, deadline), rule, deadline.AddDate(0, 1, 0), contracts.EscalationAdmin},
+		{"a step of zero days is one", referral(contracts.EscalationSpecialist, deadline),
+			contracts.SLARule{BusinessDays: 2}, deadline.AddDate(0, 0, 1), contracts.EscalationDentist},
+		{"created on without a status change", contracts.DSReferral{CreatedOn: monday}, rule, deadline, contracts.EscalationSpecialist},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, NextEscalation(test.referral, test.rule, time.UTC, test.now), test.name)
+	}
+
+	// the deadline is two business days in the clinic's time zone, not in UTC
+	location, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+	late := contracts.DSReferral{StatusChangedOn: time.Date(2026, time.March, 6, 22, 0, 0, 0, location)}
+	tuesdayEvening := time.Date(2026, time.March, 10, 21, 0, 0, 0, location)
+	assert.Equal(t, contracts.EscalationNone, NextEscalation(late, rule, location, tuesdayEvening))
+	assert.Equal(t, contracts.EscalationSpecialist, NextEscalation(late, rule, location, tuesdayEvening.Add(time.Hour)))
+}